@@ -92,6 +92,7 @@ const (
 	extensionSignatureAlgorithms     uint16 = 13
 	extensionALPN                    uint16 = 16
 	extensionSCT                     uint16 = 18
+	extensionExtendedMasterSecret    uint16 = 23
 	extensionSessionTicket           uint16 = 35
 	extensionPreSharedKey            uint16 = 41
 	extensionEarlyData               uint16 = 42
@@ -99,8 +100,10 @@ const (
 	extensionCookie                  uint16 = 44
 	extensionPSKModes                uint16 = 45
 	extensionCertificateAuthorities  uint16 = 47
+	extensionPostHandshakeAuth       uint16 = 49
 	extensionSignatureAlgorithmsCert uint16 = 50
 	extensionKeyShare                uint16 = 51
+	extensionQUICTransportParameters uint16 = 57
 	extensionRenegotiationInfo       uint16 = 0xff01
 )
 
@@ -112,8 +115,9 @@ const (
 // CurveID is the type of a TLS identifier for an elliptic curve. See
 // https://www.iana.org/assignments/tls-parameters/tls-parameters.xml#tls-parameters-8.
 //
-// In TLS 1.3, this type is called NamedGroup, but at this time this library
-// only supports Elliptic Curve based groups. See RFC 8446, Section 4.2.7.
+// In TLS 1.3, this type is called NamedGroup. Besides Elliptic Curve based
+// groups, this library supports the hybrid X25519MLKEM768 and
+// X25519Kyber768Draft00 groups. See RFC 8446, Section 4.2.7.
 type CurveID uint16
 
 const (
@@ -121,6 +125,12 @@ const (
 	CurveP384 CurveID = 24
 	CurveP521 CurveID = 25
 	X25519    CurveID = 29
+
+	// X25519MLKEM768 and X25519Kyber768Draft00 are hybrid post-quantum
+	// groups. They are only used in TLS 1.3, and only if listed in
+	// Config.CurvePreferences.
+	X25519MLKEM768        CurveID = 4588
+	X25519Kyber768Draft00 CurveID = 25497
 )
 
 // TLS 1.3 Key Share. See RFC 8446, Section 4.2.8.
@@ -276,6 +286,35 @@ type ConnectionState struct {
 	// RFC 7627, and https://mitls.org/pages/attacks/3SHAKE#channelbindings.
 	TLSUnique []byte
 
+	// ECHAccepted is true if the ClientHello was encrypted with Encrypted
+	// Client Hello and the server accepted it.
+	ECHAccepted bool
+
+	// CurveID is the group used for the key exchange, if any. It is zero
+	// for resumed TLS 1.2 connections and for RSA key exchanges.
+	CurveID CurveID
+
+	// EarlyDataAccepted is true if the client sent 0-RTT data with
+	// Conn.SetEarlyData and the server accepted it.
+	EarlyDataAccepted bool
+
+	// EarlyDataPending is true on a server that accepted early data until
+	// it has read and verified the client's Finished, and HandshakeComplete
+	// is false until then. Data returned by a Read while it is true is
+	// 0-RTT data, which may be replayed.
+	EarlyDataPending bool
+
+	// RecordSizeLimit is the most plaintext bytes of a record the peer
+	// accepts, if it sent the record_size_limit extension (RFC 8449). The
+	// records this connection writes are kept within it.
+	RecordSizeLimit int
+
+	// KeyUpdatesSent and KeyUpdatesReceived are the number of TLS 1.3
+	// KeyUpdate messages the connection sent and received, each of which
+	// replaced the traffic keys of that direction.
+	KeyUpdatesSent     int
+	KeyUpdatesReceived int
+
 	// ekm is a closure exposed via ExportKeyingMaterial.
 	ekm func(label string, context []byte, length int) ([]byte, error)
 }
@@ -344,6 +383,12 @@ type ClientSessionState struct {
 	nonce  []byte    // Ticket nonce sent by the server, to derive PSK
 	useBy  time.Time // Expiration of the ticket lifetime as set by the server
 	ageAdd uint32    // Random obfuscation factor for sending the ticket age
+
+	maxEarlyData uint32 // Most 0-RTT data the server accepts with the ticket
+	alpnProtocol string // Application protocol negotiated for the session
+
+	// TLS 1.2 fields.
+	extMasterSecret bool // Whether the session used the Extended Master Secret
 }
 
 // ClientSessionCache is a cache of ClientSessionState objects that can be used
@@ -435,6 +480,25 @@ type ClientHelloInfo struct {
 	// might be rejected if used.
 	SupportedVersions []uint16
 
+	// Fingerprints holds the JA3 and JA4 fingerprints of the ClientHello.
+	// It is nil if the ClientHello could not be parsed for them.
+	Fingerprints *ClientHelloFingerprints
+
+	// Raw is the ClientHello handshake message as received, or as rebuilt
+	// from a Gaseous frame. It must not be modified.
+	Raw []byte
+
+	// Extensions lists the IDs of the ClientHello extensions in the order
+	// the client sent them, including GREASE values.
+	Extensions []uint16
+
+	// KeyShareGroups lists the groups the client sent key shares for, in
+	// order. It is empty if the client offered no TLS 1.3 key shares.
+	KeyShareGroups []CurveID
+
+	// ViaGaseous is true if the ClientHello arrived in a Gaseous frame.
+	ViaGaseous bool
+
 	// Conn is the underlying net.Conn for the connection. Do not read
 	// from, or write to, this connection; that will cause the TLS
 	// connection to fail.
@@ -737,7 +801,102 @@ type Config struct {
 	// auto-rotation logic. See Config.ticketKeys.
 	autoSessionTicketKeys []ticketKey
 
+	// Gaseous, if not nil, enables the Gaseous protocol for the hello
+	// messages in the directions it selects. See GaseousConfig.
+	Gaseous *GaseousConfig
+
+	// GaseousEnabled enables Gaseous framing of the ClientHello with
+	// default settings when Gaseous is nil.
+	//
+	// Deprecated: set Gaseous instead.
 	GaseousEnabled bool
+
+	// ClientHelloSpec, if not nil, shapes the ClientHello sent by a client:
+	// its cipher suites, groups, extension order and contents. See
+	// ClientHelloSpec.
+	ClientHelloSpec *ClientHelloSpec
+	// GREASE makes a client send GREASE values (RFC 8701) in its
+	// ClientHello the way browsers do, in the cipher suites, supported
+	// groups, key shares, supported versions and extensions. It is ignored
+	// if ClientHelloSpec is set, which places GREASE with GREASEPlaceholder.
+	// Servers always ignore GREASE values.
+	GREASE bool
+
+	// EncryptedClientHelloConfigList is the ECHConfigList a client uses to
+	// encrypt its ClientHello with Encrypted Client Hello, hiding the SNI and
+	// the rest of the ClientHello from the network. The ClientHello then
+	// offers TLS 1.3 only. If the server rejects ECH, the handshake fails
+	// with an *ECHRejectionError, once the server has authenticated for the
+	// public name of the config.
+	EncryptedClientHelloConfigList []byte
+
+	// EncryptedClientHelloKeys are the ECH keys a server decrypts
+	// ClientHellos with. A ClientHello that none of them decrypts is handled
+	// in the clear, and the keys marked SendAsRetry are sent back to the
+	// client.
+	EncryptedClientHelloKeys []EncryptedClientHelloKey
+
+	// MaxEarlyData is the most 0-RTT data, in bytes, that a server lets
+	// clients send on connections resumed from the tickets it issues. If
+	// zero, or if AcceptEarlyData is nil, tickets don't allow early data.
+	MaxEarlyData uint32
+
+	// AcceptEarlyData is called by a server before it accepts the early
+	// data of a client, which is rejected if it returns false. A server
+	// never accepts early data without it.
+	//
+	// Early data can be replayed by an attacker, and TLS doesn't prevent
+	// it: AcceptEarlyData must provide the replay protection, for example
+	// by accepting each ClientRandom only once within the ticket lifetime,
+	// across all servers sharing the ticket keys. Early data from tickets
+	// whose age the client misreports is rejected before it is called.
+	AcceptEarlyData func(*EarlyDataInfo) bool
+
+	// CertCompressionAlgorithms are the TLS 1.3 certificate compression
+	// algorithms (RFC 8879), in preference order. A client offers them and
+	// accepts a server certificate compressed with any of them, and a server
+	// does the same in its certificate requests. Each side compresses its
+	// certificate with the first of them the peer offers. If empty,
+	// certificates are neither compressed nor accepted compressed.
+	CertCompressionAlgorithms []CertCompressionAlgo
+
+	// MaxCertificateSize is the largest size, in bytes, of a Certificate
+	// message that the peer may send compressed, once decompressed. If
+	// zero, it is 64 KiB.
+	MaxCertificateSize int
+
+	// RecordSizeLimit, if not zero, is sent in the record_size_limit
+	// extension (RFC 8449) as the largest record this endpoint accepts: the
+	// most plaintext bytes of a record, plus one for the content type in
+	// TLS 1.3, from 64 to 16385. Once negotiated, larger records from the
+	// peer are rejected. A server always answers a client that sends the
+	// extension, with the protocol maximum if RecordSizeLimit is zero, and
+	// either endpoint keeps the records it writes within the limit of the
+	// other.
+	RecordSizeLimit uint16
+
+	// RecordPadding, if not nil, is called for each protected TLS 1.3
+	// record the connection writes, and returns how many zero bytes of
+	// padding (RFC 8446, Section 5.4) to add to it. The result is clamped
+	// to the room the record has left. See PadToBlockSize, PadRandom and
+	// PadToSizes for common policies. RecordPadding is not used with QUIC.
+	RecordPadding func(*RecordPaddingInfo) int
+
+	// KeyUpdateRecords is the number of records a TLS 1.3 connection
+	// protects with a traffic key before it updates it with a KeyUpdate
+	// message. Past it on the reading side, the connection asks the peer to
+	// update its keys. If zero, it is 2^24, within the AES-GCM usage limit
+	// of RFC 8446, Section 5.5.
+	KeyUpdateRecords uint64
+
+	// KeyUpdateBytes and KeyUpdateInterval, if not zero, also make a TLS 1.3
+	// connection update its traffic keys, like KeyUpdateRecords, once they
+	// protected that many bytes of application data, or after that long
+	// since the first of them. They are checked as records are written and
+	// read; an idle connection doesn't update its keys. Keys can also be
+	// updated at any time with Conn.UpdateKeys.
+	KeyUpdateBytes    int64
+	KeyUpdateInterval time.Duration
 }
 
 const (
@@ -790,37 +949,67 @@ func (c *Config) Clone() *Config {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 	return &Config{
-		Rand:                        c.Rand,
-		Time:                        c.Time,
-		Certificates:                c.Certificates,
-		NameToCertificate:           c.NameToCertificate,
-		GetCertificate:              c.GetCertificate,
-		GetClientCertificate:        c.GetClientCertificate,
-		GetConfigForClient:          c.GetConfigForClient,
-		VerifyPeerCertificate:       c.VerifyPeerCertificate,
-		VerifyConnection:            c.VerifyConnection,
-		RootCAs:                     c.RootCAs,
-		NextProtos:                  c.NextProtos,
-		ServerName:                  c.ServerName,
-		ClientAuth:                  c.ClientAuth,
-		ClientCAs:                   c.ClientCAs,
-		InsecureSkipVerify:          c.InsecureSkipVerify,
-		CipherSuites:                c.CipherSuites,
-		PreferServerCipherSuites:    c.PreferServerCipherSuites,
-		SessionTicketsDisabled:      c.SessionTicketsDisabled,
-		SessionTicketKey:            c.SessionTicketKey,
-		ClientSessionCache:          c.ClientSessionCache,
-		MinVersion:                  c.MinVersion,
-		MaxVersion:                  c.MaxVersion,
-		CurvePreferences:            c.CurvePreferences,
-		DynamicRecordSizingDisabled: c.DynamicRecordSizingDisabled,
-		Renegotiation:               c.Renegotiation,
-		KeyLogWriter:                c.KeyLogWriter,
-		sessionTicketKeys:           c.sessionTicketKeys,
-		autoSessionTicketKeys:       c.autoSessionTicketKeys,
+		Rand:                           c.Rand,
+		Time:                           c.Time,
+		Certificates:                   c.Certificates,
+		NameToCertificate:              c.NameToCertificate,
+		GetCertificate:                 c.GetCertificate,
+		GetClientCertificate:           c.GetClientCertificate,
+		GetConfigForClient:             c.GetConfigForClient,
+		VerifyPeerCertificate:          c.VerifyPeerCertificate,
+		VerifyConnection:               c.VerifyConnection,
+		RootCAs:                        c.RootCAs,
+		NextProtos:                     c.NextProtos,
+		ServerName:                     c.ServerName,
+		ClientAuth:                     c.ClientAuth,
+		ClientCAs:                      c.ClientCAs,
+		InsecureSkipVerify:             c.InsecureSkipVerify,
+		CipherSuites:                   c.CipherSuites,
+		PreferServerCipherSuites:       c.PreferServerCipherSuites,
+		SessionTicketsDisabled:         c.SessionTicketsDisabled,
+		SessionTicketKey:               c.SessionTicketKey,
+		ClientSessionCache:             c.ClientSessionCache,
+		MinVersion:                     c.MinVersion,
+		MaxVersion:                     c.MaxVersion,
+		CurvePreferences:               c.CurvePreferences,
+		DynamicRecordSizingDisabled:    c.DynamicRecordSizingDisabled,
+		Renegotiation:                  c.Renegotiation,
+		KeyLogWriter:                   c.KeyLogWriter,
+		sessionTicketKeys:              c.sessionTicketKeys,
+		autoSessionTicketKeys:          c.autoSessionTicketKeys,
+		Gaseous:                        c.Gaseous.Clone(),
+		GaseousEnabled:                 c.GaseousEnabled,
+		ClientHelloSpec:                c.ClientHelloSpec,
+		GREASE:                         c.GREASE,
+		EncryptedClientHelloConfigList: c.EncryptedClientHelloConfigList,
+		EncryptedClientHelloKeys:       c.EncryptedClientHelloKeys,
+		MaxEarlyData:                   c.MaxEarlyData,
+		AcceptEarlyData:                c.AcceptEarlyData,
+		CertCompressionAlgorithms:      c.CertCompressionAlgorithms,
+		MaxCertificateSize:             c.MaxCertificateSize,
+		RecordSizeLimit:                c.RecordSizeLimit,
+		RecordPadding:                  c.RecordPadding,
+		KeyUpdateRecords:               c.KeyUpdateRecords,
+		KeyUpdateBytes:                 c.KeyUpdateBytes,
+		KeyUpdateInterval:              c.KeyUpdateInterval,
 	}
 }
 
+// gaseousConfig returns the effective Gaseous configuration, or nil if
+// Gaseous is disabled.
+func (c *Config) gaseousConfig() *GaseousConfig {
+	if c == nil {
+		return nil
+	}
+	if c.Gaseous != nil {
+		return c.Gaseous
+	}
+	if c.GaseousEnabled {
+		return &GaseousConfig{ClientHello: true, Fingerprint: GaseousFingerprintApproximate}
+	}
+	return nil
+}
+
 // deprecatedSessionTicketKey is set as the prefix of SessionTicketKey if it was
 // randomized for backwards compatibility but is not in use.
 var deprecatedSessionTicketKey = []byte("DEPRECATED")
@@ -1325,6 +1514,7 @@ func (c *Config) BuildNameToCertificate() {
 
 const (
 	keyLogLabelTLS12           = "CLIENT_RANDOM"
+	keyLogLabelClientEarly     = "CLIENT_EARLY_TRAFFIC_SECRET"
 	keyLogLabelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
 	keyLogLabelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
 	keyLogLabelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
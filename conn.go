@@ -53,6 +53,10 @@ type Conn struct {
 	// verifiedChains contains the certificate chains that we built, as
 	// opposed to the ones presented by the server.
 	verifiedChains [][]*x509.Certificate
+	// peerMutex guards ocspResponse, scts, peerCertificates and
+	// verifiedChains after the handshake, when a server replaces them with
+	// the answer to a post-handshake CertificateRequest.
+	peerMutex sync.Mutex
 	// serverName contains the server name indicated by the client, if any.
 	serverName string
 	// secureRenegotiation is true if the server echoed the secure
@@ -116,9 +120,64 @@ type Conn struct {
 	activeCall int32
 
 	tmp [16]byte
-	
+
+	// gaseousHelloSent records whether a hello was sent in a Gaseous frame
+	// during the handshake, and gaseousHelloReceived whether the last hello
+	// received, which after a HelloRetryRequest is the second one, was.
 	gaseousHelloSent     bool
-        gaseousHelloReceived bool
+	gaseousHelloReceived bool
+	// gaseousChainsAdvertised is set on a client that sent the hashes of its
+	// cached certificate chains; gaseousPeerChains holds them on a server.
+	gaseousChainsAdvertised bool
+	gaseousPeerChains       [][32]byte
+
+	// clientHelloRaw is the last ClientHello handshake message sent by a
+	// client or received by a server.
+	clientHelloRaw []byte
+
+	// echAccepted is set once Encrypted Client Hello was accepted. ech is a
+	// server's ECH state, and echPublicName the name a client verifies the
+	// server certificate for after the server rejected ECH.
+	echAccepted   bool
+	ech           *echServerContext
+	echPublicName string
+
+	// curveID is the group of the ECDHE or hybrid key exchange.
+	curveID CurveID
+
+	// extMasterSecret is set if a TLS 1.2 or earlier connection derived its
+	// master secret with the Extended Master Secret extension (RFC 7627).
+	extMasterSecret bool
+
+	// quic is set for connections driven by a QUICConn, which carry
+	// handshake messages in QUIC CRYPTO frames instead of records.
+	quic *quicState
+
+	// earlyData is the 0-RTT data a client sends with the ClientHello.
+	// earlyDataAccepted is set once the server accepted it. A server keeps
+	// serverEarlyData until the client's Finished, with earlyDataPending
+	// set for ConnectionState, and skips up to earlyDataSkip bytes of
+	// records of early data it rejected.
+	earlyData         []byte
+	earlyDataAccepted bool
+	serverEarlyData   *serverEarlyData
+	earlyDataPending  atomic.Bool
+	earlyDataSkip     int
+
+	// keyUpdatesSent and keyUpdatesReceived count the TLS 1.3 KeyUpdate
+	// messages of each direction. keyUpdateRequested is set once c asked
+	// the peer to update its keys, until it does. Protected by in.Mutex.
+	keyUpdatesSent     atomic.Int64
+	keyUpdatesReceived atomic.Int64
+	keyUpdateRequested bool
+
+	// postHandshakeAuth is set once a TLS 1.3 handshake in which the client
+	// offered post-handshake authentication completed. heldInput is the
+	// application data a server read while waiting for a client to answer a
+	// post-handshake CertificateRequest, which Read returns first. Protected
+	// by in.Mutex.
+	postHandshakeAuth *postHandshakeAuth
+	heldInput         []byte
 }
 
 // Access to net.Conn methods.
@@ -162,12 +221,6 @@ func (c *Conn) NetConn() net.Conn {
 	return c.conn
 }
 
-func (c *Conn) consumeHello(hello []byte) error {
-    c.hand.Reset()         // 清空 handshake buffer
-    c.hand.Write(hello)    // 写入完整 hello 消息
-    return nil
-}
-
 // A halfConn represents one direction of the record layer
 // connection, either sending or receiving.
 type halfConn struct {
@@ -184,7 +237,18 @@ type halfConn struct {
 	nextCipher any       // next encryption state
 	nextMac    hash.Hash // next MAC algorithm
 
-	trafficSecret []byte // current TLS 1.3 traffic secret
+	level         QUICEncryptionLevel // current QUIC encryption level
+	trafficSecret []byte              // current TLS 1.3 traffic secret
+
+	// recordSizeLimit, if not zero, is the most plaintext bytes of a
+	// protected record, as negotiated with record_size_limit (RFC 8449).
+	recordSizeLimit int
+
+	// keyBytes counts the plaintext bytes of application data protected
+	// with the current TLS 1.3 traffic secret, and keyTime is when the
+	// first of them was, if any.
+	keyBytes int64
+	keyTime  time.Time
 }
 
 type permanentError struct {
@@ -229,13 +293,16 @@ func (hc *halfConn) changeCipherSpec() error {
 	return nil
 }
 
-func (hc *halfConn) setTrafficSecret(suite *cipherSuiteTLS13, secret []byte) {
+func (hc *halfConn) setTrafficSecret(suite *cipherSuiteTLS13, level QUICEncryptionLevel, secret []byte) {
 	hc.trafficSecret = secret
+	hc.level = level
 	key, iv := suite.trafficKey(secret)
 	hc.cipher = suite.aead(key, iv)
 	for i := range hc.seq {
 		hc.seq[i] = 0
 	}
+	hc.keyBytes = 0
+	hc.keyTime = time.Time{}
 }
 
 // incSeq increments the sequence number.
@@ -478,8 +545,9 @@ func sliceForAppend(in []byte, n int) (head, tail []byte) {
 }
 
 // encrypt encrypts payload, adding the appropriate nonce and/or MAC, and
-// appends it to record, which must already contain the record header.
-func (hc *halfConn) encrypt(record, payload []byte, rand io.Reader) ([]byte, error) {
+// appends it to record, which must already contain the record header. In
+// TLS 1.3, padding zero bytes are added after the content type.
+func (hc *halfConn) encrypt(record, payload []byte, padding int, rand io.Reader) ([]byte, error) {
 	if hc.cipher == nil {
 		return append(record, payload...), nil
 	}
@@ -524,8 +592,11 @@ func (hc *halfConn) encrypt(record, payload []byte, rand io.Reader) ([]byte, err
 			// Encrypt the actual ContentType and replace the plaintext one.
 			record = append(record, record[0])
 			record[0] = byte(recordTypeApplicationData)
+			for i := 0; i < padding; i++ {
+				record = append(record, 0)
+			}
 
-			n := len(payload) + 1 + c.Overhead()
+			n := len(payload) + 1 + padding + c.Overhead()
 			record[3] = byte(n >> 8)
 			record[4] = byte(n)
 
@@ -656,10 +727,18 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 		// client. Bail out before reading a full 'body', if possible.
 		// The current max version is 3.3 so if the version is >= 16.0,
 		// it's probably not real.
-		if (typ != recordTypeAlert && typ != recordTypeHandshake) || vers >= 0x1000 {
+		if (typ != recordTypeAlert && typ != recordTypeHandshake && !c.expectGaseousHello(typ)) || vers >= 0x1000 {
 			return c.in.setErrorLocked(c.newRecordHeaderError(c.conn, "first record does not look like a TLS handshake"))
 		}
 	}
+	// Until TLS 1.3 handshake keys are in place, a plaintext handshake
+	// record carries a hello, including the second one after a
+	// HelloRetryRequest.
+	helloRecord := !c.haveVers || c.vers == VersionTLS13 && c.in.cipher == nil
+	if typ == recordTypeHandshake && helloRecord && c.requireGaseousHello() {
+		c.sendAlert(alertUnexpectedMessage)
+		return c.in.setErrorLocked(errors.New("tls: peer sent a plain hello but Gaseous is required"))
+	}
 	if c.vers == VersionTLS13 && n > maxCiphertextTLS13 || n > maxCiphertext {
 		c.sendAlert(alertRecordOverflow)
 		msg := fmt.Sprintf("oversized record received with length %d", n)
@@ -674,18 +753,47 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 
 	// Process message.
 	record := c.rawInput.Next(recordHeaderLen + n)
+	if typ == recordTypeGaseousHello {
+		// Gaseous frames are never encrypted; they carry handshake
+		// messages in place of ordinary handshake records.
+		if handshakeComplete || !c.expectGaseousHello(typ) {
+			return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
+		}
+		if err := c.readGaseousHello(record[recordHeaderLen:]); err != nil {
+			c.sendAlert(alertDecodeError)
+			return c.in.setErrorLocked(err)
+		}
+		c.retryCount = 0
+		return nil
+	}
 	data, typ, err := c.in.decrypt(record)
 	if err != nil {
+		if c.skipRejectedEarlyData(n) {
+			return nil
+		}
 		return c.in.setErrorLocked(c.sendAlert(err.(alert)))
 	}
-	if len(data) > maxPlaintext {
+	// A client sends its early data before it learns the record_size_limit
+	// of the server, so the limit only applies from EndOfEarlyData on.
+	earlyData := c.serverEarlyData != nil && !c.serverEarlyData.ended
+	if len(data) > maxPlaintext || c.in.receivedOverRecordSizeLimit(n, len(data)) && !earlyData {
 		return c.in.setErrorLocked(c.sendAlert(alertRecordOverflow))
 	}
 
 	// Application Data messages are always protected.
 	if c.in.cipher == nil && typ == recordTypeApplicationData {
+		if c.skipRejectedEarlyData(n) {
+			return nil
+		}
 		return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 	}
+	if typ == recordTypeHandshake {
+		// The client is past any early data it sent.
+		c.earlyDataSkip = 0
+		if helloRecord {
+			c.gaseousHelloReceived = false
+		}
+	}
 
 	if typ != recordTypeAlert && typ != recordTypeChangeCipherSpec && len(data) > 0 {
 		// This is a state-advancing message: reset the retry count.
@@ -749,10 +857,18 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 			return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 		}
 		// Some OpenSSL servers send empty records in order to randomize the
-		// CBC IV. Ignore a limited number of empty records.
+		// CBC IV. Ignore a limited number of empty records, but any number
+		// of TLS 1.3 padding records.
 		if len(data) == 0 {
+			if c.in.isPaddingRecord(n) {
+				return nil
+			}
 			return c.retryReadRecord(expectChangeCipherSpec)
 		}
+		if err := c.receiveEarlyData(len(data)); err != nil {
+			return err
+		}
+		c.in.countKeyUsage(c.config, len(data))
 		// Note that data is owned by c.rawInput, following the Next call above,
 		// to avoid copying the plaintext. This is safe because c.rawInput is
 		// not read from or written to until c.input is drained.
@@ -819,6 +935,12 @@ func (c *Conn) readFromUntil(r io.Reader, n int) error {
 
 // sendAlert sends a TLS alert message.
 func (c *Conn) sendAlertLocked(err alert) error {
+	if c.quic != nil {
+		// QUIC carries alerts as CONNECTION_CLOSE frames. QUICConn
+		// methods return an AlertError instead.
+		return c.out.setErrorLocked(&net.OpError{Op: "local error", Err: err})
+	}
+
 	switch err {
 	case alertNoRenegotiation, alertCloseNotify:
 		c.tmp[0] = alertLevelWarning
@@ -965,32 +1087,34 @@ func (c *Conn) writeRecordLocked(typ recordType, data []byte) (int, error) {
 		outBufPool.Put(outBufPtr)
 	}()
 
+	if c.quic != nil {
+		if typ != recordTypeHandshake {
+			return 0, errors.New("tls: internal error: sending non-handshake message to QUIC transport")
+		}
+		c.quicWriteCryptoData(c.out.level, data)
+		return len(data), nil
+	}
+
 	var n int
 	for len(data) > 0 {
 		m := len(data)
 		if maxPayload := c.maxPayloadSizeForWrite(typ); m > maxPayload {
 			m = maxPayload
 		}
-
-		_, outBuf = sliceForAppend(outBuf[:0], recordHeaderLen)
-		outBuf[0] = byte(typ)
-		vers := c.vers
-		if vers == 0 {
-			// Some TLS servers fail if the record version is
-			// greater than TLS 1.0 for the initial ClientHello.
-			vers = VersionTLS10
-		} else if vers == VersionTLS13 {
-			// TLS 1.3 froze the record layer version to 1.2.
-			// See RFC 8446, Section 5.1.
-			vers = VersionTLS12
+		if c.out.overRecordSizeLimit(m) {
+			m = c.out.recordSizeLimit
+		}
+		if typ == recordTypeApplicationData {
+			if c.keyUpdateDue(&c.out) {
+				if err := c.sendKeyUpdateLocked(false); err != nil {
+					return n, err
+				}
+			}
+			c.out.countKeyUsage(c.config, m)
 		}
-		outBuf[1] = byte(vers >> 8)
-		outBuf[2] = byte(vers)
-		outBuf[3] = byte(m >> 8)
-		outBuf[4] = byte(m)
 
 		var err error
-		outBuf, err = c.out.encrypt(outBuf, data[:m], c.config.rand())
+		outBuf, err = c.sealRecord(outBuf, typ, data[:m], c.recordPadding(typ, m))
 		if err != nil {
 			return n, err
 		}
@@ -1010,6 +1134,233 @@ func (c *Conn) writeRecordLocked(typ recordType, data []byte) (int, error) {
 	return n, nil
 }
 
+// sealRecord builds in outBuf the record of type typ carrying data, followed
+// by padding zero bytes of TLS 1.3 padding.
+func (c *Conn) sealRecord(outBuf []byte, typ recordType, data []byte, padding int) ([]byte, error) {
+	_, outBuf = sliceForAppend(outBuf[:0], recordHeaderLen)
+	outBuf[0] = byte(typ)
+	vers := c.vers
+	if vers == 0 {
+		// Some TLS servers fail if the record version is
+		// greater than TLS 1.0 for the initial ClientHello.
+		vers = VersionTLS10
+		if c.out.cipher != nil {
+			// TLS 1.3 early data, sent before the version is known.
+			vers = VersionTLS12
+		}
+	} else if vers == VersionTLS13 {
+		// TLS 1.3 froze the record layer version to 1.2.
+		// See RFC 8446, Section 5.1.
+		vers = VersionTLS12
+	}
+	outBuf[1] = byte(vers >> 8)
+	outBuf[2] = byte(vers)
+	outBuf[3] = byte(len(data) >> 8)
+	outBuf[4] = byte(len(data))
+
+	return c.out.encrypt(outBuf, data, padding, c.config.rand())
+}
+
+// writeHelloRecord writes a ClientHello, ServerHello or HelloRetryRequest
+// message, framed as a Gaseous record if the config enables the direction.
+func (c *Conn) writeHelloRecord(msg []byte) error {
+	if c.isClient {
+		c.clientHelloRaw = msg
+	}
+	g := c.config.gaseousConfig()
+	if g == nil || c.quic != nil || (c.isClient && !g.ClientHello) || (!c.isClient && !g.ServerHello) {
+		_, err := c.writeRecord(recordTypeHandshake, msg)
+		return err
+	}
+
+	var frame []byte
+	var err error
+	if c.isClient {
+		frame, err = packClientHelloGaseous(msg, g, true)
+	} else {
+		frame, err = packServerHelloGaseous(msg, g)
+	}
+	if err == nil && len(frame) > maxPlaintext {
+		err = ErrGaseousLimit
+	}
+	if err != nil {
+		if g.Fallback == GaseousFallbackReject {
+			c.sendAlert(alertInternalError)
+			return fmt.Errorf("tls: failed to pack Gaseous hello: %w", err)
+		}
+		_, err := c.writeRecord(recordTypeHandshake, msg)
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.isClient && !c.gaseousChainsAdvertised && g.Chains.Len() > 0 {
+		chains, err := marshalGaseousFrame(GaseousHelloTypeCachedChains, 0, marshalCachedChains(g.Chains.hashes()), g)
+		if err == nil {
+			if err := c.writeUnprotectedRecordLocked(recordTypeGaseousHello, chains); err != nil {
+				return err
+			}
+			c.gaseousChainsAdvertised = true
+		}
+	}
+	if err := c.writeUnprotectedRecordLocked(recordTypeGaseousHello, frame); err != nil {
+		return err
+	}
+	c.gaseousHelloSent = true
+	return nil
+}
+
+// writeCertificateRecord writes a TLS 1.2 Certificate message, as a Gaseous
+// certificate reference frame if the client advertised its chain.
+func (c *Conn) writeCertificateRecord(msg []byte) error {
+	if ref := c.gaseousChainReference(msg, false); ref != nil {
+		frame, err := marshalGaseousFrame(GaseousHelloTypeCertificateReference, 0, ref, c.config.gaseousConfig())
+		if err == nil && len(frame) <= maxPlaintext {
+			c.out.Lock()
+			defer c.out.Unlock()
+			return c.writeUnprotectedRecordLocked(recordTypeGaseousHello, frame)
+		}
+	}
+	_, err := c.writeRecord(recordTypeHandshake, msg)
+	return err
+}
+
+// writeUnprotectedRecordLocked writes data as a single record of type typ,
+// bypassing the current write cipher. It is used for Gaseous frames, which
+// are never encrypted.
+func (c *Conn) writeUnprotectedRecordLocked(typ recordType, data []byte) error {
+	vers := c.vers
+	if vers == 0 {
+		vers = VersionTLS10
+	} else if vers == VersionTLS13 {
+		vers = VersionTLS12
+	}
+	record := make([]byte, recordHeaderLen, recordHeaderLen+len(data))
+	record[0] = byte(typ)
+	record[1] = byte(vers >> 8)
+	record[2] = byte(vers)
+	record[3] = byte(len(data) >> 8)
+	record[4] = byte(len(data))
+	record = append(record, data...)
+	_, err := c.write(record)
+	return err
+}
+
+// expectGaseousHello reports whether a record of type typ may be a Gaseous
+// frame sent by the peer.
+func (c *Conn) expectGaseousHello(typ recordType) bool {
+	if typ != recordTypeGaseousHello {
+		return false
+	}
+	g := c.config.gaseousConfig()
+	if g == nil {
+		return false
+	}
+	if c.isClient {
+		return g.ServerHello || c.gaseousChainsAdvertised
+	}
+	return g.ClientHello
+}
+
+// requireGaseousHello reports whether the peer's hellos must arrive in
+// Gaseous frames.
+func (c *Conn) requireGaseousHello() bool {
+	g := c.config.gaseousConfig()
+	return g != nil && g.Fallback == GaseousFallbackReject &&
+		c.expectGaseousHello(recordTypeGaseousHello)
+}
+
+// readGaseousHello unpacks a Gaseous record and queues the handshake messages
+// it carries for readHandshake.
+func (c *Conn) readGaseousHello(record []byte) error {
+	if len(record) < 1+gaseousHelloHeaderSize || record[0] != recordTypeGaseousHello {
+		return ErrGaseousTrunc
+	}
+	frame := record[1:]
+	g := c.config.gaseousConfig()
+
+	// Frames replace plaintext handshake records, so they may only arrive
+	// before the keys change and never in the middle of a message.
+	if c.in.cipher != nil || c.hand.Len() > 0 {
+		return errors.New("tls: Gaseous frame received after the handshake keys changed")
+	}
+	helloType := frame[4]
+	switch {
+	case !c.isClient && helloType == GaseousHelloTypeClient:
+	case !c.isClient && helloType == GaseousHelloTypeCachedChains && !c.haveVers && c.gaseousPeerChains == nil:
+	case c.isClient && (helloType == GaseousHelloTypeServer || helloType == GaseousHelloTypeHelloRetryRequest) && g.ServerHello:
+	case c.isClient && helloType == GaseousHelloTypeServerFlight && g.ServerHello && g.ServerFlight:
+	case c.isClient && helloType == GaseousHelloTypeCertificateReference && c.gaseousChainsAdvertised && c.vers != VersionTLS13:
+	default:
+		return fmt.Errorf("tls: unexpected Gaseous message type %d", helloType)
+	}
+	msg, err := unpackGaseousHello(frame, helloType, g)
+	if err != nil {
+		return fmt.Errorf("tls: invalid Gaseous hello: %w", err)
+	}
+	var chains *GaseousChainCache
+	if c.gaseousChainsAdvertised {
+		chains = g.Chains
+	}
+	var records []byte
+	switch helloType {
+	case GaseousHelloTypeCachedChains:
+		hashes, err := parseCachedChains(msg)
+		if err != nil {
+			return fmt.Errorf("tls: invalid Gaseous cached chains: %w", err)
+		}
+		c.gaseousPeerChains = hashes
+		return nil
+	case GaseousHelloTypeServerFlight:
+		if msg, records, err = parseGaseousFlight(msg); err != nil {
+			return fmt.Errorf("tls: invalid Gaseous server flight: %w", err)
+		}
+	case GaseousHelloTypeCertificateReference:
+		if msg, err = expandChainReference(msg, false, chains); err != nil {
+			return fmt.Errorf("tls: invalid Gaseous certificate reference: %w", err)
+		}
+		fallthrough
+	default:
+		if !isGaseousHelloMessage(msg, helloType) {
+			return fmt.Errorf("tls: Gaseous message type %d does not carry exactly one matching handshake message", helloType)
+		}
+	}
+	c.hand.Write(msg)
+	if helloType != GaseousHelloTypeCertificateReference {
+		c.gaseousHelloReceived = true
+	}
+	if len(records) > 0 {
+		// The protected records bundled after the ServerHello are read as
+		// if they had followed the frame on the wire. They may alias
+		// c.rawInput, so they are copied before it is rewritten.
+		rest := c.rawInput.Bytes()
+		buf := make([]byte, 0, len(records)+len(rest))
+		buf = append(append(buf, records...), rest...)
+		c.rawInput.Reset()
+		c.rawInput.Write(buf)
+	}
+	return nil
+}
+
+// isGaseousHelloMessage reports whether msg is exactly one handshake message
+// of the kind a Gaseous frame of type helloType carries.
+func isGaseousHelloMessage(msg []byte, helloType uint8) bool {
+	if len(msg) < 4 || int(msg[1])<<16|int(msg[2])<<8|int(msg[3]) != len(msg)-4 {
+		return false
+	}
+	switch helloType {
+	case GaseousHelloTypeClient:
+		return msg[0] == typeClientHello
+	case GaseousHelloTypeServer:
+		return msg[0] == typeServerHello && !isHelloRetryRequest(msg)
+	case GaseousHelloTypeHelloRetryRequest:
+		return msg[0] == typeServerHello && isHelloRetryRequest(msg)
+	case GaseousHelloTypeCertificateReference:
+		return msg[0] == typeCertificate
+	}
+	return false
+}
+
 // writeRecord writes a TLS record with the given type and payload to the
 // connection and updates the record layer state.
 func (c *Conn) writeRecord(typ recordType, data []byte) (int, error) {
@@ -1019,13 +1370,24 @@ func (c *Conn) writeRecord(typ recordType, data []byte) (int, error) {
 	return c.writeRecordLocked(typ, data)
 }
 
+// readHandshakeBytes reads handshake data until c.hand holds at least n bytes.
+func (c *Conn) readHandshakeBytes(n int) error {
+	if c.quic != nil {
+		return c.quicReadHandshakeBytes(n)
+	}
+	for c.hand.Len() < n {
+		if err := c.readRecord(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // readHandshake reads the next handshake message from
 // the record layer.
 func (c *Conn) readHandshake() (any, error) {
-	for c.hand.Len() < 4 {
-		if err := c.readRecord(); err != nil {
-			return nil, err
-		}
+	if err := c.readHandshakeBytes(4); err != nil {
+		return nil, err
 	}
 
 	data := c.hand.Bytes()
@@ -1034,10 +1396,8 @@ func (c *Conn) readHandshake() (any, error) {
 		c.sendAlertLocked(alertInternalError)
 		return nil, c.in.setErrorLocked(fmt.Errorf("tls: handshake message of length %d bytes exceeds maximum of %d bytes", n, maxHandshake))
 	}
-	for c.hand.Len() < 4+n {
-		if err := c.readRecord(); err != nil {
-			return nil, err
-		}
+	if err := c.readHandshakeBytes(4 + n); err != nil {
+		return nil, err
 	}
 	data = c.hand.Next(4 + n)
 	var m handshakeMessage
@@ -1060,6 +1420,13 @@ func (c *Conn) readHandshake() (any, error) {
 		} else {
 			m = new(certificateMsg)
 		}
+	case typeCompressedCertificate:
+		m = new(compressedCertificateMsg)
+	case typeGaseousCertificateReference:
+		if !c.isClient || c.vers != VersionTLS13 || !c.gaseousChainsAdvertised {
+			return nil, c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
+		}
+		m = new(gaseousCertificateReferenceMsg)
 	case typeCertificateRequest:
 		if c.vers == VersionTLS13 {
 			m = new(certificateRequestMsgTLS13)
@@ -1113,9 +1480,6 @@ var (
 // must be set for both Read and Write before Write is called when the handshake
 // has not yet completed. See SetDeadline, SetReadDeadline, and
 // SetWriteDeadline.
-// Write writes application data to the connection.
-// If Gaseous mode is enabled, the first record sent is a compressed Gaseous ClientHello.
-// Otherwise, standard TLS handshake/data logic applies.
 func (c *Conn) Write(b []byte) (int, error) {
 	for {
 		x := atomic.LoadInt32(&c.activeCall)
@@ -1128,19 +1492,6 @@ func (c *Conn) Write(b []byte) (int, error) {
 	}
 	defer atomic.AddInt32(&c.activeCall, -2)
 
-	// Gaseous: send compressed ClientHello before handshake if in gaseous mode
-	if c.config != nil && c.config.GaseousEnabled && !c.gaseousHelloSent {
-		helloCompressed, err := PackClientHelloGaseous(c)
-		if err != nil {
-			return 0, fmt.Errorf("gaseous: pack client hello failed: %w", err)
-		}
-		n, err := c.writeRecordLocked(recordTypeGaseousHello, helloCompressed)
-		if err != nil {
-			return n, err
-		}
-		c.gaseousHelloSent = true
-	}
-
 	if err := c.Handshake(); err != nil {
 		return 0, err
 	}
@@ -1227,6 +1578,10 @@ func (c *Conn) handlePostHandshakeMessage() error {
 		return c.handleRenegotiation()
 	}
 
+	if c.serverEarlyData != nil {
+		return c.handleEarlyDataMessage()
+	}
+
 	msg, err := c.readHandshake()
 	if err != nil {
 		return err
@@ -1243,6 +1598,10 @@ func (c *Conn) handlePostHandshakeMessage() error {
 		return c.handleNewSessionTicket(msg)
 	case *keyUpdateMsg:
 		return c.handleKeyUpdate(msg)
+	case *certificateRequestMsgTLS13:
+		return c.handleCertificateRequest(msg)
+	case *certificateMsgTLS13, *compressedCertificateMsg, *certificateVerifyMsg, *finishedMsg:
+		return c.handleClientCertificateResponse(msg)
 	default:
 		c.sendAlert(alertUnexpectedMessage)
 		return fmt.Errorf("tls: received unexpected handshake message of type %T", msg)
@@ -1250,28 +1609,30 @@ func (c *Conn) handlePostHandshakeMessage() error {
 }
 
 func (c *Conn) handleKeyUpdate(keyUpdate *keyUpdateMsg) error {
+	if c.quic != nil {
+		// QUIC updates keys itself. See RFC 9001, Section 6.
+		c.sendAlert(alertUnexpectedMessage)
+		return c.in.setErrorLocked(errors.New("tls: received unexpected key update message"))
+	}
+
 	cipherSuite := cipherSuiteTLS13ByID(c.cipherSuite)
 	if cipherSuite == nil {
 		return c.in.setErrorLocked(c.sendAlert(alertInternalError))
 	}
 
 	newSecret := cipherSuite.nextTrafficSecret(c.in.trafficSecret)
-	c.in.setTrafficSecret(cipherSuite, newSecret)
+	c.in.setTrafficSecret(cipherSuite, QUICEncryptionLevelApplication, newSecret)
+	c.keyUpdatesReceived.Add(1)
+	c.keyUpdateRequested = false
 
 	if keyUpdate.updateRequested {
 		c.out.Lock()
 		defer c.out.Unlock()
 
-		msg := &keyUpdateMsg{}
-		_, err := c.writeRecordLocked(recordTypeHandshake, msg.marshal())
-		if err != nil {
+		if err := c.sendKeyUpdateLocked(false); err != nil {
 			// Surface the error at the next write.
 			c.out.setErrorLocked(err)
-			return nil
 		}
-
-		newSecret := cipherSuite.nextTrafficSecret(c.out.trafficSecret)
-		c.out.setTrafficSecret(cipherSuite, newSecret)
 	}
 
 	return nil
@@ -1283,8 +1644,6 @@ func (c *Conn) handleKeyUpdate(keyUpdate *keyUpdateMsg) error {
 // must be set for both Read and Write before Read is called when the handshake
 // has not yet completed. See SetDeadline, SetReadDeadline, and
 // SetWriteDeadline.
-// Read reads data from the connection.
-// If Gaseous mode is enabled, will first try to detect/parse a compressed Gaseous ClientHello/ServerHello.
 func (c *Conn) Read(b []byte) (int, error) {
 	if err := c.Handshake(); err != nil {
 		return 0, err
@@ -1296,21 +1655,13 @@ func (c *Conn) Read(b []byte) (int, error) {
 	c.in.Lock()
 	defer c.in.Unlock()
 
-	// Gaseous: receive and unpack ClientHello/ServerHello before handshake data if in gaseous mode
-	if c.config != nil && c.config.GaseousEnabled && !c.gaseousHelloReceived {
-		for c.rawInput.Len() < MinGaseousHelloLen {
-			if err := c.readRecord(); err != nil {
-				return 0, err
-			}
+	if len(c.heldInput) > 0 {
+		n := copy(b, c.heldInput)
+		c.heldInput = c.heldInput[n:]
+		if len(c.heldInput) == 0 {
+			c.heldInput = nil
 		}
-		gHello, err := UnpackClientHelloGaseous(c.rawInput.Bytes())
-		if err != nil {
-			return 0, fmt.Errorf("gaseous: unpack hello failed: %w", err)
-		}
-		if err := c.consumeHello(gHello); err != nil {
-			return 0, err
-		}
-		c.gaseousHelloReceived = true
+		return n, nil
 	}
 
 	for c.input.Len() == 0 {
@@ -1322,6 +1673,7 @@ func (c *Conn) Read(b []byte) (int, error) {
 				return 0, err
 			}
 		}
+		c.requestKeyUpdateIfDue()
 	}
 
 	n, _ := c.input.Read(b)
@@ -1441,12 +1793,18 @@ func (c *Conn) handshakeContext(ctx context.Context) (ret error) {
 	// this cancellation. In the former case, we need to close the connection.
 	defer cancel()
 
-	// Start the "interrupter" goroutine, if this context might be canceled.
-	// (The background context cannot).
-	//
-	// The interrupter goroutine waits for the input context to be done and
-	// closes the connection if this happens before the function returns.
-	if ctx.Done() != nil {
+	// A QUIC handshake blocks waiting for data from the QUICConn, and is
+	// canceled by QUICConn.Close.
+	if c.quic != nil {
+		c.quic.cancelc = handshakeCtx.Done()
+		c.quic.cancel = cancel
+	} else if ctx.Done() != nil {
+		// Start the "interrupter" goroutine, if this context might be
+		// canceled. (The background context cannot).
+		//
+		// The interrupter goroutine waits for the input context to be done
+		// and closes the connection if this happens before the function
+		// returns.
 		done := make(chan struct{})
 		interruptRes := make(chan error, 1)
 		defer func() {
@@ -1497,6 +1855,10 @@ func (c *Conn) handshakeContext(ctx context.Context) (ret error) {
 		panic("tls: internal error: handshake returned an error but is marked successful")
 	}
 
+	if c.quic != nil {
+		c.quicHandshakeDone()
+	}
+
 	return c.handshakeErr
 }
 
@@ -1509,17 +1871,26 @@ func (c *Conn) ConnectionState() ConnectionState {
 
 func (c *Conn) connectionStateLocked() ConnectionState {
 	var state ConnectionState
-	state.HandshakeComplete = c.handshakeComplete()
+	state.EarlyDataPending = c.earlyDataPending.Load()
+	state.HandshakeComplete = c.handshakeComplete() && !state.EarlyDataPending
 	state.Version = c.vers
 	state.NegotiatedProtocol = c.clientProtocol
 	state.DidResume = c.didResume
 	state.NegotiatedProtocolIsMutual = true
 	state.ServerName = c.serverName
 	state.CipherSuite = c.cipherSuite
+	c.peerMutex.Lock()
 	state.PeerCertificates = c.peerCertificates
 	state.VerifiedChains = c.verifiedChains
 	state.SignedCertificateTimestamps = c.scts
 	state.OCSPResponse = c.ocspResponse
+	c.peerMutex.Unlock()
+	state.ECHAccepted = c.echAccepted
+	state.CurveID = c.curveID
+	state.EarlyDataAccepted = c.earlyDataAccepted
+	state.RecordSizeLimit = c.out.recordSizeLimit
+	state.KeyUpdatesSent = int(c.keyUpdatesSent.Load())
+	state.KeyUpdatesReceived = int(c.keyUpdatesReceived.Load())
 	if !c.didResume && c.vers != VersionTLS13 {
 		if c.clientFinishedIsFirst {
 			state.TLSUnique = c.clientFinished[:]
@@ -1540,6 +1911,8 @@ func (c *Conn) connectionStateLocked() ConnectionState {
 func (c *Conn) OCSPResponse() []byte {
 	c.handshakeMutex.Lock()
 	defer c.handshakeMutex.Unlock()
+	c.peerMutex.Lock()
+	defer c.peerMutex.Unlock()
 
 	return c.ocspResponse
 }
@@ -1556,6 +1929,8 @@ func (c *Conn) VerifyHostname(host string) error {
 	if !c.handshakeComplete() {
 		return errors.New("tls: handshake has not yet been performed")
 	}
+	c.peerMutex.Lock()
+	defer c.peerMutex.Unlock()
 	if len(c.verifiedChains) == 0 {
 		return errors.New("tls: handshake did not verify certificate chain")
 	}
@@ -0,0 +1,220 @@
+package tls
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	utls "github.com/refraction-networking/utls"
+	"gopkg.in/yaml.v3"
+)
+
+// ========== 指纹目录 ==========
+
+// GaseousFingerprintCustomMin is the lowest ID of fingerprints registered at
+// run time. Lower IDs are reserved for the built-in uTLS presets.
+const GaseousFingerprintCustomMin = 0x1000
+
+// GaseousFingerprint is a ClientHello fingerprint in the catalogue. Its ID
+// names it in fingerprint-mode ClientHello frames, so both peers must
+// register the same fingerprints under the same IDs.
+type GaseousFingerprint struct {
+	// ID identifies the fingerprint on the wire. Built-in presets have the
+	// IDs 1 to GaseousFingerprintCustomMin-1, in a fixed order.
+	ID uint16
+	// Name is a unique name, such as "Chrome-120". Built-in presets use the
+	// uTLS ClientHelloID string.
+	Name string
+	// ClientHelloID is the uTLS preset, or the zero value for a custom spec.
+	ClientHelloID utls.ClientHelloID
+
+	// newSpec returns a fresh spec; specs hold per-connection state and
+	// can't be reused.
+	newSpec func() (*utls.ClientHelloSpec, error)
+
+	sigOnce sync.Once
+	sig     *helloSignature
+
+	// delta is the base hello of delta mode, built once; see
+	// stableDeltaBase.
+	deltaOnce sync.Once
+	delta     *deltaBase
+	deltaErr  error
+}
+
+// Spec returns a new copy of the fingerprint's ClientHelloSpec.
+func (f *GaseousFingerprint) Spec() (*utls.ClientHelloSpec, error) {
+	return f.newSpec()
+}
+
+// signature returns the fingerprint's signature, computed on first use, or
+// nil if no ClientHello can be built from it without a session.
+func (f *GaseousFingerprint) signature() *helloSignature {
+	f.sigOnce.Do(func() {
+		f.sig = fingerprintSignatureOf(f)
+	})
+	return f.sig
+}
+
+var gaseousFingerprints = struct {
+	sync.RWMutex
+	byID   map[uint16]*GaseousFingerprint
+	byName map[string]*GaseousFingerprint
+	ids    []uint16 // registration order, used when matching
+}{
+	byID:   make(map[uint16]*GaseousFingerprint),
+	byName: make(map[string]*GaseousFingerprint),
+}
+
+func init() {
+	for i, id := range allUTLSIDs {
+		id := id
+		if err := registerGaseousFingerprint(&GaseousFingerprint{
+			ID:            uint16(i + 1),
+			Name:          id.Str(),
+			ClientHelloID: id,
+			newSpec: func() (*utls.ClientHelloSpec, error) {
+				spec, err := utls.UTLSIdToSpec(id)
+				return &spec, err
+			},
+		}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterGaseousFingerprint adds a custom fingerprint to the catalogue.
+// newSpec must return a new ClientHelloSpec on every call. id must be at
+// least GaseousFingerprintCustomMin, and id and name must be unused.
+func RegisterGaseousFingerprint(id uint16, name string, newSpec func() (*utls.ClientHelloSpec, error)) (*GaseousFingerprint, error) {
+	if id < GaseousFingerprintCustomMin {
+		return nil, errors.New("gaseous: custom fingerprint IDs start at GaseousFingerprintCustomMin")
+	}
+	if name == "" || newSpec == nil {
+		return nil, errors.New("gaseous: fingerprint needs a name and a spec")
+	}
+	if _, err := newSpec(); err != nil {
+		return nil, err
+	}
+	f := &GaseousFingerprint{ID: id, Name: name, newSpec: newSpec}
+	if err := registerGaseousFingerprint(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// RegisterGaseousFingerprintJSON registers a ClientHelloSpec described in
+// the uTLS JSON format, with cipher_suites, compression_methods and
+// extensions lists.
+func RegisterGaseousFingerprintJSON(id uint16, name string, data []byte) (*GaseousFingerprint, error) {
+	data = append([]byte(nil), data...)
+	return RegisterGaseousFingerprint(id, name, func() (*utls.ClientHelloSpec, error) {
+		var u utls.ClientHelloSpecJSONUnmarshaler
+		if err := json.Unmarshal(data, &u); err != nil {
+			return nil, err
+		}
+		spec := u.ClientHelloSpec()
+		return &spec, nil
+	})
+}
+
+// RegisterGaseousFingerprintYAML is like RegisterGaseousFingerprintJSON for
+// the same description written in YAML.
+func RegisterGaseousFingerprintYAML(id uint16, name string, data []byte) (*GaseousFingerprint, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return RegisterGaseousFingerprintJSON(id, name, jsonData)
+}
+
+// RegisterGaseousFingerprintRaw registers the fingerprint of a captured
+// ClientHello handshake message, with or without a TLS record header.
+// Extensions uTLS doesn't know are sent back as captured.
+func RegisterGaseousFingerprintRaw(id uint16, name string, hello []byte) (*GaseousFingerprint, error) {
+	if len(hello) < 5 || hello[0] != byte(recordTypeHandshake) || hello[1] != 0x03 {
+		hello = append([]byte{byte(recordTypeHandshake), 3, 1, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+	} else {
+		hello = append([]byte(nil), hello...)
+	}
+	return RegisterGaseousFingerprint(id, name, func() (*utls.ClientHelloSpec, error) {
+		f := &utls.Fingerprinter{AllowBluntMimicry: true}
+		return f.FingerprintClientHello(hello)
+	})
+}
+
+func registerGaseousFingerprint(f *GaseousFingerprint) error {
+	gaseousFingerprints.Lock()
+	defer gaseousFingerprints.Unlock()
+	if _, ok := gaseousFingerprints.byID[f.ID]; ok {
+		return errors.New("gaseous: duplicate fingerprint ID")
+	}
+	key := strings.ToLower(f.Name)
+	if _, ok := gaseousFingerprints.byName[key]; ok {
+		return errors.New("gaseous: duplicate fingerprint name")
+	}
+	gaseousFingerprints.byID[f.ID] = f
+	gaseousFingerprints.byName[key] = f
+	gaseousFingerprints.ids = append(gaseousFingerprints.ids, f.ID)
+	return nil
+}
+
+// GaseousFingerprintByID returns the registered fingerprint with the given
+// ID, or nil.
+func GaseousFingerprintByID(id uint16) *GaseousFingerprint {
+	gaseousFingerprints.RLock()
+	defer gaseousFingerprints.RUnlock()
+	return gaseousFingerprints.byID[id]
+}
+
+// GaseousFingerprintByName returns the registered fingerprint with the given
+// name, compared without regard to case, or nil.
+func GaseousFingerprintByName(name string) *GaseousFingerprint {
+	gaseousFingerprints.RLock()
+	defer gaseousFingerprints.RUnlock()
+	return gaseousFingerprints.byName[strings.ToLower(name)]
+}
+
+// GaseousFingerprints returns the registered fingerprints in registration
+// order, built-in presets first.
+func GaseousFingerprints() []*GaseousFingerprint {
+	gaseousFingerprints.RLock()
+	defer gaseousFingerprints.RUnlock()
+	out := make([]*GaseousFingerprint, 0, len(gaseousFingerprints.ids))
+	for _, id := range gaseousFingerprints.ids {
+		out = append(out, gaseousFingerprints.byID[id])
+	}
+	return out
+}
+
+// fingerprintForParams returns the fingerprint a fingerprint-mode payload
+// names: by ID if it has one, and otherwise by name. uTLS presets missing
+// from the catalogue are resolved by name too.
+func fingerprintForParams(params *GaseousClientHelloParams) (*GaseousFingerprint, error) {
+	if params.SpecID != 0 {
+		if f := GaseousFingerprintByID(params.SpecID); f != nil {
+			return f, nil
+		}
+		return nil, errors.New("gaseous: unknown fingerprint ID")
+	}
+	if f := GaseousFingerprintByName(params.SpecType); f != nil {
+		return f, nil
+	}
+	id, ok := utlsIDByName(params.SpecType)
+	if !ok {
+		return nil, errors.New("unknown uTLS spec: " + params.SpecType)
+	}
+	return &GaseousFingerprint{
+		Name:          id.Str(),
+		ClientHelloID: id,
+		newSpec: func() (*utls.ClientHelloSpec, error) {
+			spec, err := utls.UTLSIdToSpec(id)
+			return &spec, err
+		},
+	}, nil
+}
@@ -0,0 +1,104 @@
+package tls
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// registerTestFingerprint registers a fingerprint for the duration of a test.
+func registerTestFingerprint(t *testing.T, f *GaseousFingerprint, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		gaseousFingerprints.Lock()
+		defer gaseousFingerprints.Unlock()
+		delete(gaseousFingerprints.byID, f.ID)
+		delete(gaseousFingerprints.byName, strings.ToLower(f.Name))
+		for i, id := range gaseousFingerprints.ids {
+			if id == f.ID {
+				gaseousFingerprints.ids = append(gaseousFingerprints.ids[:i], gaseousFingerprints.ids[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+const testFingerprintYAML = `
+cipher_suites: [TLS_AES_256_GCM_SHA384, TLS_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384]
+compression_methods: ["NULL"]
+extensions:
+  - name: server_name
+  - name: supported_groups
+    named_group_list: [secp384r1, x25519]
+  - name: signature_algorithms
+    supported_signature_algorithms: [ecdsa_secp384r1_sha384, ecdsa_secp256r1_sha256]
+  - name: key_share
+    client_shares:
+      - group: x25519
+  - name: supported_versions
+    versions: ["TLS 1.3", "TLS 1.2"]
+`
+
+func TestGaseousFingerprintCatalogue(t *testing.T) {
+	if f := GaseousFingerprintByID(1); f == nil || f.ClientHelloID != allUTLSIDs[0] {
+		t.Fatalf("built-in fingerprint 1 is %+v", f)
+	}
+	if _, err := RegisterGaseousFingerprintJSON(5, "low", []byte("{}")); err == nil {
+		t.Error("registered a custom fingerprint with a built-in ID")
+	}
+
+	f, err := RegisterGaseousFingerprintYAML(0x1001, "test-yaml", []byte(testFingerprintYAML))
+	registerTestFingerprint(t, f, err)
+	if _, err := RegisterGaseousFingerprintYAML(0x1001, "other", []byte(testFingerprintYAML)); err == nil {
+		t.Error("registered a duplicate fingerprint ID")
+	}
+	params := &GaseousClientHelloParams{SpecID: f.ID, SNI: "example.com", Random: bytes.Repeat([]byte{1}, 32)}
+	hello, err := buildUTLSClientHello(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.CipherSuites) != 3 || p.CipherSuites[0] != TLS_AES_256_GCM_SHA384 || p.SNI != "example.com" {
+		t.Errorf("ClientHello from YAML spec: %+v", p)
+	}
+
+	// A captured hello is matched to its own fingerprint, and sent in
+	// fingerprint mode under its ID.
+	raw, err := RegisterGaseousFingerprintRaw(0x1002, "test-raw", hello)
+	registerTestFingerprint(t, raw, err)
+	candidates, err := MatchClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := candidates[0]; !c.Exact() || (c.Fingerprint != f && c.Fingerprint != raw) || c.ID != (utls.ClientHelloID{}) {
+		t.Errorf("best candidate %s (%.2f) %+v", c.Fingerprint.Name, c.Confidence, c.Diff)
+	}
+	frame, err := packClientHelloGaseous(hello, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := parseGaseousFrame(trimGaseousMarker(frame), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent GaseousClientHelloParams
+	if err := json.Unmarshal(payload, &sent); err != nil || (sent.SpecID != f.ID && sent.SpecID != raw.ID) {
+		t.Fatalf("sent %s, %v", payload, err)
+	}
+	got, err := UnpackClientHelloGaseous(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := ParseClientHello(got); err != nil || !bytes.Equal(p.Random, params.Random) || p.SNI != "example.com" {
+		t.Errorf("rebuilt ClientHello %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,226 @@
+package tls
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ========== 证书压缩 ==========
+
+const (
+	extensionCompressCertificate uint16 = 27
+	typeCompressedCertificate    uint8  = 25
+)
+
+// CertCompressionAlgo is a TLS 1.3 certificate compression algorithm, see
+// RFC 8879, Section 7.3.
+type CertCompressionAlgo uint16
+
+const (
+	CertCompressionZlib   CertCompressionAlgo = 1
+	CertCompressionBrotli CertCompressionAlgo = 2
+	CertCompressionZstd   CertCompressionAlgo = 3
+)
+
+// maxCertificateSizeLimit is the largest uncompressed_length a
+// CompressedCertificate can carry.
+const maxCertificateSizeLimit = 1<<24 - 1
+
+func isSupportedCertCompression(algo CertCompressionAlgo) bool {
+	switch algo {
+	case CertCompressionZlib, CertCompressionBrotli, CertCompressionZstd:
+		return true
+	}
+	return false
+}
+
+// certCompressionAlgorithms returns the algorithms of c this package
+// implements, in order.
+func (c *Config) certCompressionAlgorithms() []CertCompressionAlgo {
+	var algos []CertCompressionAlgo
+	for _, algo := range c.CertCompressionAlgorithms {
+		if isSupportedCertCompression(algo) {
+			algos = append(algos, algo)
+		}
+	}
+	return algos
+}
+
+// maxCertificateSize returns the largest Certificate message body a peer may
+// send compressed.
+func (c *Config) maxCertificateSize() int {
+	switch {
+	case c.MaxCertificateSize <= 0:
+		return maxHandshake
+	case c.MaxCertificateSize > maxCertificateSizeLimit:
+		return maxCertificateSizeLimit
+	}
+	return c.MaxCertificateSize
+}
+
+// mutualCertCompression returns the first algorithm of c that peer lists,
+// or 0 if there is none.
+func (c *Config) mutualCertCompression(peer []CertCompressionAlgo) CertCompressionAlgo {
+	for _, algo := range c.certCompressionAlgorithms() {
+		for _, p := range peer {
+			if algo == p {
+				return algo
+			}
+		}
+	}
+	return 0
+}
+
+// compressCertificateMsg returns certMsg as a CompressedCertificate message
+// compressed with algo, or nil if compression doesn't make it smaller.
+func compressCertificateMsg(certMsg []byte, algo CertCompressionAlgo) (*compressedCertificateMsg, error) {
+	body := certMsg[4:]
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch algo {
+	case CertCompressionZlib:
+		w = zlib.NewWriter(&buf)
+	case CertCompressionBrotli:
+		w = brotli.NewWriter(&buf)
+	case CertCompressionZstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return nil, errors.New("tls: unsupported certificate compression algorithm")
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(body) {
+		return nil, nil
+	}
+	return &compressedCertificateMsg{
+		algorithm:                    algo,
+		uncompressedLength:           uint32(len(body)),
+		compressedCertificateMessage: buf.Bytes(),
+	}, nil
+}
+
+// decompressCertificateMsg returns the Certificate message carried by m,
+// which must be compressed with one of algos and be at most limit bytes long
+// uncompressed. See RFC 8879, Section 4.
+func decompressCertificateMsg(m *compressedCertificateMsg, algos []CertCompressionAlgo, limit int) (*certificateMsgTLS13, error) {
+	offered := false
+	for _, algo := range algos {
+		offered = offered || algo == m.algorithm
+	}
+	if !offered {
+		return nil, errors.New("tls: certificate compressed with an algorithm that was not offered")
+	}
+	if int(m.uncompressedLength) > limit {
+		return nil, errors.New("tls: compressed certificate exceeds the maximum certificate size")
+	}
+	in := bytes.NewReader(m.compressedCertificateMessage)
+	var r io.Reader
+	switch m.algorithm {
+	case CertCompressionZlib:
+		zr, err := zlib.NewReader(in)
+		if err != nil {
+			return nil, errors.New("tls: invalid compressed certificate: " + err.Error())
+		}
+		defer zr.Close()
+		r = zr
+	case CertCompressionBrotli:
+		r = brotli.NewReader(in)
+	case CertCompressionZstd:
+		zr, err := zstd.NewReader(in, zstd.WithDecoderMaxMemory(uint64(m.uncompressedLength)+1))
+		if err != nil {
+			return nil, errors.New("tls: invalid compressed certificate: " + err.Error())
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, errors.New("tls: certificate compressed with an unsupported algorithm")
+	}
+	body, err := io.ReadAll(io.LimitReader(r, int64(m.uncompressedLength)+1))
+	if err != nil {
+		return nil, errors.New("tls: invalid compressed certificate: " + err.Error())
+	}
+	if len(body) != int(m.uncompressedLength) {
+		return nil, errors.New("tls: compressed certificate has the wrong uncompressed length")
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeCertificate)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(body)
+	})
+	certMsg := new(certificateMsgTLS13)
+	if !certMsg.unmarshal(b.BytesOrPanic()) {
+		return nil, errors.New("tls: invalid compressed certificate message")
+	}
+	return certMsg, nil
+}
+
+// readCertificateMsg reads a Certificate message for the certificate request
+// context reqContext, which may arrive as a CompressedCertificate if the peer
+// was offered algos, and writes it to the transcript as received. A Gaseous
+// chain reference is written to the transcript as the Certificate message it
+// stands for.
+func (c *Conn) readCertificateMsg(msg any, algos []CertCompressionAlgo, reqContext []byte, transcript io.Writer) (*certificateMsgTLS13, error) {
+	var certMsg *certificateMsgTLS13
+	received, _ := msg.(handshakeMessage)
+	switch msg := msg.(type) {
+	case *certificateMsgTLS13:
+		certMsg = msg
+	case *compressedCertificateMsg:
+		var err error
+		certMsg, err = decompressCertificateMsg(msg, algos, c.config.maxCertificateSize())
+		if err != nil {
+			c.sendAlert(alertBadCertificate)
+			return nil, err
+		}
+	case *gaseousCertificateReferenceMsg:
+		var err error
+		certMsg, err = c.expandCertificateReference(msg)
+		if err != nil {
+			c.sendAlert(alertBadCertificate)
+			return nil, err
+		}
+		received = certMsg
+	default:
+		c.sendAlert(alertUnexpectedMessage)
+		return nil, unexpectedMessageError(&certificateMsgTLS13{}, msg)
+	}
+	if !bytes.Equal(certMsg.certificateRequestContext, reqContext) {
+		c.sendAlert(alertIllegalParameter)
+		return nil, errors.New("tls: certificate sent with the wrong certificate request context")
+	}
+	transcript.Write(received.marshal())
+	return certMsg, nil
+}
+
+// certificateMsgToSend returns the message to send certMsg in, compressed
+// with the first algorithm of c that the peer offers in peer, if any.
+func (c *Conn) certificateMsgToSend(certMsg *certificateMsgTLS13, peer []CertCompressionAlgo) (handshakeMessage, error) {
+	algo := c.config.mutualCertCompression(peer)
+	if algo == 0 {
+		return certMsg, nil
+	}
+	compressed, err := compressCertificateMsg(certMsg.marshal(), algo)
+	if err != nil {
+		c.sendAlert(alertInternalError)
+		return nil, err
+	}
+	if compressed == nil {
+		return certMsg, nil
+	}
+	return compressed, nil
+}
@@ -0,0 +1,97 @@
+package tls
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// repeatedCertificate returns the test certificate with a chain that
+// repeats it, so that it compresses well.
+func repeatedCertificate(t *testing.T) Certificate {
+	cert, _ := testCertificate(t)
+	cert.Certificate = [][]byte{cert.Certificate[0], cert.Certificate[0], cert.Certificate[0]}
+	return cert
+}
+
+func TestCertCompression(t *testing.T) {
+	for _, algo := range []CertCompressionAlgo{CertCompressionZlib, CertCompressionBrotli, CertCompressionZstd} {
+		clientConfig, serverConfig := testConfigs(t)
+		serverConfig.Certificates = []Certificate{repeatedCertificate(t)}
+		clientConfig.CertCompressionAlgorithms = []CertCompressionAlgo{CertCompressionZstd, CertCompressionBrotli, CertCompressionZlib}
+		serverConfig.CertCompressionAlgorithms = []CertCompressionAlgo{algo}
+		if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+			t.Fatalf("%d: %v", algo, err)
+		}
+
+		// The certificate is only rejected for its size if it was compressed.
+		clientConfig.MaxCertificateSize = 100
+		_, _, err := testHandshake(t, clientConfig, serverConfig)
+		if err == nil || !strings.Contains(err.Error(), "maximum certificate size") {
+			t.Errorf("%d: got %v, want a certificate size error", algo, err)
+		}
+	}
+}
+
+func TestCertCompressionClientCertificate(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	serverConfig.Certificates = []Certificate{repeatedCertificate(t)}
+	clientConfig.CertCompressionAlgorithms = []CertCompressionAlgo{CertCompressionBrotli}
+	serverConfig.CertCompressionAlgorithms = []CertCompressionAlgo{CertCompressionBrotli}
+	serverConfig.ClientAuth = RequireAnyClientCert
+	serverConfig.MaxCertificateSize = 100
+	clientConfig.Certificates = serverConfig.Certificates
+	_, _, err := testHandshake(t, clientConfig, serverConfig)
+	if err == nil {
+		t.Fatal("server accepted a compressed client certificate over MaxCertificateSize")
+	}
+
+	serverConfig.MaxCertificateSize = 0
+	cs, ss, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss.PeerCertificates) != 3 || len(cs.PeerCertificates) != 3 {
+		t.Errorf("got %d client and %d server certificates", len(ss.PeerCertificates), len(cs.PeerCertificates))
+	}
+}
+
+func TestCertCompressionClientHelloSpec(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	serverConfig.Certificates = []Certificate{repeatedCertificate(t)}
+	clientConfig.ClientHelloSpec = chromeLikeSpec() // brotli, as is
+	clientConfig.MaxCertificateSize = 100
+	serverConfig.CertCompressionAlgorithms = []CertCompressionAlgo{CertCompressionZlib, CertCompressionBrotli}
+	_, _, err := testHandshake(t, clientConfig, serverConfig)
+	if err == nil || !strings.Contains(err.Error(), "maximum certificate size") {
+		t.Errorf("got %v, want a certificate size error", err)
+	}
+}
+
+func TestCompressedCertificateMsg(t *testing.T) {
+	certMsg := &certificateMsgTLS13{certificate: Certificate{Certificate: [][]byte{
+		bytes.Repeat([]byte("certificate"), 50), bytes.Repeat([]byte("intermediate"), 50),
+	}}}
+	offered := []CertCompressionAlgo{CertCompressionZlib, CertCompressionBrotli, CertCompressionZstd}
+	for _, algo := range offered {
+		m, err := compressCertificateMsg(certMsg.marshal(), algo)
+		if err != nil || m == nil {
+			t.Fatalf("%d: %v", algo, err)
+		}
+		var got compressedCertificateMsg
+		if !got.unmarshal(m.marshal()) || got.algorithm != algo {
+			t.Fatalf("%d: failed to unmarshal %x", algo, m.marshal())
+		}
+		out, err := decompressCertificateMsg(&got, offered, maxHandshake)
+		if err != nil || !bytes.Equal(out.marshal(), certMsg.marshal()) {
+			t.Errorf("%d: got %v", algo, err)
+		}
+		if _, err := decompressCertificateMsg(&got, offered[:0], maxHandshake); err == nil {
+			t.Errorf("%d: accepted an algorithm that was not offered", algo)
+		}
+		got.uncompressedLength--
+		if _, err := decompressCertificateMsg(&got, offered, maxHandshake); err == nil {
+			t.Errorf("%d: accepted a wrong uncompressed length", algo)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package tls
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ========== 证书链引用 ==========
+
+// maxGaseousCachedChains is the most chain hashes a client advertises, or a
+// server accepts, in one cached chains frame.
+const maxGaseousCachedChains = 64
+
+// typeGaseousCertificateReference is the handshake message type, unassigned
+// in the TLS registry, of a TLS 1.3 chain reference. It is sent encrypted in
+// place of the server's Certificate message.
+const typeGaseousCertificateReference uint8 = 253
+
+// ErrGaseousChainMiss is returned by a client that receives a reference to a
+// certificate chain it did not advertise.
+var ErrGaseousChainMiss = errorString("gaseous: reference to unknown certificate chain")
+
+// GaseousChainHash returns the hash that identifies a certificate chain in
+// Gaseous chain references: SHA-256 over the chain in TLS 1.2
+// certificate_list encoding, each DER certificate prefixed with its 24-bit
+// length.
+func GaseousChainHash(chain [][]byte) [32]byte {
+	h := sha256.New()
+	for _, cert := range chain {
+		h.Write([]byte{byte(len(cert) >> 16), byte(len(cert) >> 8), byte(len(cert))})
+		h.Write(cert)
+	}
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+// GaseousChainCache holds the certificate chains a client already knows. A
+// client with a non-empty cache advertises their hashes, and servers send a
+// short reference instead of a matching chain. It is safe for concurrent use.
+type GaseousChainCache struct {
+	mu     sync.RWMutex
+	chains map[[32]byte][][]byte
+	order  [][32]byte
+}
+
+// NewGaseousChainCache returns a cache holding the given chains.
+func NewGaseousChainCache(chains ...[][]byte) *GaseousChainCache {
+	c := &GaseousChainCache{chains: make(map[[32]byte][][]byte)}
+	for _, chain := range chains {
+		c.Add(chain)
+	}
+	return c
+}
+
+// Add stores chain, a list of DER certificates starting with the leaf, and
+// returns its hash. Only the first 64 chains added are advertised.
+func (c *GaseousChainCache) Add(chain [][]byte) [32]byte {
+	h := GaseousChainHash(chain)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.chains == nil {
+		c.chains = make(map[[32]byte][][]byte)
+	}
+	if _, ok := c.chains[h]; !ok {
+		c.order = append(c.order, h)
+	}
+	stored := make([][]byte, len(chain))
+	for i, cert := range chain {
+		stored[i] = append([]byte(nil), cert...)
+	}
+	c.chains[h] = stored
+	return h
+}
+
+// Get returns the chain with the given hash.
+func (c *GaseousChainCache) Get(h [32]byte) ([][]byte, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	chain, ok := c.chains[h]
+	return chain, ok
+}
+
+// Len returns the number of cached chains.
+func (c *GaseousChainCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.chains)
+}
+
+func (c *GaseousChainCache) hashes() [][32]byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := len(c.order)
+	if n > maxGaseousCachedChains {
+		n = maxGaseousCachedChains
+	}
+	return append([][32]byte(nil), c.order[:n]...)
+}
+
+// marshalCachedChains encodes the payload of a cached chains frame: the
+// concatenated 32-byte chain hashes.
+func marshalCachedChains(hashes [][32]byte) []byte {
+	out := make([]byte, 0, 32*len(hashes))
+	for _, h := range hashes {
+		out = append(out, h[:]...)
+	}
+	return out
+}
+
+func parseCachedChains(payload []byte) ([][32]byte, error) {
+	if len(payload)%32 != 0 || len(payload)/32 > maxGaseousCachedChains {
+		return nil, ErrGaseousTrunc
+	}
+	hashes := make([][32]byte, len(payload)/32)
+	for i := range hashes {
+		copy(hashes[i][:], payload[32*i:])
+	}
+	return hashes, nil
+}
+
+// certificateMsgChain returns the certificate chain carried by a TLS 1.2
+// certificateMsg or a TLS 1.3 certificateMsgTLS13 handshake message.
+func certificateMsgChain(msg []byte, tls13 bool) ([][]byte, bool) {
+	var chain [][]byte
+	_, ok := rebuildCertificateMsg(msg, tls13, func(_ int, cert []byte) []byte {
+		chain = append(chain, cert)
+		return cert
+	})
+	return chain, ok
+}
+
+// makeChainReference builds the body of a chain reference: the chain hash
+// followed by the certificate message with every certificate left empty.
+func makeChainReference(msg []byte, tls13 bool, h [32]byte) ([]byte, bool) {
+	skeleton, ok := rebuildCertificateMsg(msg, tls13, func(int, []byte) []byte { return nil })
+	if !ok {
+		return nil, false
+	}
+	return append(h[:], skeleton...), true
+}
+
+// expandChainReference restores the certificate message a chain reference
+// stands for, using the client's cache.
+func expandChainReference(ref []byte, tls13 bool, cache *GaseousChainCache) ([]byte, error) {
+	if len(ref) < 32 || cache == nil {
+		return nil, ErrGaseousTrunc
+	}
+	var h [32]byte
+	copy(h[:], ref)
+	chain, ok := cache.Get(h)
+	if !ok {
+		return nil, ErrGaseousChainMiss
+	}
+	n := 0
+	msg, ok := rebuildCertificateMsg(ref[32:], tls13, func(i int, _ []byte) []byte {
+		n++
+		if i >= len(chain) {
+			return nil
+		}
+		return chain[i]
+	})
+	if !ok || n != len(chain) {
+		return nil, errors.New("gaseous: chain reference does not match cached chain")
+	}
+	return msg, nil
+}
+
+// rebuildCertificateMsg re-encodes a Certificate handshake message, replacing
+// the i-th certificate with replace(i, cert). Extensions and the request
+// context are copied unchanged.
+func rebuildCertificateMsg(msg []byte, tls13 bool, replace func(int, []byte) []byte) ([]byte, bool) {
+	s := cryptobyte.String(msg)
+	var typ uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&typ) || typ != typeCertificate ||
+		!s.ReadUint24LengthPrefixed(&body) || !s.Empty() {
+		return nil, false
+	}
+
+	var b cryptobyte.Builder
+	ok := true
+	b.AddUint8(typeCertificate)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		if tls13 {
+			var context cryptobyte.String
+			if !body.ReadUint8LengthPrefixed(&context) {
+				ok = false
+				return
+			}
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(context)
+			})
+		}
+		var list cryptobyte.String
+		if !body.ReadUint24LengthPrefixed(&list) || !body.Empty() {
+			ok = false
+			return
+		}
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			for i := 0; !list.Empty(); i++ {
+				var cert, exts cryptobyte.String
+				if !list.ReadUint24LengthPrefixed(&cert) {
+					ok = false
+					return
+				}
+				b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(replace(i, cert))
+				})
+				if tls13 {
+					if !list.ReadUint16LengthPrefixed(&exts) {
+						ok = false
+						return
+					}
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(exts)
+					})
+				}
+			}
+		})
+	})
+	if !ok {
+		return nil, false
+	}
+	out, err := b.Bytes()
+	return out, err == nil
+}
+
+// gaseousCertificateReferenceMsg is a TLS 1.3 chain reference, as built by
+// makeChainReference.
+type gaseousCertificateReferenceMsg struct {
+	raw       []byte
+	reference []byte
+}
+
+func (m *gaseousCertificateReferenceMsg) marshal() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeGaseousCertificateReference)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(m.reference)
+	})
+
+	m.raw = b.BytesOrPanic()
+	return m.raw
+}
+
+func (m *gaseousCertificateReferenceMsg) unmarshal(data []byte) bool {
+	*m = gaseousCertificateReferenceMsg{raw: data}
+	s := cryptobyte.String(data)
+	return s.Skip(1) && readUint24LengthPrefixed(&s, &m.reference) &&
+		len(m.reference) > 32 && s.Empty()
+}
+
+// expandCertificateReference restores the TLS 1.3 Certificate message a
+// chain reference received by a client stands for.
+func (c *Conn) expandCertificateReference(m *gaseousCertificateReferenceMsg) (*certificateMsgTLS13, error) {
+	var chains *GaseousChainCache
+	if g := c.config.gaseousConfig(); g != nil && c.gaseousChainsAdvertised {
+		chains = g.Chains
+	}
+	msg, err := expandChainReference(m.reference, true, chains)
+	if err != nil {
+		return nil, err
+	}
+	certMsg := new(certificateMsgTLS13)
+	if !certMsg.unmarshal(msg) {
+		return nil, errors.New("gaseous: invalid certificate reference")
+	}
+	return certMsg, nil
+}
+
+// gaseousChainReference returns a chain reference for the certificate
+// message msg if the peer advertised its chain, or nil.
+func (c *Conn) gaseousChainReference(msg []byte, tls13 bool) []byte {
+	if len(c.gaseousPeerChains) == 0 {
+		return nil
+	}
+	chain, ok := certificateMsgChain(msg, tls13)
+	if !ok || len(chain) == 0 {
+		return nil
+	}
+	h := GaseousChainHash(chain)
+	for _, advertised := range c.gaseousPeerChains {
+		if advertised == h {
+			ref, ok := makeChainReference(msg, tls13, h)
+			if !ok {
+				return nil
+			}
+			return ref
+		}
+	}
+	// A miss: the peer doesn't have this chain, so it's sent in full.
+	return nil
+}
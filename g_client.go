@@ -1,7 +1,7 @@
 package tls
 
 import (
-	"encoding/binary"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"strings"
@@ -12,14 +12,20 @@ import (
 // ========== 指纹参数结构 ==========
 type GaseousClientHelloParams struct {
 	SpecType  string            // uTLS 指纹名
+	SpecID    uint16            `json:",omitempty"` // 指纹目录 ID，优先于 SpecType
 	SNI       string
 	ALPN      []string
 	Random    []byte
 	SessionID []byte
+	GREASE    []uint16          `json:",omitempty"` // GREASE 值，按出现顺序
+	KeyShares [][]byte          `json:",omitempty"` // 非 GREASE key_share 数据，按出现顺序
 	Other     map[string][]byte // 扩展参数预留
 }
 
 // ========== uTLS 指纹集 ==========
+
+// allUTLSIDs are the built-in fingerprints; the i-th has catalogue ID i+1.
+// Entries must never be reordered or removed, only appended.
 var allUTLSIDs = []utls.ClientHelloID{
 	utls.HelloChrome_58, utls.HelloChrome_62, utls.HelloChrome_70, utls.HelloChrome_72,
 	utls.HelloChrome_83, utls.HelloChrome_87, utls.HelloChrome_96, utls.HelloChrome_100,
@@ -33,410 +39,216 @@ var allUTLSIDs = []utls.ClientHelloID{
 	utls.HelloChrome_114_Padding_PSK_Shuf, utls.HelloChrome_115_PQ_PSK,
 }
 
-// ========== ClientHello 参数字段完整解析 ==========
+// ========== 指纹比对用 ==========
 
-type ParsedClientHello struct {
-	Version            uint16
-	Random             []byte
-	SessionID          []byte
-	CipherSuites       []uint16
-	CompressionMethods []byte
-	SNI                string
-	ALPN               []string
-	Extensions         map[uint16][]byte // raw extension data
-}
+// gaseousMatchThreshold is the confidence a fingerprint match needs to be
+// used for fingerprint mode.
+const gaseousMatchThreshold = 0.9
 
-func parseClientHello(data []byte) (*ParsedClientHello, error) {
-	// TLS record layer header: type(1) + ver(2) + len(2) = 5
-	// Handshake header: type(1) + len(3) = 4
-	if len(data) < 9 {
-		return nil, errors.New("too short")
-	}
-	// Skip record header if present
-	offset := 0
-	if data[0] == 0x16 && len(data) > 5 && (data[1] == 0x03 && (data[2] >= 0x01 && data[2] <= 0x04)) {
-		// Record header found
-		recordLen := int(binary.BigEndian.Uint16(data[3:5]))
-		if len(data) < 5+recordLen {
-			return nil, errors.New("truncated TLS record")
-		}
-		offset = 5
-	}
-	hs := data[offset:]
-	if len(hs) < 4 {
-		return nil, errors.New("truncated handshake")
-	}
-	if hs[0] != 0x01 { // ClientHello
-		return nil, errors.New("not clienthello")
-	}
-	hsLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
-	if len(hs)-4 < hsLen {
-		return nil, errors.New("truncated handshake body")
-	}
-	body := hs[4 : 4+hsLen]
-	out := &ParsedClientHello{
-		Extensions: make(map[uint16][]byte),
-	}
-	// Version
-	if len(body) < 2 {
-		return nil, errors.New("truncated version")
-	}
-	out.Version = binary.BigEndian.Uint16(body[:2])
-	i := 2
-	// Random
-	if len(body[i:]) < 32 {
-		return nil, errors.New("truncated random")
-	}
-	out.Random = append([]byte{}, body[i:i+32]...)
-	i += 32
-	// SessionID
-	if len(body[i:]) < 1 {
-		return nil, errors.New("truncated sessionid len")
-	}
-	sidLen := int(body[i])
-	i++
-	if len(body[i:]) < sidLen {
-		return nil, errors.New("truncated sessionid")
-	}
-	out.SessionID = append([]byte{}, body[i:i+sidLen]...)
-	i += sidLen
-	// CipherSuites
-	if len(body[i:]) < 2 {
-		return nil, errors.New("truncated ciphersuites len")
-	}
-	csLen := int(binary.BigEndian.Uint16(body[i:]))
-	i += 2
-	if len(body[i:]) < csLen || csLen%2 != 0 {
-		return nil, errors.New("truncated/invalid ciphersuites")
-	}
-	out.CipherSuites = make([]uint16, csLen/2)
-	for j := 0; j < csLen/2; j++ {
-		out.CipherSuites[j] = binary.BigEndian.Uint16(body[i : i+2])
-		i += 2
-	}
-	// CompressionMethods
-	if len(body[i:]) < 1 {
-		return nil, errors.New("truncated compression methods len")
-	}
-	compLen := int(body[i])
-	i++
-	if len(body[i:]) < compLen {
-		return nil, errors.New("truncated compression methods")
-	}
-	out.CompressionMethods = append([]byte{}, body[i:i+compLen]...)
-	i += compLen
-	// Extensions (if any)
-	if i == len(body) {
-		return out, nil // no extensions
-	}
-	if len(body[i:]) < 2 {
-		return nil, errors.New("truncated extensions len")
-	}
-	extLen := int(binary.BigEndian.Uint16(body[i:]))
-	i += 2
-	if len(body[i:]) < extLen {
-		return nil, errors.New("truncated extensions body")
-	}
-	exts := body[i : i+extLen]
-	ei := 0
-	for ei+4 <= len(exts) {
-		extType := binary.BigEndian.Uint16(exts[ei:])
-		extL := int(binary.BigEndian.Uint16(exts[ei+2:]))
-		ei += 4
-		if ei+extL > len(exts) {
-			break
-		}
-		out.Extensions[extType] = exts[ei : ei+extL]
-		// SNI (0x00 0x00)
-		if extType == 0x0000 {
-			parseSNI(exts[ei:ei+extL], out)
-		}
-		// ALPN (0x00 0x10)
-		if extType == 0x0010 {
-			parseALPN(exts[ei:ei+extL], out)
-		}
-		ei += extL
+// matchUTLSClientHello returns the best matching uTLS fingerprint for a
+// ClientHello and the parameters to rebuild it, or "" if none matches well
+// enough.
+func matchUTLSClientHello(clientHelloBytes []byte) (string, *GaseousClientHelloParams) {
+	parsed, err := ParseClientHello(clientHelloBytes)
+	if err != nil {
+		return "", nil
 	}
-	return out, nil
-}
-
-func parseSNI(data []byte, out *ParsedClientHello) {
-	if len(data) < 2 {
-		return
-	}
-	listLen := int(binary.BigEndian.Uint16(data[:2]))
-	i := 2
-	for i+3 <= len(data) && i+listLen <= len(data) {
-		typ := data[i]
-		nameLen := int(binary.BigEndian.Uint16(data[i+1:]))
-		i += 3
-		if typ == 0 && i+nameLen <= len(data) {
-			out.SNI = string(data[i : i+nameLen])
-			return
-		}
-		i += nameLen
+	candidates := matchHelloSignature(newHelloSignature(parsed))
+	if len(candidates) == 0 || candidates[0].Confidence < gaseousMatchThreshold {
+		return "", nil
 	}
+	best := candidates[0].Fingerprint
+	params := &GaseousClientHelloParams{
+		SpecType:  best.Name,
+		SpecID:    best.ID,
+		SNI:       parsed.SNI,
+		ALPN:      parsed.ALPN,
+		Random:    parsed.Random,
+		SessionID: parsed.SessionID,
+		Other:     make(map[string][]byte),
+	}
+	params.GREASE = greaseParams(clientHelloBytes, params)
+	params.KeyShares = keyShareParams(parsed, params)
+	return best.Name, params
 }
 
-func parseALPN(data []byte, out *ParsedClientHello) {
-	if len(data) < 2 {
-		return
-	}
-	li := 2
-	alpnLen := int(binary.BigEndian.Uint16(data[:2]))
-	for li < len(data) && li-2 < alpnLen {
-		if li >= len(data) {
-			break
-		}
-		l := int(data[li])
-		li++
-		if li+l > len(data) {
-			break
-		}
-		out.ALPN = append(out.ALPN, string(data[li:li+l]))
-		li += l
+// ========== Pack/Unpack/Build ==========
+
+// PackClientHelloGaseous frames the ClientHello that c sent, if c is a client,
+// or received, if c is a server.
+func PackClientHelloGaseous(c *Conn) ([]byte, error) {
+	if c.clientHelloRaw == nil {
+		return nil, errors.New("gaseous: no ClientHello on this connection yet")
 	}
+	return packClientHelloGaseous(c.clientHelloRaw, c.config.gaseousConfig(), false)
 }
 
-// ========== 指纹比对用 ==========
-func matchUTLSClientHello(clientHelloBytes []byte, _ string, _ []string) (string, *GaseousClientHelloParams) {
-	parsed, err := parseClientHello(clientHelloBytes)
-	if err != nil {
-		return "", nil
+// PackUConnClientHelloGaseous frames the ClientHello built by uc, which must
+// have been prepared with BuildHandshakeState, using the algorithms, key,
+// templates and fingerprint policy of g, which may be nil. If uc mimics a
+// known fingerprint, its ClientHelloID is used for fingerprint mode, instead
+// of being guessed from the hello, as long as the fingerprint rebuilds the
+// hello byte for byte. Otherwise the hello is framed in the first other mode
+// that rebuilds it exactly: template, delta or raw mode.
+func PackUConnClientHelloGaseous(uc *utls.UConn, g *GaseousConfig) ([]byte, error) {
+	if uc == nil || uc.HandshakeState.Hello == nil || len(uc.HandshakeState.Hello.Raw) == 0 {
+		return nil, errors.New("gaseous: UConn has no ClientHello; call BuildHandshakeState first")
 	}
-	bestMatch := ""
-	bestScore := 0
-	var params *GaseousClientHelloParams
+	hello := uc.HandshakeState.Hello
+	return packClientHelloWithID(hello.Raw, uc.ClientHelloID, g)
+}
 
-	for _, id := range allUTLSIDs {
-		spec, err := utls.UTLSIdToSpec(id)
-		if err != nil {
-			continue
-		}
-		score := 0
+// PackRawClientHelloGaseous frames a ClientHello handshake message (with or
+// without its record header) built by the uTLS fingerprint id, using g, which
+// may be nil. If id is the zero value, the fingerprint is guessed from the
+// hello. As with PackUConnClientHelloGaseous, id is only used if it rebuilds
+// the hello exactly.
+func PackRawClientHelloGaseous(hello []byte, id utls.ClientHelloID, g *GaseousConfig) ([]byte, error) {
+	if len(hello) >= 5 && hello[0] == byte(recordTypeHandshake) && hello[1] == 0x03 {
+		hello = hello[5:]
+	}
+	if id == (utls.ClientHelloID{}) {
+		return packClientHelloGaseous(hello, g, false)
+	}
+	return packClientHelloWithID(hello, id, g)
+}
 
-		// CipherSuites (顺序相关)
-		if len(parsed.CipherSuites) > 0 && len(spec.CipherSuites) > 0 {
-			match := 0
-			for i := range parsed.CipherSuites {
-				if i < len(spec.CipherSuites) && parsed.CipherSuites[i] == spec.CipherSuites[i] {
-					match++
-				}
-			}
-			score += match * 4
-		}
-		// CompressionMethods
-		if len(parsed.CompressionMethods) > 0 && len(spec.CompressionMethods) > 0 {
-			equal := true
-			if len(parsed.CompressionMethods) != len(spec.CompressionMethods) {
-				equal = false
-			} else {
-				for i := range parsed.CompressionMethods {
-					if parsed.CompressionMethods[i] != spec.CompressionMethods[i] {
-						equal = false
-						break
-					}
-				}
-			}
-			if equal {
-				score += 8
-			}
-		}
-		// ALPN
-		if len(parsed.ALPN) > 0 {
-			alpnMatch := 0
-			for _, ext := range spec.Extensions {
-				if e, ok := ext.(*utls.ALPNExtension); ok {
-					for _, proto := range parsed.ALPN {
-						for _, want := range e.AlpnProtocols {
-							if proto == want {
-								alpnMatch++
-							}
-						}
-					}
-				}
-			}
-			score += alpnMatch * 4
-		}
-		// SNI
-		if parsed.SNI != "" {
-			for _, ext := range spec.Extensions {
-				if _, ok := ext.(*utls.SNIExtension); ok {
-					score += 3
-					break
-				}
-			}
-		}
-		if score > bestScore {
-			bestScore = score
-			bestMatch = id.Str()
-			params = &GaseousClientHelloParams{
-				SpecType:  bestMatch,
-				SNI:       parsed.SNI,
-				ALPN:      parsed.ALPN,
-				Random:    parsed.Random,
-				SessionID: parsed.SessionID,
-				Other:     make(map[string][]byte),
-			}
-		}
+// UnpackClientHelloGaseousID is like UnpackClientHelloGaseous, but checks
+// the frame against g, which may be nil, and also returns the uTLS
+// fingerprint the hello was rebuilt from, or the zero ClientHelloID if the
+// frame was not in fingerprint mode.
+func UnpackClientHelloGaseousID(data []byte, g *GaseousConfig) ([]byte, utls.ClientHelloID, error) {
+	data = trimGaseousMarker(data)
+	hdr, payload, err := parseGaseousFrame(data, g)
+	if err != nil {
+		return nil, utls.ClientHelloID{}, err
 	}
-	if bestScore >= 10 && bestMatch != "" && params != nil {
-		return bestMatch, params
+	if hdr.HelloType != GaseousHelloTypeClient {
+		return nil, utls.ClientHelloID{}, ErrGaseousType
 	}
-	return "", nil
-}
-
-// ========== Pack/Unpack/Build ==========
-func PackClientHelloGaseous(c *Conn) ([]byte, error) {
-	sni := c.serverName
-	alpn := c.config.NextProtos
-	clientHelloBytes := c.hand.Bytes()
-
-	// 支持所有压缩算法
-	compressFuncs := []struct {
-		algo GaseousHelloCompressAlgo
-		fn   func([]byte) ([]byte, error)
-	}{
-		{GaseousCompressFlate, compressFlate},
-		{GaseousCompressGzip, compressGzip},
-		{GaseousCompressBrotli, compressBrotli},
-		{GaseousCompressZstd, compressZstd},
-		{GaseousCompressLZ4, compressLZ4},
-		{GaseousCompressXZ, compressXZ},
-		{GaseousCompressLZ4Block, compressLZ4Block},
+	if hdr.TemplID != 0xffff {
+		hello, err := unpackGaseousHello(data, GaseousHelloTypeClient, g)
+		return hello, utls.ClientHelloID{}, err
 	}
-
-	if specStr, params := matchUTLSClientHello(clientHelloBytes, sni, alpn); specStr != "" {
-		paramBytes, err := json.Marshal(params)
-		if err != nil {
-			return nil, err
-		}
-		for _, cfn := range compressFuncs {
-			comp, err := cfn.fn(paramBytes)
-			if err == nil {
-				header := make([]byte, gaseousHelloHeaderSize)
-				copy(header[:2], []byte(GaseousHelloMagic))
-				header[2] = GaseousHelloVersion
-				header[3] = byte(cfn.algo)
-				header[4] = GaseousHelloTypeClient
-				binary.BigEndian.PutUint16(header[5:7], 0xffff)
-				binary.BigEndian.PutUint32(header[7:11], uint32(len(comp)))
-				return append([]byte{recordTypeGaseousHello}, append(header, comp...)...), nil
-			}
-		}
-		return nil, errors.New("all compression failed")
+	var params GaseousClientHelloParams
+	if err := json.Unmarshal(payload, &params); err != nil {
+		return nil, utls.ClientHelloID{}, err
 	}
-
-	for _, cfn := range compressFuncs {
-		comp, err := cfn.fn(clientHelloBytes)
-		if err == nil {
-			header := make([]byte, gaseousHelloHeaderSize)
-			copy(header[:2], []byte(GaseousHelloMagic))
-			header[2] = GaseousHelloVersion
-			header[3] = byte(cfn.algo)
-			header[4] = GaseousHelloTypeClient
-			binary.BigEndian.PutUint16(header[5:7], 0)
-			binary.BigEndian.PutUint32(header[7:11], uint32(len(comp)))
-			return append([]byte{recordTypeGaseousHello}, append(header, comp...)...), nil
-		}
+	f, err := fingerprintForParams(&params)
+	if err != nil {
+		return nil, utls.ClientHelloID{}, err
 	}
-	return nil, errors.New("all compression failed")
+	hello, err := buildUTLSClientHello(&params)
+	return hello, f.ClientHelloID, err
 }
 
-func UnpackClientHelloGaseous(data []byte) ([]byte, error) {
-	if len(data) < gaseousHelloHeaderSize+1 {
-		return nil, ErrGaseousTrunc
-	}
-	data = data[1:]
-	hdr := GaseousHelloHeader{}
-	copy(hdr.Magic[:], data[:2])
-	hdr.Version = data[2]
-	hdr.Algo = data[3]
-	hdr.HelloType = data[4]
-	hdr.TemplID = binary.BigEndian.Uint16(data[5:7])
-	hdr.DataLen = binary.BigEndian.Uint32(data[7:11])
-
-	if string(hdr.Magic[:]) != GaseousHelloMagic {
-		return nil, ErrGaseousMagic
-	}
-	if hdr.Version != GaseousHelloVersion {
-		return nil, ErrGaseousVersion
+// packClientHelloWithID frames hello in fingerprint mode as the uTLS
+// fingerprint id, or as packClientHelloGaseous does for exact framing if id
+// is not a reproducible fingerprint or doesn't rebuild hello exactly.
+func packClientHelloWithID(hello []byte, id utls.ClientHelloID, g *GaseousConfig) ([]byte, error) {
+	if _, ok := utlsIDByName(id.Str()); !ok || id.Seed != nil || g.fingerprintPolicy() == GaseousFingerprintDisabled {
+		return packClientHelloGaseous(hello, g, true)
+	}
+	parsed, err := ParseClientHello(hello)
+	if err != nil {
+		return nil, err
 	}
-	if hdr.HelloType != GaseousHelloTypeClient {
-		return nil, ErrGaseousType
+	params := &GaseousClientHelloParams{
+		SpecType:  id.Str(),
+		SNI:       parsed.SNI,
+		ALPN:      parsed.ALPN,
+		Random:    parsed.Random,
+		SessionID: parsed.SessionID,
+		Other:     make(map[string][]byte),
 	}
-	if int(hdr.DataLen)+gaseousHelloHeaderSize > len(data) {
-		return nil, ErrGaseousTrunc
+	if f := GaseousFingerprintByName(id.Str()); f != nil {
+		params.SpecID = f.ID
 	}
-	compressed := data[gaseousHelloHeaderSize : gaseousHelloHeaderSize+int(hdr.DataLen)]
-
-	var plain []byte
-	var err error
-	switch GaseousHelloCompressAlgo(hdr.Algo) {
-	case GaseousCompressNone:
-		plain = compressed
-	case GaseousCompressFlate:
-		plain, err = decompressFlate(compressed)
-	case GaseousCompressGzip:
-		plain, err = decompressGzip(compressed)
-	case GaseousCompressBrotli:
-		plain, err = decompressBrotli(compressed)
-	case GaseousCompressZstd:
-		plain, err = decompressZstd(compressed)
-	case GaseousCompressLZ4:
-		plain, err = decompressLZ4(compressed)
-	case GaseousCompressXZ:
-		plain, err = decompressXZ(compressed)
-	case GaseousCompressLZ4Block:
-		plain, err = decompressLZ4Block(compressed)
-	default:
-		return nil, ErrGaseousAlgo
+	params.GREASE = greaseParams(hello, params)
+	params.KeyShares = keyShareParams(parsed, params)
+	if rebuilt, err := buildUTLSClientHello(params); err != nil || !bytes.Equal(rebuilt, hello) {
+		return packClientHelloGaseous(hello, g, true)
 	}
+	paramBytes, err := json.Marshal(params)
 	if err != nil {
 		return nil, err
 	}
-	if hdr.TemplID == 0xffff {
-		var params GaseousClientHelloParams
-		if err := json.Unmarshal(plain, &params); err != nil {
-			return nil, err
+	return marshalGaseousFrame(GaseousHelloTypeClient, 0xffff, paramBytes, g)
+}
+
+// utlsIDByName returns the uTLS fingerprint whose Str() is name. Besides the
+// IDs in allUTLSIDs it accepts any "Client-Version" pair uTLS has a fixed
+// spec for; randomized and custom fingerprints can't be rebuilt.
+func utlsIDByName(name string) (utls.ClientHelloID, bool) {
+	for _, x := range allUTLSIDs {
+		if strings.EqualFold(x.Str(), name) {
+			return x, true
 		}
-		return buildUTLSClientHello(&params)
 	}
-	tmpl := gaseousTemplates.Templates[hdr.TemplID]
-	if tmpl == nil {
-		return nil, ErrGaseousTemplate
+	client, version, ok := strings.Cut(name, "-")
+	if !ok || strings.HasPrefix(client, "Randomized") ||
+		client == utls.HelloCustom.Client || client == utls.HelloGolang.Client {
+		return utls.ClientHelloID{}, false
+	}
+	id := utls.ClientHelloID{Client: client, Version: version}
+	if _, err := utls.UTLSIdToSpec(id); err != nil {
+		return utls.ClientHelloID{}, false
 	}
-	return fillHelloTemplate(tmpl, plain), nil
+	return id, true
 }
 
-// ========== uTLS指纹重建 ==========
-func buildUTLSClientHello(params *GaseousClientHelloParams) ([]byte, error) {
-	var id utls.ClientHelloID
-	found := false
-	for _, x := range allUTLSIDs {
-		if strings.EqualFold(x.Str(), params.SpecType) {
-			id = x
-			found = true
-			break
+// packClientHelloGaseous frames a ClientHello handshake message, preferring
+// fingerprint mode, then template mode, then delta mode, then raw mode. If
+// exact is set, as it is inside a handshake, fingerprint mode is only used
+// when the receiver would rebuild the same bytes. Delta mode is always exact.
+func packClientHelloGaseous(hello []byte, g *GaseousConfig, exact bool) ([]byte, error) {
+	if policy := g.fingerprintPolicy(); policy != GaseousFingerprintDisabled {
+		if specStr, params := matchUTLSClientHello(hello); specStr != "" {
+			usable := policy == GaseousFingerprintApproximate && !exact
+			if !usable {
+				rebuilt, err := buildUTLSClientHello(params)
+				usable = err == nil && bytes.Equal(rebuilt, hello)
+			}
+			if usable {
+				paramBytes, err := json.Marshal(params)
+				if err != nil {
+					return nil, err
+				}
+				return marshalGaseousFrame(GaseousHelloTypeClient, 0xffff, paramBytes, g)
+			}
 		}
 	}
-	if !found {
-		return nil, errors.New("unknown uTLS spec: " + params.SpecType)
+	if id, rest := g.templates().match(hello); id != 0 {
+		return marshalGaseousFrame(GaseousHelloTypeClient, id, rest, g)
 	}
-	uc := utls.UConn{
-		ClientHelloID: id,
+	if g.fingerprintPolicy() != GaseousFingerprintDisabled {
+		if frame, err := packClientHelloDelta(hello, g); err != nil || frame != nil {
+			return frame, err
+		}
 	}
-	spec, err := utls.UTLSIdToSpec(id)
+	return marshalGaseousFrame(GaseousHelloTypeClient, 0, hello, g)
+}
+
+func UnpackClientHelloGaseous(data []byte) ([]byte, error) {
+	return unpackGaseousHello(trimGaseousMarker(data), GaseousHelloTypeClient, nil)
+}
+
+// ========== uTLS指纹重建 ==========
+func buildUTLSClientHello(params *GaseousClientHelloParams) ([]byte, error) {
+	f, err := fingerprintForParams(params)
 	if err != nil {
 		return nil, err
 	}
-	if params.SNI != "" {
-		for _, ext := range spec.Extensions {
-			if e, ok := ext.(*utls.SNIExtension); ok {
-				e.ServerName = params.SNI
-			}
-		}
+	spec, err := f.Spec()
+	if err != nil {
+		return nil, err
 	}
+	return buildUTLSClientHelloFromSpec(spec, params)
+}
+
+// buildUTLSClientHelloFromSpec builds a ClientHello from spec, filling in the
+// per-connection fields of params.
+func buildUTLSClientHelloFromSpec(spec *utls.ClientHelloSpec, params *GaseousClientHelloParams) ([]byte, error) {
 	if len(params.ALPN) > 0 {
 		for _, ext := range spec.Extensions {
 			if e, ok := ext.(*utls.ALPNExtension); ok {
@@ -444,17 +256,96 @@ func buildUTLSClientHello(params *GaseousClientHelloParams) ([]byte, error) {
 			}
 		}
 	}
-	// uTLS随机字段不支持外部注入，后续可补丁
-	if err := uc.ApplyPreset(&spec); err != nil {
+	uc := utls.UClient(nil, &utls.Config{ServerName: params.SNI, InsecureSkipVerify: true}, utls.HelloCustom)
+	if err := uc.ApplyPreset(spec); err != nil {
 		return nil, err
 	}
+	if len(params.KeyShares) > 0 {
+		if err := setKeyShareData(uc.Extensions, params.KeyShares); err != nil {
+			return nil, err
+		}
+	}
 	hello := uc.HandshakeState.Hello
 	if hello == nil {
 		return nil, errors.New("failed to build ClientHello")
 	}
-	helloBytes, err := hello.Marshal()
-	if err != nil {
+	if len(params.Random) == 32 {
+		hello.Random = append([]byte{}, params.Random...)
+	}
+	if params.SessionID != nil {
+		hello.SessionId = append([]byte{}, params.SessionID...)
+	}
+	if err := uc.MarshalClientHello(); err != nil {
 		return nil, err
 	}
-	return helloBytes, nil
+	if len(params.GREASE) > 0 {
+		return setClientHelloGREASE(hello.Raw, params.GREASE)
+	}
+	return hello.Raw, nil
+}
+
+var errKeyShareCount = errors.New("gaseous: key share count does not match the fingerprint")
+
+// keyShareParams returns the key exchange data of the non-GREASE key shares
+// of hello for params, if a hello rebuilt from params has key shares of the
+// same groups and sizes, or nil.
+func keyShareParams(hello *ParsedClientHello, params *GaseousClientHelloParams) [][]byte {
+	var shares [][]byte
+	var groups []ParsedKeyShare
+	for _, ks := range hello.KeyShares {
+		if !isGREASE(uint16(ks.Group)) {
+			shares = append(shares, ks.Data)
+			groups = append(groups, ks)
+		}
+	}
+	if len(shares) == 0 {
+		return nil
+	}
+	rebuilt, err := buildUTLSClientHello(params)
+	if err != nil {
+		return nil
+	}
+	p, err := ParseClientHello(rebuilt)
+	if err != nil {
+		return nil
+	}
+	i := 0
+	for _, ks := range p.KeyShares {
+		if isGREASE(uint16(ks.Group)) {
+			continue
+		}
+		if i == len(groups) || ks.Group != groups[i].Group || len(ks.Data) != len(groups[i].Data) {
+			return nil
+		}
+		i++
+	}
+	if i != len(groups) {
+		return nil
+	}
+	return shares
+}
+
+// setKeyShareData writes shares, in order, over the key exchange data of the
+// non-GREASE key shares of exts.
+func setKeyShareData(exts []utls.TLSExtension, shares [][]byte) error {
+	i := 0
+	for _, ext := range exts {
+		e, ok := ext.(*utls.KeyShareExtension)
+		if !ok {
+			continue
+		}
+		for j := range e.KeyShares {
+			if isGREASE(uint16(e.KeyShares[j].Group)) {
+				continue
+			}
+			if i < len(shares) {
+				e.KeyShares[j].Data = append([]byte(nil), shares[i]...)
+			}
+			i++
+		}
+	}
+	if i != len(shares) {
+		return errKeyShareCount
+	}
+	return nil
 }
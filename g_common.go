@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"io"
+	"sync"
 
 	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/zstd"
@@ -32,6 +35,20 @@ const (
 	GaseousHelloTypeClient = 1
 	GaseousHelloTypeServer = 2
 
+	// GaseousHelloTypeHelloRetryRequest carries a TLS 1.3
+	// HelloRetryRequest, which is encoded as a ServerHello with a special
+	// random.
+	GaseousHelloTypeHelloRetryRequest = 3
+	// GaseousHelloTypeServerFlight carries a TLS 1.3 ServerHello followed by
+	// the protected records of the rest of the server's first flight.
+	GaseousHelloTypeServerFlight = 4
+	// GaseousHelloTypeCachedChains lists the hashes of the certificate
+	// chains a client has cached. It precedes the ClientHello frame.
+	GaseousHelloTypeCachedChains = 5
+	// GaseousHelloTypeCertificateReference replaces a TLS 1.2 Certificate
+	// message whose chain the client has cached.
+	GaseousHelloTypeCertificateReference = 6
+
 	gaseousHelloHeaderSize = 2 + 1 + 1 + 1 + 2 + 4 // = 11
 	recordTypeGaseousHello = 0xfe
 	MinGaseousHelloLen     = 12
@@ -53,6 +70,9 @@ var (
 	ErrGaseousTemplate = errorString("gaseous: unknown template ID")
 	ErrGaseousTrunc    = errorString("gaseous: truncated/invalid data")
 	ErrGaseousType     = errorString("gaseous: unknown hello type")
+	ErrGaseousAuth     = errorString("gaseous: authentication tag mismatch")
+	ErrGaseousLimit    = errorString("gaseous: message exceeds configured limit")
+	ErrGaseousPolicy   = errorString("gaseous: message not permitted by configuration")
 )
 
 type errorString string
@@ -64,6 +84,7 @@ type HelloTemplate struct {
 }
 
 type GaseousTemplateRegistry struct {
+	mu        sync.RWMutex
 	Templates map[uint16]*HelloTemplate
 }
 
@@ -72,7 +93,428 @@ var gaseousTemplates = &GaseousTemplateRegistry{
 }
 
 func RegisterGaseousTemplate(id uint16, tmpl *HelloTemplate) {
-	gaseousTemplates.Templates[id] = tmpl
+	gaseousTemplates.Register(id, tmpl)
+}
+
+// NewGaseousTemplateRegistry returns an empty template registry, for use in
+// GaseousConfig.Templates when the global registry is not wanted.
+func NewGaseousTemplateRegistry() *GaseousTemplateRegistry {
+	return &GaseousTemplateRegistry{Templates: make(map[uint16]*HelloTemplate)}
+}
+
+// Register adds tmpl to the registry under id, replacing any existing entry.
+// IDs 0, 0xfffe and 0xffff are reserved for raw, delta and fingerprint mode.
+func (r *GaseousTemplateRegistry) Register(id uint16, tmpl *HelloTemplate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Templates == nil {
+		r.Templates = make(map[uint16]*HelloTemplate)
+	}
+	r.Templates[id] = tmpl
+}
+
+// Lookup returns the template registered under id, or nil.
+func (r *GaseousTemplateRegistry) Lookup(id uint16) *HelloTemplate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Templates[id]
+}
+
+// Clone returns a copy of r. Templates are shared, as they are immutable once
+// registered.
+func (r *GaseousTemplateRegistry) Clone() *GaseousTemplateRegistry {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c := NewGaseousTemplateRegistry()
+	for id, tmpl := range r.Templates {
+		c.Templates[id] = tmpl
+	}
+	return c
+}
+
+// match returns the ID of the longest registered template that is a prefix
+// of msg, and the remaining bytes that fill it. It returns 0 if none match.
+func (r *GaseousTemplateRegistry) match(msg []byte) (uint16, []byte) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var bestID uint16
+	bestLen := -1
+	for id, tmpl := range r.Templates {
+		if id == 0 || id == gaseousTemplDelta || id == 0xffff || tmpl == nil {
+			continue
+		}
+		if len(tmpl.Serialized) > bestLen && bytes.HasPrefix(msg, tmpl.Serialized) {
+			bestID, bestLen = id, len(tmpl.Serialized)
+		}
+	}
+	if bestLen < 0 {
+		return 0, msg
+	}
+	return bestID, msg[bestLen:]
+}
+
+// GaseousFingerprintPolicy controls use of fingerprint mode (TemplID 0xFFFF)
+// and of delta mode (TemplID 0xFFFE), which also relies on fingerprints.
+type GaseousFingerprintPolicy uint8
+
+const (
+	// GaseousFingerprintExact uses fingerprint mode only when the receiver
+	// would rebuild a byte-identical hello. This is the only policy under
+	// which fingerprint mode is used inside a handshake.
+	GaseousFingerprintExact GaseousFingerprintPolicy = iota
+	// GaseousFingerprintDisabled never sends fingerprint or delta mode and
+	// rejects messages that use them.
+	GaseousFingerprintDisabled
+	// GaseousFingerprintApproximate uses fingerprint mode whenever a
+	// fingerprint matches closely enough, even though the rebuilt hello
+	// differs from the original (for example in its random). It only applies
+	// to the standalone Pack functions.
+	GaseousFingerprintApproximate
+)
+
+// GaseousFallbackPolicy controls what happens when a hello can't be carried
+// in a Gaseous frame.
+type GaseousFallbackPolicy uint8
+
+const (
+	// GaseousFallbackPlain sends the hello as an ordinary TLS handshake
+	// record, and accepts ordinary hellos from the peer.
+	GaseousFallbackPlain GaseousFallbackPolicy = iota
+	// GaseousFallbackReject fails the handshake instead, and rejects peers
+	// that don't send a Gaseous frame in an enabled direction.
+	GaseousFallbackReject
+)
+
+// GaseousLimits bounds the resources spent on a single Gaseous message.
+// Zero values select the defaults.
+type GaseousLimits struct {
+	// MaxPayloadSize is the largest accepted DataLen. Defaults to 16384.
+	MaxPayloadSize int
+	// MaxMessageSize is the largest accepted decompressed payload.
+	// Defaults to 65536.
+	MaxMessageSize int
+}
+
+const (
+	defaultGaseousMaxPayloadSize = 16384
+	defaultGaseousMaxMessageSize = 65536
+
+	// gaseousAuthTagLen is the length of the truncated HMAC-SHA256 tag that
+	// follows the payload when GaseousConfig.AuthKey is set.
+	gaseousAuthTagLen = 16
+)
+
+// GaseousConfig configures how a Conn uses the Gaseous protocol. Both peers
+// must agree on the directions, templates and AuthKey out-of-band.
+type GaseousConfig struct {
+	// ClientHello enables Gaseous framing of the ClientHello: clients send
+	// it as a Gaseous frame and servers accept one.
+	ClientHello bool
+
+	// ServerHello enables Gaseous framing of the ServerHello (and
+	// HelloRetryRequest): servers send it as a Gaseous frame and clients
+	// accept one.
+	ServerHello bool
+
+	// Algos lists the compression algorithms that may be used, in order of
+	// preference. Received frames using other algorithms are rejected. If
+	// empty, all algorithms are allowed and Flate is preferred.
+	Algos []GaseousHelloCompressAlgo
+
+	// Templates is the template registry used for template mode. If nil,
+	// the global registry filled by RegisterGaseousTemplate is used.
+	Templates *GaseousTemplateRegistry
+
+	// Fingerprint controls use of fingerprint mode.
+	Fingerprint GaseousFingerprintPolicy
+
+	// AuthKey, if not empty, authenticates every frame with a truncated
+	// HMAC-SHA256 tag appended after the payload. Frames with a missing or
+	// wrong tag are rejected.
+	AuthKey []byte
+
+	// Fallback controls what happens when a hello can't be sent as a
+	// Gaseous frame, or the peer sends a plain one.
+	Fallback GaseousFallbackPolicy
+
+	// ServerFlight makes a TLS 1.3 server send its ServerHello and the
+	// protected records of the rest of its first flight in a single server
+	// flight frame, in place of the ServerHello frame. The records stay
+	// encrypted with the handshake and application keys. It requires
+	// ServerHello and ServerFlight on both peers.
+	ServerFlight bool
+
+	// Chains holds the certificate chains known to a client. If it is not
+	// empty and the ClientHello is sent in a Gaseous frame, the hashes of up
+	// to 64 chains are advertised in the clear, and a server holding one of
+	// those chains sends a short reference instead: in a certificate
+	// reference frame in TLS 1.2, and in an encrypted handshake message in
+	// place of the Certificate message in TLS 1.3. Other chains are sent in
+	// full. Servers don't need to set Chains. The cache is shared, not
+	// copied, by Clone.
+	Chains *GaseousChainCache
+
+	// ServerProfile, if not nil, makes a server mimic the ServerHello of
+	// another TLS stack: its cipher suite preference, extension order and
+	// session ID behaviour. ServerHellos matching a registered profile can
+	// then be sent in fingerprint mode. Profiles are shared by Clone.
+	ServerProfile *GaseousServerProfile
+
+	// Limits bounds the size of received frames.
+	Limits GaseousLimits
+}
+
+// Clone returns a deep copy of g.
+func (g *GaseousConfig) Clone() *GaseousConfig {
+	if g == nil {
+		return nil
+	}
+	c := *g
+	if g.Algos != nil {
+		c.Algos = append([]GaseousHelloCompressAlgo(nil), g.Algos...)
+	}
+	if g.AuthKey != nil {
+		c.AuthKey = append([]byte(nil), g.AuthKey...)
+	}
+	c.Templates = g.Templates.Clone()
+	return &c
+}
+
+var defaultGaseousAlgos = []GaseousHelloCompressAlgo{
+	GaseousCompressFlate,
+	GaseousCompressGzip,
+	GaseousCompressBrotli,
+	GaseousCompressZstd,
+	GaseousCompressLZ4,
+	GaseousCompressXZ,
+	GaseousCompressLZ4Block,
+}
+
+func (g *GaseousConfig) algos() []GaseousHelloCompressAlgo {
+	if g == nil || len(g.Algos) == 0 {
+		return defaultGaseousAlgos
+	}
+	return g.Algos
+}
+
+func (g *GaseousConfig) algoAllowed(algo GaseousHelloCompressAlgo) bool {
+	if g == nil || len(g.Algos) == 0 {
+		return true
+	}
+	for _, a := range g.Algos {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GaseousConfig) templates() *GaseousTemplateRegistry {
+	if g == nil || g.Templates == nil {
+		return gaseousTemplates
+	}
+	return g.Templates
+}
+
+func (g *GaseousConfig) fingerprintPolicy() GaseousFingerprintPolicy {
+	if g == nil {
+		return GaseousFingerprintApproximate
+	}
+	return g.Fingerprint
+}
+
+func (g *GaseousConfig) authKey() []byte {
+	if g == nil {
+		return nil
+	}
+	return g.AuthKey
+}
+
+func (g *GaseousConfig) maxPayloadSize() int {
+	if g == nil || g.Limits.MaxPayloadSize <= 0 {
+		return defaultGaseousMaxPayloadSize
+	}
+	return g.Limits.MaxPayloadSize
+}
+
+func (g *GaseousConfig) maxMessageSize() int {
+	if g == nil || g.Limits.MaxMessageSize <= 0 {
+		return defaultGaseousMaxMessageSize
+	}
+	return g.Limits.MaxMessageSize
+}
+
+// marshalGaseousFrame compresses payload with the first usable algorithm in
+// g's preference order and returns the marker byte, header, payload and, if
+// g has an AuthKey, the authentication tag.
+func marshalGaseousFrame(helloType uint8, templID uint16, payload []byte, g *GaseousConfig) ([]byte, error) {
+	for _, algo := range g.algos() {
+		comp, err := gaseousCompressData(payload, algo)
+		if err != nil || len(comp) > g.maxPayloadSize() {
+			continue
+		}
+		out := make([]byte, 1+gaseousHelloHeaderSize, 1+gaseousHelloHeaderSize+len(comp)+gaseousAuthTagLen)
+		out[0] = recordTypeGaseousHello
+		header := out[1:]
+		copy(header[:2], GaseousHelloMagic)
+		header[2] = GaseousHelloVersion
+		header[3] = byte(algo)
+		header[4] = helloType
+		binary.BigEndian.PutUint16(header[5:7], templID)
+		binary.BigEndian.PutUint32(header[7:11], uint32(len(comp)))
+		out = append(out, comp...)
+		if key := g.authKey(); len(key) > 0 {
+			out = append(out, gaseousAuthTag(key, out[1:])...)
+		}
+		return out, nil
+	}
+	return nil, errorString("gaseous: all compression failed")
+}
+
+// trimGaseousMarker strips the optional record marker in front of a frame.
+func trimGaseousMarker(data []byte) []byte {
+	if len(data) > 0 && data[0] == recordTypeGaseousHello {
+		return data[1:]
+	}
+	return data
+}
+
+// parseGaseousFrame validates a frame (without the marker byte) against g
+// and returns its header and decompressed payload.
+func parseGaseousFrame(data []byte, g *GaseousConfig) (*GaseousHelloHeader, []byte, error) {
+	if len(data) < gaseousHelloHeaderSize {
+		return nil, nil, ErrGaseousTrunc
+	}
+	hdr := &GaseousHelloHeader{}
+	copy(hdr.Magic[:], data[:2])
+	hdr.Version = data[2]
+	hdr.Algo = data[3]
+	hdr.HelloType = data[4]
+	hdr.TemplID = binary.BigEndian.Uint16(data[5:7])
+	hdr.DataLen = binary.BigEndian.Uint32(data[7:11])
+
+	if string(hdr.Magic[:]) != GaseousHelloMagic {
+		return nil, nil, ErrGaseousMagic
+	}
+	if hdr.Version != GaseousHelloVersion {
+		return nil, nil, ErrGaseousVersion
+	}
+	if !g.algoAllowed(GaseousHelloCompressAlgo(hdr.Algo)) {
+		return nil, nil, ErrGaseousAlgo
+	}
+	if int64(hdr.DataLen) > int64(g.maxPayloadSize()) {
+		return nil, nil, ErrGaseousLimit
+	}
+	end := gaseousHelloHeaderSize + int(hdr.DataLen)
+	if end > len(data) {
+		return nil, nil, ErrGaseousTrunc
+	}
+	if key := g.authKey(); len(key) > 0 {
+		if len(data) < end+gaseousAuthTagLen {
+			return nil, nil, ErrGaseousAuth
+		}
+		if !hmac.Equal(data[end:end+gaseousAuthTagLen], gaseousAuthTag(key, data[:end])) {
+			return nil, nil, ErrGaseousAuth
+		}
+	}
+	if (hdr.TemplID == 0xffff || hdr.TemplID == gaseousTemplDelta) && g.fingerprintPolicy() == GaseousFingerprintDisabled {
+		return nil, nil, ErrGaseousPolicy
+	}
+	payload, err := gaseousDecompressLimited(data[gaseousHelloHeaderSize:end], GaseousHelloCompressAlgo(hdr.Algo), g.maxMessageSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, payload, nil
+}
+
+func gaseousAuthTag(key, frame []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(frame)
+	return mac.Sum(nil)[:gaseousAuthTagLen]
+}
+
+func gaseousCompressData(data []byte, algo GaseousHelloCompressAlgo) ([]byte, error) {
+	switch algo {
+	case GaseousCompressNone:
+		return data, nil
+	case GaseousCompressFlate:
+		return compressFlate(data)
+	case GaseousCompressGzip:
+		return compressGzip(data)
+	case GaseousCompressBrotli:
+		return compressBrotli(data)
+	case GaseousCompressZstd:
+		return compressZstd(data)
+	case GaseousCompressLZ4:
+		return compressLZ4(data)
+	case GaseousCompressXZ:
+		return compressXZ(data)
+	case GaseousCompressLZ4Block:
+		return compressLZ4Block(data)
+	default:
+		return nil, ErrGaseousAlgo
+	}
+}
+
+// gaseousDecompressLimited is like gaseousDecompressData but fails with
+// ErrGaseousLimit instead of producing more than limit bytes.
+func gaseousDecompressLimited(data []byte, algo GaseousHelloCompressAlgo, limit int) ([]byte, error) {
+	if algo == GaseousCompressLZ4Block {
+		// The block format carries its decompressed size up front.
+		if len(data) >= 4 && int64(binary.BigEndian.Uint32(data[:4])) > int64(limit) {
+			return nil, ErrGaseousLimit
+		}
+		return decompressLZ4Block(data)
+	}
+	var r io.Reader
+	switch algo {
+	case GaseousCompressNone:
+		if len(data) > limit {
+			return nil, ErrGaseousLimit
+		}
+		return data, nil
+	case GaseousCompressFlate:
+		fr := flate.NewReader(bytes.NewReader(data))
+		defer fr.Close()
+		r = fr
+	case GaseousCompressGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case GaseousCompressBrotli:
+		r = brotli.NewReader(bytes.NewReader(data))
+	case GaseousCompressZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case GaseousCompressLZ4:
+		r = lz4.NewReader(bytes.NewReader(data))
+	case GaseousCompressXZ:
+		xr, err := xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = xr
+	default:
+		return nil, ErrGaseousAlgo
+	}
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, ErrGaseousLimit
+	}
+	return out, nil
 }
 
 func fillHelloTemplate(tmpl *HelloTemplate, params []byte) []byte {
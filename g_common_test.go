@@ -0,0 +1,523 @@
+package tls
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestGaseousHandshake(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		clientConfig, serverConfig := testConfigs(t)
+		clientConfig.MaxVersion = vers
+		g := &GaseousConfig{
+			ClientHello: true,
+			ServerHello: true,
+			Algos:       []GaseousHelloCompressAlgo{GaseousCompressZstd, GaseousCompressFlate},
+			AuthKey:     []byte("shared secret"),
+			Fallback:    GaseousFallbackReject,
+		}
+		clientConfig.Gaseous = g
+		serverConfig.Gaseous = g.Clone()
+		if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+			t.Fatalf("%x: %v", vers, err)
+		}
+	}
+}
+
+func TestGaseousHandshakeMismatch(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.Gaseous = &GaseousConfig{ClientHello: true, AuthKey: []byte("a")}
+	serverConfig.Gaseous = &GaseousConfig{ClientHello: true, AuthKey: []byte("b")}
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil {
+		t.Fatal("handshake succeeded with mismatched AuthKey")
+	}
+
+	clientConfig, serverConfig = testConfigs(t)
+	serverConfig.Gaseous = &GaseousConfig{ClientHello: true, Fallback: GaseousFallbackReject}
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil {
+		t.Fatal("server accepted a plain ClientHello with GaseousFallbackReject")
+	}
+}
+
+func TestGaseousHandshakeRejectRetry(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	g := &GaseousConfig{ClientHello: true, ServerHello: true, Fallback: GaseousFallbackReject}
+	clientConfig.Gaseous = g
+	serverConfig.Gaseous = g.Clone()
+	// Force a HelloRetryRequest, so both sides send a second hello.
+	clientConfig.CurvePreferences = []CurveID{X25519, CurveP256}
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// After the HelloRetryRequest, a plain second ClientHello is rejected.
+	c, s := localPipe(t)
+	defer c.Close()
+	srv := Server(s, serverConfig)
+	srv.haveVers = true
+	srv.vers = VersionTLS13
+	hello := (&clientHelloMsg{vers: VersionTLS12, random: make([]byte, 32), cipherSuites: []uint16{TLS_AES_128_GCM_SHA256}, compressionMethods: []uint8{0}}).marshal()
+	go func() {
+		c.Write(append([]byte{byte(recordTypeHandshake), 3, 3, byte(len(hello) >> 8), byte(len(hello))}, hello...))
+		io.Copy(io.Discard, c)
+	}()
+	srv.in.Lock()
+	err := srv.readRecord()
+	srv.in.Unlock()
+	if err == nil {
+		t.Fatal("server accepted a plain second ClientHello with GaseousFallbackReject")
+	}
+}
+
+func TestGaseousConfigClone(t *testing.T) {
+	reg := NewGaseousTemplateRegistry()
+	reg.Register(7, &HelloTemplate{Serialized: []byte{1, 2, 3}})
+	c := &Config{Gaseous: &GaseousConfig{
+		ClientHello: true,
+		Algos:       []GaseousHelloCompressAlgo{GaseousCompressBrotli},
+		Templates:   reg,
+		AuthKey:     []byte("key"),
+	}}
+	cc := c.Clone()
+	if cc.Gaseous == c.Gaseous || cc.Gaseous.Templates == reg {
+		t.Fatal("Clone did not deep-copy GaseousConfig")
+	}
+	cc.Gaseous.Algos[0] = GaseousCompressNone
+	cc.Gaseous.AuthKey[0] = 'x'
+	cc.Gaseous.Templates.Register(8, &HelloTemplate{})
+	if c.Gaseous.Algos[0] != GaseousCompressBrotli || !bytes.Equal(c.Gaseous.AuthKey, []byte("key")) || reg.Lookup(8) != nil {
+		t.Error("modifying the clone changed the original")
+	}
+	if cc.Gaseous.Templates.Lookup(7) == nil {
+		t.Error("clone lost registered template")
+	}
+}
+
+func TestGaseousFrameLimits(t *testing.T) {
+	g := &GaseousConfig{Limits: GaseousLimits{MaxMessageSize: 100}}
+	frame, err := marshalGaseousFrame(GaseousHelloTypeClient, 0, make([]byte, 1000), g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseGaseousFrame(frame[1:], g); err != ErrGaseousLimit {
+		t.Errorf("got %v, want ErrGaseousLimit", err)
+	}
+	g.Limits.MaxMessageSize = 1000
+	if _, msg, err := parseGaseousFrame(frame[1:], g); err != nil || len(msg) != 1000 {
+		t.Errorf("got %d bytes, %v", len(msg), err)
+	}
+}
+
+// recordingConn records what is written to the underlying connection.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// gaseousFrameTypes returns the types of the Gaseous frames in a stream of
+// records.
+func gaseousFrameTypes(stream []byte) []uint8 {
+	var types []uint8
+	for len(stream) >= recordHeaderLen {
+		n := int(stream[3])<<8 | int(stream[4])
+		if len(stream) < recordHeaderLen+n {
+			break
+		}
+		if stream[0] == recordTypeGaseousHello && n > 5 {
+			types = append(types, stream[recordHeaderLen+5])
+		}
+		stream = stream[recordHeaderLen+n:]
+	}
+	return types
+}
+
+func TestGaseousServerFlight(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	g := &GaseousConfig{ClientHello: true, ServerHello: true, ServerFlight: true}
+	clientConfig.Gaseous = g
+	serverConfig.Gaseous = g
+	// Force a HelloRetryRequest ahead of the bundled flight.
+	clientConfig.CurvePreferences = []CurveID{X25519, CurveP256}
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	rec := &recordingConn{Conn: s}
+	done := make(chan error, 1)
+	go func() {
+		done <- Server(rec, serverConfig).Handshake()
+	}()
+	if err := Client(c, clientConfig).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	types := gaseousFrameTypes(rec.written.Bytes())
+	rec.mu.Unlock()
+	if !bytes.Equal(types, []uint8{GaseousHelloTypeHelloRetryRequest, GaseousHelloTypeServerFlight}) {
+		t.Errorf("server sent Gaseous frames of types %v", types)
+	}
+
+	// A client that doesn't expect a server flight rejects it.
+	clientConfig.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true}
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil {
+		t.Fatal("client accepted an unexpected server flight frame")
+	}
+}
+
+func TestGaseousServerFlightRoundTrip(t *testing.T) {
+	hello := (&serverHelloMsg{vers: VersionTLS12, random: make([]byte, 32), supportedVersion: VersionTLS13}).marshal()
+	records := []byte{
+		byte(recordTypeApplicationData), 0x03, 0x03, 0x00, 0x03, 1, 2, 3,
+		byte(recordTypeApplicationData), 0x03, 0x03, 0x00, 0x00,
+	}
+	frame, err := PackServerFlightGaseous(hello, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotHello, gotRecords, err := UnpackServerFlightGaseous(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotHello, hello) || !bytes.Equal(gotRecords, records) {
+		t.Error("server flight did not round-trip")
+	}
+	if typ, msg, err := UnpackAnyGaseousHello(frame); err != nil || typ != GaseousHelloTypeServerFlight || !bytes.Equal(msg, hello) {
+		t.Errorf("server flight as any hello: type %d, err %v", typ, err)
+	}
+
+	for name, records := range map[string][]byte{
+		"Truncated":   records[:len(records)-1],
+		"Unprotected": {byte(recordTypeHandshake), 0x03, 0x03, 0x00, 0x00},
+	} {
+		if _, err := PackServerFlightGaseous(hello, records); err == nil {
+			t.Errorf("%s: server flight accepted bad records", name)
+		}
+	}
+
+	hrr := (&serverHelloMsg{vers: VersionTLS12, random: helloRetryRequestRandom, supportedVersion: VersionTLS13, selectedGroup: X25519}).marshal()
+	frame, err = PackServerHelloGaseous(hrr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ, msg, err := UnpackAnyGaseousHello(frame); err != nil || typ != GaseousHelloTypeHelloRetryRequest || !bytes.Equal(msg, hrr) {
+		t.Errorf("HelloRetryRequest round-trip: type %d, err %v", typ, err)
+	}
+	if _, err := PackServerFlightGaseous(hrr, nil); err == nil {
+		t.Error("server flight accepted a HelloRetryRequest")
+	}
+}
+
+func TestGaseousChainReference(t *testing.T) {
+	cert, _ := testCertificate(t)
+	msg := (&certificateMsgTLS13{certificate: cert}).marshal()
+	h := GaseousChainHash(cert.Certificate)
+	ref, ok := makeChainReference(msg, true, h)
+	if !ok || len(ref) >= len(msg) {
+		t.Fatalf("makeChainReference: ok %v, %d >= %d bytes", ok, len(ref), len(msg))
+	}
+	got, err := expandChainReference(ref, true, NewGaseousChainCache(cert.Certificate))
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("expandChainReference did not restore the message: %v", err)
+	}
+	if _, err := expandChainReference(ref, true, NewGaseousChainCache([][]byte{{1, 2, 3}})); err != ErrGaseousChainMiss {
+		t.Errorf("got %v, want ErrGaseousChainMiss", err)
+	}
+
+	if _, err := parseCachedChains(make([]byte, 32*maxGaseousCachedChains)); err != nil {
+		t.Errorf("cached chains at the limit: %v", err)
+	}
+	if _, err := parseCachedChains(make([]byte, 32*(maxGaseousCachedChains+1))); err == nil {
+		t.Error("accepted more cached chains than a client advertises")
+	}
+}
+
+func TestGaseousCachedChainsVersion(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		config, _ := testConfigs(t)
+		config.MaxVersion = vers
+		config.Gaseous = &GaseousConfig{ClientHello: true, Chains: NewGaseousChainCache([][]byte{{1, 2, 3}})}
+		c, s := localPipe(t)
+		cli := Client(c, config)
+		hello, _, err := cli.makeClientHello()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			cli.writeHelloRecord(hello.marshal())
+			c.Close()
+		}()
+		records, err := io.ReadAll(s)
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, _, err := parseGaseousFrame(records[recordHeaderLen+1:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The hashes precede the ClientHello whether or not TLS 1.3 is
+		// offered.
+		if hdr.HelloType != GaseousHelloTypeCachedChains {
+			t.Errorf("%x: first frame has type %d", vers, hdr.HelloType)
+		}
+	}
+}
+
+func TestGaseousChainReferenceHandshake(t *testing.T) {
+	cert, _ := testCertificate(t)
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		var sent [2]int
+		for i, cached := range []bool{true, false} {
+			clientConfig, serverConfig := testConfigs(t)
+			clientConfig.MaxVersion = vers
+			chains := NewGaseousChainCache([][]byte{{1, 2, 3}})
+			if cached {
+				chains.Add(cert.Certificate)
+			}
+			clientConfig.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true, ServerFlight: true, Chains: chains}
+			serverConfig.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true, ServerFlight: true}
+			var peerCerts int
+			clientConfig.VerifyConnection = func(cs ConnectionState) error {
+				peerCerts = len(cs.PeerCertificates)
+				return nil
+			}
+			c, s := localPipe(t)
+			rec := &recordingConn{Conn: s}
+			done := make(chan error, 1)
+			go func() {
+				done <- Server(rec, serverConfig).Handshake()
+			}()
+			err := Client(c, clientConfig).Handshake()
+			if serr := <-done; err == nil {
+				err = serr
+			}
+			c.Close()
+			s.Close()
+			if err != nil {
+				t.Fatalf("%x, cached %v: %v", vers, cached, err)
+			}
+			if peerCerts != 1 {
+				t.Errorf("%x, cached %v: got %d peer certificates", vers, cached, peerCerts)
+			}
+			rec.mu.Lock()
+			sent[i] = rec.written.Len()
+			rec.mu.Unlock()
+		}
+		// A cached chain is replaced by a reference, encrypted in TLS 1.3.
+		if saved := sent[1] - sent[0]; saved < len(cert.Certificate[0])-64 {
+			t.Errorf("%x: a cached chain saved %d bytes of a %d byte certificate", vers, saved, len(cert.Certificate[0]))
+		}
+	}
+}
+
+func TestGaseousServerProfiles(t *testing.T) {
+	for _, profile := range []*GaseousServerProfile{GaseousServerProfileGo(), GaseousServerProfileNginxOpenSSL(), GaseousServerProfileCloudflare()} {
+		for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+			clientConfig, serverConfig := testConfigs(t)
+			clientConfig.MaxVersion = vers
+			clientConfig.NextProtos = []string{"h2"}
+			serverConfig.NextProtos = []string{"h2"}
+			g := &GaseousConfig{ServerHello: true, ServerProfile: profile}
+			clientConfig.Gaseous = g
+			serverConfig.Gaseous = g
+			cs, _, err := testHandshake(t, clientConfig, serverConfig)
+			if err != nil {
+				t.Fatalf("%s/%x: %v", profile.Name, vers, err)
+			}
+			if vers == VersionTLS13 && cs.CipherSuite != profile.CipherSuitesTLS13[0] {
+				t.Errorf("%s: negotiated %x, want %x", profile.Name, cs.CipherSuite, profile.CipherSuitesTLS13[0])
+			}
+		}
+	}
+}
+
+func TestGaseousServerProfileCopies(t *testing.T) {
+	p := GaseousServerProfileNginxOpenSSL()
+	p.Name = "changed"
+	p.ExtensionOrder[0] = extensionALPN
+	if q := GaseousServerProfileByName("nginx-openssl"); q == nil || q.ExtensionOrder[0] != extensionRenegotiationInfo {
+		t.Fatalf("catalogue changed through a built-in profile: %+v", q)
+	}
+	q := GaseousServerProfileByName("nginx-openssl")
+	q.CipherSuites[0] = 0
+	if GaseousServerProfileNginxOpenSSL().CipherSuites[0] == 0 {
+		t.Error("catalogue changed through GaseousServerProfileByName")
+	}
+}
+
+func TestGaseousServerHelloFingerprint(t *testing.T) {
+	m := &serverHelloMsg{
+		vers:                         VersionTLS12,
+		random:                       bytes.Repeat([]byte{7}, 32),
+		sessionId:                    bytes.Repeat([]byte{9}, 32),
+		cipherSuite:                  TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		secureRenegotiationSupported: true,
+		ticketSupported:              true,
+		alpnProtocol:                 "h2",
+		supportedPoints:              []uint8{pointFormatUncompressed},
+		extensionOrder:               GaseousServerProfileNginxOpenSSL().ExtensionOrder,
+	}
+	hello := m.marshal()
+	parsed, err := ParseServerHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{extensionRenegotiationInfo, extensionSupportedPoints, extensionSessionTicket, extensionALPN}
+	if len(parsed.ExtensionOrder) != len(want) {
+		t.Fatalf("extension order %v, want %v", parsed.ExtensionOrder, want)
+	}
+	for i := range want {
+		if parsed.ExtensionOrder[i] != want[i] {
+			t.Fatalf("extension order %v, want %v", parsed.ExtensionOrder, want)
+		}
+	}
+
+	frame, err := PackServerHelloGaseous(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if templID := uint16(frame[6])<<8 | uint16(frame[7]); templID != 0xffff {
+		t.Errorf("ServerHello not sent in fingerprint mode, TemplID %x", templID)
+	}
+	got, err := UnpackServerHelloGaseous(frame)
+	if err != nil || !bytes.Equal(got, hello) {
+		t.Errorf("fingerprint ServerHello did not round-trip: %v", err)
+	}
+}
+
+func TestGaseousPackUConn(t *testing.T) {
+	uc := utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloChrome_58)
+	if err := uc.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := PackUConnClientHelloGaseous(uc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if templID := uint16(frame[6])<<8 | uint16(frame[7]); templID != 0xffff {
+		t.Fatalf("UConn ClientHello not sent in fingerprint mode, TemplID %x", templID)
+	}
+	got, id, err := UnpackClientHelloGaseousID(frame, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != utls.HelloChrome_58 {
+		t.Errorf("got fingerprint %v, want %v", id.Str(), utls.HelloChrome_58.Str())
+	}
+	if !bytes.Equal(got, uc.HandshakeState.Hello.Raw) {
+		t.Error("rebuilt ClientHello differs from the UConn's")
+	}
+
+	// Key shares are carried in the parameters.
+	for _, helloID := range []utls.ClientHelloID{utls.HelloChrome_102, utls.HelloFirefox_102, utls.HelloIOS_14} {
+		uc = utls.UClient(nil, &utls.Config{ServerName: "example.com"}, helloID)
+		if err := uc.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		if frame, err = PackUConnClientHelloGaseous(uc, nil); err != nil {
+			t.Fatal(err)
+		}
+		if templID := uint16(frame[6])<<8 | uint16(frame[7]); templID != 0xffff {
+			t.Errorf("%s: ClientHello with key shares not sent in fingerprint mode, TemplID %x", helloID.Str(), templID)
+		}
+		if got, id, err = UnpackClientHelloGaseousID(frame, nil); err != nil || !bytes.Equal(got, uc.HandshakeState.Hello.Raw) || id != helloID {
+			t.Errorf("%s: ClientHello with key shares did not round-trip as %s: %v", helloID.Str(), id.Str(), err)
+		}
+	}
+
+	// Chrome 120 shuffles its extensions and sends a random ECH extension,
+	// so it can't be rebuilt from its ID. Like hellos without a reproducible
+	// ID, it is framed in another mode that still round-trips exactly.
+	uc = utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloChrome_120)
+	if err := uc.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	hello := uc.HandshakeState.Hello
+	if frame, err = PackUConnClientHelloGaseous(uc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if templID := uint16(frame[6])<<8 | uint16(frame[7]); templID != gaseousTemplDelta {
+		t.Errorf("Chrome 120 ClientHello not sent in delta mode, TemplID %x", templID)
+	}
+	if got, _, err = UnpackClientHelloGaseousID(frame, nil); err != nil || !bytes.Equal(got, hello.Raw) {
+		t.Errorf("Chrome 120 ClientHello did not round-trip: %v", err)
+	}
+	for _, id := range []utls.ClientHelloID{utls.HelloGolang, utls.HelloRandomized} {
+		frame, err := PackRawClientHelloGaseous(hello.Raw, id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := UnpackClientHelloGaseousID(frame, nil)
+		if err != nil || !bytes.Equal(got, hello.Raw) {
+			t.Errorf("ClientHello packed as %s did not round-trip: %v", id.Str(), err)
+		}
+	}
+
+	// With fingerprints disabled, a hello that matches a template uses it.
+	g := &GaseousConfig{Fingerprint: GaseousFingerprintDisabled, Templates: NewGaseousTemplateRegistry()}
+	g.Templates.Register(1, &HelloTemplate{Serialized: hello.Raw[:len(hello.Raw)/2]})
+	if frame, err = PackUConnClientHelloGaseous(uc, g); err != nil {
+		t.Fatal(err)
+	}
+	if templID := uint16(frame[6])<<8 | uint16(frame[7]); templID != 1 {
+		t.Errorf("ClientHello not sent in template mode, TemplID %x", templID)
+	}
+	if got, _, err = UnpackClientHelloGaseousID(frame, g); err != nil || !bytes.Equal(got, hello.Raw) {
+		t.Errorf("template ClientHello did not round-trip: %v", err)
+	}
+
+	if _, err := PackUConnClientHelloGaseous(utls.UClient(nil, &utls.Config{}, utls.HelloChrome_120), nil); err == nil {
+		t.Error("packed a UConn without a handshake state")
+	}
+}
+
+func TestGaseousHelloFrameContents(t *testing.T) {
+	g := &GaseousConfig{ClientHello: true}
+	hello := (&clientHelloMsg{vers: VersionTLS12, random: make([]byte, 32), cipherSuites: []uint16{TLS_AES_128_GCM_SHA256}, compressionMethods: []uint8{0}}).marshal()
+	sh := (&serverHelloMsg{vers: VersionTLS12, random: make([]byte, 32)}).marshal()
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+		ok      bool
+	}{
+		{"ClientHello", hello, true},
+		{"ServerHello", sh, false},
+		{"two ClientHellos", append(append([]byte{}, hello...), hello...), false},
+		{"truncated", hello[:len(hello)-1], false},
+	} {
+		frame, err := marshalGaseousFrame(GaseousHelloTypeClient, 0, tt.payload, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := Server(nil, &Config{Gaseous: g})
+		if err := c.readGaseousHello(frame); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+
+	// A frame can't follow a partial handshake message.
+	frame, _ := marshalGaseousFrame(GaseousHelloTypeClient, 0, hello, g)
+	c := Server(nil, &Config{Gaseous: g})
+	c.hand.Write(hello[:4])
+	if err := c.readGaseousHello(frame); err == nil {
+		t.Error("frame accepted after a partial handshake message")
+	}
+}
@@ -0,0 +1,355 @@
+package tls
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ========== 差分编码 ==========
+
+// gaseousTemplDelta is the TemplID of delta mode: a ClientHello encoded as
+// the differences from a hello rebuilt from a catalogue fingerprint.
+const gaseousTemplDelta uint16 = 0xfffe
+
+// Delta mode flags.
+const (
+	deltaCipherSuites = 1 << iota // the cipher suites are listed
+	deltaCompression              // the compression methods are listed
+)
+
+// Delta mode extension ops.
+const (
+	deltaExtCopy    uint8 = 0 // the extension of this type in the base hello
+	deltaExtLiteral uint8 = 1 // an extension given in full
+)
+
+// ErrGaseousDelta is returned for a delta-mode ClientHello that refers to
+// something the rebuilt base hello doesn't have.
+var ErrGaseousDelta = errorString("gaseous: delta does not apply to its base ClientHello")
+
+// deltaBase is a ClientHello rebuilt from a fingerprint for delta mode.
+type deltaBase struct {
+	suites      []uint16
+	compression []byte
+	exts        map[uint16][]byte // first extension of each type
+}
+
+// deltaGREASE replaces every GREASE value of a base hello, so that the
+// extensions that carry one come out the same in every build.
+const deltaGREASE = 0x0a0a
+
+// newDeltaBase builds a base hello from f, without SNI and with the spec's
+// own ALPN list.
+func newDeltaBase(f *GaseousFingerprint) (*deltaBase, error) {
+	spec, err := f.Spec()
+	if err != nil {
+		return nil, err
+	}
+	hello, err := buildUTLSClientHelloFromSpec(spec, &GaseousClientHelloParams{})
+	if err != nil {
+		return nil, err
+	}
+	rewriteClientHelloGREASE(hello, func(uint16) uint16 { return deltaGREASE })
+	p, err := ParseClientHello(hello)
+	if err != nil {
+		return nil, err
+	}
+	b := &deltaBase{suites: p.CipherSuites, compression: p.CompressionMethods, exts: make(map[uint16][]byte)}
+	for _, ext := range p.ExtensionList {
+		if _, ok := b.exts[ext.Type]; !ok {
+			b.exts[ext.Type] = ext.Data
+		}
+	}
+	return b, nil
+}
+
+// stableDeltaBase returns the parts of the base hello of f that are the same
+// in every build, built on first use.
+func (f *GaseousFingerprint) stableDeltaBase() (*deltaBase, error) {
+	f.deltaOnce.Do(func() {
+		var b1, b2 *deltaBase
+		if b1, f.deltaErr = newDeltaBase(f); f.deltaErr != nil {
+			return
+		}
+		if b2, f.deltaErr = newDeltaBase(f); f.deltaErr != nil {
+			return
+		}
+		f.delta = b1.stable(b2)
+	})
+	return f.delta, f.deltaErr
+}
+
+// deltaBaseFor returns the stable base of f with the server_name and ALPN
+// extensions for sni and alpn.
+func deltaBaseFor(f *GaseousFingerprint, sni string, alpn []string) (*deltaBase, error) {
+	stable, err := f.stableDeltaBase()
+	if err != nil {
+		return nil, err
+	}
+	b := &deltaBase{suites: stable.suites, compression: stable.compression, exts: make(map[uint16][]byte, len(stable.exts)+2)}
+	for typ, data := range stable.exts {
+		b.exts[typ] = data
+	}
+	if host := hostnameInSNI(sni); host != "" {
+		var ext cryptobyte.Builder
+		ext.AddUint16LengthPrefixed(func(ext *cryptobyte.Builder) {
+			ext.AddUint8(0) // name_type = host_name
+			ext.AddUint16LengthPrefixed(func(ext *cryptobyte.Builder) {
+				ext.AddBytes([]byte(host))
+			})
+		})
+		data, err := ext.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		b.exts[extensionServerName] = data
+	}
+	if len(alpn) > 0 {
+		var ext cryptobyte.Builder
+		ext.AddUint16LengthPrefixed(func(ext *cryptobyte.Builder) {
+			for _, proto := range alpn {
+				ext.AddUint8LengthPrefixed(func(ext *cryptobyte.Builder) {
+					ext.AddBytes([]byte(proto))
+				})
+			}
+		})
+		data, err := ext.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		b.exts[extensionALPN] = data
+	}
+	return b, nil
+}
+
+// stable returns the parts of b that are also in other. Parts that differ
+// between two builds, like key shares, must be sent in full.
+func (b *deltaBase) stable(other *deltaBase) *deltaBase {
+	out := &deltaBase{exts: make(map[uint16][]byte)}
+	if equalUint16s(b.suites, other.suites) {
+		out.suites = b.suites
+	}
+	if bytes.Equal(b.compression, other.compression) {
+		out.compression = b.compression
+	}
+	for typ, data := range b.exts {
+		if o, ok := other.exts[typ]; ok && !isGREASE(typ) && bytes.Equal(data, o) {
+			out.exts[typ] = data
+		}
+	}
+	return out
+}
+
+// marshalClientHelloDelta encodes hello as a delta against fingerprint f:
+//
+//	SpecID[2] SNI<2> ALPN<2> LegacyVersion[2] Random[32] SessionID<1> Flags[1]
+//	[CipherSuites<2>] [CompressionMethods<1>] Extensions<2>
+//
+// where ALPN holds 8-bit length-prefixed protocols, and each extension is
+// Op[1] Type[2], followed by Data<2> for a literal. Only the parts of the
+// cached base of f, and the server_name and ALPN extensions made from SNI and
+// ALPN, are copied. It returns nil if the delta isn't smaller than
+// hello or doesn't rebuild it exactly.
+func marshalClientHelloDelta(hello []byte, f *GaseousFingerprint) []byte {
+	p, err := ParseClientHello(hello)
+	if err != nil {
+		return nil
+	}
+	base, err := deltaBaseFor(f, p.SNI, p.ALPN)
+	if err != nil {
+		return nil
+	}
+
+	var flags uint8
+	if base.suites == nil || !equalUint16s(p.CipherSuites, base.suites) {
+		flags |= deltaCipherSuites
+	}
+	if base.compression == nil || !bytes.Equal(p.CompressionMethods, base.compression) {
+		flags |= deltaCompression
+	}
+	var b cryptobyte.Builder
+	b.AddUint16(f.ID)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(p.SNI))
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, proto := range p.ALPN {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(proto))
+			})
+		}
+	})
+	b.AddUint16(p.Version)
+	b.AddBytes(p.Random)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(p.SessionID)
+	})
+	b.AddUint8(flags)
+	if flags&deltaCipherSuites != 0 {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, suite := range p.CipherSuites {
+				b.AddUint16(suite)
+			}
+		})
+	}
+	if flags&deltaCompression != 0 {
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(p.CompressionMethods)
+		})
+	}
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, ext := range p.ExtensionList {
+			if data, ok := base.exts[ext.Type]; ok && bytes.Equal(data, ext.Data) {
+				b.AddUint8(deltaExtCopy)
+				b.AddUint16(ext.Type)
+				continue
+			}
+			b.AddUint8(deltaExtLiteral)
+			b.AddUint16(ext.Type)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(ext.Data)
+			})
+		}
+	})
+	delta, err := b.Bytes()
+	if err != nil || len(delta) >= len(hello) {
+		return nil
+	}
+	if rebuilt, err := buildClientHelloFromDelta(delta); err != nil || !bytes.Equal(rebuilt, hello) {
+		return nil
+	}
+	return delta
+}
+
+// buildClientHelloFromDelta rebuilds a ClientHello from a delta-mode
+// payload.
+func buildClientHelloFromDelta(delta []byte) ([]byte, error) {
+	s := cryptobyte.String(delta)
+	var specID, vers uint16
+	var sni, alpnList, random, sessionID cryptobyte.String
+	var flags uint8
+	if !s.ReadUint16(&specID) || !s.ReadUint16LengthPrefixed(&sni) ||
+		!s.ReadUint16LengthPrefixed(&alpnList) || !s.ReadUint16(&vers) ||
+		!s.ReadBytes((*[]byte)(&random), 32) || !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint8(&flags) {
+		return nil, ErrGaseousTrunc
+	}
+	var alpn []string
+	for !alpnList.Empty() {
+		var proto cryptobyte.String
+		if !alpnList.ReadUint8LengthPrefixed(&proto) {
+			return nil, ErrGaseousTrunc
+		}
+		alpn = append(alpn, string(proto))
+	}
+	f := GaseousFingerprintByID(specID)
+	if f == nil {
+		return nil, errors.New("gaseous: unknown fingerprint ID")
+	}
+	base, err := deltaBaseFor(f, string(sni), alpn)
+	if err != nil {
+		return nil, err
+	}
+
+	var suites []byte
+	if flags&deltaCipherSuites != 0 {
+		if !s.ReadUint16LengthPrefixed((*cryptobyte.String)(&suites)) {
+			return nil, ErrGaseousTrunc
+		}
+	} else {
+		for _, suite := range base.suites {
+			suites = append(suites, byte(suite>>8), byte(suite))
+		}
+	}
+	compression := base.compression
+	if flags&deltaCompression != 0 {
+		if !s.ReadUint8LengthPrefixed((*cryptobyte.String)(&compression)) {
+			return nil, ErrGaseousTrunc
+		}
+	}
+	var exts cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&exts) || !s.Empty() {
+		return nil, ErrGaseousTrunc
+	}
+
+	var b cryptobyte.Builder
+	var deltaErr error
+	b.AddUint8(typeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(vers)
+		b.AddBytes(random)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(sessionID)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(suites)
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(compression)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for !exts.Empty() {
+				var op uint8
+				var typ uint16
+				var data cryptobyte.String
+				if !exts.ReadUint8(&op) || !exts.ReadUint16(&typ) {
+					deltaErr = ErrGaseousTrunc
+					return
+				}
+				switch op {
+				case deltaExtCopy:
+					d, ok := base.exts[typ]
+					if !ok {
+						deltaErr = ErrGaseousDelta
+						return
+					}
+					data = d
+				case deltaExtLiteral:
+					if !exts.ReadUint16LengthPrefixed(&data) {
+						deltaErr = ErrGaseousTrunc
+						return
+					}
+				default:
+					deltaErr = ErrGaseousDelta
+					return
+				}
+				b.AddUint16(typ)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(data)
+				})
+			}
+		})
+	})
+	if deltaErr != nil {
+		return nil, deltaErr
+	}
+	return b.Bytes()
+}
+
+// packClientHelloDelta frames hello in delta mode against its closest
+// fingerprint, or returns nil if delta mode doesn't pay off.
+func packClientHelloDelta(hello []byte, g *GaseousConfig) ([]byte, error) {
+	candidates, err := MatchClientHello(hello)
+	if err != nil || len(candidates) == 0 || candidates[0].Fingerprint.ID == 0 {
+		return nil, nil
+	}
+	delta := marshalClientHelloDelta(hello, candidates[0].Fingerprint)
+	if delta == nil {
+		return nil, nil
+	}
+	return marshalGaseousFrame(GaseousHelloTypeClient, gaseousTemplDelta, delta, g)
+}
+
+func equalUint16s(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
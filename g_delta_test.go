@@ -0,0 +1,102 @@
+package tls
+
+import (
+	"bytes"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// customizedHello builds a Firefox 120 ClientHello with an extra extension
+// and its first two cipher suites swapped.
+func customizedHello(t *testing.T) []byte {
+	spec, err := utls.UTLSIdToSpec(utls.HelloFirefox_120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.CipherSuites[0], spec.CipherSuites[1] = spec.CipherSuites[1], spec.CipherSuites[0]
+	spec.Extensions = append(spec.Extensions[:3:3], append([]utls.TLSExtension{
+		&utls.GenericExtension{Id: 0x7777, Data: []byte{1, 2, 3}},
+	}, spec.Extensions[3:]...)...)
+	uc := utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloCustom)
+	if err := uc.ApplyPreset(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uc.MarshalClientHello(); err != nil {
+		t.Fatal(err)
+	}
+	return uc.HandshakeState.Hello.Raw
+}
+
+func TestGaseousDelta(t *testing.T) {
+	hello := customizedHello(t)
+	frame, err := packClientHelloGaseous(hello, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if templID := uint16(frame[6])<<8 | uint16(frame[7]); templID != gaseousTemplDelta {
+		t.Fatalf("customized ClientHello not sent in delta mode, TemplID %x", templID)
+	}
+	raw, err := marshalGaseousFrame(GaseousHelloTypeClient, 0, hello, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) >= len(raw) {
+		t.Errorf("delta frame is %d bytes, raw frame %d", len(frame), len(raw))
+	}
+	got, err := UnpackClientHelloGaseous(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, hello) {
+		t.Error("delta-mode ClientHello did not round-trip")
+	}
+
+	delta := marshalClientHelloDelta(hello, GaseousFingerprintByName(utls.HelloFirefox_120.Str()))
+	if delta == nil {
+		t.Fatal("no delta against Firefox 120")
+	}
+	bad := append([]byte(nil), delta...)
+	bad[1] = 0xff // a fingerprint ID nobody registered
+	if _, err := buildClientHelloFromDelta(bad); err == nil {
+		t.Error("applied a delta against an unknown fingerprint")
+	}
+
+	g := &GaseousConfig{Fingerprint: GaseousFingerprintDisabled}
+	frame, err = packClientHelloGaseous(hello, g, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if templID := uint16(frame[6])<<8 | uint16(frame[7]); templID != 0 {
+		t.Errorf("delta mode used with fingerprints disabled, TemplID %x", templID)
+	}
+}
+
+func TestGaseousDeltaBaseCache(t *testing.T) {
+	f := GaseousFingerprintByName(utls.HelloChrome_120.Str())
+	b1, err := f.stableDeltaBase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2, _ := f.stableDeltaBase(); b1 != b2 {
+		t.Error("delta base rebuilt for the same fingerprint")
+	}
+
+	// The cached base has no SNI; the server_name extension comes from the
+	// frame, so it is still copied rather than sent in full.
+	uc := utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloChrome_120)
+	if err := uc.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	hello := uc.HandshakeState.Hello.Raw
+	delta := marshalClientHelloDelta(hello, f)
+	if delta == nil {
+		t.Fatal("no delta against Chrome 120")
+	}
+	if bytes.Contains(delta[2+2+len("example.com"):], []byte("example.com")) {
+		t.Error("server_name extension sent in full")
+	}
+	if got, err := buildClientHelloFromDelta(delta); err != nil || !bytes.Equal(got, hello) {
+		t.Errorf("delta did not round-trip: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package tls
+
+import (
+	"crypto/hmac"
+	"errors"
+	"time"
+)
+
+// ========== 0-RTT 早期数据 ==========
+
+// maxEarlyDataTicketAgeSkew is how far the ticket age reported by a client
+// may be from the one a server computes, for its early data to be accepted.
+// See RFC 8446, Section 8.3.
+const maxEarlyDataTicketAgeSkew = 10 * time.Second
+
+// EarlyDataInfo describes the 0-RTT data a client offers, for
+// Config.AcceptEarlyData.
+type EarlyDataInfo struct {
+	// ServerName is the value of the Server Name Indication extension sent
+	// by the client, if any.
+	ServerName string
+
+	// NegotiatedProtocol is the application protocol selected with ALPN,
+	// which is also the one of the resumed session.
+	NegotiatedProtocol string
+
+	// ClientRandom is the random of the ClientHello. A ClientHello with early
+	// data whose random was seen before is a replay. See RFC 8446, Section 8.2.
+	ClientRandom []byte
+
+	// TicketIssued is when the server issued the session ticket, and
+	// TicketAge the age of the ticket as reported by the client.
+	TicketIssued time.Time
+	TicketAge    time.Duration
+}
+
+// SetEarlyData sets data to be sent as TLS 1.3 0-RTT early data right after
+// the ClientHello, before the handshake completes. It must be called by a
+// client before the handshake.
+//
+// Early data is only sent if the connection resumes a session whose ticket
+// allows at least len(data) bytes of it, and not with Encrypted Client Hello
+// or over QUIC. Unlike the rest of the connection, it can be replayed by an
+// attacker. ConnectionState.EarlyDataAccepted reports whether the server
+// accepted it; if not, the data was dropped, and the application can write
+// it again.
+func (c *Conn) SetEarlyData(data []byte) error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if !c.isClient {
+		return errors.New("tls: SetEarlyData called on a server connection")
+	}
+	if c.handshakeComplete() || c.handshakes > 0 {
+		return errors.New("tls: SetEarlyData called after the handshake")
+	}
+	c.earlyData = append([]byte(nil), data...)
+	return nil
+}
+
+// canSendEarlyData reports whether a client resuming session with hello can
+// send its early data.
+func (c *Conn) canSendEarlyData(session *ClientSessionState, hello *clientHelloMsg) bool {
+	if len(c.earlyData) == 0 || c.quic != nil || len(c.config.EncryptedClientHelloConfigList) > 0 {
+		return false
+	}
+	if session.maxEarlyData < uint32(len(c.earlyData)) {
+		return false
+	}
+	// The server only accepts early data for the cipher suite and the
+	// application protocol of the session. See RFC 8446, Section 4.2.10.
+	suiteOK := false
+	for _, id := range hello.cipherSuites {
+		if id == session.cipherSuite {
+			suiteOK = true
+			break
+		}
+	}
+	if !suiteOK {
+		return false
+	}
+	if session.alpnProtocol == "" {
+		return true
+	}
+	for _, proto := range hello.alpnProtocols {
+		if proto == session.alpnProtocol {
+			return true
+		}
+	}
+	return false
+}
+
+// sendEarlyData writes the early data of a client after hello, with the
+// early traffic keys of session.
+func (c *Conn) sendEarlyData(hello *clientHelloMsg, session *ClientSessionState, earlySecret []byte) error {
+	suite := cipherSuiteTLS13ByID(session.cipherSuite)
+	if suite == nil {
+		return c.sendAlert(alertInternalError)
+	}
+	transcript := suite.hash.New()
+	transcript.Write(hello.marshal())
+	secret := suite.deriveSecret(earlySecret, clientEarlyTrafficLabel, transcript)
+	if err := c.config.writeKeyLog(keyLogLabelClientEarly, hello.random, secret); err != nil {
+		c.sendAlert(alertInternalError)
+		return err
+	}
+
+	// The dummy ChangeCipherSpec goes before the first encrypted record. It
+	// is written directly, as the version isn't negotiated yet.
+	// See RFC 8446, Appendix D.4.
+	c.out.Lock()
+	err := c.writeUnprotectedRecordLocked(recordTypeChangeCipherSpec, []byte{1})
+	c.out.Unlock()
+	if err != nil {
+		return err
+	}
+	c.out.version = VersionTLS13
+	c.out.setTrafficSecret(suite, QUICEncryptionLevelEarly, secret)
+	_, err = c.writeRecord(recordTypeApplicationData, c.earlyData)
+	return err
+}
+
+// sendEndOfEarlyData ends the early data of a client, if the server accepted
+// it, and switches to the handshake traffic keys.
+func (hs *clientHandshakeStateTLS13) sendEndOfEarlyData() error {
+	c := hs.c
+
+	if !hs.earlyData {
+		return nil
+	}
+	if c.earlyDataAccepted {
+		endOfEarlyData := new(endOfEarlyDataMsg)
+		hs.transcript.Write(endOfEarlyData.marshal())
+		if _, err := c.writeRecord(recordTypeHandshake, endOfEarlyData.marshal()); err != nil {
+			return err
+		}
+	}
+	hs.earlyData = false
+	c.out.setTrafficSecret(hs.suite, QUICEncryptionLevelHandshake, hs.clientHandshakeSecret)
+	return nil
+}
+
+// acceptEarlyData reports whether a server accepts the early data offered
+// by the client, once alpn was selected.
+func (hs *serverHandshakeStateTLS13) acceptEarlyData(alpn string) bool {
+	c := hs.c
+	s := hs.session
+
+	if !hs.clientHello.earlyData || !hs.usingPSK || hs.hello.selectedIdentity != 0 || c.quic != nil {
+		return false
+	}
+	if c.config.MaxEarlyData == 0 || s.maxEarlyData == 0 ||
+		s.cipherSuite != hs.suite.id || s.alpnProtocol != alpn {
+		return false
+	}
+
+	issued := time.Unix(int64(s.createdAt), 0)
+	reported := time.Duration(hs.clientHello.pskIdentities[0].obfuscatedTicketAge-s.ageAdd) * time.Millisecond
+	if skew := c.config.time().Sub(issued) - reported; skew < -maxEarlyDataTicketAgeSkew || skew > maxEarlyDataTicketAgeSkew {
+		return false
+	}
+
+	// Without the anti-replay hook, early data is never accepted.
+	if c.config.AcceptEarlyData == nil {
+		return false
+	}
+	return c.config.AcceptEarlyData(&EarlyDataInfo{
+		ServerName:         hs.clientHello.serverName,
+		NegotiatedProtocol: alpn,
+		ClientRandom:       hs.clientHello.random,
+		TicketIssued:       issued,
+		TicketAge:          reported,
+	})
+}
+
+// serverEarlyData is the state of a server that accepted early data, from the
+// end of its handshake until the client's Finished, which Read processes
+// after the early data.
+type serverEarlyData struct {
+	suite           *cipherSuiteTLS13
+	handshakeSecret []byte // client_handshake_traffic_secret
+	trafficSecret   []byte // client_application_traffic_secret_0
+	clientFinished  []byte
+	// remaining is how much more early data the client may send.
+	remaining uint32
+	// ended is set once the EndOfEarlyData message was received.
+	ended bool
+}
+
+// receiveEarlyData accounts for n bytes of application data received by a
+// server. Early data beyond what it accepts is fatal.
+func (c *Conn) receiveEarlyData(n int) error {
+	e := c.serverEarlyData
+	if e == nil {
+		return nil
+	}
+	if e.ended || uint32(n) > e.remaining {
+		return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
+	}
+	e.remaining -= uint32(n)
+	return nil
+}
+
+// handleEarlyDataMessage processes the EndOfEarlyData and Finished messages
+// that end the client's flight after accepted early data.
+func (c *Conn) handleEarlyDataMessage() error {
+	e := c.serverEarlyData
+
+	msg, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+
+	if !e.ended {
+		if _, ok := msg.(*endOfEarlyDataMsg); !ok {
+			c.sendAlert(alertUnexpectedMessage)
+			return unexpectedMessageError(&endOfEarlyDataMsg{}, msg)
+		}
+		if c.hand.Len() != 0 {
+			c.sendAlert(alertUnexpectedMessage)
+			return errors.New("tls: handshake data left over at a key change")
+		}
+		e.ended = true
+		c.in.setTrafficSecret(e.suite, QUICEncryptionLevelHandshake, e.handshakeSecret)
+		return nil
+	}
+
+	finished, ok := msg.(*finishedMsg)
+	if !ok {
+		c.sendAlert(alertUnexpectedMessage)
+		return unexpectedMessageError(finished, msg)
+	}
+	if !hmac.Equal(e.clientFinished, finished.verifyData) {
+		c.sendAlert(alertDecryptError)
+		return errors.New("tls: invalid client finished hash")
+	}
+	c.in.setTrafficSecret(e.suite, QUICEncryptionLevelApplication, e.trafficSecret)
+	c.serverEarlyData = nil
+	c.earlyDataPending.Store(false)
+	return nil
+}
+
+// skipRejectedEarlyData reports whether a server should drop a record with a
+// payload of n bytes, as early data it rejected. Such records fail to
+// decrypt under the handshake keys, or arrive as application data in the
+// clear after a HelloRetryRequest. See RFC 8446, Section 4.2.10.
+func (c *Conn) skipRejectedEarlyData(n int) bool {
+	// The payload holds the content type and a 16-byte AEAD tag.
+	n = max(n-1-16, 0)
+	if c.isClient || c.earlyDataSkip == 0 || n > c.earlyDataSkip {
+		return false
+	}
+	c.earlyDataSkip -= n
+	return true
+}
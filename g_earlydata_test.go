@@ -0,0 +1,270 @@
+package tls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resumeWithEarlyData resumes the session in the cache of clientConfig,
+// sending early as early data. If the server rejects it, the client writes
+// it again, so the server always reads it first.
+func resumeWithEarlyData(t *testing.T, clientConfig, serverConfig *Config, early string) (cs, ss ConnectionState, err error) {
+	t.Helper()
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	done := make(chan error, 1)
+	var srv *Conn
+	go func() {
+		srv = Server(s, serverConfig)
+		if err := srv.Handshake(); err != nil {
+			s.Close()
+			done <- err
+			return
+		}
+		buf := make([]byte, len(early))
+		if _, err := io.ReadFull(srv, buf); err != nil {
+			done <- err
+			return
+		}
+		if string(buf) != early {
+			done <- fmt.Errorf("server read %q", buf)
+			return
+		}
+		// Early data is read before the handshake is complete.
+		if st := srv.ConnectionState(); st.EarlyDataAccepted && (!st.EarlyDataPending || st.HandshakeComplete) {
+			done <- fmt.Errorf("server read early data with EarlyDataPending %v, HandshakeComplete %v", st.EarlyDataPending, st.HandshakeComplete)
+			return
+		}
+		if _, err := srv.Write([]byte("ok")); err != nil {
+			done <- err
+			return
+		}
+		// Reading past the early data processes the client's Finished.
+		if _, err := io.ReadFull(srv, buf[:3]); err != nil {
+			done <- err
+			return
+		}
+		if st := srv.ConnectionState(); st.EarlyDataPending || !st.HandshakeComplete {
+			done <- fmt.Errorf("server read 1-RTT data with EarlyDataPending %v, HandshakeComplete %v", st.EarlyDataPending, st.HandshakeComplete)
+			return
+		}
+		done <- nil
+	}()
+	cli := Client(c, clientConfig)
+	if err = cli.SetEarlyData([]byte(early)); err != nil {
+		return
+	}
+	if err = cli.Handshake(); err != nil {
+		c.Close()
+		<-done
+		return
+	}
+	if !cli.ConnectionState().EarlyDataAccepted {
+		_, err = cli.Write([]byte(early))
+	}
+	if err == nil {
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(cli, buf)
+	}
+	if err == nil {
+		_, err = cli.Write([]byte("bye"))
+	}
+	if serr := <-done; err == nil {
+		err = serr
+	}
+	if err != nil {
+		return
+	}
+	return cli.ConnectionState(), srv.ConnectionState(), nil
+}
+
+func TestEarlyData(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		setup    func(client, server *Config)
+		early    string
+		accepted bool
+	}{
+		{"Accepted", func(client, server *Config) {}, "early data", true},
+		{"TooLarge", func(client, server *Config) {}, strings.Repeat("x", 2000), false},
+		{"Hook", func(client, server *Config) {
+			server.AcceptEarlyData = func(*EarlyDataInfo) bool { return false }
+		}, "early data", false},
+		{"NoHook", func(client, server *Config) {
+			server.AcceptEarlyData = nil
+		}, "early data", false},
+		{"HelloRetryRequest", func(client, server *Config) {
+			server.CurvePreferences = []CurveID{CurveP384}
+		}, "early data", false},
+		{"ALPN", func(client, server *Config) {
+			client.NextProtos = []string{"a", "b"}
+			server.NextProtos = []string{"b"}
+		}, "early data", false},
+		{"TicketAge", func(client, server *Config) {
+			server.Time = func() time.Time { return time.Now().Add(time.Minute) }
+		}, "early data", false},
+		{"Gaseous", func(client, server *Config) {
+			client.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true}
+			server.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true}
+		}, "early data", true},
+		{"ClientHelloSpec", func(client, server *Config) {
+			// The spec doesn't list early_data, which is added anyway.
+			client.ClientHelloSpec = chromeLikeSpec()
+		}, "early data", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig, serverConfig := testConfigs(t)
+			clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+			serverConfig.MaxEarlyData = 1024
+			serverConfig.AcceptEarlyData = func(*EarlyDataInfo) bool { return true }
+			clientConfig.NextProtos = []string{"a"}
+			serverConfig.NextProtos = []string{"a"}
+			if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(clientConfig, serverConfig)
+			cs, ss, err := resumeWithEarlyData(t, clientConfig, serverConfig, tt.early)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cs.DidResume || !ss.DidResume {
+				t.Error("connection did not resume")
+			}
+			if cs.EarlyDataAccepted != tt.accepted || ss.EarlyDataAccepted != tt.accepted {
+				t.Errorf("EarlyDataAccepted = %v on the client, %v on the server, want %v",
+					cs.EarlyDataAccepted, ss.EarlyDataAccepted, tt.accepted)
+			}
+		})
+	}
+}
+
+func TestEarlyDataInfo(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+	serverConfig.MaxEarlyData = 1024
+	serverConfig.AcceptEarlyData = func(*EarlyDataInfo) bool { return true }
+	clientConfig.NextProtos = []string{"a"}
+	serverConfig.NextProtos = []string{"a"}
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	var infos []*EarlyDataInfo
+	serverConfig.AcceptEarlyData = func(info *EarlyDataInfo) bool {
+		infos = append(infos, info)
+		return true
+	}
+	cs, _, err := resumeWithEarlyData(t, clientConfig, serverConfig, "early data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.EarlyDataAccepted || len(infos) != 1 {
+		t.Fatalf("accepted %v, hook called %d times", cs.EarlyDataAccepted, len(infos))
+	}
+	info := infos[0]
+	if info.ServerName != "example.com" || info.NegotiatedProtocol != "a" || len(info.ClientRandom) != 32 {
+		t.Errorf("got info %+v", info)
+	}
+	if info.TicketAge < 0 || info.TicketAge > maxEarlyDataTicketAgeSkew || time.Since(info.TicketIssued) > time.Minute {
+		t.Errorf("ticket issued at %v, reported age %v", info.TicketIssued, info.TicketAge)
+	}
+}
+
+func TestEarlyDataUnexpected(t *testing.T) {
+	// A server that doesn't take early data can't skip it.
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+	serverConfig.MaxEarlyData = 1024
+	serverConfig.AcceptEarlyData = func(*EarlyDataInfo) bool { return true }
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig.MaxEarlyData = 0
+	if _, _, err := resumeWithEarlyData(t, clientConfig, serverConfig, "early data"); err == nil {
+		t.Error("server without MaxEarlyData completed a handshake with early data")
+	}
+}
+
+func TestEarlyDataTicket(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	// Tickets issued without MaxEarlyData don't allow early data.
+	serverConfig.MaxEarlyData = 1024
+	serverConfig.AcceptEarlyData = func(*EarlyDataInfo) bool { return true }
+	cs, _, err := resumeWithEarlyData(t, clientConfig, serverConfig, "early data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.DidResume || cs.EarlyDataAccepted {
+		t.Errorf("DidResume = %v, EarlyDataAccepted = %v", cs.DidResume, cs.EarlyDataAccepted)
+	}
+
+	// Nor do tickets issued without AcceptEarlyData.
+	clientConfig, serverConfig = testConfigs(t)
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+	serverConfig.MaxEarlyData = 1024
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig.AcceptEarlyData = func(*EarlyDataInfo) bool { return true }
+	cs, _, err = resumeWithEarlyData(t, clientConfig, serverConfig, "early data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.DidResume || cs.EarlyDataAccepted {
+		t.Errorf("DidResume = %v, EarlyDataAccepted = %v", cs.DidResume, cs.EarlyDataAccepted)
+	}
+}
+
+func TestSetEarlyData(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	if err := Server(nil, serverConfig).SetEarlyData([]byte("x")); err == nil {
+		t.Error("SetEarlyData succeeded on a server")
+	}
+
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		srv := Server(s, serverConfig)
+		srv.Handshake()
+		io.Copy(io.Discard, srv)
+	}()
+	cli := Client(c, clientConfig)
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.SetEarlyData([]byte("x")); err == nil {
+		t.Error("SetEarlyData succeeded after the handshake")
+	}
+}
+
+func TestSessionStateTLS13EarlyData(t *testing.T) {
+	state := &sessionStateTLS13{
+		cipherSuite:      TLS_AES_128_GCM_SHA256,
+		createdAt:        1,
+		resumptionSecret: []byte("secret"),
+		maxEarlyData:     1024,
+		ageAdd:           42,
+		alpnProtocol:     "h2",
+	}
+	var got sessionStateTLS13
+	if !got.unmarshal(state.marshal()) || got.maxEarlyData != 1024 || got.ageAdd != 42 || got.alpnProtocol != "h2" {
+		t.Errorf("got %+v", got)
+	}
+
+	// Revision 0 tickets parse, without the 0-RTT fields.
+	rev0 := state.marshal()
+	rev0[2] = 0
+	rev0 = rev0[:len(rev0)-4-4-1-2]
+	if !got.unmarshal(rev0) || got.maxEarlyData != 0 || !bytes.Equal(got.resumptionSecret, state.resumptionSecret) {
+		t.Errorf("got %+v from a revision 0 ticket", got)
+	}
+}
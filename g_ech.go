@@ -0,0 +1,735 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/cloudflare/circl/hpke"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ========== 加密 ClientHello (ECH) ==========
+
+const (
+	extensionEncryptedClientHello uint16 = 0xfe0d
+	extensionECHOuterExtensions   uint16 = 0xfd00
+)
+
+// echConfigVersion is the ECHConfig version of draft-ietf-tls-esni-18.
+const echConfigVersion uint16 = 0xfe0d
+
+// ECH ClientHello types, see draft-ietf-tls-esni, Section 5.
+const (
+	echClientHelloOuter uint8 = 0
+	echClientHelloInner uint8 = 1
+)
+
+// Labels of the acceptance confirmations, see draft-ietf-tls-esni,
+// sections 7.2 and 7.2.1.
+const (
+	echAcceptConfirmationLabel    = "ech accept confirmation"
+	echHRRAcceptConfirmationLabel = "hrr ech accept confirmation"
+)
+
+// EncryptedClientHelloKey is an ECH key held by a server.
+type EncryptedClientHelloKey struct {
+	// Config is a serialized ECHConfig, one entry of an ECHConfigList.
+	Config []byte
+	// PrivateKey is the HPKE private key for the public key in Config, in
+	// the serialization of its KEM.
+	PrivateKey []byte
+	// SendAsRetry makes the server send Config to clients whose ECH it
+	// rejects, for them to retry with.
+	SendAsRetry bool
+}
+
+// ECHRejectionError is returned by a client handshake when the server
+// rejected Encrypted Client Hello. The handshake was completed with the
+// ClientHelloOuter, and the server authenticated for the public name of the
+// ECHConfig, before the client aborted it.
+type ECHRejectionError struct {
+	// RetryConfigList is the ECHConfigList the server sent to retry with,
+	// or nil.
+	RetryConfigList []byte
+}
+
+func (e *ECHRejectionError) Error() string {
+	return "tls: server rejected ECH"
+}
+
+var (
+	errMalformedECHConfig = errors.New("tls: malformed ECHConfigList")
+	errMalformedECHInner  = errors.New("tls: malformed ClientHelloInner")
+)
+
+// NewEncryptedClientHelloKey generates an X25519 HPKE key pair and an
+// ECHConfig for it, with the given config ID and public name. The config
+// offers HKDF-SHA256 with AES-128-GCM or ChaCha20-Poly1305.
+func NewEncryptedClientHelloKey(configID uint8, publicName string) (EncryptedClientHelloKey, error) {
+	if len(publicName) == 0 || len(publicName) > 255 {
+		return EncryptedClientHelloKey{}, errors.New("tls: invalid ECH public name")
+	}
+	kemID := hpke.KEM_X25519_HKDF_SHA256
+	pk, sk, err := kemID.Scheme().GenerateKeyPair()
+	if err != nil {
+		return EncryptedClientHelloKey{}, err
+	}
+	publicKey, err := pk.MarshalBinary()
+	if err != nil {
+		return EncryptedClientHelloKey{}, err
+	}
+	privateKey, err := sk.MarshalBinary()
+	if err != nil {
+		return EncryptedClientHelloKey{}, err
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16(echConfigVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(configID)
+		b.AddUint16(uint16(kemID))
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(publicKey)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, aead := range []hpke.AEAD{hpke.AEAD_AES128GCM, hpke.AEAD_ChaCha20Poly1305} {
+				b.AddUint16(uint16(hpke.KDF_HKDF_SHA256))
+				b.AddUint16(uint16(aead))
+			}
+		})
+		b.AddUint8(0) // maximum_name_length, unknown
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // no extensions
+	})
+	config, err := b.Bytes()
+	if err != nil {
+		return EncryptedClientHelloKey{}, err
+	}
+	return EncryptedClientHelloKey{Config: config, PrivateKey: privateKey}, nil
+}
+
+// MarshalECHConfigList returns the ECHConfigList made of configs, each a
+// serialized ECHConfig, for Config.EncryptedClientHelloConfigList or a DNS
+// HTTPS record.
+func MarshalECHConfigList(configs ...[]byte) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, config := range configs {
+			b.AddBytes(config)
+		}
+	})
+	return b.Bytes()
+}
+
+// echConfig is a parsed ECHConfig.
+type echConfig struct {
+	raw           []byte
+	configID      uint8
+	kemID         uint16
+	publicKey     []byte
+	suites        []echCipherSuite
+	maxNameLength uint8
+	publicName    []byte
+}
+
+// echCipherSuite is an HPKE KDF and AEAD pair.
+type echCipherSuite struct {
+	kdfID, aeadID uint16
+}
+
+// parseECHConfig reads one ECHConfig from s. Configs of other versions, or
+// with mandatory extensions, are skipped: the result is nil but ok is true.
+func parseECHConfig(s *cryptobyte.String) (config *echConfig, ok bool) {
+	start := *s
+	var version uint16
+	var contents cryptobyte.String
+	if !s.ReadUint16(&version) || !s.ReadUint16LengthPrefixed(&contents) {
+		return nil, false
+	}
+	if version != echConfigVersion {
+		return nil, true
+	}
+	ec := &echConfig{raw: start[:len(start)-len(*s)]}
+	var suites, extensions cryptobyte.String
+	if !contents.ReadUint8(&ec.configID) || !contents.ReadUint16(&ec.kemID) ||
+		!readUint16LengthPrefixed(&contents, &ec.publicKey) || len(ec.publicKey) == 0 ||
+		!contents.ReadUint16LengthPrefixed(&suites) || suites.Empty() {
+		return nil, false
+	}
+	for !suites.Empty() {
+		var cs echCipherSuite
+		if !suites.ReadUint16(&cs.kdfID) || !suites.ReadUint16(&cs.aeadID) {
+			return nil, false
+		}
+		ec.suites = append(ec.suites, cs)
+	}
+	if !contents.ReadUint8(&ec.maxNameLength) ||
+		!readUint8LengthPrefixed(&contents, &ec.publicName) || len(ec.publicName) == 0 ||
+		!contents.ReadUint16LengthPrefixed(&extensions) || !contents.Empty() {
+		return nil, false
+	}
+	mandatory := false
+	for !extensions.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&typ) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, false
+		}
+		mandatory = mandatory || typ&0x8000 != 0
+	}
+	if mandatory {
+		return nil, true
+	}
+	return ec, true
+}
+
+// parseECHConfigList returns the configs of an ECHConfigList this package
+// can use.
+func parseECHConfigList(data []byte) ([]*echConfig, error) {
+	s := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() || list.Empty() {
+		return nil, errMalformedECHConfig
+	}
+	var configs []*echConfig
+	for !list.Empty() {
+		ec, ok := parseECHConfig(&list)
+		if !ok {
+			return nil, errMalformedECHConfig
+		}
+		if ec != nil {
+			configs = append(configs, ec)
+		}
+	}
+	return configs, nil
+}
+
+// hpkeSuite returns the HPKE suite of ec for cs, if ec offers cs and both
+// are supported.
+func (ec *echConfig) hpkeSuite(cs echCipherSuite) (hpke.Suite, bool) {
+	kemID, kdfID, aeadID := hpke.KEM(ec.kemID), hpke.KDF(cs.kdfID), hpke.AEAD(cs.aeadID)
+	if !kemID.IsValid() || !kdfID.IsValid() || !aeadID.IsValid() {
+		return hpke.Suite{}, false
+	}
+	for _, offered := range ec.suites {
+		if offered == cs {
+			return hpke.NewSuite(kemID, kdfID, aeadID), true
+		}
+	}
+	return hpke.Suite{}, false
+}
+
+// info returns the HPKE info string for ec.
+func (ec *echConfig) info() []byte {
+	return append([]byte("tls ech\x00"), ec.raw...)
+}
+
+// echOuterExtension is the encrypted_client_hello extension of a
+// ClientHelloOuter.
+type echOuterExtension struct {
+	suite    echCipherSuite
+	configID uint8
+	enc      []byte
+	payload  []byte
+}
+
+func (e *echOuterExtension) marshal() []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(echClientHelloOuter)
+	b.AddUint16(e.suite.kdfID)
+	b.AddUint16(e.suite.aeadID)
+	b.AddUint8(e.configID)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(e.enc)
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(e.payload)
+	})
+	return b.BytesOrPanic()
+}
+
+// parseECHExtension parses the encrypted_client_hello extension of a
+// ClientHello. It returns nil for the inner extension.
+func parseECHExtension(data []byte) (*echOuterExtension, bool) {
+	s := cryptobyte.String(data)
+	var typ uint8
+	if !s.ReadUint8(&typ) {
+		return nil, false
+	}
+	if typ == echClientHelloInner {
+		return nil, s.Empty()
+	}
+	e := new(echOuterExtension)
+	if typ != echClientHelloOuter ||
+		!s.ReadUint16(&e.suite.kdfID) || !s.ReadUint16(&e.suite.aeadID) ||
+		!s.ReadUint8(&e.configID) ||
+		!readUint16LengthPrefixed(&s, &e.enc) ||
+		!readUint16LengthPrefixed(&s, &e.payload) || len(e.payload) == 0 || !s.Empty() {
+		return nil, false
+	}
+	return e, true
+}
+
+// zeroSubslice returns a copy of b with sub, a subslice of b, zeroed. The
+// offset follows from the capacities, so sub must point into b itself, as
+// fields of an unmarshaled message point into its raw bytes.
+func zeroSubslice(b, sub []byte) ([]byte, error) {
+	off := cap(b) - cap(sub)
+	if len(sub) == 0 || off < 0 || off+len(sub) > len(b) || &b[off] != &sub[0] {
+		return nil, errors.New("tls: internal error: ECH field is not part of its message")
+	}
+	out := append([]byte(nil), b...)
+	clear(out[off : off+len(sub)])
+	return out, nil
+}
+
+// echConfirmation returns the 8-byte ECH acceptance confirmation for the
+// ClientHelloInner random, the transcript so far, and msg, the ServerHello
+// or HelloRetryRequest with the confirmation zeroed.
+func echConfirmation(suite *cipherSuiteTLS13, innerRandom []byte, label string, transcript hash.Hash, msg []byte) []byte {
+	h := cloneHash(transcript, suite.hash)
+	h.Write(msg)
+	return suite.expandLabel(suite.extract(innerRandom, nil), label, h.Sum(nil), 8)
+}
+
+// encodeInnerClientHello returns the EncodedClientHelloInner of inner: the
+// ClientHello body without legacy_session_id, which the server takes from the
+// ClientHelloOuter, padded as in draft-ietf-tls-esni, Section 6.1.3.
+func encodeInnerClientHello(inner *clientHelloMsg, maxNameLength int) []byte {
+	body := inner.marshal()[4:]
+	encoded := append([]byte(nil), body[:2+32]...)
+	encoded = append(encoded, 0)
+	encoded = append(encoded, body[2+32+1+len(inner.sessionId):]...)
+
+	padding := maxNameLength + 9
+	if inner.serverName != "" {
+		padding = max(0, maxNameLength-len(inner.serverName))
+	}
+	padding += 31 - (len(encoded)+padding-1)%32
+	return append(encoded, make([]byte, padding)...)
+}
+
+// decodeInnerClientHello rebuilds the ClientHelloInner from its encoding
+// and the ClientHelloOuter, expanding ech_outer_extensions.
+func decodeInnerClientHello(outer *clientHelloMsg, encoded []byte) (*clientHelloMsg, error) {
+	s := cryptobyte.String(encoded)
+	var vers uint16
+	var random []byte
+	var sessionID, suites, compression, exts cryptobyte.String
+	if !s.ReadUint16(&vers) || !s.ReadBytes(&random, 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || !sessionID.Empty() ||
+		!s.ReadUint16LengthPrefixed(&suites) || !s.ReadUint8LengthPrefixed(&compression) ||
+		!s.ReadUint16LengthPrefixed(&exts) {
+		return nil, errMalformedECHInner
+	}
+	for _, c := range s {
+		if c != 0 {
+			return nil, errMalformedECHInner
+		}
+	}
+	parsedOuter, err := ParseClientHello(outer.marshal())
+	if err != nil {
+		return nil, err
+	}
+	outerExts := parsedOuter.ExtensionList
+
+	ok := true
+	var b cryptobyte.Builder
+	b.AddUint8(typeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(vers)
+		b.AddBytes(random)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(outer.sessionId)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(suites)
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(compression)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			add := func(typ uint16, data []byte) {
+				b.AddUint16(typ)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(data)
+				})
+			}
+			next := 0 // referenced outer extensions must come in order
+			for ok && !exts.Empty() {
+				var typ uint16
+				var data, types cryptobyte.String
+				if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+					ok = false
+					break
+				}
+				if typ != extensionECHOuterExtensions {
+					add(typ, data)
+					continue
+				}
+				if !data.ReadUint8LengthPrefixed(&types) || types.Empty() || !data.Empty() {
+					ok = false
+					break
+				}
+				for ok && !types.Empty() {
+					var ref uint16
+					if !types.ReadUint16(&ref) || ref == extensionEncryptedClientHello {
+						ok = false
+						break
+					}
+					for next < len(outerExts) && outerExts[next].Type != ref {
+						next++
+					}
+					if next == len(outerExts) {
+						ok = false
+						break
+					}
+					add(ref, outerExts[next].Data)
+					next++
+				}
+			}
+		})
+	})
+	raw, err := b.Bytes()
+	if !ok || err != nil {
+		return nil, errMalformedECHInner
+	}
+	inner := new(clientHelloMsg)
+	if !inner.unmarshal(raw) || !bytes.Equal(inner.encryptedClientHello, []byte{echClientHelloInner}) {
+		return nil, errMalformedECHInner
+	}
+	// The ClientHelloInner must only offer TLS 1.3 or later, as ECH doesn't
+	// exist below it.
+	if len(inner.supportedVersions) == 0 {
+		return nil, errors.New("tls: ClientHelloInner does not offer TLS 1.3")
+	}
+	for _, v := range inner.supportedVersions {
+		if v < VersionTLS13 {
+			return nil, errors.New("tls: ClientHelloInner offers a version below TLS 1.3")
+		}
+	}
+	return inner, nil
+}
+
+// echClientContext is the Encrypted Client Hello state of a client.
+type echClientContext struct {
+	config *echConfig
+	suite  echCipherSuite
+	enc    []byte
+	sealer hpke.Sealer
+	// outer is the last ClientHelloOuter sent.
+	outer *clientHelloMsg
+
+	// hrr is set once a HelloRetryRequest told whether the server accepted
+	// ECH, and accepted once it confirmed it did.
+	hrr, accepted bool
+	retryConfigs  []byte
+}
+
+// newECHClientContext picks a config from the client's ECHConfigList and
+// sets up HPKE for it. hello becomes the ClientHelloInner, which offers
+// TLS 1.3 only.
+func newECHClientContext(config *Config, hello *clientHelloMsg) (*echClientContext, error) {
+	configs, err := parseECHConfigList(config.EncryptedClientHelloConfigList)
+	if err != nil {
+		return nil, err
+	}
+	if hello.topVersion() != VersionTLS13 {
+		return nil, errors.New("tls: Encrypted Client Hello requires TLS 1.3")
+	}
+	for _, ec := range configs {
+		for _, cs := range ec.suites {
+			suite, ok := ec.hpkeSuite(cs)
+			if !ok {
+				continue
+			}
+			pk, err := hpke.KEM(ec.kemID).Scheme().UnmarshalBinaryPublicKey(ec.publicKey)
+			if err != nil {
+				break
+			}
+			sender, err := suite.NewSender(pk, ec.info())
+			if err != nil {
+				return nil, err
+			}
+			enc, sealer, err := sender.Setup(config.rand())
+			if err != nil {
+				return nil, err
+			}
+
+			// GREASE versions are above TLS 1.3, and stay.
+			var versions []uint16
+			for _, v := range hello.supportedVersions {
+				if v >= VersionTLS13 {
+					versions = append(versions, v)
+				}
+			}
+			hello.supportedVersions = versions
+			hello.encryptedClientHello = []byte{echClientHelloInner}
+			hello.raw = nil
+			return &echClientContext{config: ec, suite: cs, enc: enc, sealer: sealer}, nil
+		}
+	}
+	return nil, errors.New("tls: no supported config in EncryptedClientHelloConfigList")
+}
+
+// sealOuter builds the ClientHelloOuter carrying inner encrypted. The first
+// one is a copy of inner with a fresh random, the public name as SNI and no
+// PSK. The one sent after a HelloRetryRequest updates it with the new key
+// shares and cookie, and leaves out the encapsulated key.
+func (ech *echClientContext) sealOuter(rand io.Reader, inner *clientHelloMsg) error {
+	var outer clientHelloMsg
+	ext := &echOuterExtension{suite: ech.suite, configID: ech.config.configID}
+	if ech.outer == nil {
+		outer = *inner
+		outer.random = make([]byte, 32)
+		if _, err := io.ReadFull(rand, outer.random); err != nil {
+			return errors.New("tls: short read from Rand: " + err.Error())
+		}
+		outer.serverName = string(ech.config.publicName)
+		outer.pskIdentities, outer.pskBinders = nil, nil
+		outer.earlyData = false
+		ext.enc = ech.enc
+	} else {
+		outer = *ech.outer
+		outer.keyShares, outer.cookie = inner.keyShares, inner.cookie
+	}
+
+	encoded := encodeInnerClientHello(inner, int(ech.config.maxNameLength))
+	ext.payload = make([]byte, hpke.AEAD(ech.suite.aeadID).CipherLen(uint(len(encoded))))
+	outer.encryptedClientHello = ext.marshal()
+	outer.raw = nil
+	payload, err := ech.sealer.Seal(encoded, outer.marshal()[4:])
+	if err != nil {
+		return err
+	}
+	ext.payload = payload
+	outer.encryptedClientHello = ext.marshal()
+	outer.raw = nil
+	ech.outer = &outer
+	return nil
+}
+
+// checkECHHelloRetryRequest learns from the HelloRetryRequest in
+// hs.serverHello whether the server accepted ECH, and falls back to the
+// ClientHelloOuter if not. hs.transcript holds the ClientHelloInner.
+func (hs *clientHandshakeStateTLS13) checkECHHelloRetryRequest() error {
+	ech := hs.echContext
+	if ech == nil {
+		return nil
+	}
+	ech.hrr = true
+	if conf := hs.serverHello.encryptedClientHello; len(conf) == 8 {
+		hrr, err := zeroSubslice(hs.serverHello.marshal(), conf)
+		if err != nil {
+			hs.c.sendAlert(alertInternalError)
+			return err
+		}
+		chHash := hs.transcript.Sum(nil)
+		transcript := hs.suite.hash.New()
+		transcript.Write([]byte{typeMessageHash, 0, 0, uint8(len(chHash))})
+		transcript.Write(chHash)
+		want := echConfirmation(hs.suite, hs.hello.random, echHRRAcceptConfirmationLabel, transcript, hrr)
+		ech.accepted = hmac.Equal(conf, want)
+	}
+	if !ech.accepted {
+		hs.rejectECH()
+	}
+	return nil
+}
+
+// replaceRejectedPayload replaces the ECH payload of the ClientHelloOuter
+// after a HelloRetryRequest that rejected ECH. The server won't decrypt it,
+// so it is filled with random bytes rather than resent stale, and like in any
+// second ClientHelloOuter the encapsulated key is left out.
+func (ech *echClientContext) replaceRejectedPayload(rand io.Reader) error {
+	ext, ok := parseECHExtension(ech.outer.encryptedClientHello)
+	if !ok || ext == nil {
+		return errors.New("tls: internal error: invalid ClientHelloOuter encrypted_client_hello extension")
+	}
+	ext.enc = nil
+	ext.payload = make([]byte, len(ext.payload))
+	if _, err := io.ReadFull(rand, ext.payload); err != nil {
+		return errors.New("tls: short read from Rand: " + err.Error())
+	}
+	ech.outer.encryptedClientHello = ext.marshal()
+	ech.outer.raw = nil
+	return nil
+}
+
+// checkECHServerHello checks the acceptance confirmation in the ServerHello
+// random, and falls back to the ClientHelloOuter if there is none.
+func (hs *clientHandshakeStateTLS13) checkECHServerHello() error {
+	c := hs.c
+	ech := hs.echContext
+	if ech == nil || ech.hrr && !ech.accepted {
+		return nil
+	}
+	conf := hs.serverHello.random[24:]
+	serverHello, err := zeroSubslice(hs.serverHello.marshal(), conf)
+	if err != nil {
+		c.sendAlert(alertInternalError)
+		return err
+	}
+	want := echConfirmation(hs.suite, hs.hello.random, echAcceptConfirmationLabel, hs.transcript, serverHello)
+	if !hmac.Equal(conf, want) {
+		if ech.hrr {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server accepted ECH in its HelloRetryRequest but not in its ServerHello")
+		}
+		hs.rejectECH()
+		return nil
+	}
+	ech.accepted = true
+	c.echAccepted = true
+	return nil
+}
+
+// rejectECH continues the handshake with the ClientHelloOuter, which has no
+// PSK. The server certificate is then verified for the public name.
+func (hs *clientHandshakeStateTLS13) rejectECH() {
+	hs.hello = hs.echContext.outer
+	hs.session, hs.earlySecret, hs.binderKey = nil, nil, nil
+	hs.transcript = hs.suite.hash.New()
+	hs.transcript.Write(hs.hello.marshal())
+	hs.c.echPublicName = string(hs.echContext.config.publicName)
+}
+
+// echServerContext is the state of a server that accepted Encrypted Client
+// Hello, kept to decrypt the ClientHello that follows a HelloRetryRequest.
+type echServerContext struct {
+	opener   hpke.Opener
+	configID uint8
+	suite    echCipherSuite
+}
+
+// processECHClientHello decrypts the ClientHelloInner of outer with the
+// server's ECH keys. It returns nil and no error if no key decrypts it, in
+// which case the handshake goes on with outer.
+func (c *Conn) processECHClientHello(outer *clientHelloMsg) (*clientHelloMsg, *echServerContext, error) {
+	ext, ok := parseECHExtension(outer.encryptedClientHello)
+	if !ok {
+		c.sendAlert(alertDecodeError)
+		return nil, nil, errors.New("tls: malformed encrypted_client_hello extension")
+	}
+	if ext == nil {
+		c.sendAlert(alertIllegalParameter)
+		return nil, nil, errors.New("tls: client sent an inner encrypted_client_hello extension in the clear")
+	}
+	for _, key := range c.config.EncryptedClientHelloKeys {
+		s := cryptobyte.String(key.Config)
+		ec, ok := parseECHConfig(&s)
+		if !ok || ec == nil || !s.Empty() {
+			c.sendAlert(alertInternalError)
+			return nil, nil, errors.New("tls: invalid ECHConfig in EncryptedClientHelloKeys")
+		}
+		if ec.configID != ext.configID {
+			continue
+		}
+		suite, ok := ec.hpkeSuite(ext.suite)
+		if !ok {
+			continue
+		}
+		sk, err := hpke.KEM(ec.kemID).Scheme().UnmarshalBinaryPrivateKey(key.PrivateKey)
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return nil, nil, errors.New("tls: invalid private key in EncryptedClientHelloKeys")
+		}
+		receiver, err := suite.NewReceiver(sk, ec.info())
+		if err != nil {
+			continue
+		}
+		opener, err := receiver.Setup(ext.enc)
+		if err != nil {
+			continue
+		}
+		aad, err := zeroSubslice(outer.marshal(), ext.payload)
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return nil, nil, err
+		}
+		encoded, err := opener.Open(ext.payload, aad[4:])
+		if err != nil {
+			continue
+		}
+		inner, err := decodeInnerClientHello(outer, encoded)
+		if err != nil {
+			c.sendAlert(alertIllegalParameter)
+			return nil, nil, err
+		}
+		return inner, &echServerContext{opener: opener, configID: ec.configID, suite: ext.suite}, nil
+	}
+	return nil, nil, nil
+}
+
+// processECHSecondClientHello decrypts the ClientHelloInner of the
+// ClientHelloOuter sent after a HelloRetryRequest, in the HPKE context of the
+// first.
+func (c *Conn) processECHSecondClientHello(outer *clientHelloMsg) (*clientHelloMsg, error) {
+	ext, ok := parseECHExtension(outer.encryptedClientHello)
+	if !ok || ext == nil || ext.configID != c.ech.configID || ext.suite != c.ech.suite || len(ext.enc) != 0 {
+		c.sendAlert(alertIllegalParameter)
+		return nil, errors.New("tls: client sent an invalid encrypted_client_hello extension in its second ClientHello")
+	}
+	aad, err := zeroSubslice(outer.marshal(), ext.payload)
+	if err != nil {
+		c.sendAlert(alertInternalError)
+		return nil, err
+	}
+	encoded, err := c.ech.opener.Open(ext.payload, aad[4:])
+	if err != nil {
+		c.sendAlert(alertDecryptError)
+		return nil, errors.New("tls: failed to decrypt the second ClientHelloInner")
+	}
+	inner, err := decodeInnerClientHello(outer, encoded)
+	if err != nil {
+		c.sendAlert(alertIllegalParameter)
+		return nil, err
+	}
+	return inner, nil
+}
+
+// echRetryConfigs returns the ECHConfigList of the keys to send as retry
+// configs, or nil.
+func (c *Config) echRetryConfigs() []byte {
+	var configs [][]byte
+	for _, key := range c.EncryptedClientHelloKeys {
+		if key.SendAsRetry {
+			configs = append(configs, key.Config)
+		}
+	}
+	if len(configs) == 0 {
+		return nil
+	}
+	list, err := MarshalECHConfigList(configs...)
+	if err != nil {
+		return nil
+	}
+	return list
+}
+
+// setECHAcceptConfirmation puts the acceptance confirmation in the last 8
+// bytes of the ServerHello random. hs.transcript holds the messages through
+// the ClientHelloInner.
+func (hs *serverHandshakeStateTLS13) setECHAcceptConfirmation() {
+	conf := hs.hello.random[24:]
+	copy(conf, make([]byte, 8))
+	hs.hello.raw = nil
+	copy(conf, echConfirmation(hs.suite, hs.clientHello.random, echAcceptConfirmationLabel,
+		hs.transcript, hs.hello.marshal()))
+	hs.hello.raw = nil
+}
+
+// setECHHelloRetryRequestConfirmation adds the acceptance confirmation to a
+// HelloRetryRequest. hs.transcript holds the hash of the ClientHelloInner.
+func (hs *serverHandshakeStateTLS13) setECHHelloRetryRequestConfirmation(hrr *serverHelloMsg) {
+	hrr.encryptedClientHello = make([]byte, 8)
+	hrr.raw = nil
+	hrr.encryptedClientHello = echConfirmation(hs.suite, hs.clientHello.random, echHRRAcceptConfirmationLabel,
+		hs.transcript, hrr.marshal())
+	hrr.raw = nil
+}
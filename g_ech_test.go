@@ -0,0 +1,304 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// addTestECH makes client encrypt its ClientHello to secret.example, and
+// gives server the matching key and a certificate for certNames instead of
+// its own.
+func addTestECH(t *testing.T, client, server *Config, certNames ...string) {
+	t.Helper()
+	key, err := NewEncryptedClientHelloKey(7, "public.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := MarshalECHConfigList(key.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, roots := newTestCertificate(certNames...)
+	client.ServerName = "secret.example"
+	client.RootCAs = roots
+	client.EncryptedClientHelloConfigList = list
+	server.Certificates = []Certificate{cert}
+	server.EncryptedClientHelloKeys = []EncryptedClientHelloKey{key}
+}
+
+// echHandshake runs a handshake like testHandshake, and also returns the
+// ClientHello as it went over the wire.
+func echHandshake(t *testing.T, clientConfig, serverConfig *Config) (wire *ParsedClientHello, cs, ss ConnectionState, err error) {
+	t.Helper()
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	type result struct {
+		wire  *ParsedClientHello
+		state ConnectionState
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		peeked, replay, err := PeekClientHello(s, &ClientHelloPeekOptions{Config: serverConfig})
+		if err != nil {
+			s.Close()
+			done <- result{err: err}
+			return
+		}
+		srv := Server(replay, serverConfig)
+		if err := srv.Handshake(); err != nil {
+			s.Close()
+			done <- result{wire: peeked.Hello, err: err}
+			return
+		}
+		done <- result{wire: peeked.Hello, state: srv.ConnectionState()}
+	}()
+	cli := Client(c, clientConfig)
+	err = cli.Handshake()
+	if err != nil {
+		c.Close()
+	}
+	r := <-done
+	if err == nil {
+		err = r.err
+	}
+	return r.wire, cli.ConnectionState(), r.state, err
+}
+
+func TestECHAccepted(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		setup func(client, server *Config)
+	}{
+		{"Plain", func(client, server *Config) {}},
+		{"HelloRetryRequest", func(client, server *Config) {
+			server.CurvePreferences = []CurveID{CurveP384}
+		}},
+		{"GREASE", func(client, server *Config) {
+			client.GREASE = true
+		}},
+		{"ClientHelloSpec", func(client, server *Config) {
+			client.ClientHelloSpec = chromeLikeSpec()
+			server.CurvePreferences = []CurveID{CurveP256}
+		}},
+		{"Gaseous", func(client, server *Config) {
+			client.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true}
+			server.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig, serverConfig := testConfigs(t)
+			addTestECH(t, clientConfig, serverConfig, "secret.example")
+			clientConfig.NextProtos = []string{"h2"}
+			serverConfig.NextProtos = []string{"h2"}
+			tt.setup(clientConfig, serverConfig)
+			var inner *ClientHelloInfo
+			serverConfig.GetConfigForClient = func(info *ClientHelloInfo) (*Config, error) {
+				inner = info
+				return nil, nil
+			}
+			wire, cs, ss, err := echHandshake(t, clientConfig, serverConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cs.ECHAccepted || !ss.ECHAccepted {
+				t.Errorf("ECHAccepted = %v on the client, %v on the server", cs.ECHAccepted, ss.ECHAccepted)
+			}
+			if wire.SNI != "public.example" || wire.Extensions[extensionEncryptedClientHello] == nil {
+				t.Errorf("ClientHelloOuter has SNI %q, extensions %v", wire.SNI, wire.ExtensionIDs())
+			}
+			if inner.ServerName != "secret.example" || ss.ServerName != "secret.example" {
+				t.Errorf("server saw SNI %q, state %q", inner.ServerName, ss.ServerName)
+			}
+			if cs.NegotiatedProtocol != "h2" || cs.Version != VersionTLS13 {
+				t.Errorf("got protocol %q, version %x", cs.NegotiatedProtocol, cs.Version)
+			}
+		})
+	}
+}
+
+func TestECHResumption(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	addTestECH(t, clientConfig, serverConfig, "secret.example")
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+	for i := 0; i < 2; i++ {
+		cs, _, err := testHandshake(t, clientConfig, serverConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cs.ECHAccepted || cs.DidResume != (i == 1) {
+			t.Errorf("handshake %d: ECHAccepted = %v, DidResume = %v", i, cs.ECHAccepted, cs.DidResume)
+		}
+	}
+}
+
+func TestECHRejected(t *testing.T) {
+	for _, hrr := range []bool{false, true} {
+		clientConfig, serverConfig := testConfigs(t)
+		addTestECH(t, clientConfig, serverConfig, "public.example")
+		// Same config ID, another key: the server can't decrypt.
+		retryKey, err := NewEncryptedClientHelloKey(7, "public.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		retryKey.SendAsRetry = true
+		serverConfig.EncryptedClientHelloKeys = []EncryptedClientHelloKey{retryKey}
+		if hrr {
+			serverConfig.CurvePreferences = []CurveID{CurveP384}
+		}
+		var sni string
+		serverConfig.GetConfigForClient = func(info *ClientHelloInfo) (*Config, error) {
+			sni = info.ServerName
+			return nil, nil
+		}
+
+		_, cs, _, err := echHandshake(t, clientConfig, serverConfig)
+		var rejection *ECHRejectionError
+		if !errors.As(err, &rejection) {
+			t.Fatalf("hrr=%v: got error %v, want an ECHRejectionError", hrr, err)
+		}
+		want, _ := MarshalECHConfigList(retryKey.Config)
+		if !bytes.Equal(rejection.RetryConfigList, want) {
+			t.Errorf("hrr=%v: got retry configs %x, want %x", hrr, rejection.RetryConfigList, want)
+		}
+		if sni != "public.example" || cs.ECHAccepted {
+			t.Errorf("hrr=%v: server saw SNI %q, ECHAccepted = %v", hrr, sni, cs.ECHAccepted)
+		}
+
+		// The retry configs work on a new connection.
+		clientConfig.EncryptedClientHelloConfigList = rejection.RetryConfigList
+		cert, roots := newTestCertificate("secret.example")
+		clientConfig.RootCAs = roots
+		serverConfig.Certificates = []Certificate{cert}
+		if cs, _, err := testHandshake(t, clientConfig, serverConfig); err != nil || !cs.ECHAccepted {
+			t.Errorf("hrr=%v: retry: ECHAccepted = %v, err = %v", hrr, cs.ECHAccepted, err)
+		}
+	}
+}
+
+func TestECHRejectedRetryPayload(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	addTestECH(t, clientConfig, serverConfig, "secret.example")
+	c := Client(nil, clientConfig)
+	hello, _, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ech, err := newECHClientContext(clientConfig, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ech.sealOuter(rand.Reader, hello); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := parseECHExtension(ech.outer.encryptedClientHello)
+	if err := ech.replaceRejectedPayload(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	second, ok := parseECHExtension(ech.outer.encryptedClientHello)
+	if !ok || second == nil || len(second.enc) != 0 {
+		t.Fatal("second ClientHelloOuter has an invalid or keyed ECH extension")
+	}
+	if len(second.payload) != len(first.payload) || bytes.Equal(second.payload, first.payload) {
+		t.Error("ECH payload was not replaced")
+	}
+}
+
+func TestECHRejectedWithoutKeys(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	addTestECH(t, clientConfig, serverConfig, "public.example")
+	serverConfig.EncryptedClientHelloKeys = nil
+	_, _, err := testHandshake(t, clientConfig, serverConfig)
+	var rejection *ECHRejectionError
+	if !errors.As(err, &rejection) || rejection.RetryConfigList != nil {
+		t.Errorf("got error %v, want an ECHRejectionError without retry configs", err)
+	}
+
+	// The rejection must be authenticated for the public name.
+	clientConfig, serverConfig = testConfigs(t)
+	addTestECH(t, clientConfig, serverConfig, "secret.example")
+	serverConfig.EncryptedClientHelloKeys = nil
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil || errors.As(err, &rejection) {
+		t.Errorf("got error %v, want a certificate error", err)
+	}
+}
+
+func TestECHConfigList(t *testing.T) {
+	key, err := NewEncryptedClientHelloKey(1, "public.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := []byte{0xfe, 0x0c, 0, 1, 0} // another version, skipped
+	list, err := MarshalECHConfigList(unknown, key.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := parseECHConfigList(list)
+	if err != nil || len(configs) != 1 {
+		t.Fatalf("got %d configs, %v", len(configs), err)
+	}
+	if ec := configs[0]; ec.configID != 1 || string(ec.publicName) != "public.example" ||
+		!bytes.Equal(ec.raw, key.Config) || len(ec.suites) != 2 {
+		t.Errorf("got config %+v", ec)
+	}
+	for _, bad := range [][]byte{nil, {0, 0}, list[:len(list)-1], append(list, 0)} {
+		if _, err := parseECHConfigList(bad); err == nil {
+			t.Errorf("parsed malformed list %x", bad)
+		}
+	}
+
+	clientConfig, serverConfig := testConfigs(t)
+	addTestECH(t, clientConfig, serverConfig, "secret.example")
+	clientConfig.EncryptedClientHelloConfigList = list[:len(list)-1]
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil {
+		t.Error("handshake succeeded with a malformed ECHConfigList")
+	}
+	clientConfig.EncryptedClientHelloConfigList = list
+	clientConfig.MaxVersion = VersionTLS12
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil {
+		t.Error("handshake succeeded with ECH and TLS 1.2")
+	}
+}
+
+func TestECHInnerEncoding(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	addTestECH(t, clientConfig, serverConfig, "secret.example")
+	c := Client(nil, clientConfig)
+	hello, _, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ech, err := newECHClientContext(clientConfig, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ech.sealOuter(rand.Reader, hello); err != nil {
+		t.Fatal(err)
+	}
+	encoded := encodeInnerClientHello(hello, 0)
+	if len(encoded)%32 != 0 {
+		t.Errorf("EncodedClientHelloInner is %d bytes, not a multiple of 32", len(encoded))
+	}
+	inner, err := decodeInnerClientHello(ech.outer, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(inner.marshal(), hello.marshal()) {
+		t.Error("decoded ClientHelloInner differs")
+	}
+	if _, err := decodeInnerClientHello(ech.outer, append(encoded, 1)); err == nil {
+		t.Error("decoded a ClientHelloInner with non-zero padding")
+	}
+
+	for _, versions := range [][]uint16{nil, {VersionTLS13, VersionTLS12}} {
+		bad := *hello
+		bad.raw = nil
+		bad.supportedVersions = versions
+		if _, err := decodeInnerClientHello(ech.outer, encodeInnerClientHello(&bad, 0)); err == nil {
+			t.Errorf("decoded a ClientHelloInner offering versions %x", versions)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package tls
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ========== JA3 / JA4 指纹 ==========
+
+// ClientHelloFingerprints holds the JA3 and JA4 fingerprints of a
+// ClientHello. GREASE values are left out, as both specifications require.
+type ClientHelloFingerprints struct {
+	// JA3 is the JA3 string, "SSLVersion,Ciphers,Extensions,
+	// EllipticCurves,EllipticCurvePointFormats", and JA3Hash its MD5 in hex.
+	JA3     string
+	JA3Hash string
+	// JA4 is the JA4 fingerprint, such as "t13d1516h2_8daaf6152771_e5627efa2ab1",
+	// and JA4R its raw, unhashed form (JA4_r).
+	JA4  string
+	JA4R string
+}
+
+// ServerHelloFingerprints holds the JA3S and JA4S fingerprints of a
+// ServerHello.
+type ServerHelloFingerprints struct {
+	// JA3S is the JA3S string, "SSLVersion,Cipher,Extensions", and
+	// JA3SHash its MD5 in hex.
+	JA3S     string
+	JA3SHash string
+	// JA4S is the JA4S fingerprint, and JA4SR its raw form (JA4S_r).
+	JA4S  string
+	JA4SR string
+}
+
+// FingerprintClientHello computes the JA3 and JA4 fingerprints of a
+// ClientHello handshake message, with or without a TLS record header, sent
+// over TCP.
+func FingerprintClientHello(hello []byte) (*ClientHelloFingerprints, error) {
+	p, err := ParseClientHello(hello)
+	if err != nil {
+		return nil, err
+	}
+	return p.Fingerprints(), nil
+}
+
+// FingerprintServerHello computes the JA3S and JA4S fingerprints of a
+// ServerHello handshake message, with or without a TLS record header, sent
+// over TCP.
+func FingerprintServerHello(hello []byte) (*ServerHelloFingerprints, error) {
+	p, err := ParseServerHello(hello)
+	if err != nil {
+		return nil, err
+	}
+	return p.Fingerprints(), nil
+}
+
+// Fingerprints returns the JA3 and JA4 fingerprints of h, assuming TCP.
+func (h *ParsedClientHello) Fingerprints() *ClientHelloFingerprints {
+	return h.fingerprints('t')
+}
+
+// fingerprints computes the fingerprints of h. proto is the JA4 transport:
+// 't' for TCP, 'q' for QUIC or 'd' for DTLS.
+func (h *ParsedClientHello) fingerprints(proto byte) *ClientHelloFingerprints {
+	ja3 := h.ja3()
+	ja4, ja4r := h.ja4(proto)
+	return &ClientHelloFingerprints{JA3: ja3, JA3Hash: md5Hex(ja3), JA4: ja4, JA4R: ja4r}
+}
+
+// Fingerprints returns the JA3S and JA4S fingerprints of h, assuming TCP.
+func (h *ParsedServerHello) Fingerprints() *ServerHelloFingerprints {
+	return h.fingerprints('t')
+}
+
+func (h *ParsedServerHello) fingerprints(proto byte) *ServerHelloFingerprints {
+	ja3s := h.ja3s()
+	ja4s, ja4sr := h.ja4s(proto)
+	return &ServerHelloFingerprints{JA3S: ja3s, JA3SHash: md5Hex(ja3s), JA4S: ja4s, JA4SR: ja4sr}
+}
+
+func (h *ParsedClientHello) ja3() string {
+	var groups []uint16
+	for _, g := range h.SupportedGroups {
+		groups = append(groups, uint16(g))
+	}
+	points := make([]string, len(h.SupportedPoints))
+	for i, p := range h.SupportedPoints {
+		points[i] = strconv.Itoa(int(p))
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		ja3List(h.CipherSuites),
+		ja3List(h.ExtensionIDs()),
+		ja3List(groups),
+		strings.Join(points, "-"),
+	}, ",")
+}
+
+func (h *ParsedServerHello) ja3s() string {
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		strconv.Itoa(int(h.CipherSuite)),
+		ja3List(h.ExtensionOrder),
+	}, ",")
+}
+
+// ja3List formats values as decimal, dash-separated, leaving out GREASE.
+func ja3List(values []uint16) string {
+	var out []string
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(out, "-")
+}
+
+func (h *ParsedClientHello) ja4(proto byte) (hashed, raw string) {
+	vers := h.Version
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > vers {
+			vers = v
+		}
+	}
+	sni := byte('i')
+	if _, ok := h.Extensions[extensionServerName]; ok {
+		sni = 'd'
+	}
+	suites := ja4HexList(h.CipherSuites, nil)
+	exts := ja4HexList(h.ExtensionIDs(), nil)
+	alpn := ""
+	if len(h.ALPN) > 0 {
+		alpn = h.ALPN[0]
+	}
+	a := fmt.Sprintf("%c%s%c%02d%02d%s", proto, ja4Version(vers), sni,
+		min(len(suites), 99), min(len(exts), 99), ja4ALPN(alpn))
+
+	// The cipher suites and extensions are sorted, so that shuffling
+	// doesn't change the fingerprint. SNI and ALPN are already in part a.
+	sort.Strings(suites)
+	exts = ja4HexList(h.ExtensionIDs(), []uint16{extensionServerName, extensionALPN})
+	sort.Strings(exts)
+	var sigalgs []uint16
+	for _, s := range h.SignatureAlgorithms {
+		sigalgs = append(sigalgs, uint16(s))
+	}
+	c := strings.Join(exts, ",")
+	if algs := ja4HexList(sigalgs, nil); len(algs) > 0 {
+		c += "_" + strings.Join(algs, ",")
+	}
+	b := strings.Join(suites, ",")
+	raw = a + "_" + b + "_" + c
+	if len(exts) == 0 {
+		c = ""
+	}
+	return a + "_" + ja4Hash(b) + "_" + ja4Hash(c), raw
+}
+
+func (h *ParsedServerHello) ja4s(proto byte) (hashed, raw string) {
+	exts := ja4HexList(h.ExtensionOrder, nil)
+	a := fmt.Sprintf("%c%s%02d%s", proto, ja4Version(h.NegotiatedVersion()),
+		min(len(exts), 99), ja4ALPN(h.ALPN))
+	b := fmt.Sprintf("%04x", h.CipherSuite)
+	c := strings.Join(exts, ",")
+	return a + "_" + b + "_" + ja4Hash(c), a + "_" + b + "_" + c
+}
+
+// ja4HexList formats values as 4-digit hex, leaving out GREASE and skip.
+func ja4HexList(values []uint16, skip []uint16) []string {
+	var out []string
+values:
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		for _, s := range skip {
+			if v == s {
+				continue values
+			}
+		}
+		out = append(out, fmt.Sprintf("%04x", v))
+	}
+	return out
+}
+
+func ja4Version(vers uint16) string {
+	switch vers {
+	case VersionTLS13:
+		return "13"
+	case VersionTLS12:
+		return "12"
+	case VersionTLS11:
+		return "11"
+	case VersionTLS10:
+		return "10"
+	case VersionSSL30:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xfeff:
+		return "d1"
+	case 0xfefd:
+		return "d2"
+	case 0xfefc:
+		return "d3"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last characters of an ALPN protocol, or of
+// its hex encoding if either is not alphanumeric, or "00" if there is none.
+func ja4ALPN(proto string) string {
+	if proto == "" {
+		return "00"
+	}
+	first, last := proto[0], proto[len(proto)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte(proto))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// ja4Hash returns the first 12 hex digits of the SHA-256 of s, or twelve
+// zeroes if s is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
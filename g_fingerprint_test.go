@@ -0,0 +1,148 @@
+package tls
+
+import (
+	"bytes"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ja4ExampleHello builds the ClientHello of the JA4 specification's example,
+// t13d1516h2_8daaf6152771_e5627efa2ab1, with GREASE values added.
+func ja4ExampleHello() []byte {
+	suites := []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+		0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	u16s := func(vs ...uint16) []byte {
+		var b []byte
+		for _, v := range vs {
+			b = append(b, byte(v>>8), byte(v))
+		}
+		return b
+	}
+	sigalgs := u16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)
+	exts := []struct {
+		typ  uint16
+		data []byte
+	}{
+		{0x2a2a, nil},
+		{0x0000, append([]byte{0, 14, 0, 0, 11}, "example.com"...)},
+		{0x0017, nil},
+		{0xff01, []byte{0}},
+		{0x000a, append([]byte{0, 6}, u16s(0x3a3a, 0x001d, 0x0017)...)},
+		{0x000b, []byte{1, 0}},
+		{0x0023, nil},
+		{0x0010, []byte{0, 3, 2, 'h', '2'}},
+		{0x0005, []byte{1, 0, 0, 0, 0}},
+		{0x000d, append([]byte{0, byte(len(sigalgs))}, sigalgs...)},
+		{0x0012, nil},
+		{0x0033, []byte{0, 5, 0x3a, 0x3a, 0, 1, 0}},
+		{0x002d, []byte{1, 1}},
+		{0x002b, append([]byte{4}, u16s(0x5a5a, 0x0304)...)},
+		{0x001b, []byte{2, 0, 2}},
+		{0x4469, []byte{0, 3, 2, 'h', '2'}},
+		{0x0015, make([]byte, 10)},
+	}
+	var b cryptobyte.Builder
+	b.AddUint8(typeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(VersionTLS12)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(u16s(suites...))
+		})
+		b.AddBytes([]byte{1, 0})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, ext := range exts {
+				b.AddUint16(ext.typ)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(ext.data)
+				})
+			}
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func TestFingerprintClientHello(t *testing.T) {
+	fp, err := FingerprintClientHello(ja4ExampleHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "t13d1516h2_8daaf6152771_e5627efa2ab1"; fp.JA4 != want {
+		t.Errorf("JA4 = %s, want %s", fp.JA4, want)
+	}
+	if want := "t13d1516h2_002f,0035,009c,009d,1301,1302,1303,c013,c014,c02b,c02c,c02f,c030,cca8,cca9_" +
+		"0005,000a,000b,000d,0012,0015,0017,001b,0023,002b,002d,0033,4469,ff01_" +
+		"0403,0804,0401,0503,0805,0501,0806,0601"; fp.JA4R != want {
+		t.Errorf("JA4_r = %s, want %s", fp.JA4R, want)
+	}
+	if want := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23,0"; fp.JA3 != want {
+		t.Errorf("JA3 = %s, want %s", fp.JA3, want)
+	}
+	if fp.JA3Hash != md5Hex(fp.JA3) || len(fp.JA3Hash) != 32 {
+		t.Errorf("JA3 hash %s", fp.JA3Hash)
+	}
+
+	// Chrome shuffles its extensions; JA4 doesn't change, JA3 does.
+	seen := make(map[string]bool)
+	var ja4 string
+	for i := 0; i < 8; i++ {
+		uc := utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloChrome_120)
+		if err := uc.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		fp, err := FingerprintClientHello(uc.HandshakeState.Hello.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ja4 != "" && fp.JA4 != ja4 {
+			t.Errorf("JA4 changed with extension order: %s, %s", ja4, fp.JA4)
+		}
+		ja4 = fp.JA4
+		seen[fp.JA3] = true
+	}
+	if len(seen) < 2 {
+		t.Error("JA3 did not change with extension order")
+	}
+}
+
+func TestFingerprintServerHello(t *testing.T) {
+	m := &serverHelloMsg{
+		vers:             VersionTLS12,
+		random:           bytes.Repeat([]byte{1}, 32),
+		cipherSuite:      TLS_AES_128_GCM_SHA256,
+		supportedVersion: VersionTLS13,
+		serverShare:      keyShare{group: X25519, data: bytes.Repeat([]byte{3}, 32)},
+	}
+	fp, err := FingerprintServerHello(m.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "771,4865,43-51"; fp.JA3S != want {
+		t.Errorf("JA3S = %s, want %s", fp.JA3S, want)
+	}
+	if want := "t130200_1301_002b,0033"; fp.JA4SR != want {
+		t.Errorf("JA4S_r = %s, want %s", fp.JA4SR, want)
+	}
+	if want := "t130200_1301_" + ja4Hash("002b,0033"); fp.JA4S != want {
+		t.Errorf("JA4S = %s, want %s", fp.JA4S, want)
+	}
+}
+
+func TestClientHelloInfoFingerprints(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	var got *ClientHelloFingerprints
+	serverConfig.GetConfigForClient = func(chi *ClientHelloInfo) (*Config, error) {
+		got = chi.Fingerprints
+		return nil, nil
+	}
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.JA4[:4] != "t13d" || got.JA3Hash == "" {
+		t.Errorf("ClientHelloInfo.Fingerprints = %+v", got)
+	}
+}
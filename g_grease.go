@@ -0,0 +1,168 @@
+package tls
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ========== GREASE ==========
+
+// greaseExtensionOrder is the order of the extensions between the two GREASE
+// extensions of a Config.GREASE ClientHello. cookie and pre_shared_key come
+// after the second one.
+var greaseExtensionOrder = []uint16{
+	extensionServerName, extensionStatusRequest, extensionSupportedCurves,
+	extensionSupportedPoints, extensionSessionTicket, extensionSignatureAlgorithms,
+	extensionSignatureAlgorithmsCert, extensionRenegotiationInfo,
+	extensionExtendedMasterSecret, extensionALPN, extensionSCT,
+	extensionCompressCertificate, extensionRecordSizeLimit,
+	extensionSupportedVersions, extensionKeyShare, extensionEarlyData,
+	extensionPSKModes, extensionPostHandshakeAuth,
+}
+
+// injectGREASE adds GREASE values to hello the way Chrome does: first in the
+// cipher suites, supported groups, key shares and supported versions, and as
+// an empty first extension and a one-byte last extension.
+func injectGREASE(hello *clientHelloMsg, grease *helloGREASE) {
+	hello.cipherSuites = append([]uint16{grease[greaseCipher]}, hello.cipherSuites...)
+	hello.supportedCurves = append([]CurveID{CurveID(grease[greaseGroup])}, hello.supportedCurves...)
+	hello.supportedVersions = append([]uint16{grease[greaseVersion]}, hello.supportedVersions...)
+	if len(hello.keyShares) > 0 {
+		hello.keyShares = append([]keyShare{{group: CurveID(grease[greaseGroup]), data: []byte{0}}}, hello.keyShares...)
+	}
+	exts := []clientHelloExtension{{typ: grease[greaseExtension1], data: []byte{}, raw: true}}
+	for _, typ := range greaseExtensionOrder {
+		exts = append(exts, clientHelloExtension{typ: typ})
+	}
+	hello.extensions = append(exts, clientHelloExtension{typ: grease[greaseExtension2], data: []byte{0}, raw: true})
+}
+
+// isGREASEALPN reports whether proto is a GREASE ALPN identifier, two bytes
+// of the form 0x?A?A.
+func isGREASEALPN(proto string) bool {
+	return len(proto) == 2 && isGREASE(uint16(proto[0])<<8|uint16(proto[1]))
+}
+
+// errGREASECount is returned when GREASE values don't fit a rebuilt
+// ClientHello.
+var errGREASECount = errors.New("gaseous: GREASE values don't fit the rebuilt ClientHello")
+
+// clientHelloGREASEValues returns the GREASE values of a ClientHello, in the
+// order rewriteClientHelloGREASE visits them.
+func clientHelloGREASEValues(hello []byte) []uint16 {
+	var values []uint16
+	rewriteClientHelloGREASE(append([]byte(nil), hello...), func(v uint16) uint16 {
+		values = append(values, v)
+		return v
+	})
+	return values
+}
+
+// greaseParams returns the GREASE values of hello for params, if a hello
+// rebuilt from params has GREASE values in as many places, or nil.
+func greaseParams(hello []byte, params *GaseousClientHelloParams) []uint16 {
+	values := clientHelloGREASEValues(hello)
+	if len(values) == 0 {
+		return nil
+	}
+	rebuilt, err := buildUTLSClientHello(params)
+	if err != nil || len(clientHelloGREASEValues(rebuilt)) != len(values) {
+		return nil
+	}
+	return values
+}
+
+// setClientHelloGREASE returns a copy of hello with its GREASE values
+// replaced, in order, by values.
+func setClientHelloGREASE(hello []byte, values []uint16) ([]byte, error) {
+	out := append([]byte(nil), hello...)
+	i := 0
+	ok := rewriteClientHelloGREASE(out, func(v uint16) uint16 {
+		if i < len(values) {
+			v = values[i]
+		}
+		i++
+		return v
+	})
+	if !ok || i != len(values) {
+		return nil, errGREASECount
+	}
+	return out, nil
+}
+
+// rewriteClientHelloGREASE calls f for each GREASE value of a ClientHello
+// handshake message, in wire order, and replaces the value in place with the
+// one f returns. A record header is skipped. It looks at the cipher suites,
+// the extension types, and the supported groups, key share groups, supported
+// versions and signature algorithms. It reports whether hello was
+// well-formed.
+func rewriteClientHelloGREASE(hello []byte, f func(uint16) uint16) bool {
+	if len(hello) >= recordHeaderLen && hello[0] == byte(recordTypeHandshake) {
+		hello = hello[recordHeaderLen:]
+	}
+	// Offsets within hello follow from the capacity of the substrings.
+	visit := func(s *cryptobyte.String) bool {
+		off := cap(hello) - cap(*s)
+		var v uint16
+		if !s.ReadUint16(&v) {
+			return false
+		}
+		if isGREASE(v) {
+			binary.BigEndian.PutUint16(hello[off:], f(v))
+		}
+		return true
+	}
+	visitList := func(s cryptobyte.String) bool {
+		for !s.Empty() {
+			if !visit(&s) {
+				return false
+			}
+		}
+		return true
+	}
+
+	s := cryptobyte.String(hello)
+	var sessionID, compression, suites, exts cryptobyte.String
+	if !s.Skip(4+2+32) || !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&suites) || !visitList(suites) ||
+		!s.ReadUint8LengthPrefixed(&compression) {
+		return false
+	}
+	if s.Empty() {
+		return true
+	}
+	if !s.ReadUint16LengthPrefixed(&exts) {
+		return false
+	}
+	for !exts.Empty() {
+		typ := exts
+		var ext, list cryptobyte.String
+		var t uint16
+		if !typ.ReadUint16(&t) || !visit(&exts) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return false
+		}
+		switch t {
+		case extensionSupportedCurves, extensionSignatureAlgorithms, extensionSignatureAlgorithmsCert:
+			if !ext.ReadUint16LengthPrefixed(&list) || !visitList(list) {
+				return false
+			}
+		case extensionSupportedVersions:
+			if !ext.ReadUint8LengthPrefixed(&list) || !visitList(list) {
+				return false
+			}
+		case extensionKeyShare:
+			if !ext.ReadUint16LengthPrefixed(&list) {
+				return false
+			}
+			for !list.Empty() {
+				var data cryptobyte.String
+				if !visit(&list) || !list.ReadUint16LengthPrefixed(&data) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package tls
+
+import (
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestGREASEHandshake(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		for _, gaseous := range []bool{false, true} {
+			clientConfig, serverConfig := testConfigs(t)
+			clientConfig.GREASE = true
+			clientConfig.NextProtos = []string{"h2"}
+			serverConfig.NextProtos = []string{"h2"}
+			serverConfig.MaxVersion = vers
+			if gaseous {
+				clientConfig.Gaseous = &GaseousConfig{ClientHello: true}
+				serverConfig.Gaseous = &GaseousConfig{ClientHello: true}
+			}
+			var info *ClientHelloInfo
+			serverConfig.GetConfigForClient = func(chi *ClientHelloInfo) (*Config, error) {
+				info = chi
+				return nil, nil
+			}
+			cs, _, err := testHandshake(t, clientConfig, serverConfig)
+			if err != nil {
+				t.Fatalf("%x, gaseous=%v: %v", vers, gaseous, err)
+			}
+			if cs.Version != vers || cs.NegotiatedProtocol != "h2" {
+				t.Errorf("%x: got version %x, protocol %q", vers, cs.Version, cs.NegotiatedProtocol)
+			}
+			if info.ViaGaseous != gaseous {
+				t.Errorf("%x: ViaGaseous = %v", vers, info.ViaGaseous)
+			}
+			p, err := ParseClientHello(info.Raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g := p.GREASE
+			if !g.CipherSuites || !g.SupportedGroups || !g.KeyShares || !g.SupportedVersions || !g.Extensions {
+				t.Errorf("%x, gaseous=%v: missing GREASE: %+v", vers, gaseous, g)
+			}
+			if ids := p.ExtensionIDs(); !isGREASE(ids[0]) || !isGREASE(ids[len(ids)-1]) || ids[0] == ids[len(ids)-1] {
+				t.Errorf("GREASE extensions not first and last: %x", ids)
+			}
+		}
+	}
+}
+
+func TestNegotiateALPNGREASE(t *testing.T) {
+	if proto, err := negotiateALPN([]string{"h2"}, []string{"\x0a\x0a"}); proto != "" || err != nil {
+		t.Errorf("GREASE-only ALPN: got %q, %v", proto, err)
+	}
+	if proto, err := negotiateALPN([]string{"h2"}, []string{"\x1a\x1a", "h2"}); proto != "h2" || err != nil {
+		t.Errorf("got %q, %v, want h2", proto, err)
+	}
+}
+
+func TestGaseousGREASE(t *testing.T) {
+	// Chrome 58 has no key shares, so its hello is rebuilt exactly.
+	uc := utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloChrome_58)
+	if err := uc.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	hello := uc.HandshakeState.Hello.Raw
+	want := clientHelloGREASEValues(hello)
+	if len(want) == 0 {
+		t.Fatal("Chrome ClientHello has no GREASE values")
+	}
+	frame, err := PackRawClientHelloGaseous(hello, utls.HelloChrome_58, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if templID := uint16(frame[6])<<8 | uint16(frame[7]); templID != 0xffff {
+		t.Fatalf("ClientHello not sent in fingerprint mode, TemplID %x", templID)
+	}
+	got, err := UnpackClientHelloGaseous(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := clientHelloGREASEValues(got)
+	if len(values) != len(want) {
+		t.Fatalf("got GREASE values %x, want %x", values, want)
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Fatalf("got GREASE values %x, want %x", values, want)
+		}
+	}
+
+	if _, err := setClientHelloGREASE(hello, want[1:]); err != errGREASECount {
+		t.Errorf("too few GREASE values: got %v", err)
+	}
+}
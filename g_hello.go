@@ -0,0 +1,657 @@
+package tls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ========== Hello 解析 ==========
+
+// HelloParseError reports a malformed hello message.
+type HelloParseError struct {
+	// Message is the message being parsed, such as "ClientHello".
+	Message string
+	// Field names the field that could not be read.
+	Field string
+	// Offset is the byte offset of Field in the input, counting the record
+	// header if one was given.
+	Offset int
+}
+
+func (e *HelloParseError) Error() string {
+	return fmt.Sprintf("tls: malformed %s: bad %s at offset %d", e.Message, e.Field, e.Offset)
+}
+
+// helloParser tracks the input of a hello parser so that errors can report
+// offsets. cryptobyte only ever reslices its input, so the offset of any
+// cryptobyte.String read from data is the difference of their capacities.
+type helloParser struct {
+	message string
+	data    []byte
+}
+
+func (p *helloParser) errorAt(s cryptobyte.String, field string) error {
+	return &HelloParseError{Message: p.message, Field: field, Offset: cap(p.data) - cap(s)}
+}
+
+// handshakeBody strips an optional TLS record header and the handshake
+// header of a message of type typ, and returns the message body and the bytes
+// that follow it, within the record if there is one.
+func (p *helloParser) handshakeBody(typ uint8) (body, rest cryptobyte.String, err error) {
+	s := cryptobyte.String(p.data)
+	if len(p.data) >= 5 && p.data[0] == byte(recordTypeHandshake) && p.data[1] == 0x03 {
+		var record cryptobyte.String
+		s.Skip(3) // type and legacy version
+		start := s
+		if !s.ReadUint16LengthPrefixed(&record) {
+			return nil, nil, p.errorAt(start, "record length")
+		}
+		s = record
+	}
+	var msgType uint8
+	start := s
+	if !s.ReadUint8(&msgType) || msgType != typ {
+		return nil, nil, p.errorAt(start, "handshake type")
+	}
+	start = s
+	if !s.ReadUint24LengthPrefixed(&body) {
+		return nil, nil, p.errorAt(start, "handshake length")
+	}
+	return body, s, nil
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values of RFC 8701,
+// used for cipher suites, extensions, groups, signature algorithms and
+// versions.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// isGREASEUint8 reports whether v is a GREASE psk_key_exchange_modes value.
+func isGREASEUint8(v uint8) bool {
+	return v%0x1f == 0x0b
+}
+
+// IsGREASE reports whether v is a GREASE value (RFC 8701) for cipher suites,
+// extensions, named groups, signature algorithms or versions.
+func IsGREASE(v uint16) bool { return isGREASE(v) }
+
+const extensionPadding uint16 = 21
+
+// HelloExtension is an extension as it appears in a hello message.
+type HelloExtension struct {
+	Type uint16
+	Data []byte
+}
+
+// ParsedKeyShare is a key_share entry.
+type ParsedKeyShare struct {
+	Group CurveID
+	Data  []byte
+}
+
+// ParsedPSKIdentity is an identity of the pre_shared_key extension.
+type ParsedPSKIdentity struct {
+	Identity            []byte
+	ObfuscatedTicketAge uint32
+}
+
+// ClientHelloGREASE records where a ClientHello carries GREASE values.
+type ClientHelloGREASE struct {
+	CipherSuites        bool
+	Extensions          bool
+	SupportedGroups     bool
+	KeyShares           bool
+	SupportedVersions   bool
+	SignatureAlgorithms bool
+	PSKModes            bool
+	ALPN                bool
+}
+
+// ParsedClientHello holds the fields of a ClientHello. Extension fields are
+// only set if the extension is present; GREASE values are kept as sent.
+type ParsedClientHello struct {
+	Version            uint16
+	Random             []byte
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []byte
+
+	// ExtensionList holds the extensions in wire order, duplicates included.
+	ExtensionList []HelloExtension
+	// Extensions maps extension IDs to their data. With duplicates, the
+	// last one wins.
+	Extensions map[uint16][]byte
+
+	SNI                          string
+	ALPN                         []string
+	SupportedGroups              []CurveID
+	SupportedPoints              []uint8
+	SignatureAlgorithms          []SignatureScheme
+	SignatureAlgorithmsCert      []SignatureScheme
+	KeyShares                    []ParsedKeyShare
+	SupportedVersions            []uint16
+	PSKModes                     []uint8
+	PSKIdentities                []ParsedPSKIdentity
+	PSKBinders                   [][]byte
+	OCSPStapling                 bool
+	Cookie                       []byte
+	PaddingLen                   int
+	SecureRenegotiationSupported bool
+	SecureRenegotiation          []byte
+	ExtendedMasterSecret         bool
+	TicketSupported              bool
+	SessionTicket                []byte
+	EarlyData                    bool
+	CertCompressionAlgorithms    []CertCompressionAlgo
+	RecordSizeLimit              uint16
+	PostHandshakeAuth            bool
+
+	GREASE ClientHelloGREASE
+}
+
+// ExtensionIDs returns the extension IDs in wire order.
+func (h *ParsedClientHello) ExtensionIDs() []uint16 {
+	ids := make([]uint16, len(h.ExtensionList))
+	for i, ext := range h.ExtensionList {
+		ids[i] = ext.Type
+	}
+	return ids
+}
+
+// ParseClientHello parses a ClientHello handshake message, with or without a
+// TLS record header. Nothing may follow the message, in the record or in
+// data. Errors are of type *HelloParseError. The returned byte slices alias
+// data.
+func ParseClientHello(data []byte) (*ParsedClientHello, error) {
+	p := &helloParser{message: "ClientHello", data: data}
+	body, rest, err := p.handshakeBody(typeClientHello)
+	if err != nil {
+		return nil, err
+	}
+	if !rest.Empty() {
+		return nil, p.errorAt(rest, "trailing data")
+	}
+	out := &ParsedClientHello{Extensions: make(map[uint16][]byte)}
+	var random, sessionID, compression cryptobyte.String
+	var suites cryptobyte.String
+	start := body
+	if !body.ReadUint16(&out.Version) {
+		return nil, p.errorAt(start, "version")
+	}
+	start = body
+	if !body.ReadBytes((*[]byte)(&random), 32) {
+		return nil, p.errorAt(start, "random")
+	}
+	start = body
+	if !body.ReadUint8LengthPrefixed(&sessionID) {
+		return nil, p.errorAt(start, "session ID")
+	}
+	start = body
+	if !body.ReadUint16LengthPrefixed(&suites) || len(suites)%2 != 0 {
+		return nil, p.errorAt(start, "cipher suites")
+	}
+	start = body
+	if !body.ReadUint8LengthPrefixed(&compression) {
+		return nil, p.errorAt(start, "compression methods")
+	}
+	out.Random = random
+	out.SessionID = sessionID
+	out.CompressionMethods = compression
+	for !suites.Empty() {
+		var suite uint16
+		suites.ReadUint16(&suite)
+		out.GREASE.CipherSuites = out.GREASE.CipherSuites || isGREASE(suite)
+		out.CipherSuites = append(out.CipherSuites, suite)
+	}
+	if body.Empty() {
+		return out, nil
+	}
+
+	var exts cryptobyte.String
+	start = body
+	if !body.ReadUint16LengthPrefixed(&exts) {
+		return nil, p.errorAt(start, "extensions length")
+	}
+	if !body.Empty() {
+		return nil, p.errorAt(body, "trailing data")
+	}
+	for !exts.Empty() {
+		var ext uint16
+		var extData cryptobyte.String
+		start := exts
+		if !exts.ReadUint16(&ext) || !exts.ReadUint16LengthPrefixed(&extData) {
+			return nil, p.errorAt(start, "extension")
+		}
+		out.ExtensionList = append(out.ExtensionList, HelloExtension{Type: ext, Data: extData})
+		out.Extensions[ext] = extData
+		out.GREASE.Extensions = out.GREASE.Extensions || isGREASE(ext)
+		if err := p.clientHelloExtension(out, ext, extData); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// clientHelloExtension decodes the data of one ClientHello extension into
+// out. Unknown extensions are left raw.
+func (p *helloParser) clientHelloExtension(out *ParsedClientHello, ext uint16, s cryptobyte.String) error {
+	switch ext {
+	case extensionServerName:
+		var list cryptobyte.String
+		start := s
+		if !s.ReadUint16LengthPrefixed(&list) || list.Empty() {
+			return p.errorAt(start, "server_name")
+		}
+		for !list.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			start := list
+			if !list.ReadUint8(&nameType) || !list.ReadUint16LengthPrefixed(&name) {
+				return p.errorAt(start, "server_name")
+			}
+			if nameType == 0 && out.SNI == "" {
+				out.SNI = string(name)
+			}
+		}
+	case extensionALPN:
+		var list cryptobyte.String
+		start := s
+		if !s.ReadUint16LengthPrefixed(&list) || list.Empty() {
+			return p.errorAt(start, "application_layer_protocol_negotiation")
+		}
+		for !list.Empty() {
+			var proto cryptobyte.String
+			start := list
+			if !list.ReadUint8LengthPrefixed(&proto) || proto.Empty() {
+				return p.errorAt(start, "application_layer_protocol_negotiation")
+			}
+			// GREASE ALPN identifiers (draft-ietf-tls-grease) are two
+			// equal GREASE bytes, like the 16-bit codepoints.
+			if len(proto) == 2 && isGREASE(binary.BigEndian.Uint16(proto)) {
+				out.GREASE.ALPN = true
+			}
+			out.ALPN = append(out.ALPN, string(proto))
+		}
+	case extensionSupportedCurves:
+		var list cryptobyte.String
+		start := s
+		if !s.ReadUint16LengthPrefixed(&list) || len(list)%2 != 0 {
+			return p.errorAt(start, "supported_groups")
+		}
+		out.SupportedGroups = []CurveID{}
+		for !list.Empty() {
+			var group uint16
+			list.ReadUint16(&group)
+			out.GREASE.SupportedGroups = out.GREASE.SupportedGroups || isGREASE(group)
+			out.SupportedGroups = append(out.SupportedGroups, CurveID(group))
+		}
+	case extensionSupportedPoints:
+		var list cryptobyte.String
+		start := s
+		if !s.ReadUint8LengthPrefixed(&list) {
+			return p.errorAt(start, "ec_point_formats")
+		}
+		out.SupportedPoints = append([]uint8{}, list...)
+	case extensionSignatureAlgorithms, extensionSignatureAlgorithmsCert:
+		var list cryptobyte.String
+		start := s
+		if !s.ReadUint16LengthPrefixed(&list) || len(list)%2 != 0 {
+			return p.errorAt(start, "signature_algorithms")
+		}
+		schemes := []SignatureScheme{}
+		for !list.Empty() {
+			var scheme uint16
+			list.ReadUint16(&scheme)
+			out.GREASE.SignatureAlgorithms = out.GREASE.SignatureAlgorithms || isGREASE(scheme)
+			schemes = append(schemes, SignatureScheme(scheme))
+		}
+		if ext == extensionSignatureAlgorithms {
+			out.SignatureAlgorithms = schemes
+		} else {
+			out.SignatureAlgorithmsCert = schemes
+		}
+	case extensionKeyShare:
+		var list cryptobyte.String
+		start := s
+		if !s.ReadUint16LengthPrefixed(&list) {
+			return p.errorAt(start, "key_share")
+		}
+		out.KeyShares = []ParsedKeyShare{}
+		for !list.Empty() {
+			var group uint16
+			var data cryptobyte.String
+			start := list
+			if !list.ReadUint16(&group) || !list.ReadUint16LengthPrefixed(&data) {
+				return p.errorAt(start, "key_share")
+			}
+			out.GREASE.KeyShares = out.GREASE.KeyShares || isGREASE(group)
+			out.KeyShares = append(out.KeyShares, ParsedKeyShare{Group: CurveID(group), Data: data})
+		}
+	case extensionSupportedVersions:
+		var list cryptobyte.String
+		start := s
+		if !s.ReadUint8LengthPrefixed(&list) || len(list)%2 != 0 {
+			return p.errorAt(start, "supported_versions")
+		}
+		out.SupportedVersions = []uint16{}
+		for !list.Empty() {
+			var vers uint16
+			list.ReadUint16(&vers)
+			out.GREASE.SupportedVersions = out.GREASE.SupportedVersions || isGREASE(vers)
+			out.SupportedVersions = append(out.SupportedVersions, vers)
+		}
+	case extensionPSKModes:
+		var list cryptobyte.String
+		start := s
+		if !s.ReadUint8LengthPrefixed(&list) {
+			return p.errorAt(start, "psk_key_exchange_modes")
+		}
+		out.PSKModes = append([]uint8{}, list...)
+		for _, mode := range list {
+			out.GREASE.PSKModes = out.GREASE.PSKModes || isGREASEUint8(mode)
+		}
+	case extensionPreSharedKey:
+		var identities, binders cryptobyte.String
+		start := s
+		if !s.ReadUint16LengthPrefixed(&identities) || identities.Empty() {
+			return p.errorAt(start, "pre_shared_key identities")
+		}
+		for !identities.Empty() {
+			var psk ParsedPSKIdentity
+			var identity cryptobyte.String
+			start := identities
+			if !identities.ReadUint16LengthPrefixed(&identity) ||
+				!identities.ReadUint32(&psk.ObfuscatedTicketAge) {
+				return p.errorAt(start, "pre_shared_key identity")
+			}
+			psk.Identity = identity
+			out.PSKIdentities = append(out.PSKIdentities, psk)
+		}
+		start = s
+		if !s.ReadUint16LengthPrefixed(&binders) || binders.Empty() {
+			return p.errorAt(start, "pre_shared_key binders")
+		}
+		for !binders.Empty() {
+			var binder cryptobyte.String
+			start := binders
+			if !binders.ReadUint8LengthPrefixed(&binder) {
+				return p.errorAt(start, "pre_shared_key binder")
+			}
+			out.PSKBinders = append(out.PSKBinders, binder)
+		}
+	case extensionStatusRequest:
+		var statusType uint8
+		start := s
+		if !s.ReadUint8(&statusType) {
+			return p.errorAt(start, "status_request")
+		}
+		out.OCSPStapling = statusType == statusTypeOCSP
+		return nil
+	case extensionCookie:
+		var cookie cryptobyte.String
+		start := s
+		if !s.ReadUint16LengthPrefixed(&cookie) || cookie.Empty() {
+			return p.errorAt(start, "cookie")
+		}
+		out.Cookie = cookie
+	case extensionPadding:
+		out.PaddingLen = len(s)
+		return nil
+	case extensionRenegotiationInfo:
+		var info cryptobyte.String
+		start := s
+		if !s.ReadUint8LengthPrefixed(&info) {
+			return p.errorAt(start, "renegotiation_info")
+		}
+		out.SecureRenegotiationSupported = true
+		out.SecureRenegotiation = info
+	case extensionExtendedMasterSecret:
+		out.ExtendedMasterSecret = true
+	case extensionCompressCertificate:
+		var list cryptobyte.String
+		start := s
+		if !s.ReadUint8LengthPrefixed(&list) || list.Empty() || len(list)%2 != 0 {
+			return p.errorAt(start, "compress_certificate")
+		}
+		for !list.Empty() {
+			var algo uint16
+			list.ReadUint16(&algo)
+			out.CertCompressionAlgorithms = append(out.CertCompressionAlgorithms, CertCompressionAlgo(algo))
+		}
+	case extensionRecordSizeLimit:
+		start := s
+		if !s.ReadUint16(&out.RecordSizeLimit) {
+			return p.errorAt(start, "record_size_limit")
+		}
+	case extensionSessionTicket:
+		out.TicketSupported = true
+		out.SessionTicket = s
+		return nil
+	case extensionEarlyData:
+		out.EarlyData = true
+	case extensionPostHandshakeAuth:
+		out.PostHandshakeAuth = true
+	default:
+		return nil
+	}
+	if !s.Empty() {
+		return p.errorAt(s, "extension data")
+	}
+	return nil
+}
+
+// ParsedServerHello holds the fields of a ServerHello or HelloRetryRequest.
+// Extension fields are only set if the extension is present.
+type ParsedServerHello struct {
+	Version           uint16 // legacy_version
+	Random            []byte
+	SessionID         []byte
+	CipherSuite       uint16
+	CompressionMethod uint8
+
+	// IsHelloRetryRequest is set if Random is the HelloRetryRequest value
+	// of RFC 8446, Section 4.1.3.
+	IsHelloRetryRequest bool
+
+	// ExtensionOrder holds the extension IDs in wire order, and
+	// ExtensionList the extensions themselves.
+	ExtensionOrder []uint16
+	ExtensionList  []HelloExtension
+	// Extensions maps extension IDs to their data. With duplicates, the
+	// last one wins.
+	Extensions map[uint16][]byte
+
+	SupportedVersion uint16
+	// KeyShare is the server's share in a ServerHello.
+	KeyShare *ParsedKeyShare
+	// SelectedGroup is the group a HelloRetryRequest asks for.
+	SelectedGroup                CurveID
+	PSKSelected                  bool
+	SelectedIdentity             uint16
+	ALPN                         string
+	Cookie                       []byte
+	OCSPStapling                 bool
+	TicketSupported              bool
+	SecureRenegotiationSupported bool
+	SecureRenegotiation          []byte
+	ExtendedMasterSecret         bool
+	RecordSizeLimit              uint16
+	SCTs                         [][]byte
+	SupportedPoints              []uint8
+}
+
+// NegotiatedVersion returns the version the server selected: the
+// supported_versions value if present, and the legacy version otherwise.
+func (h *ParsedServerHello) NegotiatedVersion() uint16 {
+	if h.SupportedVersion != 0 {
+		return h.SupportedVersion
+	}
+	return h.Version
+}
+
+// ParseServerHello parses a ServerHello or HelloRetryRequest handshake
+// message, with or without a TLS record header. Errors are of type
+// *HelloParseError. The returned byte slices alias data.
+func ParseServerHello(data []byte) (*ParsedServerHello, error) {
+	p := &helloParser{message: "ServerHello", data: data}
+	body, _, err := p.handshakeBody(typeServerHello)
+	if err != nil {
+		return nil, err
+	}
+	out := &ParsedServerHello{Extensions: make(map[uint16][]byte)}
+	var random, sessionID cryptobyte.String
+	start := body
+	if !body.ReadUint16(&out.Version) {
+		return nil, p.errorAt(start, "version")
+	}
+	start = body
+	if !body.ReadBytes((*[]byte)(&random), 32) {
+		return nil, p.errorAt(start, "random")
+	}
+	start = body
+	if !body.ReadUint8LengthPrefixed(&sessionID) {
+		return nil, p.errorAt(start, "session ID")
+	}
+	start = body
+	if !body.ReadUint16(&out.CipherSuite) {
+		return nil, p.errorAt(start, "cipher suite")
+	}
+	start = body
+	if !body.ReadUint8(&out.CompressionMethod) {
+		return nil, p.errorAt(start, "compression method")
+	}
+	out.Random = random
+	out.SessionID = sessionID
+	out.IsHelloRetryRequest = bytes.Equal(random, helloRetryRequestRandom)
+	if body.Empty() {
+		return out, nil
+	}
+
+	var exts cryptobyte.String
+	start = body
+	if !body.ReadUint16LengthPrefixed(&exts) {
+		return nil, p.errorAt(start, "extensions length")
+	}
+	if !body.Empty() {
+		return nil, p.errorAt(body, "trailing data")
+	}
+	for !exts.Empty() {
+		var ext uint16
+		var extData cryptobyte.String
+		start := exts
+		if !exts.ReadUint16(&ext) || !exts.ReadUint16LengthPrefixed(&extData) {
+			return nil, p.errorAt(start, "extension")
+		}
+		out.ExtensionOrder = append(out.ExtensionOrder, ext)
+		out.ExtensionList = append(out.ExtensionList, HelloExtension{Type: ext, Data: extData})
+		out.Extensions[ext] = extData
+		if err := p.serverHelloExtension(out, ext, extData); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// serverHelloExtension decodes the data of one ServerHello extension into
+// out. Unknown extensions are left raw.
+func (p *helloParser) serverHelloExtension(out *ParsedServerHello, ext uint16, s cryptobyte.String) error {
+	start := s
+	ok := true
+	switch ext {
+	case extensionSupportedVersions:
+		ok = s.ReadUint16(&out.SupportedVersion)
+	case extensionKeyShare:
+		// A HelloRetryRequest carries only the selected group.
+		var group uint16
+		ok = s.ReadUint16(&group)
+		if ok && out.IsHelloRetryRequest {
+			out.SelectedGroup = CurveID(group)
+			break
+		}
+		var data cryptobyte.String
+		ok = ok && s.ReadUint16LengthPrefixed(&data) && !data.Empty()
+		out.KeyShare = &ParsedKeyShare{Group: CurveID(group), Data: data}
+	case extensionPreSharedKey:
+		out.PSKSelected = true
+		ok = s.ReadUint16(&out.SelectedIdentity)
+	case extensionALPN:
+		var list, proto cryptobyte.String
+		ok = s.ReadUint16LengthPrefixed(&list) && list.ReadUint8LengthPrefixed(&proto) &&
+			!proto.Empty() && list.Empty()
+		out.ALPN = string(proto)
+	case extensionCookie:
+		var cookie cryptobyte.String
+		ok = s.ReadUint16LengthPrefixed(&cookie) && !cookie.Empty()
+		out.Cookie = cookie
+	case extensionStatusRequest:
+		out.OCSPStapling = true
+	case extensionSessionTicket:
+		out.TicketSupported = true
+	case extensionRenegotiationInfo:
+		var info cryptobyte.String
+		ok = s.ReadUint8LengthPrefixed(&info)
+		out.SecureRenegotiationSupported = true
+		out.SecureRenegotiation = info
+	case extensionExtendedMasterSecret:
+		out.ExtendedMasterSecret = true
+	case extensionRecordSizeLimit:
+		ok = s.ReadUint16(&out.RecordSizeLimit)
+	case extensionSCT:
+		var list cryptobyte.String
+		ok = s.ReadUint16LengthPrefixed(&list) && !list.Empty()
+		for ok && !list.Empty() {
+			var sct cryptobyte.String
+			ok = list.ReadUint16LengthPrefixed(&sct) && !sct.Empty()
+			out.SCTs = append(out.SCTs, sct)
+		}
+	case extensionSupportedPoints:
+		var list cryptobyte.String
+		ok = s.ReadUint8LengthPrefixed(&list) && !list.Empty()
+		out.SupportedPoints = append([]uint8{}, list...)
+	default:
+		return nil
+	}
+	if !ok || !s.Empty() {
+		return p.errorAt(start, extensionName(ext))
+	}
+	return nil
+}
+
+// extensionName returns the RFC name of a known extension, for errors.
+func extensionName(ext uint16) string {
+	switch ext {
+	case extensionSupportedVersions:
+		return "supported_versions"
+	case extensionKeyShare:
+		return "key_share"
+	case extensionPreSharedKey:
+		return "pre_shared_key"
+	case extensionALPN:
+		return "application_layer_protocol_negotiation"
+	case extensionCookie:
+		return "cookie"
+	case extensionStatusRequest:
+		return "status_request"
+	case extensionSessionTicket:
+		return "session_ticket"
+	case extensionRenegotiationInfo:
+		return "renegotiation_info"
+	case extensionExtendedMasterSecret:
+		return "extended_master_secret"
+	case extensionCompressCertificate:
+		return "compress_certificate"
+	case extensionRecordSizeLimit:
+		return "record_size_limit"
+	case extensionPostHandshakeAuth:
+		return "post_handshake_auth"
+	case extensionSCT:
+		return "signed_certificate_timestamp"
+	case extensionSupportedPoints:
+		return "ec_point_formats"
+	}
+	return fmt.Sprintf("extension %d", ext)
+}
@@ -0,0 +1,173 @@
+package tls
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestParseClientHello(t *testing.T) {
+	m := &clientHelloMsg{
+		vers:                             VersionTLS12,
+		random:                           bytes.Repeat([]byte{1}, 32),
+		sessionId:                        bytes.Repeat([]byte{2}, 32),
+		cipherSuites:                     []uint16{TLS_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		compressionMethods:               []uint8{compressionNone},
+		serverName:                       "example.com",
+		ocspStapling:                     true,
+		supportedCurves:                  []CurveID{X25519, CurveP256},
+		supportedPoints:                  []uint8{pointFormatUncompressed},
+		ticketSupported:                  true,
+		supportedSignatureAlgorithms:     []SignatureScheme{ECDSAWithP256AndSHA256, PSSWithSHA256},
+		supportedSignatureAlgorithmsCert: []SignatureScheme{PKCS1WithSHA256},
+		secureRenegotiationSupported:     true,
+		alpnProtocols:                    []string{"h2", "http/1.1"},
+		supportedVersions:                []uint16{VersionTLS13, VersionTLS12},
+		cookie:                           []byte("cookie"),
+		keyShares:                        []keyShare{{group: X25519, data: bytes.Repeat([]byte{3}, 32)}},
+		earlyData:                        true,
+		pskModes:                         []uint8{pskModeDHE},
+		pskIdentities:                    []pskIdentity{{label: []byte("ticket"), obfuscatedTicketAge: 42}},
+		pskBinders:                       [][]byte{bytes.Repeat([]byte{4}, 32)},
+	}
+	hello := m.marshal()
+	record := append([]byte{byte(recordTypeHandshake), 3, 1, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+	for _, data := range [][]byte{hello, record} {
+		p, err := ParseClientHello(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.SNI != "example.com" || !reflect.DeepEqual(p.ALPN, m.alpnProtocols) ||
+			!reflect.DeepEqual(p.SupportedGroups, m.supportedCurves) ||
+			!reflect.DeepEqual(p.SignatureAlgorithms, m.supportedSignatureAlgorithms) ||
+			!reflect.DeepEqual(p.SignatureAlgorithmsCert, m.supportedSignatureAlgorithmsCert) ||
+			!reflect.DeepEqual(p.SupportedVersions, m.supportedVersions) ||
+			!reflect.DeepEqual(p.PSKModes, m.pskModes) ||
+			!bytes.Equal(p.Cookie, m.cookie) || !p.OCSPStapling || !p.EarlyData ||
+			!p.SecureRenegotiationSupported || !p.TicketSupported {
+			t.Errorf("parsed ClientHello %+v does not match %+v", p, m)
+		}
+		if len(p.KeyShares) != 1 || p.KeyShares[0].Group != X25519 || !bytes.Equal(p.KeyShares[0].Data, m.keyShares[0].data) {
+			t.Errorf("key shares %+v", p.KeyShares)
+		}
+		if len(p.PSKIdentities) != 1 || string(p.PSKIdentities[0].Identity) != "ticket" ||
+			p.PSKIdentities[0].ObfuscatedTicketAge != 42 || len(p.PSKBinders) != 1 {
+			t.Errorf("pre_shared_key %+v %x", p.PSKIdentities, p.PSKBinders)
+		}
+		if ids := p.ExtensionIDs(); ids[len(ids)-1] != extensionPreSharedKey {
+			t.Errorf("extension order %v does not end with pre_shared_key", ids)
+		}
+		if p.GREASE != (ClientHelloGREASE{}) {
+			t.Errorf("unexpected GREASE %+v", p.GREASE)
+		}
+	}
+
+	// Offsets point at the field that could not be read.
+	_, err := ParseClientHello(hello[:4+2+20])
+	var perr *HelloParseError
+	if !errors.As(err, &perr) || perr.Offset != 1 {
+		t.Errorf("truncated handshake: got %v", err)
+	}
+	bad := append([]byte(nil), hello...)
+	bad[4+2+32] = 33 // session ID length
+	if _, err := ParseClientHello(bad); !errors.As(err, &perr) || perr.Field != "cipher suites" || perr.Offset != 4+2+32+1+33 {
+		t.Errorf("bad session ID length: got %v", err)
+	}
+	if _, err := ParseClientHello(record[:len(record)-1]); !errors.As(err, &perr) || perr.Offset != 3 {
+		t.Errorf("truncated record: got %v", err)
+	}
+
+	// A record may carry nothing after the ClientHello.
+	trailing := append([]byte{byte(recordTypeHandshake), 3, 1, byte((len(hello) + 4) >> 8), byte(len(hello) + 4)}, hello...)
+	trailing = append(trailing, typeFinished, 0, 0, 0)
+	if _, err := ParseClientHello(trailing); !errors.As(err, &perr) || perr.Field != "trailing data" || perr.Offset != 5+len(hello) {
+		t.Errorf("trailing message: got %v", err)
+	}
+	if _, err := ParseClientHello(append(hello[:len(hello):len(hello)], 0)); !errors.As(err, &perr) || perr.Offset != len(hello) {
+		t.Errorf("trailing byte: got %v", err)
+	}
+}
+
+func TestParseClientHelloGREASE(t *testing.T) {
+	uc := utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloChrome_120)
+	if err := uc.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParseClientHello(uc.HandshakeState.Hello.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := p.GREASE
+	if !g.CipherSuites || !g.Extensions || !g.SupportedGroups || !g.KeyShares || !g.SupportedVersions {
+		t.Errorf("GREASE not detected: %+v", g)
+	}
+	wantPadding := 0
+	for _, ext := range p.ExtensionList {
+		if ext.Type == extensionPadding {
+			wantPadding = len(ext.Data)
+		}
+	}
+	if p.PaddingLen != wantPadding {
+		t.Errorf("PaddingLen = %d, want %d", p.PaddingLen, wantPadding)
+	}
+	if !isGREASE(0x1a1a) || isGREASE(0x1a2a) || !isGREASEUint8(0x2a) || isGREASEUint8(0x01) {
+		t.Error("isGREASE is wrong")
+	}
+}
+
+func TestParseServerHello(t *testing.T) {
+	m := &serverHelloMsg{
+		vers:                    VersionTLS12,
+		random:                  bytes.Repeat([]byte{1}, 32),
+		sessionId:               bytes.Repeat([]byte{2}, 32),
+		cipherSuite:             TLS_AES_128_GCM_SHA256,
+		alpnProtocol:            "h2",
+		supportedVersion:        VersionTLS13,
+		serverShare:             keyShare{group: X25519, data: bytes.Repeat([]byte{3}, 32)},
+		selectedIdentityPresent: true,
+		selectedIdentity:        1,
+	}
+	hello := m.marshal()
+	p, err := ParseServerHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.IsHelloRetryRequest || p.NegotiatedVersion() != VersionTLS13 || p.CipherSuite != m.cipherSuite ||
+		p.ALPN != "h2" || !p.PSKSelected || p.SelectedIdentity != 1 ||
+		p.KeyShare == nil || p.KeyShare.Group != X25519 || !bytes.Equal(p.KeyShare.Data, m.serverShare.data) {
+		t.Errorf("parsed ServerHello %+v does not match %+v", p, m)
+	}
+	if len(p.ExtensionOrder) != 4 || len(p.ExtensionList) != 4 {
+		t.Errorf("extension order %v", p.ExtensionOrder)
+	}
+
+	hrr := &serverHelloMsg{
+		vers:             VersionTLS12,
+		random:           helloRetryRequestRandom,
+		sessionId:        m.sessionId,
+		cipherSuite:      TLS_AES_128_GCM_SHA256,
+		supportedVersion: VersionTLS13,
+		selectedGroup:    CurveP256,
+		cookie:           []byte("cookie"),
+	}
+	p, err = ParseServerHello(hrr.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsHelloRetryRequest || p.SelectedGroup != CurveP256 || p.KeyShare != nil || string(p.Cookie) != "cookie" {
+		t.Errorf("parsed HelloRetryRequest %+v does not match %+v", p, hrr)
+	}
+
+	// A key_share with no key exchange is only valid in a HelloRetryRequest.
+	m.raw, m.serverShare.data = nil, nil
+	var perr *HelloParseError
+	if _, err := ParseServerHello(m.marshal()); !errors.As(err, &perr) || perr.Field != "key_share" {
+		t.Errorf("ServerHello key_share without key exchange: got %v", err)
+	}
+	if _, err := ParseClientHello(hello); !errors.As(err, &perr) || perr.Offset != 0 {
+		t.Errorf("ServerHello parsed as ClientHello: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package tls
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// ========== 密钥更新 ==========
+
+// defaultKeyUpdateRecords is the number of records protected with a TLS 1.3
+// traffic key before it is updated, if Config.KeyUpdateRecords is zero. It
+// is below the 2^24.5 records RFC 8446, Section 5.5 allows for AES-GCM.
+const defaultKeyUpdateRecords = 1 << 24
+
+func (c *Config) keyUpdateRecords() uint64 {
+	if c.KeyUpdateRecords == 0 {
+		return defaultKeyUpdateRecords
+	}
+	return c.KeyUpdateRecords
+}
+
+// countKeyUsage records that n bytes of application data were protected with
+// the current TLS 1.3 traffic key of hc.
+func (hc *halfConn) countKeyUsage(config *Config, n int) {
+	if hc.version != VersionTLS13 || hc.cipher == nil {
+		return
+	}
+	if hc.keyTime.IsZero() {
+		hc.keyTime = config.time()
+	}
+	hc.keyBytes += int64(n)
+}
+
+// keyUpdateDue reports whether the application traffic key of hc, one of
+// c.in and c.out, is due to be updated according to c.config.
+func (c *Conn) keyUpdateDue(hc *halfConn) bool {
+	if c.vers != VersionTLS13 || c.quic != nil || !c.handshakeComplete() ||
+		hc.level != QUICEncryptionLevelApplication {
+		return false
+	}
+	var records uint64
+	for _, b := range hc.seq {
+		records = records<<8 | uint64(b)
+	}
+	switch {
+	case records >= c.config.keyUpdateRecords():
+		return true
+	case c.config.KeyUpdateBytes > 0 && hc.keyBytes >= c.config.KeyUpdateBytes:
+		return true
+	case c.config.KeyUpdateInterval > 0 && !hc.keyTime.IsZero() &&
+		c.config.time().Sub(hc.keyTime) >= c.config.KeyUpdateInterval:
+		return true
+	}
+	return false
+}
+
+// sendKeyUpdateLocked sends a KeyUpdate message, which asks the peer to
+// update its own keys in turn if requestUpdate is set, and switches to the
+// next application traffic secret for writing. c.out must be locked.
+func (c *Conn) sendKeyUpdateLocked(requestUpdate bool) error {
+	cipherSuite := cipherSuiteTLS13ByID(c.cipherSuite)
+	if cipherSuite == nil {
+		return c.sendAlertLocked(alertInternalError)
+	}
+
+	msg := &keyUpdateMsg{updateRequested: requestUpdate}
+	if _, err := c.writeRecordLocked(recordTypeHandshake, msg.marshal()); err != nil {
+		return err
+	}
+
+	newSecret := cipherSuite.nextTrafficSecret(c.out.trafficSecret)
+	c.out.setTrafficSecret(cipherSuite, QUICEncryptionLevelApplication, newSecret)
+	c.keyUpdatesSent.Add(1)
+	return nil
+}
+
+// requestKeyUpdateIfDue asks the peer to update its keys if the key c reads
+// with is due to be updated, unless it already did. c.in must be locked.
+func (c *Conn) requestKeyUpdateIfDue() {
+	if c.keyUpdateRequested || !c.keyUpdateDue(&c.in) {
+		return
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if c.out.err != nil || c.closeNotifySent {
+		return
+	}
+	if err := c.sendKeyUpdateLocked(true); err != nil {
+		// Surface the error at the next write.
+		c.out.setErrorLocked(err)
+		return
+	}
+	c.keyUpdateRequested = true
+}
+
+// UpdateKeys sends a TLS 1.3 KeyUpdate message and switches to new traffic
+// keys for writing. If requestPeerUpdate is set, the peer is asked to update
+// the keys it writes with too. Config.KeyUpdateRecords, KeyUpdateBytes and
+// KeyUpdateInterval make a connection do so on its own.
+//
+// UpdateKeys completes the handshake first if needed, and returns an error
+// for connections that did not negotiate TLS 1.3 or that are driven by QUIC.
+func (c *Conn) UpdateKeys(requestPeerUpdate bool) error {
+	for {
+		x := atomic.LoadInt32(&c.activeCall)
+		if x&1 != 0 {
+			return net.ErrClosed
+		}
+		if atomic.CompareAndSwapInt32(&c.activeCall, x, x+2) {
+			break
+		}
+	}
+	defer atomic.AddInt32(&c.activeCall, -2)
+
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.out.err; err != nil {
+		return err
+	}
+	if c.vers != VersionTLS13 || c.quic != nil {
+		return errors.New("tls: key updates require TLS 1.3")
+	}
+	if c.closeNotifySent {
+		return errShutdown
+	}
+	return c.out.setErrorLocked(c.sendKeyUpdateLocked(requestPeerUpdate))
+}
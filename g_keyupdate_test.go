@@ -0,0 +1,121 @@
+package tls
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateKeys(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	cli, srv := testConns(t, clientConfig, serverConfig)
+
+	if err := cli.UpdateKeys(true); err != nil {
+		t.Fatal(err)
+	}
+	testExchange(t, cli, srv, "after update")
+	// The server answers the request with its own KeyUpdate.
+	testExchange(t, srv, cli, "reply")
+
+	cs, ss := cli.ConnectionState(), srv.ConnectionState()
+	if cs.KeyUpdatesSent != 1 || cs.KeyUpdatesReceived != 1 {
+		t.Errorf("client counters: sent %d, received %d", cs.KeyUpdatesSent, cs.KeyUpdatesReceived)
+	}
+	if ss.KeyUpdatesSent != 1 || ss.KeyUpdatesReceived != 1 {
+		t.Errorf("server counters: sent %d, received %d", ss.KeyUpdatesSent, ss.KeyUpdatesReceived)
+	}
+
+	if err := srv.UpdateKeys(false); err != nil {
+		t.Fatal(err)
+	}
+	testExchange(t, srv, cli, "no request")
+	testExchange(t, cli, srv, "ok")
+	if cs := cli.ConnectionState(); cs.KeyUpdatesSent != 1 || cs.KeyUpdatesReceived != 2 {
+		t.Errorf("client counters: sent %d, received %d", cs.KeyUpdatesSent, cs.KeyUpdatesReceived)
+	}
+
+	clientConfig.MaxVersion = VersionTLS12
+	cli, _ = testConns(t, clientConfig, serverConfig)
+	if err := cli.UpdateKeys(false); err == nil {
+		t.Error("UpdateKeys succeeded in TLS 1.2")
+	}
+}
+
+func TestAutomaticKeyUpdate(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.KeyUpdateRecords = 3
+	cli, srv := testConns(t, clientConfig, serverConfig)
+	for range 10 {
+		testExchange(t, cli, srv, "x")
+	}
+	if n := cli.ConnectionState().KeyUpdatesSent; n < 3 {
+		t.Errorf("client sent %d key updates after 10 records", n)
+	}
+
+	// Past the limit on the reading side, the client asks the server to
+	// update its keys too.
+	for range 10 {
+		testExchange(t, srv, cli, "y")
+	}
+	testExchange(t, cli, srv, "z")
+	if n := srv.ConnectionState().KeyUpdatesSent; n == 0 {
+		t.Error("server never updated its keys at the client's request")
+	}
+
+	clientConfig.KeyUpdateRecords = 0
+	clientConfig.KeyUpdateBytes = 100
+	cli, srv = testConns(t, clientConfig, serverConfig)
+	testExchange(t, cli, srv, string(make([]byte, 150)))
+	testExchange(t, cli, srv, "z")
+	if n := cli.ConnectionState().KeyUpdatesSent; n != 1 {
+		t.Errorf("client sent %d key updates past the byte limit, want 1", n)
+	}
+
+	now := time.Now()
+	clientConfig.KeyUpdateBytes = 0
+	clientConfig.KeyUpdateInterval = time.Minute
+	clientConfig.Time = func() time.Time { return now }
+	cli, srv = testConns(t, clientConfig, serverConfig)
+	testExchange(t, cli, srv, "a")
+	testExchange(t, cli, srv, "b")
+	if n := cli.ConnectionState().KeyUpdatesSent; n != 0 {
+		t.Errorf("client sent %d key updates within the interval", n)
+	}
+	now = now.Add(2 * time.Minute)
+	testExchange(t, cli, srv, "c")
+	if n := cli.ConnectionState().KeyUpdatesSent; n != 1 {
+		t.Errorf("client sent %d key updates past the interval, want 1", n)
+	}
+}
+
+func TestKeyUpdateWritePadding(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.KeyUpdateRecords = 3
+	clientConfig.RecordSizeLimit = 100
+	serverConfig.RecordSizeLimit = 100
+	cli, srv := testConns(t, clientConfig, serverConfig)
+	if err := cli.WritePadding(99 * 10); err != nil {
+		t.Fatal(err)
+	}
+	testExchange(t, cli, srv, "x")
+	if n := cli.ConnectionState().KeyUpdatesSent; n < 3 {
+		t.Errorf("client sent %d key updates after 11 records", n)
+	}
+}
+
+func TestKeyUpdateBytesApplicationData(t *testing.T) {
+	// The session tickets the server sends after the handshake are not
+	// application data, and don't count towards KeyUpdateBytes.
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+	serverConfig.KeyUpdateBytes = 10
+	cli, srv := testConns(t, clientConfig, serverConfig)
+	testExchange(t, cli, srv, "x")
+	testExchange(t, srv, cli, "0123456789")
+	if n := srv.ConnectionState().KeyUpdatesSent; n != 0 {
+		t.Errorf("server sent %d key updates before the byte limit", n)
+	}
+	testExchange(t, srv, cli, "y")
+	if n := srv.ConnectionState().KeyUpdatesSent; n != 1 {
+		t.Errorf("server sent %d key updates past the byte limit, want 1", n)
+	}
+}
@@ -0,0 +1,306 @@
+package tls
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// ========== 指纹匹配 ==========
+
+// FingerprintFieldDiff describes a ClientHello field that differs from a
+// candidate fingerprint.
+type FingerprintFieldDiff struct {
+	Field string // such as "cipher_suites" or "extensions"
+	Want  string // the fingerprint's value
+	Got   string // the ClientHello's value
+}
+
+// FingerprintCandidate is a fingerprint a ClientHello was compared with.
+type FingerprintCandidate struct {
+	Fingerprint *GaseousFingerprint
+	// ID is the fingerprint's uTLS preset, or the zero value for a custom
+	// spec.
+	ID utls.ClientHelloID
+	// Confidence is between 0 and 1. It is 1 if every compared field
+	// matches.
+	Confidence float64
+	// Diff lists the fields that don't match.
+	Diff []FingerprintFieldDiff
+}
+
+// Exact reports whether every compared field matches.
+func (c *FingerprintCandidate) Exact() bool { return len(c.Diff) == 0 }
+
+// MatchClientHello compares a ClientHello handshake message, with or without
+// a TLS record header, with the fingerprint catalogue and returns them
+// ranked by confidence, best first. Fingerprints with a confidence of 0 are
+// left out.
+//
+// Fields that vary per connection (random, session ID, key exchange data,
+// server name, padding and pre-shared keys) and GREASE values are not
+// compared. Extension order is ignored for fingerprints that shuffle their
+// extensions.
+func MatchClientHello(hello []byte) ([]FingerprintCandidate, error) {
+	p, err := ParseClientHello(hello)
+	if err != nil {
+		return nil, err
+	}
+	return matchHelloSignature(newHelloSignature(p)), nil
+}
+
+// helloSignature is the normalised structure of a ClientHello that a
+// fingerprint fixes. GREASE values and per-connection extensions are left
+// out of every list.
+type helloSignature struct {
+	suites         []uint16
+	compression    []uint16
+	exts           []uint16
+	groups         []uint16
+	sigalgs        []uint16
+	versions       []uint16
+	points         []uint16
+	keyShareGroups []uint16
+	pskModes       []uint16
+	alpn           []string
+	grease         bool
+
+	// shuffled is set for fingerprints that randomize extension order.
+	shuffled bool
+}
+
+// signatureField is one compared field of a helloSignature.
+type signatureField struct {
+	name   string
+	weight float64
+	list   func(*helloSignature) []uint16
+}
+
+var signatureFields = []signatureField{
+	{"cipher_suites", 4, func(s *helloSignature) []uint16 { return s.suites }},
+	{"extensions", 4, func(s *helloSignature) []uint16 { return s.exts }},
+	{"supported_groups", 2, func(s *helloSignature) []uint16 { return s.groups }},
+	{"signature_algorithms", 2, func(s *helloSignature) []uint16 { return s.sigalgs }},
+	{"supported_versions", 2, func(s *helloSignature) []uint16 { return s.versions }},
+	{"key_share", 1, func(s *helloSignature) []uint16 { return s.keyShareGroups }},
+	{"psk_key_exchange_modes", 1, func(s *helloSignature) []uint16 { return s.pskModes }},
+	{"ec_point_formats", 1, func(s *helloSignature) []uint16 { return s.points }},
+	{"compression_methods", 1, func(s *helloSignature) []uint16 { return s.compression }},
+}
+
+// ALPN and GREASE weigh little: the ALPN list is carried in fingerprint-mode
+// frames, and GREASE only tells browsers from other clients.
+const (
+	signatureALPNWeight   = 1
+	signatureGREASEWeight = 1
+)
+
+// perConnectionExtensions are present or absent depending on the connection,
+// not the fingerprint.
+var perConnectionExtensions = []uint16{
+	extensionServerName, extensionPadding, extensionPreSharedKey, extensionEarlyData,
+}
+
+func newHelloSignature(p *ParsedClientHello) *helloSignature {
+	s := &helloSignature{
+		suites:      withoutGREASE(p.CipherSuites),
+		compression: widen(p.CompressionMethods),
+		points:      widen(p.SupportedPoints),
+		alpn:        p.ALPN,
+		grease:      p.GREASE != (ClientHelloGREASE{}),
+	}
+	for _, id := range p.ExtensionIDs() {
+		if !isGREASE(id) && !containsUint16(perConnectionExtensions, id) {
+			s.exts = append(s.exts, id)
+		}
+	}
+	for _, g := range p.SupportedGroups {
+		if !isGREASE(uint16(g)) {
+			s.groups = append(s.groups, uint16(g))
+		}
+	}
+	for _, a := range p.SignatureAlgorithms {
+		if !isGREASE(uint16(a)) {
+			s.sigalgs = append(s.sigalgs, uint16(a))
+		}
+	}
+	for _, ks := range p.KeyShares {
+		if !isGREASE(uint16(ks.Group)) {
+			s.keyShareGroups = append(s.keyShareGroups, uint16(ks.Group))
+		}
+	}
+	for _, m := range p.PSKModes {
+		if !isGREASEUint8(m) {
+			s.pskModes = append(s.pskModes, uint16(m))
+		}
+	}
+	s.versions = withoutGREASE(p.SupportedVersions)
+	return s
+}
+
+// compare scores how well the ClientHello signature got matches the
+// fingerprint signature s.
+func (s *helloSignature) compare(got *helloSignature) (float64, []FingerprintFieldDiff) {
+	var score, total float64
+	var diff []FingerprintFieldDiff
+	for _, f := range signatureFields {
+		want, have := f.list(s), f.list(got)
+		total += f.weight
+		var sim float64
+		if f.name == "extensions" && s.shuffled {
+			sim = sameSetSimilarity(want, have)
+		} else {
+			sim = listSimilarity(want, have)
+		}
+		score += f.weight * sim
+		if sim < 1 {
+			diff = append(diff, FingerprintFieldDiff{Field: f.name, Want: hexList(want), Got: hexList(have)})
+		}
+	}
+	total += signatureALPNWeight + signatureGREASEWeight
+	if strings.Join(s.alpn, ",") == strings.Join(got.alpn, ",") {
+		score += signatureALPNWeight
+	} else {
+		diff = append(diff, FingerprintFieldDiff{Field: "alpn",
+			Want: strings.Join(s.alpn, ","), Got: strings.Join(got.alpn, ",")})
+	}
+	if s.grease == got.grease {
+		score += signatureGREASEWeight
+	} else {
+		diff = append(diff, FingerprintFieldDiff{Field: "grease",
+			Want: fmt.Sprint(s.grease), Got: fmt.Sprint(got.grease)})
+	}
+	return score / total, diff
+}
+
+// listSimilarity is 1 for equal lists and otherwise half the Jaccard index
+// of their elements, so that a reordering never scores as a match.
+func listSimilarity(a, b []uint16) float64 {
+	if len(a) == len(b) {
+		equal := true
+		for i := range a {
+			if a[i] != b[i] {
+				equal = false
+				break
+			}
+		}
+		if equal {
+			return 1
+		}
+	}
+	return jaccard(a, b) / 2
+}
+
+// sameSetSimilarity is 1 for lists with the same elements in any order, and
+// otherwise half their Jaccard index.
+func sameSetSimilarity(a, b []uint16) float64 {
+	if j := jaccard(a, b); j < 1 || len(a) != len(b) {
+		return j / 2
+	}
+	return 1
+}
+
+func jaccard(a, b []uint16) float64 {
+	set := make(map[uint16]uint8)
+	for _, v := range a {
+		set[v] |= 1
+	}
+	for _, v := range b {
+		set[v] |= 2
+	}
+	if len(set) == 0 {
+		return 1
+	}
+	both := 0
+	for _, in := range set {
+		if in == 3 {
+			both++
+		}
+	}
+	return float64(both) / float64(len(set))
+}
+
+// fingerprintSignatureOf builds a ClientHello from f and returns its
+// signature, or nil if f can't be built without a session, like the uTLS
+// PSK presets. A fingerprint is shuffled if building it again yields another
+// extension order.
+func fingerprintSignatureOf(f *GaseousFingerprint) *helloSignature {
+	build := func() *helloSignature {
+		spec, err := f.Spec()
+		if err != nil {
+			return nil
+		}
+		hello, err := buildUTLSClientHelloFromSpec(spec, &GaseousClientHelloParams{SNI: "example.com"})
+		if err != nil {
+			return nil
+		}
+		p, err := ParseClientHello(hello)
+		if err != nil {
+			return nil
+		}
+		return newHelloSignature(p)
+	}
+	sig := build()
+	if sig == nil {
+		return nil
+	}
+	for i := 0; i < 3 && !sig.shuffled; i++ {
+		if again := build(); again != nil && listSimilarity(sig.exts, again.exts) < 1 {
+			sig.shuffled = true
+		}
+	}
+	return sig
+}
+
+func matchHelloSignature(got *helloSignature) []FingerprintCandidate {
+	var out []FingerprintCandidate
+	for _, f := range GaseousFingerprints() {
+		sig := f.signature()
+		if sig == nil {
+			continue
+		}
+		confidence, diff := sig.compare(got)
+		if confidence > 0 {
+			out = append(out, FingerprintCandidate{Fingerprint: f, ID: f.ClientHelloID, Confidence: confidence, Diff: diff})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Confidence > out[j].Confidence })
+	return out
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var out []uint16
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func widen(values []uint8) []uint16 {
+	out := make([]uint16, len(values))
+	for i, v := range values {
+		out[i] = uint16(v)
+	}
+	return out
+}
+
+func containsUint16(values []uint16, v uint16) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func hexList(values []uint16) string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(out, ",")
+}
@@ -0,0 +1,64 @@
+package tls
+
+import (
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestMatchClientHello(t *testing.T) {
+	for _, id := range []utls.ClientHelloID{utls.HelloChrome_120, utls.HelloChrome_131, utls.HelloFirefox_120, utls.HelloIOS_14, utls.HelloSafari_16_0} {
+		uc := utls.UClient(nil, &utls.Config{ServerName: "example.org"}, id)
+		if err := uc.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		candidates, err := MatchClientHello(uc.HandshakeState.Hello.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, c := range candidates {
+			if !c.Exact() {
+				break
+			}
+			found = found || c.ID == id
+		}
+		switch {
+		case len(candidates) == 0:
+			t.Errorf("%s: no candidates", id.Str())
+		case !found:
+			t.Errorf("%s: not among the exact matches, best is %s (%.2f) with diff %+v",
+				id.Str(), candidates[0].ID.Str(), candidates[0].Confidence, candidates[0].Diff)
+		}
+	}
+
+	if sig := GaseousFingerprintByName(utls.HelloChrome_120.Str()).signature(); sig == nil || !sig.shuffled {
+		t.Error("Chrome 120 extension shuffling not detected")
+	}
+
+	// A Go ClientHello is close to no browser.
+	m := &clientHelloMsg{
+		vers:                         VersionTLS12,
+		random:                       make([]byte, 32),
+		cipherSuites:                 []uint16{TLS_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		compressionMethods:           []uint8{compressionNone},
+		supportedCurves:              []CurveID{X25519},
+		supportedSignatureAlgorithms: []SignatureScheme{ECDSAWithP256AndSHA256},
+		supportedVersions:            []uint16{VersionTLS13, VersionTLS12},
+	}
+	candidates, err := MatchClientHello(m.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) == 0 {
+		t.Fatal("Go ClientHello has no candidates")
+	}
+	if candidates[0].Confidence >= gaseousMatchThreshold || len(candidates[0].Diff) == 0 {
+		t.Errorf("Go ClientHello matched %+v", candidates[0])
+	}
+	for i := 1; i < len(candidates); i++ {
+		if candidates[i].Confidence > candidates[i-1].Confidence {
+			t.Fatal("candidates are not ranked")
+		}
+	}
+}
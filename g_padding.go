@@ -0,0 +1,220 @@
+package tls
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// ========== 记录填充 ==========
+
+// RecordPaddingInfo describes an outgoing TLS 1.3 record to
+// Config.RecordPadding.
+type RecordPaddingInfo struct {
+	// ContentType is the TLS content type of the record, such as 23 for
+	// application_data or 22 for handshake.
+	ContentType uint8
+
+	// Length is the number of content bytes in the record, zero for the
+	// records written by Conn.WritePadding.
+	Length int
+
+	// MaxPadding is the most padding the record can carry within the
+	// maximum record size, including any record_size_limit of the peer.
+	MaxPadding int
+
+	// Rand is the source of randomness of the connection, Config.Rand or
+	// crypto/rand. Policies that pad by random amounts should draw from it.
+	Rand io.Reader
+}
+
+// randomFloat returns a random number in [0, 1) read from info.Rand, or
+// from crypto/rand if it is nil. It reports false if reading fails.
+func (info *RecordPaddingInfo) randomFloat() (float64, bool) {
+	r := info.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, false
+	}
+	return float64(binary.LittleEndian.Uint64(b[:])>>11) / (1 << 53), true
+}
+
+// PadToBlockSize returns a RecordPadding policy that pads each record's
+// content to a multiple of blockSize bytes, or as close as the record has
+// room for.
+func PadToBlockSize(blockSize int) func(*RecordPaddingInfo) int {
+	return func(info *RecordPaddingInfo) int {
+		if blockSize <= 1 {
+			return 0
+		}
+		return (blockSize - info.Length%blockSize) % blockSize
+	}
+}
+
+// PadRandom returns a RecordPadding policy that adds from zero to max bytes
+// of padding to each record, chosen uniformly at random from info.Rand.
+func PadRandom(max int) func(*RecordPaddingInfo) int {
+	return func(info *RecordPaddingInfo) int {
+		if max <= 0 {
+			return 0
+		}
+		f, ok := info.randomFloat()
+		if !ok {
+			return 0
+		}
+		return int(f * float64(max+1))
+	}
+}
+
+// PadToSizes returns a RecordPadding policy that pads each record's content
+// to a size drawn from sizes, each picked with the matching weight, so that
+// record lengths follow a target distribution. Sizes smaller than a record
+// are not drawn for it; a record larger than every size is not padded. If
+// weights is nil, all sizes are equally likely. Sizes are drawn from
+// info.Rand.
+func PadToSizes(sizes []int, weights []float64) func(*RecordPaddingInfo) int {
+	sizes = append([]int(nil), sizes...)
+	weights = append([]float64(nil), weights...)
+	return func(info *RecordPaddingInfo) int {
+		var total float64
+		for i, size := range sizes {
+			if size >= info.Length {
+				total += sizeWeight(weights, i)
+			}
+		}
+		if total <= 0 {
+			return 0
+		}
+		f, ok := info.randomFloat()
+		if !ok {
+			return 0
+		}
+		r := f * total
+		target := info.Length
+		for i, size := range sizes {
+			if size < info.Length {
+				continue
+			}
+			target = size
+			if r -= sizeWeight(weights, i); r < 0 {
+				break
+			}
+		}
+		return target - info.Length
+	}
+}
+
+func sizeWeight(weights []float64, i int) float64 {
+	if weights == nil {
+		return 1
+	}
+	if i >= len(weights) || weights[i] < 0 {
+		return 0
+	}
+	return weights[i]
+}
+
+// maxRecordContent returns the most content and padding bytes a protected
+// TLS 1.3 record written by c can carry.
+func (c *Conn) maxRecordContent() int {
+	if c.out.recordSizeLimit > 0 && c.out.recordSizeLimit < maxPlaintext {
+		return c.out.recordSizeLimit
+	}
+	return maxPlaintext
+}
+
+// recordPadding returns the padding to add to a record of type typ carrying
+// n bytes of content, according to c.config.RecordPadding.
+func (c *Conn) recordPadding(typ recordType, n int) int {
+	if c.config.RecordPadding == nil || c.quic != nil ||
+		c.out.version != VersionTLS13 || c.out.cipher == nil {
+		return 0
+	}
+	info := &RecordPaddingInfo{
+		ContentType: uint8(typ),
+		Length:      n,
+		MaxPadding:  c.maxRecordContent() - n,
+		Rand:        c.config.rand(),
+	}
+	padding := c.config.RecordPadding(info)
+	switch {
+	case padding < 0:
+		return 0
+	case padding > info.MaxPadding:
+		return info.MaxPadding
+	}
+	return padding
+}
+
+// isPaddingRecord reports whether an empty TLS 1.3 record of n bytes on the
+// wire carried padding, as opposed to being empty.
+func (hc *halfConn) isPaddingRecord(n int) bool {
+	if hc.version != VersionTLS13 {
+		return false
+	}
+	c, ok := hc.cipher.(aead)
+	return ok && n > 1+c.Overhead()
+}
+
+// WritePadding writes n bytes of padding to the connection as application
+// data records with no content, split into as many records as the maximum
+// record size requires. The peer discards them. WritePadding requires TLS
+// 1.3 and, like Write, completes the handshake first if needed.
+func (c *Conn) WritePadding(n int) error {
+	if n < 0 {
+		return errors.New("tls: negative padding length")
+	}
+	for {
+		x := atomic.LoadInt32(&c.activeCall)
+		if x&1 != 0 {
+			return net.ErrClosed
+		}
+		if atomic.CompareAndSwapInt32(&c.activeCall, x, x+2) {
+			break
+		}
+	}
+	defer atomic.AddInt32(&c.activeCall, -2)
+
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.out.err; err != nil {
+		return err
+	}
+	if c.vers != VersionTLS13 || c.quic != nil {
+		return errors.New("tls: padding records require TLS 1.3")
+	}
+	if c.closeNotifySent {
+		return errShutdown
+	}
+
+	var outBuf []byte
+	for n > 0 {
+		m := min(n, c.maxRecordContent())
+		if c.keyUpdateDue(&c.out) {
+			if err := c.sendKeyUpdateLocked(false); err != nil {
+				return c.out.setErrorLocked(err)
+			}
+		}
+		var err error
+		outBuf, err = c.sealRecord(outBuf, recordTypeApplicationData, nil, m)
+		if err != nil {
+			return c.out.setErrorLocked(err)
+		}
+		if _, err := c.write(outBuf); err != nil {
+			return c.out.setErrorLocked(err)
+		}
+		n -= m
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package tls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestRecordPadding(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.RecordPadding = PadToBlockSize(1024)
+	serverConfig.RecordPadding = PadRandom(300)
+	cli, srv := testConns(t, clientConfig, serverConfig)
+
+	sent := cli.bytesSent
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cli.bytesSent-sent, int64(recordHeaderLen+1024+1+16); got != want {
+		t.Errorf("padded record is %d bytes, want %d", got, want)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(srv, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	data := bytes.Repeat([]byte("x"), 40000)
+	go srv.Write(data)
+	buf = make([]byte, len(data))
+	if _, err := io.ReadFull(cli, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("padded data mismatch: %v", err)
+	}
+}
+
+func TestWritePadding(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.RecordSizeLimit = 100
+	cli, srv := testConns(t, clientConfig, serverConfig)
+
+	// Many more padding-only records than empty records are tolerated.
+	go func() {
+		if err := srv.WritePadding(99 * (maxUselessRecords + 10)); err != nil {
+			t.Error(err)
+		}
+		srv.Write([]byte("data"))
+	}()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	clientConfig.MaxVersion = VersionTLS12
+	cli, _ = testConns(t, clientConfig, serverConfig)
+	if err := cli.WritePadding(10); err == nil {
+		t.Error("WritePadding succeeded in TLS 1.2")
+	}
+}
+
+func TestPaddingPolicies(t *testing.T) {
+	info := &RecordPaddingInfo{ContentType: 23, Length: 100, MaxPadding: 1000}
+	if got := PadToBlockSize(64)(info); got != 28 {
+		t.Errorf("PadToBlockSize: got %d, want 28", got)
+	}
+	for range 100 {
+		if got := PadRandom(10)(info); got < 0 || got > 10 {
+			t.Fatalf("PadRandom: got %d", got)
+		}
+		got := PadToSizes([]int{50, 200, 500}, []float64{1, 1, 0})(info)
+		if got != 100 {
+			t.Fatalf("PadToSizes: got %d, want 100", got)
+		}
+	}
+	info.Length = 600
+	if got := PadToSizes([]int{50, 200, 500}, nil)(info); got != 0 {
+		t.Errorf("PadToSizes: got %d for an oversized record", got)
+	}
+
+	// The random policies draw from info.Rand.
+	info.Length = 100
+	info.Rand = bytes.NewReader(make([]byte, 16))
+	if got := PadRandom(10)(info); got != 0 {
+		t.Errorf("PadRandom: got %d with zero randomness", got)
+	}
+	if got := PadToSizes([]int{200, 500}, nil)(info); got != 100 {
+		t.Errorf("PadToSizes: got %d with zero randomness, want 100", got)
+	}
+	info.Rand = bytes.NewReader(bytes.Repeat([]byte{0xff}, 8))
+	if got := PadRandom(10)(info); got != 10 {
+		t.Errorf("PadRandom: got %d with all-ones randomness", got)
+	}
+	if got := PadRandom(10)(info); got != 0 {
+		t.Errorf("PadRandom: got %d after Rand failed", got)
+	}
+}
+
+func TestRecordPaddingRand(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	var infos []*RecordPaddingInfo
+	clientConfig.RecordPadding = func(info *RecordPaddingInfo) int {
+		infos = append(infos, info)
+		return 0
+	}
+	clientConfig.Rand = bufio.NewReader(rand.Reader)
+	cli, _ := testConns(t, clientConfig, serverConfig)
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) == 0 {
+		t.Fatal("RecordPadding was not called")
+	}
+	for _, info := range infos {
+		if info.Rand != clientConfig.Rand {
+			t.Fatal("RecordPaddingInfo.Rand is not Config.Rand")
+		}
+	}
+}
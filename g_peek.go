@@ -0,0 +1,188 @@
+package tls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ========== 预读 ClientHello ==========
+
+// ClientHelloPeekOptions controls PeekClientHello.
+type ClientHelloPeekOptions struct {
+	// Config supplies the Gaseous settings, as it would to Server. Gaseous
+	// frames are rejected unless it accepts Gaseous ClientHellos.
+	Config *Config
+	// Timeout bounds the time spent reading. Zero means 10 seconds, and a
+	// negative value no deadline.
+	Timeout time.Duration
+	// MaxSize caps the number of bytes read. Zero means 64 KiB.
+	MaxSize int
+}
+
+const (
+	defaultPeekTimeout = 10 * time.Second
+	defaultPeekMaxSize = 64 << 10
+)
+
+func (o *ClientHelloPeekOptions) timeout() time.Duration {
+	if o == nil || o.Timeout == 0 {
+		return defaultPeekTimeout
+	}
+	return o.Timeout
+}
+
+func (o *ClientHelloPeekOptions) maxSize() int {
+	if o == nil || o.MaxSize <= 0 {
+		return defaultPeekMaxSize
+	}
+	return o.MaxSize
+}
+
+func (o *ClientHelloPeekOptions) gaseousConfig() *GaseousConfig {
+	if o == nil {
+		return nil
+	}
+	return o.Config.gaseousConfig()
+}
+
+// PeekedClientHello is a ClientHello read by PeekClientHello.
+type PeekedClientHello struct {
+	// Hello is the parsed ClientHello.
+	Hello *ParsedClientHello
+	// Raw is the ClientHello handshake message, rebuilt if it came in a
+	// Gaseous frame.
+	Raw []byte
+	// ViaGaseous is set if the ClientHello came in a Gaseous frame.
+	ViaGaseous bool
+}
+
+// errPeekSize is returned when the ClientHello doesn't fit in MaxSize.
+var errPeekSize = errors.New("tls: ClientHello exceeds the peek size limit")
+
+// PeekClientHello reads the records or Gaseous frames that carry the first
+// ClientHello on conn and parses it, rebuilding it if it came in a Gaseous
+// frame. It returns a net.Conn that reads the consumed bytes again before
+// the rest of conn, so it can be passed to Server or proxied unchanged. The
+// returned net.Conn is valid even if err is not nil.
+//
+// The read deadline of conn is cleared on return.
+func PeekClientHello(conn net.Conn, opts *ClientHelloPeekOptions) (*PeekedClientHello, net.Conn, error) {
+	if d := opts.timeout(); d > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(d)); err != nil {
+			return nil, conn, err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	p := &helloPeeker{conn: conn, max: opts.maxSize()}
+	peeked, err := p.peek(opts.gaseousConfig())
+	return peeked, &replayConn{Conn: conn, buf: p.buf}, err
+}
+
+// helloPeeker reads from conn and keeps everything it reads.
+type helloPeeker struct {
+	conn net.Conn
+	max  int
+	buf  []byte
+}
+
+// read returns the next n bytes from the connection.
+func (p *helloPeeker) read(n int) ([]byte, error) {
+	start := len(p.buf)
+	if start+n > p.max {
+		return nil, errPeekSize
+	}
+	p.buf = append(p.buf, make([]byte, n)...)
+	got, err := io.ReadFull(p.conn, p.buf[start:])
+	p.buf = p.buf[:start+got]
+	if err != nil {
+		return nil, err
+	}
+	return p.buf[start:], nil
+}
+
+func (p *helloPeeker) peek(g *GaseousConfig) (*PeekedClientHello, error) {
+	var msg []byte
+	gaseous, sawChains := false, false
+	for {
+		hdr, err := p.read(recordHeaderLen)
+		if err != nil {
+			return nil, err
+		}
+		typ := recordType(hdr[0])
+		vers := uint16(hdr[1])<<8 | uint16(hdr[2])
+		n := int(hdr[3])<<8 | int(hdr[4])
+		if vers >= 0x1000 || n > maxCiphertext {
+			return nil, errors.New("tls: first record does not look like a TLS handshake")
+		}
+		body, err := p.read(n)
+		if err != nil {
+			return nil, err
+		}
+
+		if typ == recordTypeHandshake {
+			// A plain ClientHello may span several records.
+			msg = append(msg, body...)
+			if len(msg) < 4 {
+				continue
+			}
+			if msg[0] != typeClientHello {
+				return nil, errors.New("tls: first handshake message is not a ClientHello")
+			}
+			size := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if size > maxHandshake {
+				return nil, fmt.Errorf("tls: oversized ClientHello of length %d", size-4)
+			}
+			if len(msg) < size {
+				continue
+			}
+			msg = msg[:size]
+			break
+		}
+		if typ != recordTypeGaseousHello || len(msg) > 0 {
+			return nil, errors.New("tls: first record does not look like a TLS handshake")
+		}
+		if g == nil || !g.ClientHello {
+			return nil, errors.New("tls: unexpected Gaseous frame")
+		}
+		if len(body) < 1+gaseousHelloHeaderSize || body[0] != recordTypeGaseousHello {
+			return nil, ErrGaseousTrunc
+		}
+		frame := body[1:]
+		switch helloType := frame[4]; {
+		case helloType == GaseousHelloTypeCachedChains && !sawChains:
+			// Cached chains come first and are left to the server.
+			sawChains = true
+			continue
+		case helloType != GaseousHelloTypeClient:
+			return nil, fmt.Errorf("tls: unexpected Gaseous message type %d", helloType)
+		}
+		if msg, err = unpackGaseousHello(frame, GaseousHelloTypeClient, g); err != nil {
+			return nil, fmt.Errorf("tls: invalid Gaseous hello: %w", err)
+		}
+		gaseous = true
+		break
+	}
+	hello, err := ParseClientHello(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &PeekedClientHello{Hello: hello, Raw: msg, ViaGaseous: gaseous}, nil
+}
+
+// replayConn is a net.Conn that reads buf before the underlying connection.
+type replayConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.buf) == 0 {
+		return c.Conn.Read(b)
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,70 @@
+package tls
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPeekClientHello(t *testing.T) {
+	for _, gaseous := range []bool{false, true} {
+		clientConfig, serverConfig := testConfigs(t)
+		clientConfig.NextProtos = []string{"h2"}
+		if gaseous {
+			clientConfig.Gaseous = &GaseousConfig{ClientHello: true, AuthKey: []byte("key")}
+			serverConfig.Gaseous = clientConfig.Gaseous.Clone()
+		}
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			done <- Client(c, clientConfig).Handshake()
+			c.Close()
+		}()
+
+		peeked, replay, err := PeekClientHello(s, &ClientHelloPeekOptions{Config: serverConfig})
+		if err != nil {
+			t.Fatalf("gaseous=%v: %v", gaseous, err)
+		}
+		if peeked.ViaGaseous != gaseous || peeked.Hello.SNI != "example.com" ||
+			len(peeked.Hello.ALPN) != 1 || peeked.Hello.ALPN[0] != "h2" {
+			t.Errorf("gaseous=%v: got ViaGaseous %v, SNI %q, ALPN %q", gaseous,
+				peeked.ViaGaseous, peeked.Hello.SNI, peeked.Hello.ALPN)
+		}
+		srv := Server(replay, serverConfig)
+		if err := srv.Handshake(); err != nil {
+			t.Fatalf("gaseous=%v: handshake over the replayed conn: %v", gaseous, err)
+		}
+		if !bytes.Equal(srv.clientHelloRaw, peeked.Raw) {
+			t.Errorf("gaseous=%v: peeked ClientHello differs from the one the server read", gaseous)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("gaseous=%v: client: %v", gaseous, err)
+		}
+		s.Close()
+	}
+}
+
+func TestPeekClientHelloLimits(t *testing.T) {
+	clientConfig, _ := testConfigs(t)
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	go Client(c, clientConfig).Handshake()
+
+	_, replay, err := PeekClientHello(s, &ClientHelloPeekOptions{MaxSize: 64})
+	if err != errPeekSize {
+		t.Fatalf("got %v, want errPeekSize", err)
+	}
+	// What was read is still there to replay.
+	buf := make([]byte, recordHeaderLen)
+	if _, err := replay.Read(buf); err != nil || buf[0] != byte(recordTypeHandshake) {
+		t.Errorf("replayed %x, %v", buf, err)
+	}
+
+	c2, s2 := localPipe(t)
+	defer c2.Close()
+	defer s2.Close()
+	if _, _, err := PeekClientHello(s2, &ClientHelloPeekOptions{Timeout: 50 * time.Millisecond}); err == nil {
+		t.Fatal("peek succeeded on a silent connection")
+	}
+}
@@ -0,0 +1,338 @@
+package tls
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ========== 握手后客户端认证 ==========
+
+// maxHeldInput is the most application data a server keeps for Read while it
+// waits for the answer to a post-handshake CertificateRequest.
+const maxHeldInput = 1 << 20
+
+// postHandshakeAuth is the state of TLS 1.3 post-handshake client
+// authentication (RFC 8446, Section 4.6.2), kept for connections whose
+// client offered it.
+type postHandshakeAuth struct {
+	suite *cipherSuiteTLS13
+	// transcript runs through the client Finished. Each CertificateRequest
+	// continues a clone of it.
+	transcript hash.Hash
+
+	// requestMutex serializes Conn.RequestClientCertificate. mu guards
+	// pending, the request a server waits for the client to answer.
+	requestMutex sync.Mutex
+	mu           sync.Mutex
+	pending      *clientCertRequest
+}
+
+// clientCertRequest is a post-handshake CertificateRequest sent by a server.
+type clientCertRequest struct {
+	certReq    *certificateRequestMsgTLS13
+	clientAuth ClientAuthType
+	transcript hash.Hash
+	// certMsg is the client's Certificate once received, and certs and
+	// chains the chain parsed from it and the chains it was verified with.
+	// They are only published to the Conn once the client's Finished checked
+	// out. verified is set once its CertificateVerify checked out or wasn't
+	// needed.
+	certMsg  *certificateMsgTLS13
+	certs    []*x509.Certificate
+	chains   [][]*x509.Certificate
+	verified bool
+
+	done chan struct{}
+	err  error
+}
+
+// pendingRequest returns the request the client is expected to answer, if any.
+func (a *postHandshakeAuth) pendingRequest() *clientCertRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.pending
+}
+
+// finish completes req with err, unless it already completed.
+func (a *postHandshakeAuth) finish(req *clientCertRequest, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending != req {
+		return
+	}
+	a.pending = nil
+	req.err = err
+	close(req.done)
+}
+
+// RequestClientCertificate asks the client for a certificate after the
+// handshake, with a TLS 1.3 post-handshake CertificateRequest, and waits until
+// the client answered with its Certificate, CertificateVerify and Finished
+// messages. The certificate is then verified as clientAuth requires, like
+// Config.ClientAuth does during the handshake, and Config.VerifyPeerCertificate
+// and Config.VerifyConnection are called again. On success, the new
+// certificates are reported by ConnectionState.
+//
+// The client must have offered post-handshake authentication, which it does
+// when it has Config.Certificates or Config.GetClientCertificate. Application
+// data that arrives in the meantime is kept for Read, up to 1 MiB; the request
+// fails if the client sends more. As with Read, a read deadline bounds how
+// long RequestClientCertificate waits. A failed request is fatal to the
+// connection.
+func (c *Conn) RequestClientCertificate(clientAuth ClientAuthType) error {
+	if c.isClient {
+		return errors.New("tls: RequestClientCertificate called on a client connection")
+	}
+	if clientAuth == NoClientCert {
+		return errors.New("tls: RequestClientCertificate requires a ClientAuthType that requests a certificate")
+	}
+
+	for {
+		x := atomic.LoadInt32(&c.activeCall)
+		if x&1 != 0 {
+			return net.ErrClosed
+		}
+		if atomic.CompareAndSwapInt32(&c.activeCall, x, x+2) {
+			break
+		}
+	}
+	defer atomic.AddInt32(&c.activeCall, -2)
+
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	auth := c.postHandshakeAuth
+	if c.vers != VersionTLS13 || auth == nil {
+		return errors.New("tls: client did not offer post-handshake authentication")
+	}
+
+	auth.requestMutex.Lock()
+	defer auth.requestMutex.Unlock()
+
+	reqContext := make([]byte, 16)
+	if _, err := io.ReadFull(c.config.rand(), reqContext); err != nil {
+		return errors.New("tls: short read from Rand: " + err.Error())
+	}
+	req := &clientCertRequest{
+		certReq:    c.certificateRequestTLS13(reqContext),
+		clientAuth: clientAuth,
+		transcript: cloneHash(auth.transcript, auth.suite.hash),
+		done:       make(chan struct{}),
+	}
+	if req.transcript == nil {
+		return errors.New("tls: internal error: failed to clone hash")
+	}
+	req.transcript.Write(req.certReq.marshal())
+
+	auth.mu.Lock()
+	auth.pending = req
+	auth.mu.Unlock()
+
+	if err := c.writeCertificateRequest(req.certReq); err != nil {
+		auth.finish(req, err)
+		return err
+	}
+
+	// A concurrent Read may process the answer instead, in which case this
+	// goroutine finds req done once it gets hold of c.in.
+	go c.awaitClientCertificate(req)
+	<-req.done
+	return req.err
+}
+
+func (c *Conn) writeCertificateRequest(certReq *certificateRequestMsgTLS13) error {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.out.err; err != nil {
+		return err
+	}
+	if c.closeNotifySent {
+		return errShutdown
+	}
+	_, err := c.writeRecordLocked(recordTypeHandshake, certReq.marshal())
+	return c.out.setErrorLocked(err)
+}
+
+// awaitClientCertificate reads records until the client answered req. The
+// application data it reads is kept for Read, up to maxHeldInput bytes,
+// beyond which req fails.
+func (c *Conn) awaitClientCertificate(req *clientCertRequest) {
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	auth := c.postHandshakeAuth
+	for auth.pendingRequest() == req {
+		if c.input.Len() == 0 {
+			if err := c.readRecord(); err != nil {
+				auth.finish(req, err)
+				return
+			}
+		}
+		if len(c.heldInput)+c.input.Len() > maxHeldInput {
+			c.sendAlert(alertUnexpectedMessage)
+			auth.finish(req, c.in.setErrorLocked(errors.New("tls: too much application data while waiting for a client certificate")))
+			return
+		}
+		if c.input.Len() > 0 {
+			held := make([]byte, c.input.Len())
+			c.input.Read(held)
+			c.heldInput = append(c.heldInput, held...)
+		}
+		for c.hand.Len() > 0 {
+			if err := c.handlePostHandshakeMessage(); err != nil {
+				auth.finish(req, err)
+				return
+			}
+		}
+	}
+}
+
+// handleClientCertificateResponse processes a message of the client's
+// answer to a post-handshake CertificateRequest.
+func (c *Conn) handleClientCertificateResponse(msg any) error {
+	var req *clientCertRequest
+	if auth := c.postHandshakeAuth; !c.isClient && auth != nil {
+		req = auth.pendingRequest()
+	}
+	if req == nil {
+		c.sendAlert(alertUnexpectedMessage)
+		return c.in.setErrorLocked(fmt.Errorf("tls: received unexpected handshake message of type %T", msg))
+	}
+
+	done, err := c.processClientCertificateResponse(req, msg)
+	if err != nil {
+		err = c.in.setErrorLocked(err)
+		c.postHandshakeAuth.finish(req, err)
+		return err
+	}
+	if done {
+		c.postHandshakeAuth.finish(req, nil)
+	}
+	return nil
+}
+
+// processClientCertificateResponse processes msg as the next message of the
+// answer to req, and reports whether it was the client's Finished.
+func (c *Conn) processClientCertificateResponse(req *clientCertRequest, msg any) (bool, error) {
+	if req.certMsg == nil {
+		certMsg, err := c.readCertificateMsg(msg, req.certReq.certCompressionAlgorithms,
+			req.certReq.certificateRequestContext, req.transcript)
+		if err != nil {
+			return false, err
+		}
+
+		certs, chains, err := c.verifyCertsFromClient(certMsg.certificate, req.clientAuth)
+		if err != nil {
+			return false, err
+		}
+		if c.config.VerifyConnection != nil {
+			state := c.connectionStateLocked()
+			state.PeerCertificates = certs
+			state.VerifiedChains = chains
+			state.SignedCertificateTimestamps = certMsg.certificate.SignedCertificateTimestamps
+			state.OCSPResponse = certMsg.certificate.OCSPStaple
+			if err := c.config.VerifyConnection(state); err != nil {
+				c.sendAlert(alertBadCertificate)
+				return false, err
+			}
+		}
+		req.certMsg = certMsg
+		req.certs = certs
+		req.chains = chains
+		req.verified = len(certs) == 0
+		return false, nil
+	}
+
+	if !req.verified {
+		certVerify, ok := msg.(*certificateVerifyMsg)
+		if !ok {
+			c.sendAlert(alertUnexpectedMessage)
+			return false, unexpectedMessageError(certVerify, msg)
+		}
+		if err := c.verifyClientCertificateVerify(certVerify, req.transcript, req.certs[0].PublicKey); err != nil {
+			return false, err
+		}
+		req.transcript.Write(certVerify.marshal())
+		req.verified = true
+		return false, nil
+	}
+
+	finished, ok := msg.(*finishedMsg)
+	if !ok {
+		c.sendAlert(alertUnexpectedMessage)
+		return false, unexpectedMessageError(finished, msg)
+	}
+	expectedMAC := c.postHandshakeAuth.suite.finishedHash(c.in.trafficSecret, req.transcript)
+	if !hmac.Equal(expectedMAC, finished.verifyData) {
+		c.sendAlert(alertDecryptError)
+		return false, errors.New("tls: invalid client finished hash")
+	}
+
+	c.peerMutex.Lock()
+	defer c.peerMutex.Unlock()
+	c.peerCertificates = req.certs
+	c.verifiedChains = req.chains
+	c.ocspResponse = req.certMsg.certificate.OCSPStaple
+	c.scts = req.certMsg.certificate.SignedCertificateTimestamps
+	return true, nil
+}
+
+// handleCertificateRequest answers a post-handshake CertificateRequest from
+// the server with a certificate from Config.GetClientCertificate or
+// Config.Certificates, which may be empty.
+func (c *Conn) handleCertificateRequest(certReq *certificateRequestMsgTLS13) error {
+	auth := c.postHandshakeAuth
+	if !c.isClient || auth == nil {
+		c.sendAlert(alertUnexpectedMessage)
+		return c.in.setErrorLocked(errors.New("tls: received unexpected certificate request"))
+	}
+	if len(certReq.certificateRequestContext) == 0 {
+		c.sendAlert(alertIllegalParameter)
+		return c.in.setErrorLocked(errors.New("tls: received a post-handshake certificate request without a context"))
+	}
+
+	transcript := cloneHash(auth.transcript, auth.suite.hash)
+	if transcript == nil {
+		return c.in.setErrorLocked(c.sendAlert(alertInternalError))
+	}
+	transcript.Write(certReq.marshal())
+
+	cert, err := c.getClientCertificate(&CertificateRequestInfo{
+		AcceptableCAs:    certReq.certificateAuthorities,
+		SignatureSchemes: certReq.supportedSignatureAlgorithms,
+		Version:          c.vers,
+		ctx:              context.Background(),
+	})
+	if err != nil {
+		c.sendAlert(alertInternalError)
+		return c.in.setErrorLocked(err)
+	}
+	msgs, err := c.clientCertificateMsgs(certReq, cert, transcript)
+	if err != nil {
+		return c.in.setErrorLocked(err)
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	msgs = append(msgs, &finishedMsg{
+		verifyData: auth.suite.finishedHash(c.out.trafficSecret, transcript),
+	})
+	for _, msg := range msgs {
+		if _, err := c.writeRecordLocked(recordTypeHandshake, msg.marshal()); err != nil {
+			// Surface the error at the next write.
+			c.out.setErrorLocked(err)
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package tls
+
+import (
+	"io"
+	"testing"
+)
+
+func TestPostHandshakeAuth(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.Certificates = serverConfig.Certificates
+	serverConfig.ClientCAs = clientConfig.RootCAs
+	clientConfig.CertCompressionAlgorithms = []CertCompressionAlgo{CertCompressionZlib}
+	serverConfig.CertCompressionAlgorithms = []CertCompressionAlgo{CertCompressionZlib}
+	cli, srv := testConns(t, clientConfig, serverConfig)
+	if n := len(srv.ConnectionState().PeerCertificates); n != 0 {
+		t.Fatalf("server got %d client certificates during the handshake", n)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		// The client answers the request as it reads.
+		if _, err := cli.Write([]byte("in flight")); err != nil {
+			errc <- err
+			return
+		}
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(cli, buf)
+		errc <- err
+	}()
+	if err := srv.RequestClientCertificate(RequireAndVerifyClientCert); err != nil {
+		t.Fatal(err)
+	}
+	if ss := srv.ConnectionState(); len(ss.PeerCertificates) != 1 || len(ss.VerifiedChains) == 0 {
+		t.Errorf("got %d certificates and %d chains after post-handshake auth", len(ss.PeerCertificates), len(ss.VerifiedChains))
+	}
+
+	// Application data read while waiting for the answer is kept.
+	buf := make([]byte, len("in flight"))
+	if _, err := io.ReadFull(srv, buf); err != nil || string(buf) != "in flight" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	if _, err := srv.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostHandshakeAuthConcurrentRead(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.Certificates = serverConfig.Certificates
+	serverConfig.ClientCAs = clientConfig.RootCAs
+	cli, srv := testConns(t, clientConfig, serverConfig)
+
+	readc := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(srv, buf)
+		readc <- string(buf)
+	}()
+	go io.Copy(io.Discard, cli)
+	// ConnectionState doesn't wait for the request.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				srv.ConnectionState()
+			}
+		}
+	}()
+	if err := srv.RequestClientCertificate(RequireAnyClientCert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Write([]byte("done")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-readc; got != "done" {
+		t.Errorf("server read %q", got)
+	}
+}
+
+func TestPostHandshakeAuthNoCertificate(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	serverConfig.ClientCAs = clientConfig.RootCAs
+	clientConfig.GetClientCertificate = func(*CertificateRequestInfo) (*Certificate, error) {
+		return new(Certificate), nil
+	}
+
+	cli, srv := testConns(t, clientConfig, serverConfig)
+	go io.Copy(io.Discard, cli)
+	if err := srv.RequestClientCertificate(RequestClientCert); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.ConnectionState().PeerCertificates); n != 0 {
+		t.Errorf("got %d certificates", n)
+	}
+	if err := srv.RequestClientCertificate(RequireAnyClientCert); err == nil {
+		t.Error("server accepted an empty certificate it required")
+	}
+
+	// A client with no certificate to answer with doesn't offer it.
+	clientConfig.GetClientCertificate = nil
+	_, srv = testConns(t, clientConfig, serverConfig)
+	if err := srv.RequestClientCertificate(RequestClientCert); err == nil {
+		t.Error("RequestClientCertificate succeeded without post_handshake_auth")
+	}
+}
+
+func TestPostHandshakeAuthClientHello(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.Certificates = serverConfig.Certificates
+	c := Client(nil, clientConfig)
+	hello, _, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseClientHello(hello.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.PostHandshakeAuth {
+		t.Error("ClientHello does not offer post_handshake_auth")
+	}
+}
+
+func TestPostHandshakeAuthBadSignature(t *testing.T) {
+	// A certificate is only reported once the client proved it holds its
+	// key and its Finished checked out.
+	clientConfig, serverConfig := testConfigs(t)
+	cert, roots := newTestCertificate("client.example")
+	other, _ := newTestCertificate("other.example")
+	cert.PrivateKey = other.PrivateKey
+	clientConfig.Certificates = []Certificate{cert}
+	serverConfig.ClientCAs = roots
+
+	cli, srv := testConns(t, clientConfig, serverConfig)
+	go io.Copy(io.Discard, cli)
+	if err := srv.RequestClientCertificate(RequireAndVerifyClientCert); err == nil {
+		t.Fatal("server accepted a CertificateVerify by the wrong key")
+	}
+	if n := len(srv.ConnectionState().PeerCertificates); n != 0 {
+		t.Errorf("got %d certificates after a failed request", n)
+	}
+}
+
+func TestPostHandshakeAuthHeldInput(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.Certificates = serverConfig.Certificates
+	serverConfig.ClientCAs = clientConfig.RootCAs
+	cli, srv := testConns(t, clientConfig, serverConfig)
+
+	// The client floods the server and never reads the request.
+	go cli.Write(make([]byte, maxHeldInput+maxPlaintext))
+	if err := srv.RequestClientCertificate(RequireAnyClientCert); err == nil {
+		t.Fatal("request succeeded without an answer")
+	}
+	// What was held is still returned, then the error.
+	if n, err := io.Copy(io.Discard, srv); err == nil || n > maxHeldInput+maxPlaintext {
+		t.Errorf("read %d bytes, then %v", n, err)
+	}
+}
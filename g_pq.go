@@ -0,0 +1,179 @@
+package tls
+
+import (
+	"errors"
+	"io"
+
+	"github.com/cloudflare/circl/kem"
+	"github.com/cloudflare/circl/kem/kyber/kyber768"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+)
+
+// ========== 后量子混合密钥交换 ==========
+
+// hybridGroup is a TLS 1.3 group that combines X25519 with a KEM. Key
+// shares and shared secrets are the concatenation of both halves.
+type hybridGroup struct {
+	kem kem.Scheme
+	// x25519First is set if the X25519 half comes first.
+	x25519First bool
+}
+
+// hybridGroupFor returns the hybrid group of id, if it is one.
+func hybridGroupFor(id CurveID) (hybridGroup, bool) {
+	switch id {
+	case X25519MLKEM768:
+		// draft-kwiatkowski-tls-ecdhe-mlkem: the ML-KEM half comes first.
+		return hybridGroup{kem: mlkem768.Scheme()}, true
+	case X25519Kyber768Draft00:
+		// draft-tls-westerbaan-xyber768d00
+		return hybridGroup{kem: kyber768.Scheme(), x25519First: true}, true
+	}
+	return hybridGroup{}, false
+}
+
+// isSupportedGroup reports whether key shares can be made for id in TLS 1.3.
+// Hybrid groups are never used in TLS 1.2.
+func isSupportedGroup(id CurveID) bool {
+	if _, ok := curveForCurveID(id); ok || id == X25519 {
+		return true
+	}
+	_, ok := hybridGroupFor(id)
+	return ok
+}
+
+// join concatenates the X25519 and KEM halves in the order of g.
+func (g hybridGroup) join(x25519, kemPart []byte) []byte {
+	if g.x25519First {
+		return append(append([]byte(nil), x25519...), kemPart...)
+	}
+	return append(append([]byte(nil), kemPart...), x25519...)
+}
+
+// split splits b into its X25519 half and a KEM half of kemLen bytes.
+func (g hybridGroup) split(b []byte, kemLen int) (x25519, kemPart []byte, ok bool) {
+	if len(b) != kemLen+32 {
+		return nil, nil, false
+	}
+	if g.x25519First {
+		return b[:32], b[32:], true
+	}
+	return b[kemLen:], b[:kemLen], true
+}
+
+// hybridParameters is the client side of a hybrid group: an X25519 key pair
+// and a KEM decapsulation key.
+type hybridParameters struct {
+	curveID   CurveID
+	group     hybridGroup
+	x25519    ecdheParameters
+	kemKey    kem.PrivateKey
+	publicKey []byte
+}
+
+func generateHybridParameters(rand io.Reader, curveID CurveID, group hybridGroup) (ecdheParameters, error) {
+	x25519, err := generateECDHEParameters(rand, X25519)
+	if err != nil {
+		return nil, err
+	}
+	seed := make([]byte, group.kem.SeedSize())
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, err
+	}
+	pk, sk := group.kem.DeriveKeyPair(seed)
+	kemPublic, err := pk.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &hybridParameters{
+		curveID:   curveID,
+		group:     group,
+		x25519:    x25519,
+		kemKey:    sk,
+		publicKey: group.join(x25519.PublicKey(), kemPublic),
+	}, nil
+}
+
+func (p *hybridParameters) CurveID() CurveID {
+	return p.curveID
+}
+
+func (p *hybridParameters) PublicKey() []byte {
+	return p.publicKey
+}
+
+// SharedKey decapsulates the KEM ciphertext in the server's key share and
+// completes the X25519 exchange.
+func (p *hybridParameters) SharedKey(serverShare []byte) []byte {
+	x25519, ciphertext, ok := p.group.split(serverShare, p.group.kem.CiphertextSize())
+	if !ok {
+		return nil
+	}
+	x25519Shared := p.x25519.SharedKey(x25519)
+	if x25519Shared == nil {
+		return nil
+	}
+	kemShared, err := p.group.kem.Decapsulate(p.kemKey, ciphertext)
+	if err != nil {
+		return nil
+	}
+	return p.group.join(x25519Shared, kemShared)
+}
+
+// serverKeyShare returns the key share a server answers clientShare with,
+// and the shared secret. For ECDHE groups it is a fresh key pair. For hybrid
+// groups the KEM half is a ciphertext encapsulated to the client's key. The
+// shared secret is nil if clientShare is invalid.
+func serverKeyShare(rand io.Reader, curveID CurveID, clientShare []byte) (share, sharedKey []byte, err error) {
+	group, ok := hybridGroupFor(curveID)
+	if !ok {
+		params, err := generateECDHEParameters(rand, curveID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return params.PublicKey(), params.SharedKey(clientShare), nil
+	}
+
+	x25519, kemPublic, ok := group.split(clientShare, group.kem.PublicKeySize())
+	if !ok {
+		return nil, nil, nil
+	}
+	pk, err := group.kem.UnmarshalBinaryPublicKey(kemPublic)
+	if err != nil {
+		return nil, nil, nil
+	}
+	seed := make([]byte, group.kem.EncapsulationSeedSize())
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, nil, err
+	}
+	ciphertext, kemShared, err := group.kem.EncapsulateDeterministically(pk, seed)
+	if err != nil {
+		return nil, nil, errors.New("tls: internal error: " + err.Error())
+	}
+	params, err := generateECDHEParameters(rand, X25519)
+	if err != nil {
+		return nil, nil, err
+	}
+	x25519Shared := params.SharedKey(x25519)
+	if x25519Shared == nil {
+		return nil, nil, nil
+	}
+	return group.join(params.PublicKey(), ciphertext), group.join(x25519Shared, kemShared), nil
+}
+
+// containsCurve reports whether curves contains id.
+func containsCurve(curves []CurveID, id CurveID) bool {
+	for _, c := range curves {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsECDHECurve is like supportsCurve, for the ECDHE key exchange of
+// TLS 1.2, which hybrid groups can't be used in.
+func (c *Config) supportsECDHECurve(curve CurveID) bool {
+	_, hybrid := hybridGroupFor(curve)
+	return !hybrid && c.supportsCurve(curve)
+}
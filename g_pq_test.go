@@ -0,0 +1,104 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestHybridKeyExchange(t *testing.T) {
+	for _, group := range []CurveID{X25519MLKEM768, X25519Kyber768Draft00} {
+		t.Run(group.String(), func(t *testing.T) {
+			for _, tt := range []struct {
+				name         string
+				clientCurves []CurveID
+				serverCurves []CurveID
+				maxVersion   uint16
+				want         CurveID
+			}{
+				{"Direct", []CurveID{group, X25519}, []CurveID{group, X25519}, 0, group},
+				{"HelloRetryRequest", []CurveID{X25519, group}, []CurveID{group}, 0, group},
+				{"HelloRetryRequestOnly", []CurveID{CurveP256, group}, []CurveID{group, CurveP384}, 0, group},
+				{"FallbackX25519", []CurveID{group, X25519}, nil, 0, X25519},
+				{"FallbackHelloRetryRequest", []CurveID{group, CurveP384}, nil, 0, CurveP384},
+				{"TLS12", []CurveID{group, CurveP256}, []CurveID{group, CurveP256}, VersionTLS12, CurveP256},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					clientConfig, serverConfig := testConfigs(t)
+					clientConfig.CurvePreferences = tt.clientCurves
+					serverConfig.CurvePreferences = tt.serverCurves
+					clientConfig.MaxVersion = tt.maxVersion
+					cs, ss, err := testHandshake(t, clientConfig, serverConfig)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if cs.CurveID != tt.want || ss.CurveID != tt.want {
+						t.Errorf("CurveID = %v on the client, %v on the server, want %v", cs.CurveID, ss.CurveID, tt.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestHybridKeyExchangeGaseous(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.CurvePreferences = []CurveID{X25519MLKEM768}
+	serverConfig.CurvePreferences = []CurveID{X25519MLKEM768}
+	clientConfig.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true}
+	serverConfig.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true}
+	cs, _, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.CurveID != X25519MLKEM768 {
+		t.Errorf("CurveID = %v", cs.CurveID)
+	}
+}
+
+func TestHybridKeyShares(t *testing.T) {
+	clientConfig, _ := testConfigs(t)
+	clientConfig.CurvePreferences = []CurveID{X25519MLKEM768, CurveP256, X25519}
+	hello, params, err := Client(nil, clientConfig).makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hello.keyShares) != 2 || len(params) != 2 ||
+		hello.keyShares[0].group != X25519MLKEM768 || hello.keyShares[1].group != X25519 {
+		t.Fatalf("got key shares %v", hello.keyShares)
+	}
+	if n := len(hello.keyShares[0].data); n != 1184+32 {
+		t.Errorf("X25519MLKEM768 key share is %d bytes", n)
+	}
+
+	clientConfig.CurvePreferences = []CurveID{X25519MLKEM768, CurveP256}
+	if hello, _, err := Client(nil, clientConfig).makeClientHello(); err != nil || len(hello.keyShares) != 1 {
+		t.Errorf("got %d key shares without X25519 preferred, err %v", len(hello.keyShares), err)
+	}
+}
+
+func TestHybridSharedKey(t *testing.T) {
+	for _, group := range []CurveID{X25519MLKEM768, X25519Kyber768Draft00} {
+		params, err := generateECDHEParameters(rand.Reader, group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		share, serverSecret, err := serverKeyShare(rand.Reader, group, params.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientSecret := params.SharedKey(share)
+		if len(clientSecret) != 64 || !bytes.Equal(clientSecret, serverSecret) {
+			t.Errorf("%v: client secret %x, server secret %x", group, clientSecret, serverSecret)
+		}
+
+		for _, bad := range [][]byte{nil, params.PublicKey()[1:], append(params.PublicKey(), 0)} {
+			if _, secret, err := serverKeyShare(rand.Reader, group, bad); err != nil || secret != nil {
+				t.Errorf("%v: accepted a %d-byte client share: %v", group, len(bad), err)
+			}
+		}
+		if params.SharedKey(share[1:]) != nil {
+			t.Errorf("%v: accepted a short server share", group)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package tls
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ========== 服务端模仿配置 ==========
+
+// GaseousSessionIDPolicy controls the session ID a TLS 1.2 server sends in a
+// full handshake. Resumptions always echo the client's session ID, as does
+// every TLS 1.3 ServerHello.
+type GaseousSessionIDPolicy uint8
+
+const (
+	// GaseousSessionIDEmpty sends an empty session ID.
+	GaseousSessionIDEmpty GaseousSessionIDPolicy = iota
+	// GaseousSessionIDRandom sends a new random 32-byte session ID.
+	GaseousSessionIDRandom
+)
+
+// GaseousServerProfile describes the ServerHello behaviour of a popular TLS
+// server stack. A server with GaseousConfig.ServerProfile set mimics it, and
+// the profile ID names it in fingerprint-mode ServerHello frames.
+type GaseousServerProfile struct {
+	// ID identifies the profile on the wire. It must be unique and not 0.
+	ID uint16
+	// Name is a human-readable name, such as "nginx-openssl".
+	Name string
+	// CipherSuitesTLS13 is the server's TLS 1.3 cipher suite preference
+	// order. If empty, the package default is used.
+	CipherSuitesTLS13 []uint16
+	// CipherSuites is the server's TLS 1.0–1.2 cipher suite preference
+	// order. Suites not enabled in Config are skipped. If empty, the package
+	// default is used.
+	CipherSuites []uint16
+	// ExtensionOrder lists ServerHello extension IDs in the order the stack
+	// sends them. Unlisted extensions follow in the package default order.
+	ExtensionOrder []uint16
+	// SessionID selects the TLS 1.2 full handshake session ID behaviour.
+	SessionID GaseousSessionIDPolicy
+}
+
+// Clone returns a deep copy of p.
+func (p *GaseousServerProfile) Clone() *GaseousServerProfile {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.CipherSuitesTLS13 = slices.Clone(p.CipherSuitesTLS13)
+	c.CipherSuites = slices.Clone(p.CipherSuites)
+	c.ExtensionOrder = slices.Clone(p.ExtensionOrder)
+	return &c
+}
+
+// GaseousServerProfileGo returns a copy of the built-in profile of this
+// package's own ServerHello.
+func GaseousServerProfileGo() *GaseousServerProfile {
+	return gaseousServerProfileGo.Clone()
+}
+
+// GaseousServerProfileNginxOpenSSL returns a copy of the built-in profile of
+// nginx built with OpenSSL.
+func GaseousServerProfileNginxOpenSSL() *GaseousServerProfile {
+	return gaseousServerProfileNginxOpenSSL.Clone()
+}
+
+// GaseousServerProfileCloudflare returns a copy of the built-in profile of
+// Cloudflare's edge servers.
+func GaseousServerProfileCloudflare() *GaseousServerProfile {
+	return gaseousServerProfileCloudflare.Clone()
+}
+
+// Built-in server profiles. They cover the ServerHello fields this package
+// can produce; extensions it doesn't implement are never sent. They are only
+// handed out as copies, so the catalogue can't be changed through them.
+var (
+	gaseousServerProfileGo = &GaseousServerProfile{
+		ID:   1,
+		Name: "go",
+		CipherSuitesTLS13: []uint16{
+			TLS_AES_128_GCM_SHA256,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_AES_256_GCM_SHA384,
+		},
+		SessionID: GaseousSessionIDEmpty,
+	}
+	gaseousServerProfileNginxOpenSSL = &GaseousServerProfile{
+		ID:   2,
+		Name: "nginx-openssl",
+		CipherSuitesTLS13: []uint16{
+			TLS_AES_256_GCM_SHA384,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_AES_128_GCM_SHA256,
+		},
+		CipherSuites: []uint16{
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		},
+		ExtensionOrder: []uint16{
+			extensionRenegotiationInfo,
+			extensionSupportedPoints,
+			extensionSessionTicket,
+			extensionStatusRequest,
+			extensionALPN,
+			extensionSCT,
+			extensionSupportedVersions,
+			extensionKeyShare,
+			extensionPreSharedKey,
+		},
+		SessionID: GaseousSessionIDRandom,
+	}
+	gaseousServerProfileCloudflare = &GaseousServerProfile{
+		ID:   3,
+		Name: "cloudflare",
+		CipherSuitesTLS13: []uint16{
+			TLS_AES_128_GCM_SHA256,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_AES_256_GCM_SHA384,
+		},
+		CipherSuites: []uint16{
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		},
+		ExtensionOrder: []uint16{
+			extensionPreSharedKey,
+			extensionKeyShare,
+			extensionSupportedVersions,
+			extensionRenegotiationInfo,
+			extensionSessionTicket,
+			extensionStatusRequest,
+			extensionSCT,
+			extensionALPN,
+			extensionSupportedPoints,
+		},
+		SessionID: GaseousSessionIDRandom,
+	}
+)
+
+var gaseousServerProfiles = struct {
+	sync.RWMutex
+	byID map[uint16]*GaseousServerProfile
+	ids  []uint16 // registration order, used when matching
+}{
+	byID: make(map[uint16]*GaseousServerProfile),
+}
+
+func init() {
+	for _, p := range []*GaseousServerProfile{
+		gaseousServerProfileGo,
+		gaseousServerProfileNginxOpenSSL,
+		gaseousServerProfileCloudflare,
+	} {
+		if err := RegisterGaseousServerProfile(p); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterGaseousServerProfile adds a copy of p to the server profile
+// catalogue, so it can be named in fingerprint-mode ServerHello frames. Both
+// peers must register the same profiles under the same IDs.
+func RegisterGaseousServerProfile(p *GaseousServerProfile) error {
+	if p == nil || p.ID == 0 {
+		return errors.New("gaseous: server profile needs a non-zero ID")
+	}
+	gaseousServerProfiles.Lock()
+	defer gaseousServerProfiles.Unlock()
+	if _, ok := gaseousServerProfiles.byID[p.ID]; ok {
+		return errors.New("gaseous: duplicate server profile ID")
+	}
+	gaseousServerProfiles.byID[p.ID] = p.Clone()
+	gaseousServerProfiles.ids = append(gaseousServerProfiles.ids, p.ID)
+	return nil
+}
+
+// GaseousServerProfileByName returns a copy of the registered profile with
+// the given name, or nil.
+func GaseousServerProfileByName(name string) *GaseousServerProfile {
+	gaseousServerProfiles.RLock()
+	defer gaseousServerProfiles.RUnlock()
+	for _, id := range gaseousServerProfiles.ids {
+		if p := gaseousServerProfiles.byID[id]; p.Name == name {
+			return p.Clone()
+		}
+	}
+	return nil
+}
+
+func gaseousServerProfileByID(id uint16) *GaseousServerProfile {
+	gaseousServerProfiles.RLock()
+	defer gaseousServerProfiles.RUnlock()
+	return gaseousServerProfiles.byID[id]
+}
+
+func allGaseousServerProfiles() []*GaseousServerProfile {
+	gaseousServerProfiles.RLock()
+	defer gaseousServerProfiles.RUnlock()
+	out := make([]*GaseousServerProfile, 0, len(gaseousServerProfiles.ids))
+	for _, id := range gaseousServerProfiles.ids {
+		out = append(out, gaseousServerProfiles.byID[id])
+	}
+	return out
+}
+
+// serverProfile returns the profile a server mimics, or nil.
+func (g *GaseousConfig) serverProfile() *GaseousServerProfile {
+	if g == nil {
+		return nil
+	}
+	return g.ServerProfile
+}
+
+// ========== ServerHello 指纹模式 ==========
+
+// matchServerProfile returns the first registered profile that rebuilds hello
+// byte for byte from its fields, along with those fields.
+func matchServerProfile(hello []byte) (*GaseousServerProfile, *serverHelloMsg) {
+	m := new(serverHelloMsg)
+	if !m.unmarshal(append([]byte{}, hello...)) {
+		return nil, nil
+	}
+	for _, p := range allGaseousServerProfiles() {
+		m.raw = nil
+		m.extensionOrder = p.ExtensionOrder
+		if bytes.Equal(m.marshal(), hello) {
+			return p, m
+		}
+	}
+	return nil, nil
+}
+
+// Flags of a fingerprint-mode ServerHello payload.
+const (
+	gaseousSHFlagOCSP = 1 << iota
+	gaseousSHFlagTicket
+	gaseousSHFlagRenegotiation
+	gaseousSHFlagSelectedIdentity
+	gaseousSHFlagExtendedMasterSecret
+	gaseousSHFlagRecordSizeLimit // followed by the limit, after the other fields
+)
+
+// marshalServerHelloParams encodes the fields of m that vary between
+// connections, for a fingerprint-mode ServerHello frame.
+func marshalServerHelloParams(p *GaseousServerProfile, m *serverHelloMsg) []byte {
+	var flags uint8
+	if m.ocspStapling {
+		flags |= gaseousSHFlagOCSP
+	}
+	if m.ticketSupported {
+		flags |= gaseousSHFlagTicket
+	}
+	if m.secureRenegotiationSupported {
+		flags |= gaseousSHFlagRenegotiation
+	}
+	if m.selectedIdentityPresent {
+		flags |= gaseousSHFlagSelectedIdentity
+	}
+	if m.extendedMasterSecret {
+		flags |= gaseousSHFlagExtendedMasterSecret
+	}
+	if m.recordSizeLimit != 0 {
+		flags |= gaseousSHFlagRecordSizeLimit
+	}
+	var b cryptobyte.Builder
+	b.AddUint16(p.ID)
+	b.AddUint16(m.vers)
+	addBytesWithLength(&b, m.random, 32)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(m.sessionId) })
+	b.AddUint16(m.cipherSuite)
+	b.AddUint8(m.compressionMethod)
+	b.AddUint8(flags)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(m.secureRenegotiation) })
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(m.alpnProtocol)) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, sct := range m.scts {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(sct) })
+		}
+	})
+	b.AddUint16(m.supportedVersion)
+	b.AddUint16(uint16(m.serverShare.group))
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(m.serverShare.data) })
+	b.AddUint16(m.selectedIdentity)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(m.cookie) })
+	b.AddUint16(uint16(m.selectedGroup))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(m.supportedPoints) })
+	if m.recordSizeLimit != 0 {
+		b.AddUint16(m.recordSizeLimit)
+	}
+	return b.BytesOrPanic()
+}
+
+// buildServerHelloFromParams rebuilds the ServerHello handshake message
+// encoded by marshalServerHelloParams.
+func buildServerHelloFromParams(payload []byte) ([]byte, error) {
+	s := cryptobyte.String(payload)
+	m := new(serverHelloMsg)
+	var id, group, selectedGroup uint16
+	var flags uint8
+	var alpn []byte
+	var scts cryptobyte.String
+	if !s.ReadUint16(&id) || !s.ReadUint16(&m.vers) || !s.ReadBytes(&m.random, 32) ||
+		!readUint8LengthPrefixed(&s, &m.sessionId) ||
+		!s.ReadUint16(&m.cipherSuite) || !s.ReadUint8(&m.compressionMethod) ||
+		!s.ReadUint8(&flags) ||
+		!readUint8LengthPrefixed(&s, &m.secureRenegotiation) ||
+		!readUint8LengthPrefixed(&s, &alpn) ||
+		!s.ReadUint16LengthPrefixed(&scts) ||
+		!s.ReadUint16(&m.supportedVersion) ||
+		!s.ReadUint16(&group) || !readUint16LengthPrefixed(&s, &m.serverShare.data) ||
+		!s.ReadUint16(&m.selectedIdentity) ||
+		!readUint16LengthPrefixed(&s, &m.cookie) ||
+		!s.ReadUint16(&selectedGroup) ||
+		!readUint8LengthPrefixed(&s, &m.supportedPoints) {
+		return nil, ErrGaseousTrunc
+	}
+	if flags&gaseousSHFlagRecordSizeLimit != 0 && (!s.ReadUint16(&m.recordSizeLimit) || m.recordSizeLimit == 0) {
+		return nil, ErrGaseousTrunc
+	}
+	if !s.Empty() {
+		return nil, ErrGaseousTrunc
+	}
+	for !scts.Empty() {
+		var sct []byte
+		if !readUint16LengthPrefixed(&scts, &sct) || len(sct) == 0 {
+			return nil, ErrGaseousTrunc
+		}
+		m.scts = append(m.scts, sct)
+	}
+	p := gaseousServerProfileByID(id)
+	if p == nil {
+		return nil, ErrGaseousTemplate
+	}
+	m.extensionOrder = p.ExtensionOrder
+	m.ocspStapling = flags&gaseousSHFlagOCSP != 0
+	m.ticketSupported = flags&gaseousSHFlagTicket != 0
+	m.secureRenegotiationSupported = flags&gaseousSHFlagRenegotiation != 0
+	m.selectedIdentityPresent = flags&gaseousSHFlagSelectedIdentity != 0
+	m.extendedMasterSecret = flags&gaseousSHFlagExtendedMasterSecret != 0
+	m.alpnProtocol = string(alpn)
+	m.serverShare.group = CurveID(group)
+	m.selectedGroup = CurveID(selectedGroup)
+	return m.marshal(), nil
+}
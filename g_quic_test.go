@@ -0,0 +1,243 @@
+package tls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// testQUICConn is one side of a QUIC connection, with the secrets it was
+// given.
+type testQUICConn struct {
+	conn        *QUICConn
+	readSecret  map[QUICEncryptionLevel][]byte
+	writeSecret map[QUICEncryptionLevel][]byte
+	peerParams  []byte
+	complete    bool
+	// onParamsRequired, if set, provides transport parameters late.
+	onParamsRequired func() []byte
+}
+
+func newTestQUICClient(config *Config) *testQUICConn {
+	q := &testQUICConn{conn: QUICClient(&QUICConfig{TLSConfig: config})}
+	q.conn.SetTransportParameters([]byte("client params"))
+	return q
+}
+
+func newTestQUICServer(config *Config) *testQUICConn {
+	q := &testQUICConn{conn: QUICServer(&QUICConfig{TLSConfig: config})}
+	q.conn.SetTransportParameters([]byte("server params"))
+	return q
+}
+
+// runTestQUICConnection runs a handshake between cli and srv, passing the
+// data each one writes to the other at the same level.
+func runTestQUICConnection(ctx context.Context, cli, srv *testQUICConn) error {
+	for _, q := range []*testQUICConn{cli, srv} {
+		q.readSecret = make(map[QUICEncryptionLevel][]byte)
+		q.writeSecret = make(map[QUICEncryptionLevel][]byte)
+	}
+	if err := cli.conn.Start(ctx); err != nil {
+		return err
+	}
+	if err := srv.conn.Start(ctx); err != nil {
+		return err
+	}
+	// Alternate between the sides until neither has anything left to do.
+	a, b := cli, srv
+	idle := 0
+	for idle < 2 {
+		e := a.conn.NextEvent()
+		switch e.Kind {
+		case QUICNoEvent:
+			idle++
+			a, b = b, a
+			continue
+		case QUICSetReadSecret:
+			a.readSecret[e.Level] = append([]byte(nil), e.Data...)
+		case QUICSetWriteSecret:
+			a.writeSecret[e.Level] = append([]byte(nil), e.Data...)
+		case QUICWriteData:
+			if err := b.conn.HandleData(e.Level, e.Data); err != nil {
+				return err
+			}
+		case QUICTransportParameters:
+			a.peerParams = append([]byte(nil), e.Data...)
+		case QUICTransportParametersRequired:
+			a.conn.SetTransportParameters(a.onParamsRequired())
+		case QUICHandshakeDone:
+			a.complete = true
+		}
+		idle = 0
+	}
+	if !cli.complete || !srv.complete {
+		return errors.New("handshake stalled")
+	}
+	return nil
+}
+
+func TestQUICConnection(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		setup func(client, server *Config)
+	}{
+		{"Plain", func(client, server *Config) {}},
+		{"HelloRetryRequest", func(client, server *Config) {
+			server.CurvePreferences = []CurveID{CurveP384}
+		}},
+		{"ClientCertificate", func(client, server *Config) {
+			client.Certificates = server.Certificates
+			server.ClientAuth = RequireAnyClientCert
+		}},
+		{"Gaseous", func(client, server *Config) {
+			// Gaseous frames are a record layer feature, and QUIC has none.
+			client.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true, ServerFlight: true}
+			server.Gaseous = &GaseousConfig{ClientHello: true, ServerHello: true, ServerFlight: true}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig, serverConfig := testConfigs(t)
+			clientConfig.MinVersion = VersionTLS13
+			serverConfig.MinVersion = VersionTLS13
+			clientConfig.NextProtos = []string{"h3"}
+			serverConfig.NextProtos = []string{"h3"}
+			tt.setup(clientConfig, serverConfig)
+			cli := newTestQUICClient(clientConfig)
+			srv := newTestQUICServer(serverConfig)
+			defer cli.conn.Close()
+			defer srv.conn.Close()
+			if err := runTestQUICConnection(context.Background(), cli, srv); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, level := range []QUICEncryptionLevel{QUICEncryptionLevelHandshake, QUICEncryptionLevelApplication} {
+				if cli.writeSecret[level] == nil || !bytes.Equal(cli.writeSecret[level], srv.readSecret[level]) ||
+					!bytes.Equal(srv.writeSecret[level], cli.readSecret[level]) {
+					t.Errorf("%v secrets don't match", level)
+				}
+			}
+			if string(cli.peerParams) != "server params" || string(srv.peerParams) != "client params" {
+				t.Errorf("got transport parameters %q and %q", cli.peerParams, srv.peerParams)
+			}
+			cs := cli.conn.ConnectionState()
+			if cs.Version != VersionTLS13 || cs.NegotiatedProtocol != "h3" || !cs.HandshakeComplete {
+				t.Errorf("got version %x, protocol %q", cs.Version, cs.NegotiatedProtocol)
+			}
+		})
+	}
+}
+
+func TestQUICTransportParametersRequired(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.MinVersion = VersionTLS13
+	serverConfig.MinVersion = VersionTLS13
+	cli := newTestQUICClient(clientConfig)
+	srv := &testQUICConn{conn: QUICServer(&QUICConfig{TLSConfig: serverConfig})}
+	var seen []byte
+	srv.onParamsRequired = func() []byte {
+		// The client's parameters arrive before the server must send its own.
+		seen = srv.peerParams
+		return []byte("late params")
+	}
+	if err := runTestQUICConnection(context.Background(), cli, srv); err != nil {
+		t.Fatal(err)
+	}
+	if string(seen) != "client params" || string(cli.peerParams) != "late params" {
+		t.Errorf("server saw %q before sending, client got %q", seen, cli.peerParams)
+	}
+}
+
+func TestQUICSessionResumption(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.MinVersion = VersionTLS13
+	serverConfig.MinVersion = VersionTLS13
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+
+	cli := newTestQUICClient(clientConfig)
+	srv := newTestQUICServer(serverConfig)
+	if err := runTestQUICConnection(context.Background(), cli, srv); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.conn.SendSessionTicket(); err == nil {
+		t.Error("client sent a session ticket")
+	}
+	if err := srv.conn.SendSessionTicket(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.conn.SendSessionTicket(); err == nil {
+		t.Error("sent a second session ticket")
+	}
+	e := srv.conn.NextEvent()
+	if e.Kind != QUICWriteData || e.Level != QUICEncryptionLevelApplication {
+		t.Fatalf("got event %+v, want application data", e)
+	}
+	if err := cli.conn.HandleData(e.Level, e.Data); err != nil {
+		t.Fatal(err)
+	}
+
+	cli = newTestQUICClient(clientConfig)
+	srv = newTestQUICServer(serverConfig)
+	if err := runTestQUICConnection(context.Background(), cli, srv); err != nil {
+		t.Fatal(err)
+	}
+	if !cli.conn.ConnectionState().DidResume || !srv.conn.ConnectionState().DidResume {
+		t.Error("second connection did not resume")
+	}
+}
+
+func TestQUICAlerts(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.MinVersion = VersionTLS13
+	serverConfig.MinVersion = VersionTLS13
+	clientConfig.NextProtos = []string{"h3"}
+	serverConfig.NextProtos = []string{"h2"}
+	cli := newTestQUICClient(clientConfig)
+	srv := newTestQUICServer(serverConfig)
+	err := runTestQUICConnection(context.Background(), cli, srv)
+	var ae AlertError
+	if !errors.As(err, &ae) || alert(ae) != alertNoApplicationProtocol {
+		t.Errorf("got error %v, want a no_application_protocol AlertError", err)
+	}
+
+	clientConfig.MinVersion = VersionTLS12
+	if err := QUICClient(&QUICConfig{TLSConfig: clientConfig}).Start(context.Background()); err == nil {
+		t.Error("started a QUIC connection that allows TLS 1.2")
+	}
+}
+
+func TestQUICWrongLevel(t *testing.T) {
+	clientConfig, _ := testConfigs(t)
+	clientConfig.MinVersion = VersionTLS13
+	cli := newTestQUICClient(clientConfig)
+	if err := cli.conn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.conn.HandleData(QUICEncryptionLevelHandshake, []byte{0}); err == nil {
+		t.Error("accepted handshake data at the wrong level")
+	}
+	if err := cli.conn.Close(); err == nil {
+		t.Error("Close during the handshake returned no error")
+	}
+}
+
+func TestQUICClientHello(t *testing.T) {
+	clientConfig, _ := testConfigs(t)
+	clientConfig.MinVersion = VersionTLS13
+	cli := newTestQUICClient(clientConfig)
+	if err := cli.conn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.conn.Close()
+	e := cli.conn.NextEvent()
+	if e.Kind != QUICWriteData || e.Level != QUICEncryptionLevelInitial {
+		t.Fatalf("got event %+v, want Initial data", e)
+	}
+	hello, err := ParseClientHello(e.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hello.SessionID) != 0 || hello.Extensions[extensionQUICTransportParameters] == nil {
+		t.Errorf("got session ID %x, extensions %v", hello.SessionID, hello.ExtensionIDs())
+	}
+}
@@ -0,0 +1,89 @@
+package tls
+
+import "errors"
+
+// ========== 记录大小限制 ==========
+
+const extensionRecordSizeLimit uint16 = 28
+
+// minRecordSizeLimit is the smallest record_size_limit an endpoint may
+// advertise. See RFC 8449, Section 4.
+const minRecordSizeLimit = 64
+
+// maxRecordSizeLimit returns the largest record_size_limit of vers: the
+// maximum plaintext of a record, plus the content type in TLS 1.3.
+func maxRecordSizeLimit(vers uint16) uint16 {
+	if vers == VersionTLS13 {
+		return maxPlaintext + 1
+	}
+	return maxPlaintext
+}
+
+// recordSizeLimit returns the record_size_limit an endpoint of c advertises
+// for vers. If c.RecordSizeLimit is zero, it is the protocol maximum.
+func (c *Config) recordSizeLimit(vers uint16) uint16 {
+	limit := c.RecordSizeLimit
+	switch {
+	case limit == 0 || limit > maxRecordSizeLimit(vers):
+		return maxRecordSizeLimit(vers)
+	case limit < minRecordSizeLimit:
+		return minRecordSizeLimit
+	}
+	return limit
+}
+
+// recordSizeLimitPlaintext returns the most plaintext bytes of a record
+// allowed by the record_size_limit value limit, once vers is negotiated.
+func recordSizeLimitPlaintext(vers, limit uint16) int {
+	if limit > maxRecordSizeLimit(vers) {
+		limit = maxRecordSizeLimit(vers)
+	}
+	if vers == VersionTLS13 {
+		return int(limit) - 1
+	}
+	return int(limit)
+}
+
+// setRecordSizeLimits applies the record_size_limit values negotiated by the
+// two endpoints, local being the one c sent, to the protected records of
+// the connection.
+func (c *Conn) setRecordSizeLimits(local, peer uint16) error {
+	if peer < minRecordSizeLimit {
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: peer sent a record_size_limit below 64")
+	}
+	c.in.recordSizeLimit = recordSizeLimitPlaintext(c.vers, local)
+	c.out.recordSizeLimit = recordSizeLimitPlaintext(c.vers, peer)
+	return nil
+}
+
+// overRecordSizeLimit reports whether n bytes of plaintext exceed the
+// negotiated record size limit of hc. Unprotected records are not limited.
+func (hc *halfConn) overRecordSizeLimit(n int) bool {
+	return hc.cipher != nil && hc.recordSizeLimit > 0 && n > hc.recordSizeLimit
+}
+
+// receivedOverRecordSizeLimit is like overRecordSizeLimit for a received
+// record with a payload of n bytes on the wire, which decrypted to plaintext
+// bytes of content. In TLS 1.3 the limit covers the content type and padding
+// too, which decrypt already stripped, so it is checked against the payload.
+func (hc *halfConn) receivedOverRecordSizeLimit(n, plaintext int) bool {
+	if c, ok := hc.cipher.(aead); ok && hc.version == VersionTLS13 {
+		// hc.recordSizeLimit doesn't count the content type.
+		return hc.overRecordSizeLimit(n - c.Overhead() - 1)
+	}
+	return hc.overRecordSizeLimit(plaintext)
+}
+
+// checkRecordSizeLimit applies the record_size_limit the server answered
+// hello with, if any.
+func (c *Conn) checkRecordSizeLimit(hello *clientHelloMsg, limit uint16) error {
+	if limit == 0 {
+		return nil
+	}
+	if hello.recordSizeLimit == 0 {
+		c.sendAlert(alertUnsupportedExtension)
+		return errors.New("tls: server sent an unrequested record_size_limit extension")
+	}
+	return c.setRecordSizeLimits(hello.recordSizeLimit, limit)
+}
@@ -0,0 +1,80 @@
+package tls
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRecordSizeLimit(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		clientConfig, serverConfig := testConfigs(t)
+		clientConfig.MaxVersion = vers
+		clientConfig.RecordSizeLimit = 256
+		serverConfig.RecordSizeLimit = 512
+		cli, srv := testConns(t, clientConfig, serverConfig)
+		want := [2]int{512, 256}
+		if vers == VersionTLS13 {
+			want = [2]int{511, 255}
+		}
+		if got := [2]int{cli.ConnectionState().RecordSizeLimit, srv.ConnectionState().RecordSizeLimit}; got != want {
+			t.Errorf("%x: got limits %v, want %v", vers, got, want)
+		}
+
+		data := bytes.Repeat([]byte("x"), 3000)
+		go func() {
+			srv.Write(data)
+			io.Copy(io.Discard, srv)
+		}()
+		if _, err := cli.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(cli, buf); err != nil {
+			t.Fatalf("%x: %v", vers, err)
+		}
+
+		// A peer that ignores the limit is caught on read.
+		srv.out.Lock()
+		srv.out.recordSizeLimit = 0
+		srv.out.Unlock()
+		go srv.Write(data)
+		if _, err := io.ReadFull(cli, buf); err == nil {
+			t.Errorf("%x: client accepted a record over its limit", vers)
+		}
+	}
+}
+
+func TestRecordSizeLimitPadding(t *testing.T) {
+	// In TLS 1.3 the limit covers the padding, even of a record with no
+	// content.
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.RecordSizeLimit = 256
+	cli, srv := testConns(t, clientConfig, serverConfig)
+	srv.out.Lock()
+	srv.out.recordSizeLimit = 0
+	srv.out.Unlock()
+	go func() {
+		srv.WritePadding(256)
+		srv.Write([]byte("x"))
+	}()
+	if _, err := cli.Read(make([]byte, 1)); err == nil {
+		t.Error("client accepted a padded record over its limit")
+	}
+}
+
+func TestRecordSizeLimitServerDefault(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.RecordSizeLimit = 100
+	cli, srv := testConns(t, clientConfig, serverConfig)
+	if cs, ss := cli.ConnectionState(), srv.ConnectionState(); cs.RecordSizeLimit != maxPlaintext || ss.RecordSizeLimit != 99 {
+		t.Errorf("got limits %d and %d", cs.RecordSizeLimit, ss.RecordSizeLimit)
+	}
+
+	clientConfig.RecordSizeLimit = 0
+	serverConfig.RecordSizeLimit = 100
+	cli, _ = testConns(t, clientConfig, serverConfig)
+	if cs := cli.ConnectionState(); cs.RecordSizeLimit != 0 {
+		t.Errorf("server sent record_size_limit unrequested: %d", cs.RecordSizeLimit)
+	}
+}
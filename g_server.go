@@ -1,45 +1,168 @@
 package tls
 
 import (
-	"encoding/binary"
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/crypto/cryptobyte"
 )
 
+// PackServerHelloGaseous frames a ServerHello handshake message. A
+// HelloRetryRequest is framed as GaseousHelloTypeHelloRetryRequest.
+func PackServerHelloGaseous(hello []byte) ([]byte, error) {
+	return packServerHelloGaseous(hello, nil)
+}
+
+// UnpackServerHelloGaseous returns the ServerHello or HelloRetryRequest
+// handshake message carried by data.
 func UnpackServerHelloGaseous(data []byte) ([]byte, error) {
-	if len(data) < gaseousHelloHeaderSize {
-		return nil, ErrGaseousTrunc
-	}
-	hdr := GaseousHelloHeader{}
-	copy(hdr.Magic[:], data[:2])
-	hdr.Version = data[2]
-	hdr.Algo = data[3]
-	hdr.HelloType = data[4]
-	hdr.TemplID = binary.BigEndian.Uint16(data[5:7])
-	hdr.DataLen = binary.BigEndian.Uint32(data[7:11])
+	data = trimGaseousMarker(data)
+	if len(data) > 4 && data[4] == GaseousHelloTypeHelloRetryRequest {
+		return unpackGaseousHello(data, GaseousHelloTypeHelloRetryRequest, nil)
+	}
+	return unpackGaseousHello(data, GaseousHelloTypeServer, nil)
+}
+
+// PackServerFlightGaseous frames a TLS 1.3 ServerHello handshake message
+// together with records, the protected records the server sends after it in
+// its first flight.
+func PackServerFlightGaseous(serverHello, records []byte) ([]byte, error) {
+	return packServerFlightGaseous(serverHello, records, nil)
+}
 
-	if string(hdr.Magic[:]) != GaseousHelloMagic {
-		return nil, ErrGaseousMagic
+// UnpackServerFlightGaseous returns the ServerHello handshake message and the
+// protected records carried by a server flight frame.
+func UnpackServerFlightGaseous(data []byte) (serverHello, records []byte, err error) {
+	payload, err := unpackGaseousHello(trimGaseousMarker(data), GaseousHelloTypeServerFlight, nil)
+	if err != nil {
+		return nil, nil, err
 	}
-	if hdr.Version != GaseousHelloVersion {
-		return nil, ErrGaseousVersion
+	return parseGaseousFlight(payload)
+}
+
+// packServerHelloGaseous frames a ServerHello or HelloRetryRequest handshake
+// message, using template mode if a registered template matches and raw mode
+// otherwise.
+func packServerHelloGaseous(hello []byte, g *GaseousConfig) ([]byte, error) {
+	helloType := uint8(GaseousHelloTypeServer)
+	if isHelloRetryRequest(hello) {
+		helloType = GaseousHelloTypeHelloRetryRequest
 	}
-	if hdr.HelloType != GaseousHelloTypeServer {
-		return nil, ErrGaseousType
+	// Fingerprint mode is always exact for ServerHellos, as every field
+	// that varies is carried in the payload.
+	if g.fingerprintPolicy() != GaseousFingerprintDisabled {
+		if p, m := matchServerProfile(hello); p != nil {
+			return marshalGaseousFrame(helloType, 0xffff, marshalServerHelloParams(p, m), g)
+		}
 	}
-	if _, ok := gaseousTemplates.Templates[hdr.TemplID]; !ok {
-		return nil, ErrGaseousTemplate
+	if id, rest := g.templates().match(hello); id != 0 {
+		return marshalGaseousFrame(helloType, id, rest, g)
 	}
-	if int(hdr.DataLen)+gaseousHelloHeaderSize > len(data) {
-		return nil, ErrGaseousTrunc
+	return marshalGaseousFrame(helloType, 0, hello, g)
+}
+
+// isHelloRetryRequest reports whether msg is a ServerHello handshake
+// message carrying the HelloRetryRequest random.
+func isHelloRetryRequest(msg []byte) bool {
+	return len(msg) >= 4+2+32 && msg[0] == typeServerHello &&
+		bytes.Equal(msg[6:38], helloRetryRequestRandom)
+}
+
+func packServerFlightGaseous(serverHello, records []byte, g *GaseousConfig) ([]byte, error) {
+	payload := append(append([]byte(nil), serverHello...), records...)
+	if _, _, err := parseGaseousFlight(payload); err != nil {
+		return nil, err
+	}
+	return marshalGaseousFrame(GaseousHelloTypeServerFlight, 0, payload, g)
+}
+
+// parseGaseousFlight splits a server flight payload into the ServerHello and
+// the records that follow it, checking that the records are complete and
+// protected.
+func parseGaseousFlight(payload []byte) (serverHello, records []byte, err error) {
+	s := cryptobyte.String(payload)
+	var typ uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&typ) || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, nil, ErrGaseousTrunc
+	}
+	serverHello = payload[:len(payload)-len(s)]
+	if typ != typeServerHello || isHelloRetryRequest(serverHello) {
+		return nil, nil, errors.New("gaseous: server flight must start with a ServerHello")
+	}
+	records = s
+	for !s.Empty() {
+		var vers uint16
+		var fragment cryptobyte.String
+		if !s.ReadUint8(&typ) || !s.ReadUint16(&vers) || !s.ReadUint16LengthPrefixed(&fragment) {
+			return nil, nil, ErrGaseousTrunc
+		}
+		if recordType(typ) != recordTypeApplicationData {
+			return nil, nil, errors.New("gaseous: server flight carries an unprotected record")
+		}
 	}
-	compressed := data[gaseousHelloHeaderSize : gaseousHelloHeaderSize+int(hdr.DataLen)]
+	return serverHello, records, nil
+}
 
-	decompressed, err := gaseousDecompressData(compressed, GaseousHelloCompressAlgo(hdr.Algo))
+// unpackGaseousHello parses a frame (without the marker byte) of the given
+// type and rebuilds the handshake message it carries.
+func unpackGaseousHello(data []byte, helloType uint8, g *GaseousConfig) ([]byte, error) {
+	hdr, payload, err := parseGaseousFrame(data, g)
 	if err != nil {
 		return nil, err
 	}
-	tmpl := gaseousTemplates.Templates[hdr.TemplID]
-	helloMsg := fillHelloTemplate(tmpl, decompressed)
-	return helloMsg, nil
+	if hdr.HelloType != helloType {
+		return nil, ErrGaseousType
+	}
+	var msg []byte
+	switch hdr.TemplID {
+	case 0:
+		msg = payload
+	case 0xffff:
+		if helloType == GaseousHelloTypeServer || helloType == GaseousHelloTypeHelloRetryRequest {
+			if msg, err = buildServerHelloFromParams(payload); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if helloType != GaseousHelloTypeClient {
+			return nil, ErrGaseousTemplate
+		}
+		var params GaseousClientHelloParams
+		if err := json.Unmarshal(payload, &params); err != nil {
+			return nil, err
+		}
+		if msg, err = buildUTLSClientHello(&params); err != nil {
+			return nil, err
+		}
+	case gaseousTemplDelta:
+		if helloType != GaseousHelloTypeClient {
+			return nil, ErrGaseousTemplate
+		}
+		if msg, err = buildClientHelloFromDelta(payload); err != nil {
+			return nil, err
+		}
+	default:
+		tmpl := g.templates().Lookup(hdr.TemplID)
+		if tmpl == nil || helloType == GaseousHelloTypeServerFlight {
+			return nil, ErrGaseousTemplate
+		}
+		msg = fillHelloTemplate(tmpl, payload)
+	}
+	switch helloType {
+	case GaseousHelloTypeServer, GaseousHelloTypeHelloRetryRequest:
+		// Whatever mode it came in, the result must be a well-formed
+		// ServerHello of the announced kind.
+		parsed, err := ParseServerHello(msg)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.IsHelloRetryRequest != (helloType == GaseousHelloTypeHelloRetryRequest) {
+			return nil, ErrGaseousType
+		}
+	}
+	return msg, nil
 }
 
 func gaseousDecompressData(data []byte, algo GaseousHelloCompressAlgo) ([]byte, error) {
@@ -70,18 +193,18 @@ func IsGaseousHello(data []byte) bool {
 }
 
 func UnpackAnyGaseousHello(data []byte) (helloType uint8, helloMsg []byte, err error) {
+	data = trimGaseousMarker(data)
 	if len(data) < gaseousHelloHeaderSize {
 		return 0, nil, ErrGaseousTrunc
 	}
 	helloType = data[4]
 	switch helloType {
-	case GaseousHelloTypeClient:
-		// 客户端 Hello 解包，调用 UnpackClientHelloGaseous
-		hello, err := UnpackClientHelloGaseous(data)
-		return 1, hello, err
-	case GaseousHelloTypeServer:
-		hello, err := UnpackServerHelloGaseous(data)
-		return 2, hello, err
+	case GaseousHelloTypeClient, GaseousHelloTypeServer, GaseousHelloTypeHelloRetryRequest:
+		hello, err := unpackGaseousHello(data, helloType, nil)
+		return helloType, hello, err
+	case GaseousHelloTypeServerFlight:
+		hello, _, err := UnpackServerFlightGaseous(data)
+		return helloType, hello, err
 	default:
 		return helloType, nil, ErrGaseousType
 	}
@@ -0,0 +1,416 @@
+package tls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ========== ClientHello 构造 ==========
+
+// GREASEPlaceholder stands for a GREASE value (RFC 8701) in a
+// ClientHelloSpec. Each connection picks its own GREASE values, the way
+// browsers do.
+const GREASEPlaceholder uint16 = 0x0a0a
+
+// ClientHelloSpec describes the ClientHello a client sends, for
+// Config.ClientHelloSpec. Nil fields keep the values the client would send
+// without a spec. The handshake itself is unchanged: whatever the server
+// selects from the hello is negotiated with this package's key schedule.
+type ClientHelloSpec struct {
+	// CipherSuites lists the cipher suites in order, TLS 1.3 ones included.
+	// Suites this package doesn't implement may be listed, but the
+	// handshake fails if the server selects one.
+	CipherSuites []uint16
+	// CompressionMethods defaults to the null method only.
+	CompressionMethods []uint8
+	// SupportedCurves are the supported_groups.
+	SupportedCurves []CurveID
+	// KeyShareCurves are the groups to send TLS 1.3 key shares for, in
+	// order. It defaults to the first group of SupportedCurves.
+	KeyShareCurves          []CurveID
+	SupportedPoints         []uint8
+	SignatureAlgorithms     []SignatureScheme
+	SignatureAlgorithmsCert []SignatureScheme
+	// SupportedVersions should stay within MinVersion and MaxVersion.
+	SupportedVersions []uint16
+	// PSKModes defaults to psk_dhe_ke.
+	PSKModes []uint8
+
+	// Extensions lists the extensions in wire order. If nil, the usual
+	// extensions are sent in the usual order.
+	//
+	// An extension with nil Data is built from the spec and the Config, and
+	// left out if there is nothing to send, like server_name without a
+	// ServerName. An extension of type GREASEPlaceholder is a GREASE
+	// extension: empty the first time, one zero byte the next. padding
+	// (type 21) pads the hello to 512 bytes, the way BoringSSL does, if it
+	// would be between 256 and 511 bytes long. Extensions this package
+	// doesn't know are sent empty.
+	//
+	// An extension with Data is sent as is. The handshake doesn't read it,
+	// so replacing an extension this package negotiates, like ALPN, must
+	// agree with the Config. compress_certificate and record_size_limit are
+	// the exceptions: the client accepts a certificate compressed with any
+	// algorithm listed that this package implements, and rejects records
+	// over the limit sent.
+	//
+	// pre_shared_key, if listed, must come last. It and cookie are sent when
+	// resuming or after a HelloRetryRequest even if they aren't listed.
+	Extensions []HelloExtension
+}
+
+// clientHelloExtension is an entry of clientHelloMsg.extensions.
+type clientHelloExtension struct {
+	typ  uint16
+	data []byte // sent as is if raw
+	raw  bool
+}
+
+// GREASE values of a ClientHello, by use.
+const (
+	greaseCipher = iota
+	greaseGroup
+	greaseExtension1
+	greaseExtension2
+	greaseVersion
+	greaseSignature
+	greaseCount
+)
+
+// helloGREASE holds the GREASE values of one ClientHello.
+type helloGREASE [greaseCount]uint16
+
+func newHelloGREASE(rand io.Reader) (*helloGREASE, error) {
+	var seed [greaseCount]byte
+	if _, err := io.ReadFull(rand, seed[:]); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	g := new(helloGREASE)
+	for i, s := range seed {
+		b := uint16(s&0xf0 | 0x0a)
+		g[i] = b<<8 | b
+	}
+	// The two GREASE extensions must have different types.
+	if g[greaseExtension1] == g[greaseExtension2] {
+		g[greaseExtension2] ^= 0x1010
+	}
+	return g, nil
+}
+
+// replaceGREASE returns a copy of values with GREASEPlaceholder replaced by
+// grease.
+func replaceGREASE[T ~uint16](values []T, grease uint16) []T {
+	if values == nil {
+		return nil
+	}
+	out := make([]T, len(values))
+	for i, v := range values {
+		if uint16(v) == GREASEPlaceholder {
+			v = T(grease)
+		}
+		out[i] = v
+	}
+	return out
+}
+
+// applyClientHelloSpec shapes hello after spec and returns the key share
+// parameters, in the order of hello.keyShares.
+func applyClientHelloSpec(hello *clientHelloMsg, spec *ClientHelloSpec, config *Config) ([]ecdheParameters, error) {
+	grease, err := newHelloGREASE(config.rand())
+	if err != nil {
+		return nil, err
+	}
+	if spec.CipherSuites != nil {
+		hello.cipherSuites = replaceGREASE(spec.CipherSuites, grease[greaseCipher])
+	}
+	if spec.CompressionMethods != nil {
+		hello.compressionMethods = spec.CompressionMethods
+	}
+	if spec.SupportedCurves != nil {
+		hello.supportedCurves = replaceGREASE(spec.SupportedCurves, grease[greaseGroup])
+	}
+	if spec.SupportedPoints != nil {
+		hello.supportedPoints = spec.SupportedPoints
+	}
+	if spec.SignatureAlgorithms != nil {
+		hello.supportedSignatureAlgorithms = replaceGREASE(spec.SignatureAlgorithms, grease[greaseSignature])
+	}
+	if spec.SignatureAlgorithmsCert != nil {
+		hello.supportedSignatureAlgorithmsCert = replaceGREASE(spec.SignatureAlgorithmsCert, grease[greaseSignature])
+	}
+	if spec.SupportedVersions != nil {
+		hello.supportedVersions = replaceGREASE(spec.SupportedVersions, grease[greaseVersion])
+	}
+	if hello.topVersion() == 0 {
+		return nil, errors.New("tls: ClientHelloSpec offers no protocol version")
+	}
+	tls13 := hello.topVersion() == VersionTLS13
+	if spec.PSKModes != nil {
+		hello.pskModes = spec.PSKModes
+	}
+
+	if spec.Extensions != nil {
+		if hello.extensions, err = specExtensions(hello, spec, grease, tls13); err != nil {
+			return nil, err
+		}
+	}
+
+	var params []ecdheParameters
+	hello.keyShares = nil
+	if tls13 {
+		keyShareCurves := spec.KeyShareCurves
+		if keyShareCurves == nil {
+			for _, curveID := range hello.supportedCurves {
+				if !isGREASE(uint16(curveID)) {
+					keyShareCurves = []CurveID{curveID}
+					break
+				}
+			}
+		}
+		for _, curveID := range keyShareCurves {
+			if uint16(curveID) == GREASEPlaceholder {
+				hello.keyShares = append(hello.keyShares, keyShare{group: CurveID(grease[greaseGroup]), data: []byte{0}})
+				continue
+			}
+			if !isSupportedGroup(curveID) {
+				return nil, errors.New("tls: ClientHelloSpec includes unsupported key share curve")
+			}
+			p, err := generateECDHEParameters(config.rand(), curveID)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, p)
+			hello.keyShares = append(hello.keyShares, keyShare{group: curveID, data: p.PublicKey()})
+		}
+		if len(params) == 0 {
+			return nil, errors.New("tls: ClientHelloSpec offers TLS 1.3 without a key share")
+		}
+	}
+	return params, nil
+}
+
+// specExtensions turns spec.Extensions into the extension list of hello and
+// switches the extensions that are only sent when listed on or off.
+func specExtensions(hello *clientHelloMsg, spec *ClientHelloSpec, grease *helloGREASE, tls13 bool) ([]clientHelloExtension, error) {
+	listed := make(map[uint16]bool)
+	greaseExts := 0
+	exts := make([]clientHelloExtension, 0, len(spec.Extensions))
+	for i, ext := range spec.Extensions {
+		if ext.Type == GREASEPlaceholder {
+			if greaseExts == 2 {
+				return nil, errors.New("tls: ClientHelloSpec lists more than two GREASE extensions")
+			}
+			data := ext.Data
+			if data == nil {
+				data = make([]byte, greaseExts)
+			}
+			exts = append(exts, clientHelloExtension{typ: grease[greaseExtension1+greaseExts], data: data, raw: true})
+			greaseExts++
+			continue
+		}
+		if listed[ext.Type] {
+			return nil, fmt.Errorf("tls: ClientHelloSpec lists extension %d twice", ext.Type)
+		}
+		listed[ext.Type] = true
+		if ext.Type == extensionPreSharedKey && i != len(spec.Extensions)-1 {
+			return nil, errors.New("tls: ClientHelloSpec must list pre_shared_key last")
+		}
+		switch {
+		case ext.Data != nil:
+			if ext.Type == extensionCompressCertificate {
+				hello.certCompressionAlgorithms = nil
+				s := cryptobyte.String(ext.Data)
+				if !readCertCompressionAlgorithms(&s, &hello.certCompressionAlgorithms) || !s.Empty() {
+					return nil, errors.New("tls: ClientHelloSpec includes an invalid compress_certificate extension")
+				}
+			}
+			if ext.Type == extensionRecordSizeLimit {
+				s := cryptobyte.String(ext.Data)
+				if !s.ReadUint16(&hello.recordSizeLimit) || !s.Empty() || hello.recordSizeLimit < minRecordSizeLimit {
+					return nil, errors.New("tls: ClientHelloSpec includes an invalid record_size_limit extension")
+				}
+			}
+			exts = append(exts, clientHelloExtension{typ: ext.Type, data: ext.Data, raw: true})
+		case ext.Type == extensionPadding || builtClientHelloExtension(ext.Type):
+			exts = append(exts, clientHelloExtension{typ: ext.Type})
+		default:
+			exts = append(exts, clientHelloExtension{typ: ext.Type, data: []byte{}, raw: true})
+		}
+	}
+	if tls13 && (!listed[extensionSupportedVersions] || !listed[extensionKeyShare]) {
+		return nil, errors.New("tls: ClientHelloSpec offers TLS 1.3 without supported_versions and key_share")
+	}
+
+	hello.ocspStapling = listed[extensionStatusRequest]
+	hello.scts = listed[extensionSCT]
+	hello.secureRenegotiationSupported = listed[extensionRenegotiationInfo]
+	hello.extendedMasterSecret = listed[extensionExtendedMasterSecret]
+	hello.postHandshakeAuth = listed[extensionPostHandshakeAuth]
+	if !listed[extensionCompressCertificate] {
+		hello.certCompressionAlgorithms = nil
+	}
+	if !listed[extensionRecordSizeLimit] {
+		hello.recordSizeLimit = 0
+	}
+	hello.ticketSupported = listed[extensionSessionTicket]
+	if listed[extensionSupportedPoints] && hello.supportedPoints == nil {
+		hello.supportedPoints = []uint8{pointFormatUncompressed}
+	}
+	if listed[extensionSignatureAlgorithms] && hello.supportedSignatureAlgorithms == nil {
+		hello.supportedSignatureAlgorithms = supportedSignatureAlgorithms
+	}
+	if listed[extensionPSKModes] && hello.pskModes == nil {
+		hello.pskModes = []uint8{pskModeDHE}
+	}
+	return exts, nil
+}
+
+// builtClientHelloExtension reports whether clientHelloMsg.marshal builds
+// extensions of type typ.
+func builtClientHelloExtension(typ uint16) bool {
+	switch typ {
+	case extensionServerName, extensionStatusRequest, extensionSupportedCurves,
+		extensionSupportedPoints, extensionSessionTicket, extensionSignatureAlgorithms,
+		extensionSignatureAlgorithmsCert, extensionRenegotiationInfo,
+		extensionExtendedMasterSecret, extensionALPN, extensionSCT,
+		extensionCompressCertificate, extensionRecordSizeLimit,
+		extensionSupportedVersions, extensionCookie, extensionKeyShare,
+		extensionEarlyData, extensionPSKModes, extensionPostHandshakeAuth,
+		extensionQUICTransportParameters,
+		extensionEncryptedClientHello, extensionPreSharedKey:
+		return true
+	}
+	return false
+}
+
+// topVersion returns the first supported version that isn't GREASE, or 0.
+func (m *clientHelloMsg) topVersion() uint16 {
+	for _, v := range m.supportedVersions {
+		if !isGREASE(v) {
+			return v
+		}
+	}
+	return 0
+}
+
+// marshalWithExtensions marshals m with the extensions of m.extensions, in
+// that order.
+func (m *clientHelloMsg) marshalWithExtensions() []byte {
+	// Build the extensions this package knows as usual, then pick them out.
+	plain := *m
+	plain.raw, plain.extensions = nil, nil
+	hello := plain.marshal()
+	built := make(map[uint16][]byte)
+	s := cryptobyte.String(hello[4:])
+	var exts cryptobyte.String
+	if !s.Skip(2+32) || !s.Skip(1+len(m.sessionId)) || !s.Skip(2+2*len(m.cipherSuites)) ||
+		!s.Skip(1+len(m.compressionMethods)) {
+		panic("tls: internal error: failed to parse marshaled ClientHello")
+	}
+	if !s.Empty() && !s.ReadUint16LengthPrefixed(&exts) {
+		panic("tls: internal error: failed to parse marshaled ClientHello")
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			panic("tls: internal error: failed to parse marshaled ClientHello")
+		}
+		built[typ] = data
+	}
+
+	marshal := func(padding int) []byte {
+		var b cryptobyte.Builder
+		b.AddUint8(typeClientHello)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(m.vers)
+			addBytesWithLength(b, m.random, 32)
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.sessionId)
+			})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, suite := range m.cipherSuites {
+					b.AddUint16(suite)
+				}
+			})
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.compressionMethods)
+			})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				add := func(typ uint16, data []byte) {
+					b.AddUint16(typ)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(data)
+					})
+				}
+				sent := make(map[uint16]bool)
+				var psk *clientHelloExtension
+				for i, ext := range m.extensions {
+					switch {
+					case ext.typ == extensionPreSharedKey:
+						psk = &m.extensions[i]
+						continue
+					case ext.raw:
+						add(ext.typ, ext.data)
+					case ext.typ == extensionPadding:
+						if padding >= 0 {
+							add(ext.typ, make([]byte, padding))
+						}
+					default:
+						if data, ok := built[ext.typ]; ok {
+							add(ext.typ, data)
+						}
+					}
+					sent[ext.typ] = true
+				}
+				// cookie, quic_transport_parameters, early_data,
+				// encrypted_client_hello and pre_shared_key are needed whether
+				// listed or not, and pre_shared_key must be last.
+				for _, typ := range []uint16{extensionCookie, extensionQUICTransportParameters, extensionEarlyData, extensionEncryptedClientHello} {
+					if data, ok := built[typ]; ok && !sent[typ] {
+						add(typ, data)
+					}
+				}
+				if psk != nil && psk.raw {
+					add(psk.typ, psk.data)
+				} else if data, ok := built[extensionPreSharedKey]; ok {
+					add(extensionPreSharedKey, data)
+				}
+			})
+		})
+		return b.BytesOrPanic()
+	}
+	out := marshal(-1)
+	if padding, ok := boringPadding(len(out)); ok && m.hasExtension(extensionPadding) {
+		out = marshal(padding)
+	}
+	return out
+}
+
+func (m *clientHelloMsg) hasExtension(typ uint16) bool {
+	for _, ext := range m.extensions {
+		if ext.typ == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// boringPadding returns the padding extension length that brings a
+// ClientHello of unpaddedLen bytes to 512, if it is between 256 and 511
+// bytes long, to work around servers that choke on such hellos.
+func boringPadding(unpaddedLen int) (int, bool) {
+	if unpaddedLen <= 0xff || unpaddedLen >= 0x200 {
+		return 0, false
+	}
+	padding := 0x200 - unpaddedLen
+	if padding >= 4+1 {
+		padding -= 4
+	} else {
+		padding = 1
+	}
+	return padding, true
+}
@@ -0,0 +1,168 @@
+package tls
+
+import (
+	"bytes"
+	"testing"
+)
+
+// chromeLikeSpec is a ClientHelloSpec in the shape of a Chrome ClientHello.
+func chromeLikeSpec() *ClientHelloSpec {
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{
+			GREASEPlaceholder, TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384,
+			TLS_CHACHA20_POLY1305_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		SupportedCurves:   []CurveID{CurveID(GREASEPlaceholder), X25519, CurveP256, CurveP384},
+		KeyShareCurves:    []CurveID{CurveID(GREASEPlaceholder), X25519, CurveP256},
+		SupportedVersions: []uint16{GREASEPlaceholder, VersionTLS13, VersionTLS12},
+		Extensions: []HelloExtension{
+			{Type: GREASEPlaceholder},
+			{Type: extensionServerName},
+			{Type: extensionSessionTicket},
+			{Type: extensionSupportedCurves},
+			{Type: extensionSupportedPoints},
+			{Type: extensionStatusRequest},
+			{Type: extensionALPN},
+			{Type: extensionSignatureAlgorithms},
+			{Type: extensionSCT},
+			{Type: extensionKeyShare},
+			{Type: extensionPSKModes},
+			{Type: extensionSupportedVersions},
+			{Type: 27, Data: []byte{2, 0, 2}}, // compress_certificate, as is
+			{Type: 17513},                     // application_settings, empty
+			{Type: GREASEPlaceholder},
+			{Type: extensionPadding},
+		},
+	}
+}
+
+func TestClientHelloSpec(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.ClientHelloSpec = chromeLikeSpec()
+	clientConfig.NextProtos = []string{"h2", "http/1.1"}
+	serverConfig.NextProtos = []string{"h2"}
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+	var raw []byte
+	serverConfig.GetConfigForClient = func(info *ClientHelloInfo) (*Config, error) {
+		raw = info.Raw
+		return nil, nil
+	}
+	cs, ss, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Version != VersionTLS13 || ss.NegotiatedProtocol != "h2" {
+		t.Errorf("got version %x, protocol %q", cs.Version, ss.NegotiatedProtocol)
+	}
+
+	p, err := ParseClientHello(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []uint16
+	for _, ext := range clientConfig.ClientHelloSpec.Extensions {
+		want = append(want, ext.Type)
+	}
+	got := p.ExtensionIDs()
+	if len(got) != len(want) {
+		t.Fatalf("got extensions %v, want %v", got, want)
+	}
+	for i := range want {
+		if want[i] == GREASEPlaceholder {
+			if !isGREASE(got[i]) {
+				t.Errorf("extension %d is %04x, want GREASE", i, got[i])
+			}
+		} else if got[i] != want[i] {
+			t.Errorf("extension %d is %d, want %d", i, got[i], want[i])
+		}
+	}
+	if got[0] == got[len(got)-2] {
+		t.Error("both GREASE extensions have the same type")
+	}
+	if !bytes.Equal(p.Extensions[27], []byte{2, 0, 2}) || p.Extensions[17513] == nil {
+		t.Error("custom extensions were not sent as given")
+	}
+	g := p.GREASE
+	if !g.CipherSuites || !g.SupportedGroups || !g.KeyShares || !g.SupportedVersions || !g.Extensions {
+		t.Errorf("missing GREASE: %+v", g)
+	}
+	if len(raw) != 512 {
+		t.Errorf("padded ClientHello is %d bytes, want 512", len(raw))
+	}
+}
+
+func TestClientHelloSpecHelloRetryRequest(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.ClientHelloSpec = chromeLikeSpec()
+	serverConfig.CurvePreferences = []CurveID{CurveP384}
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientHelloSpecResumption(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.ClientHelloSpec = chromeLikeSpec()
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+	for i := 0; i < 2; i++ {
+		cs, _, err := testHandshake(t, clientConfig, serverConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cs.DidResume != (i == 1) {
+			t.Errorf("handshake %d: DidResume = %v", i, cs.DidResume)
+		}
+	}
+}
+
+func TestClientHelloSpecPSKLast(t *testing.T) {
+	// early_data isn't listed, so it's added, but still before
+	// pre_shared_key.
+	m := &clientHelloMsg{
+		vers:               VersionTLS12,
+		random:             make([]byte, 32),
+		cipherSuites:       []uint16{TLS_AES_128_GCM_SHA256},
+		compressionMethods: []uint8{compressionNone},
+		supportedVersions:  []uint16{VersionTLS13},
+		keyShares:          []keyShare{{group: X25519, data: make([]byte, 32)}},
+		pskModes:           []uint8{pskModeDHE},
+		earlyData:          true,
+		pskIdentities:      []pskIdentity{{label: []byte("ticket"), obfuscatedTicketAge: 1}},
+		pskBinders:         [][]byte{make([]byte, 32)},
+		extensions: []clientHelloExtension{
+			{typ: extensionSupportedVersions}, {typ: extensionKeyShare},
+			{typ: extensionPSKModes}, {typ: extensionPreSharedKey},
+		},
+	}
+	raw := m.marshalWithExtensions()
+	var got clientHelloMsg
+	if !got.unmarshal(raw) {
+		t.Fatal("failed to unmarshal the ClientHello")
+	}
+	if !got.earlyData || len(got.pskIdentities) != 1 {
+		t.Errorf("got early_data %v and %d PSK identities", got.earlyData, len(got.pskIdentities))
+	}
+	p, err := ParseClientHello(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := p.ExtensionIDs(); ids[len(ids)-1] != extensionPreSharedKey {
+		t.Errorf("got extensions %v, want pre_shared_key last", ids)
+	}
+}
+
+func TestClientHelloSpecErrors(t *testing.T) {
+	for _, spec := range []*ClientHelloSpec{
+		{Extensions: []HelloExtension{{Type: extensionPreSharedKey}, {Type: extensionKeyShare}}},
+		{Extensions: []HelloExtension{{Type: extensionALPN}, {Type: extensionALPN}}},
+		{Extensions: []HelloExtension{{Type: extensionServerName}}}, // TLS 1.3 without key_share
+		{KeyShareCurves: []CurveID{CurveID(0x1234)}},
+	} {
+		clientConfig, serverConfig := testConfigs(t)
+		clientConfig.ClientHelloSpec = spec
+		if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil {
+			t.Errorf("handshake succeeded with %+v", spec)
+		}
+	}
+}
@@ -4,14 +4,13 @@ go 1.24
 
 require (
 	github.com/andybalholm/brotli v1.1.0
+	github.com/cloudflare/circl v1.5.0
 	github.com/klauspost/compress v1.17.4
 	github.com/pierrec/lz4/v4 v4.1.21
 	github.com/refraction-networking/utls v1.7.3
 	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/crypto v0.36.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/cloudflare/circl v1.5.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
-)
+require golang.org/x/sys v0.31.0 // indirect
@@ -34,7 +34,9 @@ type clientHandshakeState struct {
 	session      *ClientSessionState
 }
 
-func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
+// makeClientHello returns the ClientHello to send and the key share
+// parameters, in the order of its key shares.
+func (c *Conn) makeClientHello() (*clientHelloMsg, []ecdheParameters, error) {
 	config := c.config
 	if len(config.ServerName) == 0 && !config.InsecureSkipVerify {
 		return nil, nil, errors.New("tls: either ServerName or InsecureSkipVerify must be specified in the tls.Config")
@@ -76,6 +78,7 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
 		supportedCurves:              config.curvePreferences(),
 		supportedPoints:              []uint8{pointFormatUncompressed},
 		secureRenegotiationSupported: true,
+		extendedMasterSecret:         true,
 		alpnProtocols:                config.NextProtos,
 		supportedVersions:            supportedVersions,
 	}
@@ -111,8 +114,11 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
 
 	// A random session ID is used to detect when the server accepted a ticket
 	// and is resuming a session (see RFC 5077). In TLS 1.3, it's always set as
-	// a compatibility measure (see RFC 8446, Section 4.1.2).
-	if _, err := io.ReadFull(config.rand(), hello.sessionId); err != nil {
+	// a compatibility measure (see RFC 8446, Section 4.1.2). It is not set
+	// for QUIC connections (see RFC 9001, Section 8.4).
+	if c.quic != nil {
+		hello.sessionId = nil
+	} else if _, err := io.ReadFull(config.rand(), hello.sessionId); err != nil {
 		return nil, nil, errors.New("tls: short read from Rand: " + err.Error())
 	}
 
@@ -120,23 +126,73 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
 		hello.supportedSignatureAlgorithms = supportedSignatureAlgorithms
 	}
 
-	var params ecdheParameters
 	if hello.supportedVersions[0] == VersionTLS13 {
 		if hasAESGCMHardwareSupport {
 			hello.cipherSuites = append(hello.cipherSuites, defaultCipherSuitesTLS13...)
 		} else {
 			hello.cipherSuites = append(hello.cipherSuites, defaultCipherSuitesTLS13NoAES...)
 		}
+		hello.certCompressionAlgorithms = config.certCompressionAlgorithms()
+	}
+
+	// Offer post-handshake authentication if there is a certificate to
+	// answer it with. QUIC doesn't allow it, see RFC 9001, Section 4.4.
+	if hello.supportedVersions[0] == VersionTLS13 && c.quic == nil &&
+		(config.GetClientCertificate != nil || len(config.Certificates) > 0) {
+		hello.postHandshakeAuth = true
+	}
+
+	if config.RecordSizeLimit != 0 && c.quic == nil {
+		hello.recordSizeLimit = config.recordSizeLimit(hello.supportedVersions[0])
+	}
 
+	if c.quic != nil {
+		p, err := c.quicGetTransportParameters()
+		if err != nil {
+			return nil, nil, err
+		}
+		hello.quicTransportParameters = p
+	}
+
+	if config.ClientHelloSpec != nil {
+		params, err := applyClientHelloSpec(hello, config.ClientHelloSpec, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		return hello, params, nil
+	}
+
+	var params []ecdheParameters
+	if hello.supportedVersions[0] == VersionTLS13 {
 		curveID := config.curvePreferences()[0]
-		if _, ok := curveForCurveID(curveID); curveID != X25519 && !ok {
+		if !isSupportedGroup(curveID) {
 			return nil, nil, errors.New("tls: CurvePreferences includes unsupported curve")
 		}
-		params, err = generateECDHEParameters(config.rand(), curveID)
+		p, err := generateECDHEParameters(config.rand(), curveID)
+		if err != nil {
+			return nil, nil, err
+		}
+		params = append(params, p)
+		hello.keyShares = []keyShare{{group: curveID, data: p.PublicKey()}}
+		// A hybrid key share is large, and many servers don't support it
+		// yet. If X25519 is also preferred, offer it too rather than cost
+		// those servers a HelloRetryRequest.
+		if _, ok := hybridGroupFor(curveID); ok && containsCurve(config.curvePreferences(), X25519) {
+			p, err := generateECDHEParameters(config.rand(), X25519)
+			if err != nil {
+				return nil, nil, err
+			}
+			params = append(params, p)
+			hello.keyShares = append(hello.keyShares, keyShare{group: X25519, data: p.PublicKey()})
+		}
+	}
+
+	if config.GREASE {
+		grease, err := newHelloGREASE(config.rand())
 		if err != nil {
 			return nil, nil, err
 		}
-		hello.keyShares = []keyShare{{group: curveID, data: params.PublicKey()}}
+		injectGREASE(hello, grease)
 	}
 
 	return hello, params, nil
@@ -150,11 +206,19 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	// This may be a renegotiation handshake, in which case some fields
 	// need to be reset.
 	c.didResume = false
+	c.curveID = 0
+	c.extMasterSecret = false
 
-	hello, ecdheParams, err := c.makeClientHello()
+	hello, keyShareParams, err := c.makeClientHello()
 	if err != nil {
 		return err
 	}
+	var ech *echClientContext
+	if len(c.config.EncryptedClientHelloConfigList) > 0 {
+		if ech, err = newECHClientContext(c.config, hello); err != nil {
+			return err
+		}
+	}
 	c.serverName = hello.serverName
 
 	cacheKey, session, earlySecret, binderKey := c.loadSession(hello)
@@ -172,9 +236,22 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 		}()
 	}
 
-	if _, err := c.writeRecord(recordTypeHandshake, hello.marshal()); err != nil {
+	// With ECH, hello is the ClientHelloInner, sent encrypted in the outer.
+	sent := hello
+	if ech != nil {
+		if err := ech.sealOuter(c.config.rand(), hello); err != nil {
+			return err
+		}
+		sent = ech.outer
+	}
+	if err := c.writeHelloRecord(sent.marshal()); err != nil {
 		return err
 	}
+	if hello.earlyData {
+		if err := c.sendEarlyData(hello, session, earlySecret); err != nil {
+			return err
+		}
+	}
 
 	msg, err := c.readHandshake()
 	if err != nil {
@@ -203,16 +280,33 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 		return errors.New("tls: downgrade attempt detected, possibly due to a MitM attack or a broken middlebox")
 	}
 
+	if ech != nil && c.vers != VersionTLS13 {
+		c.sendAlert(alertProtocolVersion)
+		return errors.New("tls: server selected TLS 1.2 in response to an Encrypted Client Hello")
+	}
+
+	if hello.earlyData && c.vers != VersionTLS13 {
+		c.sendAlert(alertProtocolVersion)
+		return errors.New("tls: server selected TLS 1.2 after the client sent early data")
+	}
+
 	if c.vers == VersionTLS13 {
 		hs := &clientHandshakeStateTLS13{
 			c:           c,
 			ctx:         ctx,
 			serverHello: serverHello,
 			hello:       hello,
-			ecdheParams: ecdheParams,
 			session:     session,
 			earlySecret: earlySecret,
 			binderKey:   binderKey,
+			echContext:  ech,
+			// Early data went out after a ChangeCipherSpec.
+			earlyData:    hello.earlyData,
+			sentDummyCCS: hello.earlyData,
+		}
+
+		if len(keyShareParams) > 0 {
+			hs.ecdheParams, hs.extraParams = keyShareParams[0], keyShareParams[1:]
 		}
 
 		// In TLS 1.3, session tickets are delivered after the handshake.
@@ -248,7 +342,7 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 
 	hello.ticketSupported = true
 
-	if hello.supportedVersions[0] == VersionTLS13 {
+	if hello.topVersion() == VersionTLS13 && hello.pskModes == nil {
 		// Require DHE on resumption as it guarantees forward secrecy against
 		// compromise of the session ticket key. See RFC 8446, Section 4.2.9.
 		hello.pskModes = []uint8{pskModeDHE}
@@ -262,7 +356,7 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 	}
 
 	// Try to resume a previously negotiated TLS session, if available.
-	cacheKey = clientSessionCacheKey(c.conn.RemoteAddr(), c.config)
+	cacheKey = c.clientSessionCacheKey()
 	session, ok := c.config.ClientSessionCache.Get(cacheKey)
 	if !ok || session == nil {
 		return cacheKey, nil, nil, nil
@@ -334,6 +428,8 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 		return cacheKey, nil, nil, nil
 	}
 
+	hello.earlyData = c.canSendEarlyData(session, hello)
+
 	// Set the pre_shared_key extension. See RFC 8446, Section 4.2.11.1.
 	ticketAge := uint32(c.config.time().Sub(session.receivedAt) / time.Millisecond)
 	identity := pskIdentity{
@@ -536,6 +632,9 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			c.sendAlert(alertUnexpectedMessage)
 			return err
 		}
+		if ka, ok := keyAgreement.(*ecdheKeyAgreement); ok {
+			c.curveID = ka.params.CurveID()
+		}
 
 		msg, err = c.readHandshake()
 		if err != nil {
@@ -593,6 +692,19 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		}
 	}
 
+	if hs.serverHello.extendedMasterSecret {
+		c.extMasterSecret = true
+		hs.masterSecret = extMasterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret,
+			hs.finishedHash.Sum())
+	} else {
+		hs.masterSecret = masterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret,
+			hs.hello.random, hs.serverHello.random)
+	}
+	if err := c.config.writeKeyLog(keyLogLabelTLS12, hs.hello.random, hs.masterSecret); err != nil {
+		c.sendAlert(alertInternalError)
+		return errors.New("tls: failed to write to key log: " + err.Error())
+	}
+
 	if chainToSend != nil && len(chainToSend.Certificate) > 0 {
 		certVerify := &certificateVerifyMsg{}
 
@@ -641,12 +753,6 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		}
 	}
 
-	hs.masterSecret = masterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.hello.random, hs.serverHello.random)
-	if err := c.config.writeKeyLog(keyLogLabelTLS12, hs.hello.random, hs.masterSecret); err != nil {
-		c.sendAlert(alertInternalError)
-		return errors.New("tls: failed to write to key log: " + err.Error())
-	}
-
 	hs.finishedHash.discardHandshakeBuffer()
 
 	return nil
@@ -693,6 +799,15 @@ func (hs *clientHandshakeState) processServerHello() (bool, error) {
 		return false, errors.New("tls: server selected unsupported compression format")
 	}
 
+	if hs.serverHello.extendedMasterSecret && !hs.hello.extendedMasterSecret {
+		c.sendAlert(alertUnsupportedExtension)
+		return false, errors.New("tls: server sent an unrequested extended_master_secret extension")
+	}
+
+	if err := c.checkRecordSizeLimit(hs.hello, hs.serverHello.recordSizeLimit); err != nil {
+		return false, err
+	}
+
 	if c.handshakes == 0 && hs.serverHello.secureRenegotiationSupported {
 		c.secureRenegotiation = true
 		if len(hs.serverHello.secureRenegotiation) != 0 {
@@ -733,6 +848,13 @@ func (hs *clientHandshakeState) processServerHello() (bool, error) {
 		return false, errors.New("tls: server resumed a session with a different cipher suite")
 	}
 
+	// See RFC 7627, Section 5.3.
+	if hs.session.extMasterSecret != hs.serverHello.extendedMasterSecret {
+		c.sendAlert(alertHandshakeFailure)
+		return false, errors.New("tls: server resumed a session with a different extended_master_secret setting")
+	}
+	c.extMasterSecret = hs.session.extMasterSecret
+
 	// Restore masterSecret, peerCerts, and ocspResponse from previous state
 	hs.masterSecret = hs.session.masterSecret
 	c.peerCertificates = hs.session.serverCertificates
@@ -819,6 +941,7 @@ func (hs *clientHandshakeState) readSessionTicket() error {
 		receivedAt:         c.config.time(),
 		ocspResponse:       c.ocspResponse,
 		scts:               c.scts,
+		extMasterSecret:    c.extMasterSecret,
 	}
 
 	return nil
@@ -861,6 +984,11 @@ func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
 			DNSName:       c.config.ServerName,
 			Intermediates: x509.NewCertPool(),
 		}
+		if c.echPublicName != "" {
+			// The server rejected ECH: it must authenticate for the
+			// public name instead.
+			opts.DNSName = c.echPublicName
+		}
 		for _, cert := range certs[1:] {
 			opts.Intermediates.AddCert(cert)
 		}
@@ -983,11 +1111,14 @@ func (c *Conn) getClientCertificate(cri *CertificateRequestInfo) (*Certificate,
 
 // clientSessionCacheKey returns a key used to cache sessionTickets that could
 // be used to resume previously negotiated TLS sessions with a server.
-func clientSessionCacheKey(serverAddr net.Addr, config *Config) string {
-	if len(config.ServerName) > 0 {
-		return config.ServerName
+func (c *Conn) clientSessionCacheKey() string {
+	if len(c.config.ServerName) > 0 {
+		return c.config.ServerName
+	}
+	if c.conn != nil {
+		return c.conn.RemoteAddr().String()
 	}
-	return serverAddr.String()
+	return ""
 }
 
 // hostnameInSNI converts name into an appropriate hostname for SNI.
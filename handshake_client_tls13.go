@@ -22,10 +22,19 @@ type clientHandshakeStateTLS13 struct {
 	serverHello *serverHelloMsg
 	hello       *clientHelloMsg
 	ecdheParams ecdheParameters
+	// extraParams are the parameters of the key shares after the first,
+	// sent for a ClientHelloSpec.
+	extraParams []ecdheParameters
 
 	session     *ClientSessionState
 	earlySecret []byte
 	binderKey   []byte
+	// echContext is set when hs.hello is a ClientHelloInner.
+	echContext *echClientContext
+	// earlyData is set while the client writes with the early traffic
+	// keys, and clientHandshakeSecret holds the keys it switches to after.
+	earlyData             bool
+	clientHandshakeSecret []byte
 
 	certReq       *certificateRequestMsgTLS13
 	usingPSK      bool
@@ -49,7 +58,7 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	}
 
 	// Consistency check on the presence of a keyShare and its parameters.
-	if hs.ecdheParams == nil || len(hs.hello.keyShares) != 1 {
+	if hs.ecdheParams == nil || len(hs.hello.keyShares) < 1+len(hs.extraParams) {
 		return c.sendAlert(alertInternalError)
 	}
 
@@ -61,6 +70,9 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	hs.transcript.Write(hs.hello.marshal())
 
 	if bytes.Equal(hs.serverHello.random, helloRetryRequestRandom) {
+		if err := hs.checkECHHelloRetryRequest(); err != nil {
+			return err
+		}
 		if err := hs.sendDummyChangeCipherSpec(); err != nil {
 			return err
 		}
@@ -69,6 +81,9 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 		}
 	}
 
+	if err := hs.checkECHServerHello(); err != nil {
+		return err
+	}
 	hs.transcript.Write(hs.serverHello.marshal())
 
 	c.buffering = true
@@ -90,6 +105,13 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	if err := hs.readServerFinished(); err != nil {
 		return err
 	}
+	if ech := hs.echContext; ech != nil && !ech.accepted {
+		c.sendAlert(alertECHRequired)
+		return &ECHRejectionError{RetryConfigList: ech.retryConfigs}
+	}
+	if err := hs.sendEndOfEarlyData(); err != nil {
+		return err
+	}
 	if err := hs.sendClientCertificate(); err != nil {
 		return err
 	}
@@ -99,6 +121,9 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	if _, err := c.flush(); err != nil {
 		return err
 	}
+	if hs.hello.postHandshakeAuth {
+		c.postHandshakeAuth = &postHandshakeAuth{suite: hs.suite, transcript: hs.transcript}
+	}
 
 	atomic.StoreUint32(&c.handshakeStatus, 1)
 
@@ -128,6 +153,8 @@ func (hs *clientHandshakeStateTLS13) checkServerHelloOrHRR() error {
 	if hs.serverHello.ocspStapling ||
 		hs.serverHello.ticketSupported ||
 		hs.serverHello.secureRenegotiationSupported ||
+		hs.serverHello.extendedMasterSecret ||
+		hs.serverHello.recordSizeLimit != 0 ||
 		len(hs.serverHello.secureRenegotiation) != 0 ||
 		len(hs.serverHello.alpnProtocol) != 0 ||
 		len(hs.serverHello.scts) != 0 {
@@ -163,6 +190,9 @@ func (hs *clientHandshakeStateTLS13) checkServerHelloOrHRR() error {
 // sendDummyChangeCipherSpec sends a ChangeCipherSpec record for compatibility
 // with middleboxes that didn't implement TLS correctly. See RFC 8446, Appendix D.4.
 func (hs *clientHandshakeStateTLS13) sendDummyChangeCipherSpec() error {
+	if hs.c.quic != nil {
+		return nil
+	}
 	if hs.sentDummyCCS {
 		return nil
 	}
@@ -218,11 +248,11 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 			c.sendAlert(alertIllegalParameter)
 			return errors.New("tls: server selected unsupported group")
 		}
-		if hs.ecdheParams.CurveID() == curveID {
+		if hs.keyShareParams(curveID) != nil {
 			c.sendAlert(alertIllegalParameter)
 			return errors.New("tls: server sent an unnecessary HelloRetryRequest key_share")
 		}
-		if _, ok := curveForCurveID(curveID); curveID != X25519 && !ok {
+		if !isSupportedGroup(curveID) {
 			c.sendAlert(alertInternalError)
 			return errors.New("tls: CurvePreferences includes unsupported curve")
 		}
@@ -231,10 +261,18 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 			c.sendAlert(alertInternalError)
 			return err
 		}
-		hs.ecdheParams = params
+		hs.ecdheParams, hs.extraParams = params, nil
 		hs.hello.keyShares = []keyShare{{group: curveID, data: params.PublicKey()}}
 	}
 
+	if hs.earlyData {
+		// The early data is rejected, and the second ClientHello, which
+		// must not offer it again, is sent in the clear.
+		hs.earlyData = false
+		hs.hello.earlyData = false
+		c.out.cipher = nil
+	}
+
 	hs.hello.raw = nil
 	if len(hs.hello.pskIdentities) > 0 {
 		pskSuite := cipherSuiteTLS13ByID(hs.session.cipherSuite)
@@ -260,8 +298,23 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 		}
 	}
 
+	if ech := hs.echContext; ech != nil && !ech.accepted {
+		// hs.hello is the ClientHelloOuter.
+		if err := ech.replaceRejectedPayload(c.config.rand()); err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+	}
 	hs.transcript.Write(hs.hello.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, hs.hello.marshal()); err != nil {
+	sent := hs.hello
+	if ech := hs.echContext; ech != nil && ech.accepted {
+		if err := ech.sealOuter(c.config.rand(), hs.hello); err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+		sent = ech.outer
+	}
+	if err := c.writeHelloRecord(sent.marshal()); err != nil {
 		return err
 	}
 
@@ -284,6 +337,20 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 	return nil
 }
 
+// keyShareParams returns the parameters of the key share sent for curveID,
+// or nil.
+func (hs *clientHandshakeStateTLS13) keyShareParams(curveID CurveID) ecdheParameters {
+	if hs.ecdheParams.CurveID() == curveID {
+		return hs.ecdheParams
+	}
+	for _, params := range hs.extraParams {
+		if params.CurveID() == curveID {
+			return params
+		}
+	}
+	return nil
+}
+
 func (hs *clientHandshakeStateTLS13) processServerHello() error {
 	c := hs.c
 
@@ -306,10 +373,13 @@ func (hs *clientHandshakeStateTLS13) processServerHello() error {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: server did not send a key share")
 	}
-	if hs.serverHello.serverShare.group != hs.ecdheParams.CurveID() {
+	params := hs.keyShareParams(hs.serverHello.serverShare.group)
+	if params == nil {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: server selected unsupported group")
 	}
+	hs.ecdheParams = params
+	c.curveID = params.CurveID()
 
 	if !hs.serverHello.selectedIdentityPresent {
 		return nil
@@ -359,10 +429,24 @@ func (hs *clientHandshakeStateTLS13) establishHandshakeKeys() error {
 
 	clientSecret := hs.suite.deriveSecret(handshakeSecret,
 		clientHandshakeTrafficLabel, hs.transcript)
-	c.out.setTrafficSecret(hs.suite, clientSecret)
+	if hs.earlyData {
+		// Keep writing with the early traffic keys until EndOfEarlyData.
+		hs.clientHandshakeSecret = clientSecret
+	} else {
+		c.out.setTrafficSecret(hs.suite, QUICEncryptionLevelHandshake, clientSecret)
+	}
 	serverSecret := hs.suite.deriveSecret(handshakeSecret,
 		serverHandshakeTrafficLabel, hs.transcript)
-	c.in.setTrafficSecret(hs.suite, serverSecret)
+	c.in.setTrafficSecret(hs.suite, QUICEncryptionLevelHandshake, serverSecret)
+
+	if c.quic != nil {
+		if c.hand.Len() != 0 {
+			c.sendAlert(alertUnexpectedMessage)
+			return errors.New("tls: handshake data left over at a key change")
+		}
+		c.quicSetWriteSecret(QUICEncryptionLevelHandshake, hs.suite.id, clientSecret)
+		c.quicSetReadSecret(QUICEncryptionLevelHandshake, hs.suite.id, serverSecret)
+	}
 
 	err := c.config.writeKeyLog(keyLogLabelClientHandshake, hs.hello.random, clientSecret)
 	if err != nil {
@@ -402,6 +486,35 @@ func (hs *clientHandshakeStateTLS13) readServerParameters() error {
 	}
 	c.clientProtocol = encryptedExtensions.alpnProtocol
 
+	if c.quic != nil {
+		// See RFC 9001, Sections 8.1 and 8.2.
+		if c.clientProtocol == "" && len(hs.hello.alpnProtocols) > 0 {
+			c.sendAlert(alertNoApplicationProtocol)
+			return errors.New("tls: server did not select an ALPN protocol")
+		}
+		if encryptedExtensions.quicTransportParameters == nil {
+			c.sendAlert(alertMissingExtension)
+			return errors.New("tls: server did not send a quic_transport_parameters extension")
+		}
+		c.quicSetTransportParameters(encryptedExtensions.quicTransportParameters)
+	} else if encryptedExtensions.quicTransportParameters != nil {
+		c.sendAlert(alertUnsupportedExtension)
+		return errors.New("tls: server sent an unexpected quic_transport_parameters extension")
+	}
+	if hs.echContext != nil {
+		hs.echContext.retryConfigs = encryptedExtensions.echRetryConfigs
+	}
+	if encryptedExtensions.earlyData {
+		if !hs.earlyData {
+			c.sendAlert(alertUnsupportedExtension)
+			return errors.New("tls: server accepted early data the client didn't send")
+		}
+		c.earlyDataAccepted = true
+	}
+	if err := c.checkRecordSizeLimit(hs.hello, encryptedExtensions.recordSizeLimit); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -430,6 +543,10 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 
 	certReq, ok := msg.(*certificateRequestMsgTLS13)
 	if ok {
+		if len(certReq.certificateRequestContext) != 0 {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server sent a certificate request context during the handshake")
+		}
 		hs.transcript.Write(certReq.marshal())
 
 		hs.certReq = certReq
@@ -440,16 +557,14 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 		}
 	}
 
-	certMsg, ok := msg.(*certificateMsgTLS13)
-	if !ok {
-		c.sendAlert(alertUnexpectedMessage)
-		return unexpectedMessageError(certMsg, msg)
+	certMsg, err := c.readCertificateMsg(msg, hs.hello.certCompressionAlgorithms, nil, hs.transcript)
+	if err != nil {
+		return err
 	}
 	if len(certMsg.certificate.Certificate) == 0 {
 		c.sendAlert(alertDecodeError)
 		return errors.New("tls: received empty certificates message")
 	}
-	hs.transcript.Write(certMsg.marshal())
 
 	c.scts = certMsg.certificate.SignedCertificateTimestamps
 	c.ocspResponse = certMsg.certificate.OCSPStaple
@@ -522,7 +637,7 @@ func (hs *clientHandshakeStateTLS13) readServerFinished() error {
 		clientApplicationTrafficLabel, hs.transcript)
 	serverSecret := hs.suite.deriveSecret(hs.masterSecret,
 		serverApplicationTrafficLabel, hs.transcript)
-	c.in.setTrafficSecret(hs.suite, serverSecret)
+	c.in.setTrafficSecret(hs.suite, QUICEncryptionLevelApplication, serverSecret)
 
 	err = c.config.writeKeyLog(keyLogLabelClientTraffic, hs.hello.random, hs.trafficSecret)
 	if err != nil {
@@ -557,39 +672,58 @@ func (hs *clientHandshakeStateTLS13) sendClientCertificate() error {
 		return err
 	}
 
+	msgs, err := c.clientCertificateMsgs(hs.certReq, cert, hs.transcript)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if _, err := c.writeRecord(recordTypeHandshake, msg.marshal()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clientCertificateMsgs returns the Certificate message, and the
+// CertificateVerify message if cert is not empty, answering certReq with
+// cert. It writes them to transcript.
+func (c *Conn) clientCertificateMsgs(certReq *certificateRequestMsgTLS13, cert *Certificate, transcript hash.Hash) ([]handshakeMessage, error) {
 	certMsg := new(certificateMsgTLS13)
 
+	certMsg.certificateRequestContext = certReq.certificateRequestContext
 	certMsg.certificate = *cert
-	certMsg.scts = hs.certReq.scts && len(cert.SignedCertificateTimestamps) > 0
-	certMsg.ocspStapling = hs.certReq.ocspStapling && len(cert.OCSPStaple) > 0
+	certMsg.scts = certReq.scts && len(cert.SignedCertificateTimestamps) > 0
+	certMsg.ocspStapling = certReq.ocspStapling && len(cert.OCSPStaple) > 0
 
-	hs.transcript.Write(certMsg.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, certMsg.marshal()); err != nil {
-		return err
+	msg, err := c.certificateMsgToSend(certMsg, certReq.certCompressionAlgorithms)
+	if err != nil {
+		return nil, err
 	}
+	transcript.Write(msg.marshal())
 
 	// If we sent an empty certificate message, skip the CertificateVerify.
 	if len(cert.Certificate) == 0 {
-		return nil
+		return []handshakeMessage{msg}, nil
 	}
 
 	certVerifyMsg := new(certificateVerifyMsg)
 	certVerifyMsg.hasSignatureAlgorithm = true
 
-	certVerifyMsg.signatureAlgorithm, err = selectSignatureScheme(c.vers, cert, hs.certReq.supportedSignatureAlgorithms)
+	certVerifyMsg.signatureAlgorithm, err = selectSignatureScheme(c.vers, cert, certReq.supportedSignatureAlgorithms)
 	if err != nil {
 		// getClientCertificate returned a certificate incompatible with the
 		// CertificateRequestInfo supported signature algorithms.
 		c.sendAlert(alertHandshakeFailure)
-		return err
+		return nil, err
 	}
 
 	sigType, sigHash, err := typeAndHashFromSignatureScheme(certVerifyMsg.signatureAlgorithm)
 	if err != nil {
-		return c.sendAlert(alertInternalError)
+		return nil, c.sendAlert(alertInternalError)
 	}
 
-	signed := signedMessage(sigHash, clientSignatureContext, hs.transcript)
+	signed := signedMessage(sigHash, clientSignatureContext, transcript)
 	signOpts := crypto.SignerOpts(sigHash)
 	if sigType == signatureRSAPSS {
 		signOpts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: sigHash}
@@ -597,16 +731,12 @@ func (hs *clientHandshakeStateTLS13) sendClientCertificate() error {
 	sig, err := cert.PrivateKey.(crypto.Signer).Sign(c.config.rand(), signed, signOpts)
 	if err != nil {
 		c.sendAlert(alertInternalError)
-		return errors.New("tls: failed to sign handshake: " + err.Error())
+		return nil, errors.New("tls: failed to sign handshake: " + err.Error())
 	}
 	certVerifyMsg.signature = sig
 
-	hs.transcript.Write(certVerifyMsg.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, certVerifyMsg.marshal()); err != nil {
-		return err
-	}
-
-	return nil
+	transcript.Write(certVerifyMsg.marshal())
+	return []handshakeMessage{msg, certVerifyMsg}, nil
 }
 
 func (hs *clientHandshakeStateTLS13) sendClientFinished() error {
@@ -621,7 +751,15 @@ func (hs *clientHandshakeStateTLS13) sendClientFinished() error {
 		return err
 	}
 
-	c.out.setTrafficSecret(hs.suite, hs.trafficSecret)
+	c.out.setTrafficSecret(hs.suite, QUICEncryptionLevelApplication, hs.trafficSecret)
+
+	if c.quic != nil {
+		if c.hand.Len() != 0 {
+			c.sendAlert(alertUnexpectedMessage)
+			return errors.New("tls: handshake data left over at a key change")
+		}
+		c.quicSetWriteSecret(QUICEncryptionLevelApplication, hs.suite.id, hs.trafficSecret)
+	}
 
 	if !c.config.SessionTicketsDisabled && c.config.ClientSessionCache != nil {
 		c.resumptionSecret = hs.suite.deriveSecret(hs.masterSecret,
@@ -673,9 +811,11 @@ func (c *Conn) handleNewSessionTicket(msg *newSessionTicketMsgTLS13) error {
 		ageAdd:             msg.ageAdd,
 		ocspResponse:       c.ocspResponse,
 		scts:               c.scts,
+		maxEarlyData:       msg.maxEarlyData,
+		alpnProtocol:       c.clientProtocol,
 	}
 
-	cacheKey := clientSessionCacheKey(c.conn.RemoteAddr(), c.config)
+	cacheKey := c.clientSessionCacheKey()
 	c.config.ClientSessionCache.Put(cacheKey, session)
 
 	return nil
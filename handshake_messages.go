@@ -83,21 +83,35 @@ type clientHelloMsg struct {
 	supportedSignatureAlgorithmsCert []SignatureScheme
 	secureRenegotiationSupported     bool
 	secureRenegotiation              []byte
+	extendedMasterSecret             bool
 	alpnProtocols                    []string
 	scts                             bool
+	certCompressionAlgorithms        []CertCompressionAlgo
+	recordSizeLimit                  uint16
 	supportedVersions                []uint16
 	cookie                           []byte
 	keyShares                        []keyShare
 	earlyData                        bool
 	pskModes                         []uint8
+	postHandshakeAuth                bool
 	pskIdentities                    []pskIdentity
 	pskBinders                       [][]byte
+	encryptedClientHello             []byte
+	quicTransportParameters          []byte
+
+	// extensions, if not nil, fixes the extensions sent and their order.
+	// See ClientHelloSpec.
+	extensions []clientHelloExtension
 }
 
 func (m *clientHelloMsg) marshal() []byte {
 	if m.raw != nil {
 		return m.raw
 	}
+	if m.extensions != nil {
+		m.raw = m.marshalWithExtensions()
+		return m.raw
+	}
 
 	var b cryptobyte.Builder
 	b.AddUint8(typeClientHello)
@@ -200,6 +214,11 @@ func (m *clientHelloMsg) marshal() []byte {
 					})
 				})
 			}
+			if m.extendedMasterSecret {
+				// RFC 7627
+				b.AddUint16(extensionExtendedMasterSecret)
+				b.AddUint16(0) // empty extension_data
+			}
 			if len(m.alpnProtocols) > 0 {
 				// RFC 7301, Section 3.1
 				b.AddUint16(extensionALPN)
@@ -218,6 +237,20 @@ func (m *clientHelloMsg) marshal() []byte {
 				b.AddUint16(extensionSCT)
 				b.AddUint16(0) // empty extension_data
 			}
+			if len(m.certCompressionAlgorithms) > 0 {
+				// RFC 8879, Section 3
+				b.AddUint16(extensionCompressCertificate)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					addCertCompressionAlgorithms(b, m.certCompressionAlgorithms)
+				})
+			}
+			if m.recordSizeLimit != 0 {
+				// RFC 8449, Section 4
+				b.AddUint16(extensionRecordSizeLimit)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(m.recordSizeLimit)
+				})
+			}
 			if len(m.supportedVersions) > 0 {
 				// RFC 8446, Section 4.2.1
 				b.AddUint16(extensionSupportedVersions)
@@ -266,6 +299,25 @@ func (m *clientHelloMsg) marshal() []byte {
 					})
 				})
 			}
+			if m.postHandshakeAuth {
+				// RFC 8446, Section 4.2.6
+				b.AddUint16(extensionPostHandshakeAuth)
+				b.AddUint16(0) // empty extension_data
+			}
+			if m.quicTransportParameters != nil { // marshal zero-length parameters when present
+				// RFC 9001, Section 8.2
+				b.AddUint16(extensionQUICTransportParameters)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.quicTransportParameters)
+				})
+			}
+			if len(m.encryptedClientHello) > 0 {
+				// draft-ietf-tls-esni, Section 5
+				b.AddUint16(extensionEncryptedClientHello)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.encryptedClientHello)
+				})
+			}
 			if len(m.pskIdentities) > 0 { // pre_shared_key must be the last extension
 				// RFC 8446, Section 4.2.11
 				b.AddUint16(extensionPreSharedKey)
@@ -487,6 +539,9 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.secureRenegotiationSupported = true
+		case extensionExtendedMasterSecret:
+			// RFC 7627
+			m.extendedMasterSecret = true
 		case extensionALPN:
 			// RFC 7301, Section 3.1
 			var protoList cryptobyte.String
@@ -503,6 +558,16 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 		case extensionSCT:
 			// RFC 6962, Section 3.3.1
 			m.scts = true
+		case extensionCompressCertificate:
+			// RFC 8879, Section 3
+			if !readCertCompressionAlgorithms(&extData, &m.certCompressionAlgorithms) {
+				return false
+			}
+		case extensionRecordSizeLimit:
+			// RFC 8449, Section 4
+			if !extData.ReadUint16(&m.recordSizeLimit) || m.recordSizeLimit == 0 {
+				return false
+			}
 		case extensionSupportedVersions:
 			// RFC 8446, Section 4.2.1
 			var versList cryptobyte.String
@@ -545,6 +610,9 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 			if !readUint8LengthPrefixed(&extData, &m.pskModes) {
 				return false
 			}
+		case extensionPostHandshakeAuth:
+			// RFC 8446, Section 4.2.6
+			m.postHandshakeAuth = true
 		case extensionPreSharedKey:
 			// RFC 8446, Section 4.2.11
 			if !extensions.Empty() {
@@ -575,6 +643,18 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 				}
 				m.pskBinders = append(m.pskBinders, binder)
 			}
+		case extensionEncryptedClientHello:
+			// draft-ietf-tls-esni, Section 5
+			if !extData.ReadBytes(&m.encryptedClientHello, len(extData)) ||
+				len(m.encryptedClientHello) == 0 {
+				return false
+			}
+		case extensionQUICTransportParameters:
+			// RFC 9001, Section 8.2
+			m.quicTransportParameters = make([]byte, len(extData))
+			if !extData.CopyBytes(m.quicTransportParameters) {
+				return false
+			}
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -599,6 +679,8 @@ type serverHelloMsg struct {
 	ticketSupported              bool
 	secureRenegotiationSupported bool
 	secureRenegotiation          []byte
+	extendedMasterSecret         bool
+	recordSizeLimit              uint16
 	alpnProtocol                 string
 	scts                         [][]byte
 	supportedVersion             uint16
@@ -608,8 +690,13 @@ type serverHelloMsg struct {
 	supportedPoints              []uint8
 
 	// HelloRetryRequest extensions
-	cookie        []byte
-	selectedGroup CurveID
+	cookie               []byte
+	selectedGroup        CurveID
+	encryptedClientHello []byte // ECH acceptance confirmation
+
+	// extensionOrder, if not empty, lists extension IDs in the order they
+	// are marshaled. Unlisted extensions follow in the default order.
+	extensionOrder []uint16
 }
 
 func (m *serverHelloMsg) marshal() []byte {
@@ -617,6 +704,97 @@ func (m *serverHelloMsg) marshal() []byte {
 		return m.raw
 	}
 
+	var exts []serverHelloExtension
+	addExt := func(id uint16, body func(b *cryptobyte.Builder)) {
+		var b cryptobyte.Builder
+		body(&b)
+		exts = append(exts, serverHelloExtension{id, b.BytesOrPanic()})
+	}
+	if m.ocspStapling {
+		addExt(extensionStatusRequest, func(b *cryptobyte.Builder) {})
+	}
+	if m.ticketSupported {
+		addExt(extensionSessionTicket, func(b *cryptobyte.Builder) {})
+	}
+	if m.secureRenegotiationSupported {
+		addExt(extensionRenegotiationInfo, func(b *cryptobyte.Builder) {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.secureRenegotiation)
+			})
+		})
+	}
+	if m.extendedMasterSecret {
+		addExt(extensionExtendedMasterSecret, func(b *cryptobyte.Builder) {})
+	}
+	if m.recordSizeLimit != 0 {
+		addExt(extensionRecordSizeLimit, func(b *cryptobyte.Builder) {
+			b.AddUint16(m.recordSizeLimit)
+		})
+	}
+	if len(m.alpnProtocol) > 0 {
+		addExt(extensionALPN, func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte(m.alpnProtocol))
+				})
+			})
+		})
+	}
+	if len(m.scts) > 0 {
+		addExt(extensionSCT, func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, sct := range m.scts {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(sct)
+					})
+				}
+			})
+		})
+	}
+	if m.supportedVersion != 0 {
+		addExt(extensionSupportedVersions, func(b *cryptobyte.Builder) {
+			b.AddUint16(m.supportedVersion)
+		})
+	}
+	if m.serverShare.group != 0 {
+		addExt(extensionKeyShare, func(b *cryptobyte.Builder) {
+			b.AddUint16(uint16(m.serverShare.group))
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.serverShare.data)
+			})
+		})
+	}
+	if m.selectedIdentityPresent {
+		addExt(extensionPreSharedKey, func(b *cryptobyte.Builder) {
+			b.AddUint16(m.selectedIdentity)
+		})
+	}
+	if len(m.cookie) > 0 {
+		addExt(extensionCookie, func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.cookie)
+			})
+		})
+	}
+	if m.selectedGroup != 0 {
+		addExt(extensionKeyShare, func(b *cryptobyte.Builder) {
+			b.AddUint16(uint16(m.selectedGroup))
+		})
+	}
+	if len(m.encryptedClientHello) > 0 {
+		addExt(extensionEncryptedClientHello, func(b *cryptobyte.Builder) {
+			b.AddBytes(m.encryptedClientHello)
+		})
+	}
+	if len(m.supportedPoints) > 0 {
+		addExt(extensionSupportedPoints, func(b *cryptobyte.Builder) {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.supportedPoints)
+			})
+		})
+	}
+	exts = orderServerHelloExtensions(exts, m.extensionOrder)
+
 	var b cryptobyte.Builder
 	b.AddUint8(typeServerHello)
 	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
@@ -629,105 +807,52 @@ func (m *serverHelloMsg) marshal() []byte {
 		b.AddUint8(m.compressionMethod)
 
 		// If extensions aren't present, omit them.
-		var extensionsPresent bool
-		bWithoutExtensions := *b
-
+		if len(exts) == 0 {
+			return
+		}
 		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-			if m.ocspStapling {
-				b.AddUint16(extensionStatusRequest)
-				b.AddUint16(0) // empty extension_data
-			}
-			if m.ticketSupported {
-				b.AddUint16(extensionSessionTicket)
-				b.AddUint16(0) // empty extension_data
-			}
-			if m.secureRenegotiationSupported {
-				b.AddUint16(extensionRenegotiationInfo)
+			for _, ext := range exts {
+				b.AddUint16(ext.id)
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.secureRenegotiation)
-					})
+					b.AddBytes(ext.data)
 				})
 			}
-			if len(m.alpnProtocol) > 0 {
-				b.AddUint16(extensionALPN)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-							b.AddBytes([]byte(m.alpnProtocol))
-						})
-					})
-				})
-			}
-			if len(m.scts) > 0 {
-				b.AddUint16(extensionSCT)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, sct := range m.scts {
-							b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-								b.AddBytes(sct)
-							})
-						}
-					})
-				})
-			}
-			if m.supportedVersion != 0 {
-				b.AddUint16(extensionSupportedVersions)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16(m.supportedVersion)
-				})
-			}
-			if m.serverShare.group != 0 {
-				b.AddUint16(extensionKeyShare)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16(uint16(m.serverShare.group))
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.serverShare.data)
-					})
-				})
-			}
-			if m.selectedIdentityPresent {
-				b.AddUint16(extensionPreSharedKey)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16(m.selectedIdentity)
-				})
-			}
-
-			if len(m.cookie) > 0 {
-				b.AddUint16(extensionCookie)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.cookie)
-					})
-				})
-			}
-			if m.selectedGroup != 0 {
-				b.AddUint16(extensionKeyShare)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16(uint16(m.selectedGroup))
-				})
-			}
-			if len(m.supportedPoints) > 0 {
-				b.AddUint16(extensionSupportedPoints)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.supportedPoints)
-					})
-				})
-			}
-
-			extensionsPresent = len(b.BytesOrPanic()) > 2
 		})
-
-		if !extensionsPresent {
-			*b = bWithoutExtensions
-		}
 	})
 
 	m.raw = b.BytesOrPanic()
 	return m.raw
 }
 
+type serverHelloExtension struct {
+	id   uint16
+	data []byte
+}
+
+// orderServerHelloExtensions sorts exts so that those listed in order come
+// first, in that order, followed by the rest in their original order.
+func orderServerHelloExtensions(exts []serverHelloExtension, order []uint16) []serverHelloExtension {
+	if len(order) == 0 {
+		return exts
+	}
+	sorted := make([]serverHelloExtension, 0, len(exts))
+	used := make([]bool, len(exts))
+	for _, id := range order {
+		for i, ext := range exts {
+			if !used[i] && ext.id == id {
+				sorted = append(sorted, ext)
+				used[i] = true
+			}
+		}
+	}
+	for i, ext := range exts {
+		if !used[i] {
+			sorted = append(sorted, ext)
+		}
+	}
+	return sorted
+}
+
 func (m *serverHelloMsg) unmarshal(data []byte) bool {
 	*m = serverHelloMsg{raw: data}
 	s := cryptobyte.String(data)
@@ -768,6 +893,12 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.secureRenegotiationSupported = true
+		case extensionExtendedMasterSecret:
+			m.extendedMasterSecret = true
+		case extensionRecordSizeLimit:
+			if !extData.ReadUint16(&m.recordSizeLimit) || m.recordSizeLimit == 0 {
+				return false
+			}
 		case extensionALPN:
 			var protoList cryptobyte.String
 			if !extData.ReadUint16LengthPrefixed(&protoList) || protoList.Empty() {
@@ -819,6 +950,10 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 			if !extData.ReadUint16(&m.selectedIdentity) {
 				return false
 			}
+		case extensionEncryptedClientHello:
+			if !extData.ReadBytes(&m.encryptedClientHello, 8) {
+				return false
+			}
 		case extensionSupportedPoints:
 			// RFC 4492, Section 5.1.2
 			if !readUint8LengthPrefixed(&extData, &m.supportedPoints) ||
@@ -839,8 +974,12 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 }
 
 type encryptedExtensionsMsg struct {
-	raw          []byte
-	alpnProtocol string
+	raw                     []byte
+	alpnProtocol            string
+	echRetryConfigs         []byte
+	quicTransportParameters []byte
+	earlyData               bool
+	recordSizeLimit         uint16
 }
 
 func (m *encryptedExtensionsMsg) marshal() []byte {
@@ -862,6 +1001,32 @@ func (m *encryptedExtensionsMsg) marshal() []byte {
 					})
 				})
 			}
+			if len(m.echRetryConfigs) > 0 {
+				// draft-ietf-tls-esni, Section 7
+				b.AddUint16(extensionEncryptedClientHello)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.echRetryConfigs)
+				})
+			}
+			if m.quicTransportParameters != nil { // marshal zero-length parameters when present
+				// RFC 9001, Section 8.2
+				b.AddUint16(extensionQUICTransportParameters)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.quicTransportParameters)
+				})
+			}
+			if m.earlyData {
+				// RFC 8446, Section 4.2.10
+				b.AddUint16(extensionEarlyData)
+				b.AddUint16(0) // empty extension_data
+			}
+			if m.recordSizeLimit != 0 {
+				// RFC 8449, Section 4
+				b.AddUint16(extensionRecordSizeLimit)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(m.recordSizeLimit)
+				})
+			}
 		})
 	})
 
@@ -899,6 +1064,24 @@ func (m *encryptedExtensionsMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.alpnProtocol = string(proto)
+		case extensionEncryptedClientHello:
+			if !extData.ReadBytes(&m.echRetryConfigs, len(extData)) ||
+				len(m.echRetryConfigs) == 0 {
+				return false
+			}
+		case extensionQUICTransportParameters:
+			m.quicTransportParameters = make([]byte, len(extData))
+			if !extData.CopyBytes(m.quicTransportParameters) {
+				return false
+			}
+		case extensionEarlyData:
+			// RFC 8446, Section 4.2.10
+			m.earlyData = true
+		case extensionRecordSizeLimit:
+			// RFC 8449, Section 4
+			if !extData.ReadUint16(&m.recordSizeLimit) || m.recordSizeLimit == 0 {
+				return false
+			}
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -1051,11 +1234,13 @@ func (m *newSessionTicketMsgTLS13) unmarshal(data []byte) bool {
 
 type certificateRequestMsgTLS13 struct {
 	raw                              []byte
+	certificateRequestContext        []byte
 	ocspStapling                     bool
 	scts                             bool
 	supportedSignatureAlgorithms     []SignatureScheme
 	supportedSignatureAlgorithmsCert []SignatureScheme
 	certificateAuthorities           [][]byte
+	certCompressionAlgorithms        []CertCompressionAlgo
 }
 
 func (m *certificateRequestMsgTLS13) marshal() []byte {
@@ -1068,7 +1253,9 @@ func (m *certificateRequestMsgTLS13) marshal() []byte {
 	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
 		// certificate_request_context (SHALL be zero length unless used for
 		// post-handshake authentication)
-		b.AddUint8(0)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(m.certificateRequestContext)
+		})
 
 		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 			if m.ocspStapling {
@@ -1116,6 +1303,12 @@ func (m *certificateRequestMsgTLS13) marshal() []byte {
 					})
 				})
 			}
+			if len(m.certCompressionAlgorithms) > 0 {
+				b.AddUint16(extensionCompressCertificate)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					addCertCompressionAlgorithms(b, m.certCompressionAlgorithms)
+				})
+			}
 		})
 	})
 
@@ -1127,9 +1320,9 @@ func (m *certificateRequestMsgTLS13) unmarshal(data []byte) bool {
 	*m = certificateRequestMsgTLS13{raw: data}
 	s := cryptobyte.String(data)
 
-	var context, extensions cryptobyte.String
+	var extensions cryptobyte.String
 	if !s.Skip(4) || // message type and uint24 length field
-		!s.ReadUint8LengthPrefixed(&context) || !context.Empty() ||
+		!readUint8LengthPrefixed(&s, &m.certificateRequestContext) ||
 		!s.ReadUint16LengthPrefixed(&extensions) ||
 		!s.Empty() {
 		return false
@@ -1186,6 +1379,10 @@ func (m *certificateRequestMsgTLS13) unmarshal(data []byte) bool {
 				}
 				m.certificateAuthorities = append(m.certificateAuthorities, ca)
 			}
+		case extensionCompressCertificate:
+			if !readCertCompressionAlgorithms(&extData, &m.certCompressionAlgorithms) {
+				return false
+			}
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -1277,10 +1474,11 @@ func (m *certificateMsg) unmarshal(data []byte) bool {
 }
 
 type certificateMsgTLS13 struct {
-	raw          []byte
-	certificate  Certificate
-	ocspStapling bool
-	scts         bool
+	raw                       []byte
+	certificateRequestContext []byte
+	certificate               Certificate
+	ocspStapling              bool
+	scts                      bool
 }
 
 func (m *certificateMsgTLS13) marshal() []byte {
@@ -1291,7 +1489,9 @@ func (m *certificateMsgTLS13) marshal() []byte {
 	var b cryptobyte.Builder
 	b.AddUint8(typeCertificate)
 	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
-		b.AddUint8(0) // certificate_request_context
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(m.certificateRequestContext)
+		})
 
 		certificate := m.certificate
 		if !m.ocspStapling {
@@ -1348,9 +1548,8 @@ func (m *certificateMsgTLS13) unmarshal(data []byte) bool {
 	*m = certificateMsgTLS13{raw: data}
 	s := cryptobyte.String(data)
 
-	var context cryptobyte.String
 	if !s.Skip(4) || // message type and uint24 length field
-		!s.ReadUint8LengthPrefixed(&context) || !context.Empty() ||
+		!readUint8LengthPrefixed(&s, &m.certificateRequestContext) ||
 		!unmarshalCertificate(&s, &m.certificate) ||
 		!s.Empty() {
 		return false
@@ -1422,6 +1621,73 @@ func unmarshalCertificate(s *cryptobyte.String, certificate *Certificate) bool {
 	return true
 }
 
+func addCertCompressionAlgorithms(b *cryptobyte.Builder, algos []CertCompressionAlgo) {
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, algo := range algos {
+			b.AddUint16(uint16(algo))
+		}
+	})
+}
+
+func readCertCompressionAlgorithms(s *cryptobyte.String, out *[]CertCompressionAlgo) bool {
+	var algos cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&algos) || algos.Empty() {
+		return false
+	}
+	for !algos.Empty() {
+		var algo uint16
+		if !algos.ReadUint16(&algo) {
+			return false
+		}
+		*out = append(*out, CertCompressionAlgo(algo))
+	}
+	return true
+}
+
+type compressedCertificateMsg struct {
+	raw                          []byte
+	algorithm                    CertCompressionAlgo
+	uncompressedLength           uint32 // uint24
+	compressedCertificateMessage []byte
+}
+
+func (m *compressedCertificateMsg) marshal() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeCompressedCertificate)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(uint16(m.algorithm))
+		b.AddUint24(m.uncompressedLength)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(m.compressedCertificateMessage)
+		})
+	})
+
+	m.raw = b.BytesOrPanic()
+	return m.raw
+}
+
+func (m *compressedCertificateMsg) unmarshal(data []byte) bool {
+	*m = compressedCertificateMsg{raw: data}
+	s := cryptobyte.String(data)
+
+	var algorithm uint16
+	if !s.Skip(4) || // message type and uint24 length field
+		!s.ReadUint16(&algorithm) ||
+		!s.ReadUint24(&m.uncompressedLength) ||
+		!readUint24LengthPrefixed(&s, &m.compressedCertificateMessage) ||
+		len(m.compressedCertificateMessage) == 0 ||
+		!s.Empty() {
+		return false
+	}
+	m.algorithm = CertCompressionAlgo(algorithm)
+
+	return true
+}
+
 type serverKeyExchangeMsg struct {
 	raw []byte
 	key []byte
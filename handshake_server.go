@@ -138,6 +138,17 @@ func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, error) {
 		c.sendAlert(alertUnexpectedMessage)
 		return nil, unexpectedMessageError(clientHello, msg)
 	}
+	if len(c.config.EncryptedClientHelloKeys) > 0 && len(clientHello.encryptedClientHello) > 0 {
+		inner, ech, err := c.processECHClientHello(clientHello)
+		if err != nil {
+			return nil, err
+		}
+		if inner != nil {
+			// Go on with the ClientHelloInner, as if it came in the clear.
+			clientHello, c.ech, c.echAccepted = inner, ech, true
+		}
+	}
+	c.clientHelloRaw = clientHello.marshal()
 
 	var configForClient *Config
 	originalConfig := c.config
@@ -173,6 +184,9 @@ func (hs *serverHandshakeState) processClientHello() error {
 
 	hs.hello = new(serverHelloMsg)
 	hs.hello.vers = c.vers
+	if profile := c.config.gaseousConfig().serverProfile(); profile != nil {
+		hs.hello.extensionOrder = profile.ExtensionOrder
+	}
 
 	foundCompression := false
 	// We only support null compression, so check that the client offered it.
@@ -212,6 +226,13 @@ func (hs *serverHandshakeState) processClientHello() error {
 	}
 
 	hs.hello.secureRenegotiationSupported = hs.clientHello.secureRenegotiationSupported
+	hs.hello.extendedMasterSecret = hs.clientHello.extendedMasterSecret
+	if hs.clientHello.recordSizeLimit != 0 {
+		hs.hello.recordSizeLimit = c.config.recordSizeLimit(c.vers)
+		if err := c.setRecordSizeLimits(hs.hello.recordSizeLimit, hs.clientHello.recordSizeLimit); err != nil {
+			return err
+		}
+	}
 	hs.hello.compressionMethod = compressionNone
 	if len(hs.clientHello.serverName) > 0 {
 		c.serverName = hs.clientHello.serverName
@@ -279,6 +300,15 @@ func (hs *serverHandshakeState) processClientHello() error {
 // preference order. If ALPN is not configured or the peer doesn't support it,
 // it returns "" and no error.
 func negotiateALPN(serverProtos, clientProtos []string) (string, error) {
+	// GREASE identifiers are never selected, and a client offering only
+	// GREASE is treated as not supporting ALPN. See RFC 8701, Section 3.2.
+	var offered []string
+	for _, c := range clientProtos {
+		if !isGREASEALPN(c) {
+			offered = append(offered, c)
+		}
+	}
+	clientProtos = offered
 	if len(serverProtos) == 0 || len(clientProtos) == 0 {
 		return "", nil
 	}
@@ -308,7 +338,7 @@ func negotiateALPN(serverProtos, clientProtos []string) (string, error) {
 func supportsECDHE(c *Config, supportedCurves []CurveID, supportedPoints []uint8) bool {
 	supportsCurve := false
 	for _, curve := range supportedCurves {
-		if c.supportsCurve(curve) {
+		if c.supportsECDHECurve(curve) {
 			supportsCurve = true
 			break
 		}
@@ -341,6 +371,9 @@ func (hs *serverHandshakeState) pickCipherSuite() error {
 	}
 
 	configCipherSuites := c.config.cipherSuites()
+	if profile := c.config.gaseousConfig().serverProfile(); profile != nil && len(profile.CipherSuites) > 0 {
+		preferenceOrder = profile.CipherSuites
+	}
 	preferenceList := make([]uint16, 0, len(configCipherSuites))
 	for _, suiteID := range preferenceOrder {
 		for _, id := range configCipherSuites {
@@ -449,6 +482,12 @@ func (hs *serverHandshakeState) checkForResumption() bool {
 		return false
 	}
 
+	// A session is only resumed with the same Extended Master Secret
+	// setting, or else a full handshake is done. See RFC 7627, Section 5.3.
+	if hs.sessionState.extMasterSecret != hs.clientHello.extendedMasterSecret {
+		return false
+	}
+
 	return true
 }
 
@@ -465,13 +504,13 @@ func (hs *serverHandshakeState) doResumeHandshake() error {
 	hs.finishedHash.discardHandshakeBuffer()
 	hs.finishedHash.Write(hs.clientHello.marshal())
 	hs.finishedHash.Write(hs.hello.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, hs.hello.marshal()); err != nil {
+	if err := c.writeHelloRecord(hs.hello.marshal()); err != nil {
 		return err
 	}
 
 	if err := c.processCertsFromClient(Certificate{
 		Certificate: hs.sessionState.certificates,
-	}); err != nil {
+	}, c.config.ClientAuth); err != nil {
 		return err
 	}
 
@@ -483,6 +522,7 @@ func (hs *serverHandshakeState) doResumeHandshake() error {
 	}
 
 	hs.masterSecret = hs.sessionState.masterSecret
+	c.extMasterSecret = hs.sessionState.extMasterSecret
 
 	return nil
 }
@@ -496,6 +536,13 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 
 	hs.hello.ticketSupported = hs.clientHello.ticketSupported && !c.config.SessionTicketsDisabled
 	hs.hello.cipherSuite = hs.suite.id
+	if profile := c.config.gaseousConfig().serverProfile(); profile != nil && profile.SessionID == GaseousSessionIDRandom {
+		hs.hello.sessionId = make([]byte, 32)
+		if _, err := io.ReadFull(c.config.rand(), hs.hello.sessionId); err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+	}
 
 	hs.finishedHash = newFinishedHash(hs.c.vers, hs.suite)
 	if c.config.ClientAuth == NoClientCert {
@@ -505,14 +552,14 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 	}
 	hs.finishedHash.Write(hs.clientHello.marshal())
 	hs.finishedHash.Write(hs.hello.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, hs.hello.marshal()); err != nil {
+	if err := c.writeHelloRecord(hs.hello.marshal()); err != nil {
 		return err
 	}
 
 	certMsg := new(certificateMsg)
 	certMsg.certificates = hs.cert.Certificate
 	hs.finishedHash.Write(certMsg.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, certMsg.marshal()); err != nil {
+	if err := c.writeCertificateRecord(certMsg.marshal()); err != nil {
 		return err
 	}
 
@@ -531,6 +578,9 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		c.sendAlert(alertHandshakeFailure)
 		return err
 	}
+	if ka, ok := keyAgreement.(*ecdheKeyAgreement); ok {
+		c.curveID = ka.params.CurveID()
+	}
 	if skx != nil {
 		hs.finishedHash.Write(skx.marshal())
 		if _, err := c.writeRecord(recordTypeHandshake, skx.marshal()); err != nil {
@@ -594,7 +644,7 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 
 		if err := c.processCertsFromClient(Certificate{
 			Certificate: certMsg.certificates,
-		}); err != nil {
+		}, c.config.ClientAuth); err != nil {
 			return err
 		}
 		if len(certMsg.certificates) != 0 {
@@ -626,7 +676,14 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		c.sendAlert(alertHandshakeFailure)
 		return err
 	}
-	hs.masterSecret = masterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.clientHello.random, hs.hello.random)
+	if hs.hello.extendedMasterSecret {
+		c.extMasterSecret = true
+		hs.masterSecret = extMasterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret,
+			hs.finishedHash.Sum())
+	} else {
+		hs.masterSecret = masterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret,
+			hs.clientHello.random, hs.hello.random)
+	}
 	if err := c.config.writeKeyLog(keyLogLabelTLS12, hs.clientHello.random, hs.masterSecret); err != nil {
 		c.sendAlert(alertInternalError)
 		return err
@@ -759,11 +816,12 @@ func (hs *serverHandshakeState) sendSessionTicket() error {
 		certsFromClient = append(certsFromClient, cert.Raw)
 	}
 	state := sessionState{
-		vers:         c.vers,
-		cipherSuite:  hs.suite.id,
-		createdAt:    createdAt,
-		masterSecret: hs.masterSecret,
-		certificates: certsFromClient,
+		vers:            c.vers,
+		cipherSuite:     hs.suite.id,
+		createdAt:       createdAt,
+		masterSecret:    hs.masterSecret,
+		certificates:    certsFromClient,
+		extMasterSecret: c.extMasterSecret,
 	}
 	var err error
 	m.ticket, err = c.encryptTicket(state.marshal())
@@ -799,25 +857,38 @@ func (hs *serverHandshakeState) sendFinished(out []byte) error {
 }
 
 // processCertsFromClient takes a chain of client certificates either from a
-// Certificates message or from a sessionState and verifies them. It returns
-// the public key of the leaf certificate.
-func (c *Conn) processCertsFromClient(certificate Certificate) error {
+// Certificates message or from a sessionState and verifies them as required
+// by clientAuth. It returns the public key of the leaf certificate.
+func (c *Conn) processCertsFromClient(certificate Certificate, clientAuth ClientAuthType) error {
+	certs, chains, err := c.verifyCertsFromClient(certificate, clientAuth)
+	if err != nil {
+		return err
+	}
+	c.verifiedChains = chains
+	c.peerCertificates = certs
+	c.ocspResponse = certificate.OCSPStaple
+	c.scts = certificate.SignedCertificateTimestamps
+	return nil
+}
+
+// verifyCertsFromClient parses and verifies the certificate chain of a client
+// as clientAuth requires, and returns it with the chains it verified.
+func (c *Conn) verifyCertsFromClient(certificate Certificate, clientAuth ClientAuthType) (certs []*x509.Certificate, chains [][]*x509.Certificate, err error) {
 	certificates := certificate.Certificate
-	certs := make([]*x509.Certificate, len(certificates))
-	var err error
+	certs = make([]*x509.Certificate, len(certificates))
 	for i, asn1Data := range certificates {
 		if certs[i], err = x509.ParseCertificate(asn1Data); err != nil {
 			c.sendAlert(alertBadCertificate)
-			return errors.New("tls: failed to parse client certificate: " + err.Error())
+			return nil, nil, errors.New("tls: failed to parse client certificate: " + err.Error())
 		}
 	}
 
-	if len(certs) == 0 && requiresClientCert(c.config.ClientAuth) {
+	if len(certs) == 0 && requiresClientCert(clientAuth) {
 		c.sendAlert(alertBadCertificate)
-		return errors.New("tls: client didn't provide a certificate")
+		return nil, nil, errors.New("tls: client didn't provide a certificate")
 	}
 
-	if c.config.ClientAuth >= VerifyClientCertIfGiven && len(certs) > 0 {
+	if clientAuth >= VerifyClientCertIfGiven && len(certs) > 0 {
 		opts := x509.VerifyOptions{
 			Roots:         c.config.ClientCAs,
 			CurrentTime:   c.config.time(),
@@ -829,36 +900,30 @@ func (c *Conn) processCertsFromClient(certificate Certificate) error {
 			opts.Intermediates.AddCert(cert)
 		}
 
-		chains, err := certs[0].Verify(opts)
+		chains, err = certs[0].Verify(opts)
 		if err != nil {
 			c.sendAlert(alertBadCertificate)
-			return errors.New("tls: failed to verify client certificate: " + err.Error())
+			return nil, nil, errors.New("tls: failed to verify client certificate: " + err.Error())
 		}
-
-		c.verifiedChains = chains
 	}
 
-	c.peerCertificates = certs
-	c.ocspResponse = certificate.OCSPStaple
-	c.scts = certificate.SignedCertificateTimestamps
-
 	if len(certs) > 0 {
 		switch certs[0].PublicKey.(type) {
 		case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
 		default:
 			c.sendAlert(alertUnsupportedCertificate)
-			return fmt.Errorf("tls: client certificate contains an unsupported public key of type %T", certs[0].PublicKey)
+			return nil, nil, fmt.Errorf("tls: client certificate contains an unsupported public key of type %T", certs[0].PublicKey)
 		}
 	}
 
 	if c.config.VerifyPeerCertificate != nil {
-		if err := c.config.VerifyPeerCertificate(certificates, c.verifiedChains); err != nil {
+		if err := c.config.VerifyPeerCertificate(certificates, chains); err != nil {
 			c.sendAlert(alertBadCertificate)
-			return err
+			return nil, nil, err
 		}
 	}
 
-	return nil
+	return certs, chains, nil
 }
 
 func clientHelloInfo(ctx context.Context, c *Conn, clientHello *clientHelloMsg) *ClientHelloInfo {
@@ -866,6 +931,17 @@ func clientHelloInfo(ctx context.Context, c *Conn, clientHello *clientHelloMsg)
 	if len(clientHello.supportedVersions) == 0 {
 		supportedVersions = supportedVersionsFromMax(clientHello.vers)
 	}
+	raw := clientHello.marshal()
+	var fingerprints *ClientHelloFingerprints
+	var extensions []uint16
+	if parsed, err := ParseClientHello(raw); err == nil {
+		fingerprints = parsed.Fingerprints()
+		extensions = parsed.ExtensionIDs()
+	}
+	var keyShareGroups []CurveID
+	for _, ks := range clientHello.keyShares {
+		keyShareGroups = append(keyShareGroups, ks.group)
+	}
 
 	return &ClientHelloInfo{
 		CipherSuites:      clientHello.cipherSuites,
@@ -875,6 +951,11 @@ func clientHelloInfo(ctx context.Context, c *Conn, clientHello *clientHelloMsg)
 		SignatureSchemes:  clientHello.supportedSignatureAlgorithms,
 		SupportedProtos:   clientHello.alpnProtocols,
 		SupportedVersions: supportedVersions,
+		Fingerprints:      fingerprints,
+		Raw:               raw,
+		Extensions:        extensions,
+		KeyShareGroups:    keyShareGroups,
+		ViaGaseous:        c.gaseousHelloReceived,
 		Conn:              c.conn,
 		config:            c.config,
 		ctx:               ctx,
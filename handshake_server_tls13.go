@@ -40,6 +40,18 @@ type serverHandshakeStateTLS13 struct {
 	trafficSecret   []byte // client_application_traffic_secret_0
 	transcript      hash.Hash
 	clientFinished  []byte
+	// session is the resumed session, and earlyTrafficSecret the
+	// client_early_traffic_secret if the client offered early data with it.
+	session            *sessionStateTLS13
+	earlyTrafficSecret []byte
+	earlyData          bool
+
+	// flightStart and flightRecords are the offsets in c.sendBuf of the
+	// ServerHello frame and of the records after it, when they are to be
+	// sent as a single Gaseous server flight frame.
+	flightStart   int
+	flightRecords int
+	bundleFlight  bool
 }
 
 func (hs *serverHandshakeStateTLS13) handshake() error {
@@ -68,12 +80,34 @@ func (hs *serverHandshakeStateTLS13) handshake() error {
 	// Note that at this point we could start sending application data without
 	// waiting for the client's second flight, but the application might not
 	// expect the lack of replay protection of the ClientHello parameters.
+	if err := hs.flushFlight(); err != nil {
+		return err
+	}
 	if _, err := c.flush(); err != nil {
 		return err
 	}
 	if err := hs.readClientCertificate(); err != nil {
 		return err
 	}
+	if hs.clientHello.postHandshakeAuth && c.quic == nil {
+		// The transcript now runs through the client Finished.
+		c.postHandshakeAuth = &postHandshakeAuth{suite: hs.suite, transcript: hs.transcript}
+	}
+	if hs.earlyData {
+		// Let the application read the early data right away. The rest of
+		// the client's flight is processed by Read, once it's done.
+		c.serverEarlyData = &serverEarlyData{
+			suite:           hs.suite,
+			handshakeSecret: c.in.trafficSecret,
+			trafficSecret:   hs.trafficSecret,
+			clientFinished:  hs.clientFinished,
+			remaining:       c.config.MaxEarlyData,
+		}
+		c.in.setTrafficSecret(hs.suite, QUICEncryptionLevelEarly, hs.earlyTrafficSecret)
+		c.earlyDataPending.Store(true)
+		atomic.StoreUint32(&c.handshakeStatus, 1)
+		return nil
+	}
 	if err := hs.readClientFinished(); err != nil {
 		return err
 	}
@@ -92,6 +126,10 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 	// supported_versions instead. See RFC 8446, sections 4.1.3 and 4.2.1.
 	hs.hello.vers = VersionTLS12
 	hs.hello.supportedVersion = c.vers
+	profile := c.config.gaseousConfig().serverProfile()
+	if profile != nil {
+		hs.hello.extensionOrder = profile.ExtensionOrder
+	}
 
 	if len(hs.clientHello.supportedVersions) == 0 {
 		c.sendAlert(alertIllegalParameter)
@@ -136,15 +174,37 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 		return errors.New("tls: initial handshake had non-empty renegotiation extension")
 	}
 
-	if hs.clientHello.earlyData {
+	if hs.clientHello.earlyData && c.quic == nil {
 		// See RFC 8446, Section 4.2.10 for the complicated behavior required
-		// here. The scenario is that a different server at our address offered
-		// to accept early data in the past, which we can't handle. For now, all
-		// 0-RTT enabled session tickets need to expire before a Go server can
-		// replace a server or join a pool. That's the same requirement that
-		// applies to mixing or replacing with any TLS 1.2 server.
+		// here. Unless it is accepted, the early data that follows is skipped,
+		// up to as much as we'd have accepted. Without MaxEarlyData, the
+		// scenario is that a different server at our address offered to
+		// accept early data in the past, which we can't handle. All 0-RTT
+		// enabled session tickets need to expire before a server without
+		// MaxEarlyData can replace a server or join a pool. That's the same
+		// requirement that applies to mixing or replacing with any TLS 1.2
+		// server. Over QUIC, early data never reaches the TLS layer.
+		if c.config.MaxEarlyData == 0 {
+			c.sendAlert(alertUnsupportedExtension)
+			return errors.New("tls: client sent unexpected early data")
+		}
+		c.earlyDataSkip = int(c.config.MaxEarlyData)
+	}
+
+	if c.quic != nil {
+		// See RFC 9001, Sections 8.2 and 8.4.
+		if len(hs.clientHello.sessionId) > 0 {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: client sent a legacy session ID over QUIC")
+		}
+		if hs.clientHello.quicTransportParameters == nil {
+			c.sendAlert(alertMissingExtension)
+			return errors.New("tls: client did not send a quic_transport_parameters extension")
+		}
+		c.quicSetTransportParameters(hs.clientHello.quicTransportParameters)
+	} else if hs.clientHello.quicTransportParameters != nil {
 		c.sendAlert(alertUnsupportedExtension)
-		return errors.New("tls: client sent unexpected early data")
+		return errors.New("tls: client sent an unexpected quic_transport_parameters extension")
 	}
 
 	hs.hello.sessionId = hs.clientHello.sessionId
@@ -154,6 +214,9 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 	if !hasAESGCMHardwareSupport || !aesgcmPreferred(hs.clientHello.cipherSuites) {
 		preferenceList = defaultCipherSuitesTLS13NoAES
 	}
+	if profile != nil && len(profile.CipherSuitesTLS13) > 0 {
+		preferenceList = profile.CipherSuitesTLS13
+	}
 	for _, suiteID := range preferenceList {
 		hs.suite = mutualCipherSuiteTLS13(hs.clientHello.cipherSuites, suiteID)
 		if hs.suite != nil {
@@ -202,17 +265,20 @@ GroupSelection:
 		clientKeyShare = &hs.clientHello.keyShares[0]
 	}
 
-	if _, ok := curveForCurveID(selectedGroup); selectedGroup != X25519 && !ok {
+	if !isSupportedGroup(selectedGroup) {
 		c.sendAlert(alertInternalError)
 		return errors.New("tls: CurvePreferences includes unsupported curve")
 	}
-	params, err := generateECDHEParameters(c.config.rand(), selectedGroup)
+	// For a hybrid group the server share carries a KEM ciphertext
+	// encapsulated to the client's key.
+	share, sharedKey, err := serverKeyShare(c.config.rand(), selectedGroup, clientKeyShare.data)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
 	}
-	hs.hello.serverShare = keyShare{group: selectedGroup, data: params.PublicKey()}
-	hs.sharedKey = params.SharedKey(clientKeyShare.data)
+	hs.hello.serverShare = keyShare{group: selectedGroup, data: share}
+	hs.sharedKey = sharedKey
+	c.curveID = selectedGroup
 	if hs.sharedKey == nil {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: invalid client key share")
@@ -267,9 +333,9 @@ func (hs *serverHandshakeStateTLS13) checkForResumption() error {
 			continue
 		}
 
-		// We don't check the obfuscated ticket age because it's affected by
-		// clock skew and it's only a freshness signal useful for shrinking the
-		// window for replay attacks, which don't affect us as we don't do 0-RTT.
+		// The obfuscated ticket age is only checked before accepting early
+		// data, as it's affected by clock skew and it's only a freshness
+		// signal useful for shrinking the window for replay attacks.
 
 		pskSuite := cipherSuiteTLS13ByID(sessionState.cipherSuite)
 		if pskSuite == nil || pskSuite.hash != hs.suite.hash {
@@ -306,13 +372,14 @@ func (hs *serverHandshakeStateTLS13) checkForResumption() error {
 		}
 
 		c.didResume = true
-		if err := c.processCertsFromClient(sessionState.certificate); err != nil {
+		if err := c.processCertsFromClient(sessionState.certificate, c.config.ClientAuth); err != nil {
 			return err
 		}
 
 		hs.hello.selectedIdentityPresent = true
 		hs.hello.selectedIdentity = uint16(i)
 		hs.usingPSK = true
+		hs.session = sessionState
 		return nil
 	}
 
@@ -384,6 +451,9 @@ func (hs *serverHandshakeStateTLS13) pickCertificate() error {
 // sendDummyChangeCipherSpec sends a ChangeCipherSpec record for compatibility
 // with middleboxes that didn't implement TLS correctly. See RFC 8446, Appendix D.4.
 func (hs *serverHandshakeStateTLS13) sendDummyChangeCipherSpec() error {
+	if hs.c.quic != nil {
+		return nil
+	}
 	if hs.sentDummyCCS {
 		return nil
 	}
@@ -412,10 +482,14 @@ func (hs *serverHandshakeStateTLS13) doHelloRetryRequest(selectedGroup CurveID)
 		compressionMethod: hs.hello.compressionMethod,
 		supportedVersion:  hs.hello.supportedVersion,
 		selectedGroup:     selectedGroup,
+		extensionOrder:    hs.hello.extensionOrder,
+	}
+	if c.ech != nil {
+		hs.setECHHelloRetryRequestConfirmation(helloRetryRequest)
 	}
 
 	hs.transcript.Write(helloRetryRequest.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, helloRetryRequest.marshal()); err != nil {
+	if err := c.writeHelloRecord(helloRetryRequest.marshal()); err != nil {
 		return err
 	}
 
@@ -433,6 +507,12 @@ func (hs *serverHandshakeStateTLS13) doHelloRetryRequest(selectedGroup CurveID)
 		c.sendAlert(alertUnexpectedMessage)
 		return unexpectedMessageError(clientHello, msg)
 	}
+	if c.ech != nil {
+		if clientHello, err = c.processECHSecondClientHello(clientHello); err != nil {
+			return err
+		}
+	}
+	c.clientHelloRaw = clientHello.marshal()
 
 	if len(clientHello.keyShares) != 1 || clientHello.keyShares[0].group != selectedGroup {
 		c.sendAlert(alertIllegalParameter)
@@ -462,7 +542,8 @@ func illegalClientHelloChange(ch, ch1 *clientHelloMsg) bool {
 		len(ch.supportedCurves) != len(ch1.supportedCurves) ||
 		len(ch.supportedSignatureAlgorithms) != len(ch1.supportedSignatureAlgorithms) ||
 		len(ch.supportedSignatureAlgorithmsCert) != len(ch1.supportedSignatureAlgorithmsCert) ||
-		len(ch.alpnProtocols) != len(ch1.alpnProtocols) {
+		len(ch.alpnProtocols) != len(ch1.alpnProtocols) ||
+		len(ch.certCompressionAlgorithms) != len(ch1.certCompressionAlgorithms) {
 		return true
 	}
 	for i := range ch.supportedVersions {
@@ -495,6 +576,11 @@ func illegalClientHelloChange(ch, ch1 *clientHelloMsg) bool {
 			return true
 		}
 	}
+	for i := range ch.certCompressionAlgorithms {
+		if ch.certCompressionAlgorithms[i] != ch1.certCompressionAlgorithms[i] {
+			return true
+		}
+	}
 	return ch.vers != ch1.vers ||
 		!bytes.Equal(ch.random, ch1.random) ||
 		!bytes.Equal(ch.sessionId, ch1.sessionId) ||
@@ -506,6 +592,9 @@ func illegalClientHelloChange(ch, ch1 *clientHelloMsg) bool {
 		!bytes.Equal(ch.sessionTicket, ch1.sessionTicket) ||
 		ch.secureRenegotiationSupported != ch1.secureRenegotiationSupported ||
 		!bytes.Equal(ch.secureRenegotiation, ch1.secureRenegotiation) ||
+		ch.extendedMasterSecret != ch1.extendedMasterSecret ||
+		ch.recordSizeLimit != ch1.recordSizeLimit ||
+		ch.postHandshakeAuth != ch1.postHandshakeAuth ||
 		ch.scts != ch1.scts ||
 		!bytes.Equal(ch.cookie, ch1.cookie) ||
 		!bytes.Equal(ch.pskModes, ch1.pskModes)
@@ -515,8 +604,16 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 	c := hs.c
 
 	hs.transcript.Write(hs.clientHello.marshal())
+	if hs.clientHello.earlyData && hs.usingPSK {
+		hs.earlyTrafficSecret = hs.suite.deriveSecret(hs.earlySecret,
+			clientEarlyTrafficLabel, hs.transcript)
+	}
+	if c.echAccepted {
+		hs.setECHAcceptConfirmation()
+	}
 	hs.transcript.Write(hs.hello.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, hs.hello.marshal()); err != nil {
+	flightStart := len(c.sendBuf)
+	if err := c.writeHelloRecord(hs.hello.marshal()); err != nil {
 		return err
 	}
 
@@ -524,6 +621,13 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 		return err
 	}
 
+	if g := c.config.gaseousConfig(); g != nil && g.ServerFlight && c.gaseousHelloSent {
+		// The records that follow are sent along with the ServerHello by
+		// flushFlight.
+		hs.flightStart, hs.flightRecords = flightStart, len(c.sendBuf)
+		hs.bundleFlight = true
+	}
+
 	earlySecret := hs.earlySecret
 	if earlySecret == nil {
 		earlySecret = hs.suite.extract(nil, nil)
@@ -533,10 +637,19 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 
 	clientSecret := hs.suite.deriveSecret(hs.handshakeSecret,
 		clientHandshakeTrafficLabel, hs.transcript)
-	c.in.setTrafficSecret(hs.suite, clientSecret)
+	c.in.setTrafficSecret(hs.suite, QUICEncryptionLevelHandshake, clientSecret)
 	serverSecret := hs.suite.deriveSecret(hs.handshakeSecret,
 		serverHandshakeTrafficLabel, hs.transcript)
-	c.out.setTrafficSecret(hs.suite, serverSecret)
+	c.out.setTrafficSecret(hs.suite, QUICEncryptionLevelHandshake, serverSecret)
+
+	if c.quic != nil {
+		if c.hand.Len() != 0 {
+			c.sendAlert(alertUnexpectedMessage)
+			return errors.New("tls: handshake data left over at a key change")
+		}
+		c.quicSetWriteSecret(QUICEncryptionLevelHandshake, hs.suite.id, serverSecret)
+		c.quicSetReadSecret(QUICEncryptionLevelHandshake, hs.suite.id, clientSecret)
+	}
 
 	err := c.config.writeKeyLog(keyLogLabelClientHandshake, hs.clientHello.random, clientSecret)
 	if err != nil {
@@ -556,8 +669,39 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 		c.sendAlert(alertNoApplicationProtocol)
 		return err
 	}
+	if c.quic != nil && selectedProto == "" && len(c.config.NextProtos) > 0 {
+		// See RFC 9001, Section 8.1.
+		c.sendAlert(alertNoApplicationProtocol)
+		return errors.New("tls: client did not request an application protocol")
+	}
 	encryptedExtensions.alpnProtocol = selectedProto
 	c.clientProtocol = selectedProto
+	if c.quic != nil {
+		p, err := c.quicGetTransportParameters()
+		if err != nil {
+			return err
+		}
+		encryptedExtensions.quicTransportParameters = p
+	}
+	if !c.echAccepted && len(hs.clientHello.encryptedClientHello) > 0 {
+		encryptedExtensions.echRetryConfigs = c.config.echRetryConfigs()
+	}
+	if hs.acceptEarlyData(selectedProto) {
+		if err := c.config.writeKeyLog(keyLogLabelClientEarly, hs.clientHello.random, hs.earlyTrafficSecret); err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+		hs.earlyData = true
+		encryptedExtensions.earlyData = true
+		c.earlyDataAccepted = true
+		c.earlyDataSkip = 0
+	}
+	if hs.clientHello.recordSizeLimit != 0 && c.quic == nil {
+		encryptedExtensions.recordSizeLimit = c.config.recordSizeLimit(c.vers)
+		if err := c.setRecordSizeLimits(encryptedExtensions.recordSizeLimit, hs.clientHello.recordSizeLimit); err != nil {
+			return err
+		}
+	}
 
 	hs.transcript.Write(encryptedExtensions.marshal())
 	if _, err := c.writeRecord(recordTypeHandshake, encryptedExtensions.marshal()); err != nil {
@@ -581,14 +725,7 @@ func (hs *serverHandshakeStateTLS13) sendServerCertificate() error {
 
 	if hs.requestClientCert() {
 		// Request a client certificate
-		certReq := new(certificateRequestMsgTLS13)
-		certReq.ocspStapling = true
-		certReq.scts = true
-		certReq.supportedSignatureAlgorithms = supportedSignatureAlgorithms
-		if c.config.ClientCAs != nil {
-			certReq.certificateAuthorities = c.config.ClientCAs.Subjects()
-		}
-
+		certReq := c.certificateRequestTLS13(nil)
 		hs.transcript.Write(certReq.marshal())
 		if _, err := c.writeRecord(recordTypeHandshake, certReq.marshal()); err != nil {
 			return err
@@ -601,8 +738,19 @@ func (hs *serverHandshakeStateTLS13) sendServerCertificate() error {
 	certMsg.scts = hs.clientHello.scts && len(hs.cert.SignedCertificateTimestamps) > 0
 	certMsg.ocspStapling = hs.clientHello.ocspStapling && len(hs.cert.OCSPStaple) > 0
 
-	hs.transcript.Write(certMsg.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, certMsg.marshal()); err != nil {
+	msg, err := c.certificateMsgToSend(certMsg, hs.clientHello.certCompressionAlgorithms)
+	if err != nil {
+		return err
+	}
+	if ref := c.gaseousChainReference(certMsg.marshal(), true); ref != nil {
+		// The transcript holds the full Certificate message, which the
+		// client restores from its cache.
+		hs.transcript.Write(certMsg.marshal())
+		msg = &gaseousCertificateReferenceMsg{reference: ref}
+	} else {
+		hs.transcript.Write(msg.marshal())
+	}
+	if _, err := c.writeRecord(recordTypeHandshake, msg.marshal()); err != nil {
 		return err
 	}
 
@@ -641,6 +789,21 @@ func (hs *serverHandshakeStateTLS13) sendServerCertificate() error {
 	return nil
 }
 
+// certificateRequestTLS13 returns a CertificateRequest message with the
+// certificate request context reqContext.
+func (c *Conn) certificateRequestTLS13(reqContext []byte) *certificateRequestMsgTLS13 {
+	certReq := new(certificateRequestMsgTLS13)
+	certReq.certificateRequestContext = reqContext
+	certReq.ocspStapling = true
+	certReq.scts = true
+	certReq.supportedSignatureAlgorithms = supportedSignatureAlgorithms
+	if c.config.ClientCAs != nil {
+		certReq.certificateAuthorities = c.config.ClientCAs.Subjects()
+	}
+	certReq.certCompressionAlgorithms = c.config.certCompressionAlgorithms()
+	return certReq
+}
+
 func (hs *serverHandshakeStateTLS13) sendServerFinished() error {
 	c := hs.c
 
@@ -662,7 +825,15 @@ func (hs *serverHandshakeStateTLS13) sendServerFinished() error {
 		clientApplicationTrafficLabel, hs.transcript)
 	serverSecret := hs.suite.deriveSecret(hs.masterSecret,
 		serverApplicationTrafficLabel, hs.transcript)
-	c.out.setTrafficSecret(hs.suite, serverSecret)
+	c.out.setTrafficSecret(hs.suite, QUICEncryptionLevelApplication, serverSecret)
+
+	if c.quic != nil {
+		if c.hand.Len() != 0 {
+			c.sendAlert(alertUnexpectedMessage)
+			return errors.New("tls: handshake data left over at a key change")
+		}
+		c.quicSetWriteSecret(QUICEncryptionLevelApplication, hs.suite.id, serverSecret)
+	}
 
 	err := c.config.writeKeyLog(keyLogLabelClientTraffic, hs.clientHello.random, hs.trafficSecret)
 	if err != nil {
@@ -677,6 +848,12 @@ func (hs *serverHandshakeStateTLS13) sendServerFinished() error {
 
 	c.ekm = hs.suite.exportKeyingMaterial(hs.masterSecret, hs.transcript)
 
+	// The client ends its early data with an EndOfEarlyData message, which
+	// is always the same.
+	if hs.earlyData {
+		hs.transcript.Write((&endOfEarlyDataMsg{}).marshal())
+	}
+
 	// If we did not request client certificates, at this point we can
 	// precompute the client finished and roll the transcript forward to send
 	// session tickets in our first flight.
@@ -689,6 +866,27 @@ func (hs *serverHandshakeStateTLS13) sendServerFinished() error {
 	return nil
 }
 
+// flushFlight replaces the buffered ServerHello frame and dummy
+// ChangeCipherSpec with a Gaseous server flight frame that also carries the
+// protected records written since. If the frame can't be built, the buffer is
+// sent as it is.
+func (hs *serverHandshakeStateTLS13) flushFlight() error {
+	c := hs.c
+	if !hs.bundleFlight {
+		return nil
+	}
+	hs.bundleFlight = false
+
+	frame, err := packServerFlightGaseous(hs.hello.marshal(), c.sendBuf[hs.flightRecords:], c.config.gaseousConfig())
+	if err != nil || len(frame) > maxPlaintext {
+		return nil
+	}
+	c.out.Lock()
+	defer c.out.Unlock()
+	c.sendBuf = c.sendBuf[:hs.flightStart]
+	return c.writeUnprotectedRecordLocked(recordTypeGaseousHello, frame)
+}
+
 func (hs *serverHandshakeStateTLS13) shouldSendSessionTickets() bool {
 	if hs.c.config.SessionTicketsDisabled {
 		return false
@@ -716,9 +914,20 @@ func (hs *serverHandshakeStateTLS13) sendSessionTickets() error {
 		return nil
 	}
 
-	resumptionSecret := hs.suite.deriveSecret(hs.masterSecret,
+	c.resumptionSecret = hs.suite.deriveSecret(hs.masterSecret,
 		resumptionLabel, hs.transcript)
 
+	// QUIC tickets are sent by QUICConn.SendSessionTicket, once the
+	// handshake is complete.
+	if c.quic != nil {
+		return nil
+	}
+	return c.sendSessionTicket()
+}
+
+// sendSessionTicket sends a NewSessionTicket message for the session, based
+// on c.resumptionSecret.
+func (c *Conn) sendSessionTicket() error {
 	m := new(newSessionTicketMsgTLS13)
 
 	var certsFromClient [][]byte
@@ -726,31 +935,37 @@ func (hs *serverHandshakeStateTLS13) sendSessionTickets() error {
 		certsFromClient = append(certsFromClient, cert.Raw)
 	}
 	state := sessionStateTLS13{
-		cipherSuite:      hs.suite.id,
+		cipherSuite:      c.cipherSuite,
 		createdAt:        uint64(c.config.time().Unix()),
-		resumptionSecret: resumptionSecret,
+		resumptionSecret: c.resumptionSecret,
 		certificate: Certificate{
 			Certificate:                 certsFromClient,
 			OCSPStaple:                  c.ocspResponse,
 			SignedCertificateTimestamps: c.scts,
 		},
+		alpnProtocol: c.clientProtocol,
 	}
-	var err error
-	m.label, err = c.encryptTicket(state.marshal())
-	if err != nil {
-		return err
+	if c.quic == nil && c.config.AcceptEarlyData != nil {
+		state.maxEarlyData = c.config.MaxEarlyData
 	}
-	m.lifetime = uint32(maxSessionTicketLifetime / time.Second)
 
 	// ticket_age_add is a random 32-bit value. See RFC 8446, section 4.6.1
-	// The value is not stored anywhere; we never need to check the ticket age
-	// because 0-RTT is not supported.
+	// It is stored in the ticket to check the ticket age before accepting
+	// early data.
 	ageAdd := make([]byte, 4)
-	_, err = hs.c.config.rand().Read(ageAdd)
+	if _, err := c.config.rand().Read(ageAdd); err != nil {
+		return err
+	}
+	state.ageAdd = binary.LittleEndian.Uint32(ageAdd)
+
+	var err error
+	m.label, err = c.encryptTicket(state.marshal())
 	if err != nil {
 		return err
 	}
-	m.ageAdd = binary.LittleEndian.Uint32(ageAdd)
+	m.lifetime = uint32(maxSessionTicketLifetime / time.Second)
+	m.ageAdd = state.ageAdd
+	m.maxEarlyData = state.maxEarlyData
 
 	// ticket_nonce, which must be unique per connection, is always left at
 	// zero because we only ever send one ticket per connection.
@@ -785,14 +1000,12 @@ func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
 		return err
 	}
 
-	certMsg, ok := msg.(*certificateMsgTLS13)
-	if !ok {
-		c.sendAlert(alertUnexpectedMessage)
-		return unexpectedMessageError(certMsg, msg)
+	certMsg, err := c.readCertificateMsg(msg, c.config.certCompressionAlgorithms(), nil, hs.transcript)
+	if err != nil {
+		return err
 	}
-	hs.transcript.Write(certMsg.marshal())
 
-	if err := c.processCertsFromClient(certMsg.certificate); err != nil {
+	if err := c.processCertsFromClient(certMsg.certificate, c.config.ClientAuth); err != nil {
 		return err
 	}
 
@@ -814,25 +1027,8 @@ func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
 			c.sendAlert(alertUnexpectedMessage)
 			return unexpectedMessageError(certVerify, msg)
 		}
-
-		// See RFC 8446, Section 4.4.3.
-		if !isSupportedSignatureAlgorithm(certVerify.signatureAlgorithm, supportedSignatureAlgorithms) {
-			c.sendAlert(alertIllegalParameter)
-			return errors.New("tls: client certificate used with invalid signature algorithm")
-		}
-		sigType, sigHash, err := typeAndHashFromSignatureScheme(certVerify.signatureAlgorithm)
-		if err != nil {
-			return c.sendAlert(alertInternalError)
-		}
-		if sigType == signaturePKCS1v15 || sigHash == crypto.SHA1 {
-			c.sendAlert(alertIllegalParameter)
-			return errors.New("tls: client certificate used with invalid signature algorithm")
-		}
-		signed := signedMessage(sigHash, clientSignatureContext, hs.transcript)
-		if err := verifyHandshakeSignature(sigType, c.peerCertificates[0].PublicKey,
-			sigHash, signed, certVerify.signature); err != nil {
-			c.sendAlert(alertDecryptError)
-			return errors.New("tls: invalid signature by the client certificate: " + err.Error())
+		if err := c.verifyClientCertificateVerify(certVerify, hs.transcript, c.peerCertificates[0].PublicKey); err != nil {
+			return err
 		}
 
 		hs.transcript.Write(certVerify.marshal())
@@ -847,6 +1043,31 @@ func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
 	return nil
 }
 
+// verifyClientCertificateVerify checks the signature of certVerify over
+// transcript by pub, the key of the client's leaf certificate.
+func (c *Conn) verifyClientCertificateVerify(certVerify *certificateVerifyMsg, transcript hash.Hash, pub crypto.PublicKey) error {
+	// See RFC 8446, Section 4.4.3.
+	if !isSupportedSignatureAlgorithm(certVerify.signatureAlgorithm, supportedSignatureAlgorithms) {
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: client certificate used with invalid signature algorithm")
+	}
+	sigType, sigHash, err := typeAndHashFromSignatureScheme(certVerify.signatureAlgorithm)
+	if err != nil {
+		return c.sendAlert(alertInternalError)
+	}
+	if sigType == signaturePKCS1v15 || sigHash == crypto.SHA1 {
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: client certificate used with invalid signature algorithm")
+	}
+	signed := signedMessage(sigHash, clientSignatureContext, transcript)
+	if err := verifyHandshakeSignature(sigType, pub,
+		sigHash, signed, certVerify.signature); err != nil {
+		c.sendAlert(alertDecryptError)
+		return errors.New("tls: invalid signature by the client certificate: " + err.Error())
+	}
+	return nil
+}
+
 func (hs *serverHandshakeStateTLS13) readClientFinished() error {
 	c := hs.c
 
@@ -866,7 +1087,7 @@ func (hs *serverHandshakeStateTLS13) readClientFinished() error {
 		return errors.New("tls: invalid client finished hash")
 	}
 
-	c.in.setTrafficSecret(hs.suite, hs.trafficSecret)
+	c.in.setTrafficSecret(hs.suite, QUICEncryptionLevelApplication, hs.trafficSecret)
 
 	return nil
 }
@@ -0,0 +1,309 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testCertOnce sync.Once
+	testCert     Certificate
+	testRoots    *x509.CertPool
+)
+
+// testCertificate returns a self-signed ECDSA certificate for "example.com"
+// and a pool containing it.
+func testCertificate(t *testing.T) (Certificate, *x509.CertPool) {
+	testCertOnce.Do(func() {
+		testCert, testRoots = newTestCertificate("example.com")
+	})
+	return testCert, testRoots
+}
+
+// newTestCertificate returns a new self-signed ECDSA certificate for names,
+// and a pool containing it. It panics on error, as it also runs outside of
+// a test in testCertificate.
+func newTestCertificate(names ...string) (Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+// testConfigs returns a matching client and server Config pair.
+func testConfigs(t *testing.T) (client, server *Config) {
+	cert, roots := testCertificate(t)
+	server = &Config{Certificates: []Certificate{cert}}
+	client = &Config{ServerName: "example.com", RootCAs: roots}
+	return client, server
+}
+
+// testConns returns a client and server Conn that completed a handshake
+// over a local connection.
+func testConns(t *testing.T, clientConfig, serverConfig *Config) (cli, srv *Conn) {
+	t.Helper()
+	c, s := localPipe(t)
+	t.Cleanup(func() { c.Close(); s.Close() })
+	done := make(chan error, 1)
+	srv = Server(s, serverConfig)
+	go func() { done <- srv.Handshake() }()
+	cli = Client(c, clientConfig)
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return cli, srv
+}
+
+// testExchange writes msg from w and reads it back from r.
+func testExchange(t *testing.T, w, r *Conn, msg string) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte(msg))
+		errc <- err
+	}()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != msg {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// localPipe returns a connected pair of TCP connections. Unlike net.Pipe,
+// writes are buffered, so both peers can write at once as in TLS 1.3.
+func localPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+// testHandshake runs a handshake over a local connection, exchanges a
+// message in each direction, and returns both connection states.
+func testHandshake(t *testing.T, clientConfig, serverConfig *Config) (clientState, serverState ConnectionState, err error) {
+	t.Helper()
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	done := make(chan error, 1)
+	var srv *Conn
+	go func() {
+		srv = Server(s, serverConfig)
+		if err := srv.Handshake(); err != nil {
+			s.Close()
+			done <- err
+			return
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(srv, buf); err != nil {
+			done <- err
+			return
+		}
+		_, err := srv.Write(buf)
+		done <- err
+	}()
+	cli := Client(c, clientConfig)
+	if err = cli.Handshake(); err != nil {
+		c.Close()
+		<-done
+		return
+	}
+	if _, err = cli.Write([]byte("hello")); err == nil {
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(cli, buf)
+	}
+	if serr := <-done; err == nil {
+		err = serr
+	}
+	if err != nil {
+		return
+	}
+	return cli.ConnectionState(), srv.ConnectionState(), nil
+}
+
+func TestHandshakeVersions(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		clientConfig, serverConfig := testConfigs(t)
+		clientConfig.MaxVersion = vers
+		cs, ss, err := testHandshake(t, clientConfig, serverConfig)
+		if err != nil {
+			t.Fatalf("%x: %v", vers, err)
+		}
+		if cs.Version != vers || ss.Version != vers {
+			t.Errorf("%x: negotiated %x/%x", vers, cs.Version, ss.Version)
+		}
+	}
+}
+
+func TestClientHelloInfoRaw(t *testing.T) {
+	for _, gaseous := range []bool{false, true} {
+		clientConfig, serverConfig := testConfigs(t)
+		if gaseous {
+			clientConfig.Gaseous = &GaseousConfig{ClientHello: true}
+			serverConfig.Gaseous = &GaseousConfig{ClientHello: true}
+		}
+		var info *ClientHelloInfo
+		serverConfig.GetConfigForClient = func(chi *ClientHelloInfo) (*Config, error) {
+			info = chi
+			return nil, nil
+		}
+		if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+			t.Fatal(err)
+		}
+		p, err := ParseClientHello(info.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ViaGaseous != gaseous || p.SNI != clientConfig.ServerName ||
+			len(info.Extensions) == 0 || len(info.Extensions) != len(p.ExtensionList) ||
+			len(info.KeyShareGroups) != 1 || info.KeyShareGroups[0] != X25519 {
+			t.Errorf("gaseous %v: ClientHelloInfo %+v", gaseous, info)
+		}
+	}
+}
+
+func TestClientHelloInfoViaGaseousRetry(t *testing.T) {
+	_, serverConfig := testConfigs(t)
+	serverConfig.Gaseous = &GaseousConfig{ClientHello: true}
+	hello := (&clientHelloMsg{vers: VersionTLS12, random: make([]byte, 32), cipherSuites: []uint16{TLS_AES_128_GCM_SHA256}, compressionMethods: []uint8{0}}).marshal()
+	frame, err := marshalGaseousFrame(GaseousHelloTypeClient, 0, hello, serverConfig.Gaseous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(typ recordType, data []byte) []byte {
+		return append([]byte{byte(typ), 3, 1, byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+
+	c, s := localPipe(t)
+	defer c.Close()
+	go func() {
+		c.Write(record(recordTypeGaseousHello, frame))
+		c.Write(record(recordTypeHandshake, hello))
+	}()
+	srv := Server(s, serverConfig)
+	srv.in.Lock()
+	defer srv.in.Unlock()
+	if err := srv.readRecord(); err != nil || !srv.gaseousHelloReceived {
+		t.Fatalf("first hello: ViaGaseous %v, %v", srv.gaseousHelloReceived, err)
+	}
+	// A plain second ClientHello after a HelloRetryRequest.
+	srv.hand.Reset()
+	srv.haveVers = true
+	srv.vers = VersionTLS13
+	if err := srv.readRecord(); err != nil || srv.gaseousHelloReceived {
+		t.Fatalf("second hello: ViaGaseous %v, %v", srv.gaseousHelloReceived, err)
+	}
+}
+
+// oneSessionCache is a ClientSessionCache that holds the last session put.
+type oneSessionCache struct {
+	session *ClientSessionState
+}
+
+func (c *oneSessionCache) Get(string) (*ClientSessionState, bool) {
+	return c.session, c.session != nil
+}
+
+func (c *oneSessionCache) Put(_ string, cs *ClientSessionState) {
+	c.session = cs
+}
+
+func TestExtendedMasterSecret(t *testing.T) {
+	clientConfig, serverConfig := testConfigs(t)
+	clientConfig.MaxVersion = VersionTLS12
+	cache := &oneSessionCache{}
+	clientConfig.ClientSessionCache = cache
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	if cache.session == nil || !cache.session.extMasterSecret {
+		t.Fatalf("session %+v did not use the extended master secret", cache.session)
+	}
+	cs, _, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.DidResume {
+		t.Error("session was not resumed")
+	}
+
+	// The server resumes the ticket, which has the extension, so the client
+	// must refuse to resume a session that didn't.
+	cache.session.extMasterSecret = false
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil {
+		t.Error("client resumed a session across an extended_master_secret mismatch")
+	}
+}
+
+func TestSessionStateExtendedMasterSecret(t *testing.T) {
+	state := &sessionState{
+		vers:            VersionTLS12,
+		cipherSuite:     TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		createdAt:       1,
+		masterSecret:    []byte("secret"),
+		extMasterSecret: true,
+	}
+	var got sessionState
+	if !got.unmarshal(state.marshal()) || !got.extMasterSecret {
+		t.Errorf("got %+v", got)
+	}
+
+	// Tickets from before the flag was stored never used the extension.
+	old := state.marshal()
+	old = old[:len(old)-1]
+	if !got.unmarshal(old) || got.extMasterSecret || !bytes.Equal(got.masterSecret, state.masterSecret) {
+		t.Errorf("got %+v from a ticket without the flag", got)
+	}
+}
@@ -26,6 +26,9 @@ type sessionState struct {
 	masterSecret []byte // opaque master_secret<1..2^16-1>;
 	// struct { opaque certificate<1..2^24-1> } Certificate;
 	certificates [][]byte // Certificate certificate_list<0..2^24-1>;
+	// uint8 extended_master_secret, absent in tickets issued before it was
+	// supported, which never used it.
+	extMasterSecret bool
 
 	// usedOldKey is true if the ticket from which this session came from
 	// was encrypted with an older key and thus should be refreshed.
@@ -47,6 +50,11 @@ func (m *sessionState) marshal() []byte {
 			})
 		}
 	})
+	if m.extMasterSecret {
+		b.AddUint8(1)
+	} else {
+		b.AddUint8(0)
+	}
 	return b.BytesOrPanic()
 }
 
@@ -71,31 +79,50 @@ func (m *sessionState) unmarshal(data []byte) bool {
 		}
 		m.certificates = append(m.certificates, cert)
 	}
+	if s.Empty() {
+		return true
+	}
+	var extMasterSecret uint8
+	if !s.ReadUint8(&extMasterSecret) || extMasterSecret > 1 {
+		return false
+	}
+	m.extMasterSecret = extMasterSecret == 1
 	return s.Empty()
 }
 
 // sessionStateTLS13 is the content of a TLS 1.3 session ticket. Its first
 // version (revision = 0) doesn't carry any of the information needed for 0-RTT
-// validation and the nonce is always empty.
+// validation and the nonce is always empty. Revision 1 adds the 0-RTT fields,
+// and is what we issue.
 type sessionStateTLS13 struct {
 	// uint8 version  = 0x0304;
-	// uint8 revision = 0;
+	// uint8 revision = 1;
 	cipherSuite      uint16
 	createdAt        uint64
 	resumptionSecret []byte      // opaque resumption_master_secret<1..2^8-1>;
 	certificate      Certificate // CertificateEntry certificate_list<0..2^24-1>;
+
+	// Revision 1 fields.
+	maxEarlyData uint32 // uint32 max_early_data_size;
+	ageAdd       uint32 // uint32 ticket_age_add;
+	alpnProtocol string // opaque alpn_protocol<0..2^8-1>;
 }
 
 func (m *sessionStateTLS13) marshal() []byte {
 	var b cryptobyte.Builder
 	b.AddUint16(VersionTLS13)
-	b.AddUint8(0) // revision
+	b.AddUint8(1) // revision
 	b.AddUint16(m.cipherSuite)
 	addUint64(&b, m.createdAt)
 	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
 		b.AddBytes(m.resumptionSecret)
 	})
 	marshalCertificate(&b, m.certificate)
+	b.AddUint32(m.maxEarlyData)
+	b.AddUint32(m.ageAdd)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(m.alpnProtocol))
+	})
 	return b.BytesOrPanic()
 }
 
@@ -104,16 +131,29 @@ func (m *sessionStateTLS13) unmarshal(data []byte) bool {
 	s := cryptobyte.String(data)
 	var version uint16
 	var revision uint8
-	return s.ReadUint16(&version) &&
-		version == VersionTLS13 &&
-		s.ReadUint8(&revision) &&
-		revision == 0 &&
-		s.ReadUint16(&m.cipherSuite) &&
-		readUint64(&s, &m.createdAt) &&
-		readUint8LengthPrefixed(&s, &m.resumptionSecret) &&
-		len(m.resumptionSecret) != 0 &&
-		unmarshalCertificate(&s, &m.certificate) &&
-		s.Empty()
+	if !s.ReadUint16(&version) ||
+		version != VersionTLS13 ||
+		!s.ReadUint8(&revision) ||
+		revision > 1 ||
+		!s.ReadUint16(&m.cipherSuite) ||
+		!readUint64(&s, &m.createdAt) ||
+		!readUint8LengthPrefixed(&s, &m.resumptionSecret) ||
+		len(m.resumptionSecret) == 0 ||
+		!unmarshalCertificate(&s, &m.certificate) {
+		return false
+	}
+	if revision == 0 {
+		return s.Empty()
+	}
+	var alpn []byte
+	if !s.ReadUint32(&m.maxEarlyData) ||
+		!s.ReadUint32(&m.ageAdd) ||
+		!readUint8LengthPrefixed(&s, &alpn) ||
+		!s.Empty() {
+		return false
+	}
+	m.alpnProtocol = string(alpn)
+	return true
 }
 
 func (c *Conn) encryptTicket(state []byte) ([]byte, error) {